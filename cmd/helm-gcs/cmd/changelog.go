@@ -0,0 +1,75 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagChangelog      bool
+	flagChangelogChart string
+	flagChangelogLimit int
+)
+
+var changelogCmd = &cobra.Command{
+	Use:   "changelog [repository]",
+	Short: "show the history of a repository",
+	Long: `This command prints the changes recorded in the CHANGELOG.ndjson file of a repository, most recent first.
+Changes are recorded by push and rm when --changelog is set.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := loadRepo(args[0])
+		if err != nil {
+			return err
+		}
+		entries, err := r.Changelog(cmd.Context())
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DATE\tACTION\tCHART\tVERSION\tACTOR\tDIGEST")
+		printed := 0
+		for idx := len(entries) - 1; idx >= 0; idx-- {
+			e := entries[idx]
+			if flagChangelogChart != "" && e.Chart != flagChangelogChart {
+				continue
+			}
+			if flagChangelogLimit > 0 && printed == flagChangelogLimit {
+				break
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Timestamp.Format(time.RFC3339), e.Action, e.Chart, e.Version, e.Actor, e.Digest)
+			printed++
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(changelogCmd)
+	changelogCmd.Flags().StringVar(&flagChangelogChart, "chart", "", "only show the changes of this chart")
+	changelogCmd.Flags().IntVar(&flagChangelogLimit, "limit", 0, "maximum number of changes to show")
+}
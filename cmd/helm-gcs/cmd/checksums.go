@@ -0,0 +1,87 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagChecksums        bool
+	checksumsVerifyRepos repoSelection
+)
+
+var checksumsCmd = &cobra.Command{
+	Use:   "checksums",
+	Short: "manage the SHA256SUMS file of a repository",
+	Long: `A repository can maintain a SHA256SUMS file next to its index, listing the digest of every chart.
+It is updated on push and rm when --checksums is set.`,
+}
+
+var checksumsVerifyCmd = &cobra.Command{
+	Use:   "verify [repository...]",
+	Short: "verify charts against SHA256SUMS",
+	Long:  `This command downloads every chart listed in the SHA256SUMS file of a repository and checks its digest.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		names, err := checksumsVerifyRepos.resolve(args)
+		if err != nil {
+			return err
+		}
+		return forEachRepo(cmd.Context(), names, verifyChecksums)
+	},
+}
+
+func verifyChecksums(ctx context.Context, name string) error {
+	r, err := loadRepo(name, repoOptions()...)
+	if err != nil {
+		return err
+	}
+	results, err := r.VerifyChecksums(ctx)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			failed++
+			fmt.Printf("%s: FAILED (%s)\n", result.File, result.Err)
+		case !result.OK():
+			failed++
+			fmt.Printf("%s: FAILED\n", result.File)
+		default:
+			infof("%s: OK\n", result.File)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d computed checksums did NOT match", failed, len(results))
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(checksumsCmd)
+	checksumsCmd.AddCommand(checksumsVerifyCmd)
+	checksumsVerifyRepos.addFlags(checksumsVerifyCmd)
+}
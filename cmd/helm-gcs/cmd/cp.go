@@ -0,0 +1,85 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+	"github.com/spf13/cobra"
+	"google.golang.org/api/googleapi"
+)
+
+var flagCpNoClobber bool
+
+var cpCmd = &cobra.Command{
+	Use:   "cp gs://bucket/path/src.tgz gs://bucket/path/dst.tgz",
+	Short: "copy an object server-side",
+	Long: `This command copies an object, e.g. a single chart for a manual repair or a mirror, with a
+GCS server-side copy: the content never transits through the machine, even across buckets.
+The metadata, content type and cache control of the object are preserved.
+If the destination ends with "/", the object is copied into it with the same name.
+The index of the repositories is not updated.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		src, dst := args[0], args[1]
+		if !strings.HasPrefix(src, "gs://") || !strings.HasPrefix(dst, "gs://") {
+			return fmt.Errorf("source and destination must be gs:// URLs")
+		}
+		if strings.HasSuffix(dst, "/") {
+			dst += path.Base(src)
+		}
+		if src == dst {
+			return fmt.Errorf("source and destination are the same object")
+		}
+		client, err := repoClient(dst)
+		if err != nil {
+			return err
+		}
+		copyObject := gcs.Copy
+		if flagCpNoClobber {
+			copyObject = gcs.CopyIfNotExist
+		}
+		attrs, err := copyObject(cmd.Context(), client, src, dst)
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+			return fmt.Errorf("%s already exists, not overwritten with --no-clobber", dst)
+		}
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return fmt.Errorf("%s not found", src)
+		}
+		if err != nil {
+			return err
+		}
+		infof("copied %s to %s (%d bytes)\n", src, dst, attrs.Size)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cpCmd)
+	cpCmd.Flags().BoolVarP(&flagCpNoClobber, "no-clobber", "n", false, "do not overwrite an existing destination object")
+}
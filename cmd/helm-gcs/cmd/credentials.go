@@ -0,0 +1,133 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+	"github.com/hayorov/helm-gcs/pkg/repo"
+)
+
+// serviceAccountEnv is the credentials file used when --service-account is not set.
+// HELM_GCS_SERVICE_ACCOUNT_<REPOSITORY> overrides it for a repository.
+const serviceAccountEnv = "HELM_GCS_SERVICE_ACCOUNT"
+
+// repoClients are the clients created for the repositories with their own credentials,
+// by credentials file.
+var repoClients = map[string]*storage.Client{}
+
+// downloaderCredentials is the credentials file helm passed to the downloader as the
+// certificate or the key of the repository ("helm repo add --cert-file"), if any.
+var downloaderCredentials string
+
+// repoServiceAccountEnv returns the environment variable holding the credentials file of a
+// repository: the name upper cased, with characters other than letters and digits replaced
+// by "_", e.g. HELM_GCS_SERVICE_ACCOUNT_MY_REPO for my-repo.
+func repoServiceAccountEnv(name string) string {
+	suffix := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(name))
+	return serviceAccountEnv + "_" + suffix
+}
+
+// repoServiceAccount returns the credentials file set for the repository, given by helm name
+// or by the URL of one of its objects, or "" if it has none or --service-account is set.
+func repoServiceAccount(nameOrURL string) string {
+	if flagServiceAccount != "" {
+		return ""
+	}
+	if downloaderCredentials != "" {
+		return downloaderCredentials
+	}
+	if !hasRepoServiceAccounts() {
+		return ""
+	}
+	name := nameOrURL
+	if strings.Contains(nameOrURL, "://") {
+		var err error
+		if name, err = repo.RepositoryName(nameOrURL); err != nil || name == "" {
+			return ""
+		}
+	}
+	return os.Getenv(repoServiceAccountEnv(name))
+}
+
+// hasRepoServiceAccounts reports whether credentials are set for any repository.
+func hasRepoServiceAccounts() bool {
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, serviceAccountEnv+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// repoAuth returns the authentication to the repository given by helm name or object URL:
+// the one set by flags, with the credentials file of the repository if it has one.
+func repoAuth(nameOrURL string) gcs.Auth {
+	auth := gcsAuth()
+	if sa := repoServiceAccount(nameOrURL); sa != "" {
+		auth.ServiceAccountPath = sa
+	}
+	return auth
+}
+
+// repoClient returns the client to the repository given by helm name or object URL.
+func repoClient(nameOrURL string) (*storage.Client, error) {
+	sa := repoServiceAccount(nameOrURL)
+	if sa == "" {
+		return gcsClient, nil
+	}
+	if client, ok := repoClients[sa]; ok {
+		return client, nil
+	}
+	client, err := gcs.NewClient(repoAuth(nameOrURL))
+	if err != nil {
+		return nil, err
+	}
+	repoClients[sa] = client
+	return client, nil
+}
+
+// loadRepo loads the repository added to helm with this name, with its credentials.
+func loadRepo(name string, opts ...repo.Option) (*repo.Repo, error) {
+	client, err := repoClient(name)
+	if err != nil {
+		return nil, err
+	}
+	return repo.Load(name, client, opts...)
+}
+
+// newRepo opens the repository at this URL, with the credentials of the repository added
+// to helm at this URL, if any.
+func newRepo(repoURL string, opts ...repo.Option) (*repo.Repo, error) {
+	client, err := repoClient(strings.TrimSuffix(repoURL, "/") + "/index.yaml")
+	if err != nil {
+		return nil, err
+	}
+	return repo.New(repoURL, client, opts...)
+}
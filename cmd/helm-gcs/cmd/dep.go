@@ -0,0 +1,74 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var flagDepUpdate bool
+
+var depCmd = &cobra.Command{
+	Use:   "dep",
+	Short: "manage the dependencies of a chart served by GCS repositories",
+}
+
+var depBuildCmd = &cobra.Command{
+	Use:   "build [chart directory]",
+	Short: "download the dependencies of a chart from GCS repositories into charts/",
+	Long: `This command downloads the dependencies of a chart whose repository, in Chart.yaml, is a gs:// URL
+or a GCS repository added to helm ("@name"), into the charts/ directory of the chart, without going
+through helm downloader plugins.
+
+The versions pinned in Chart.lock are downloaded while it matches Chart.yaml, like "helm dependency build".
+Otherwise, or with --update, the version ranges of Chart.yaml are resolved and Chart.lock is written,
+like "helm dependency update".`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := jsonOutput(); err != nil {
+			return err
+		}
+		built, err := repo.BuildDependencies(cmd.Context(), args[0], gcsClient, flagDepUpdate, repoOptions()...)
+		if err != nil {
+			return err
+		}
+		if asJSON, _ := jsonOutput(); asJSON {
+			return printJSON(built)
+		}
+		for _, dep := range built {
+			if dep.Alias != "" {
+				infof("downloaded %s-%s from %s as %s\n", dep.Name, dep.Version, dep.Repository, dep.Alias)
+				continue
+			}
+			infof("downloaded %s-%s from %s\n", dep.Name, dep.Version, dep.Repository)
+		}
+		infof("%d dependencies saved in %s\n", len(built), args[0])
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(depCmd)
+	depCmd.AddCommand(depBuildCmd)
+	depBuildCmd.Flags().BoolVar(&flagDepUpdate, "update", false, "resolve the version ranges of Chart.yaml again and rewrite Chart.lock")
+	addOutputFlag(depBuildCmd)
+}
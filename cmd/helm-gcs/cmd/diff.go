@@ -0,0 +1,73 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+	helmrepo "helm.sh/helm/v3/pkg/repo"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff [repository|gs://bucket/path] [repository|gs://bucket/path]",
+	Short: "compare the charts of two repositories",
+	Long: `This command compares the indexes of two repositories, given by helm name or gs:// URL,
+e.g. to validate the mirroring of a repository to another region.
+It reports the chart versions indexed by only one of them, and the ones whose digests differ.
+URLs are not compared. The command fails if the repositories differ.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var indexes [2]*helmrepo.IndexFile
+		for n, nameOrURL := range args {
+			repoURL, err := resolveRepoURL(nameOrURL)
+			if err != nil {
+				return err
+			}
+			r, err := newRepo(repoURL)
+			if err != nil {
+				return err
+			}
+			if indexes[n], err = r.Index(cmd.Context()); err != nil {
+				return fmt.Errorf("load index of %s: %w", nameOrURL, err)
+			}
+		}
+		diffs := repo.Diff(indexes[0], indexes[1])
+		if len(diffs) == 0 {
+			infof("repositories are identical\n")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CHART\tVERSION\tDIFFERENCE\tDIGEST A\tDIGEST B")
+		for _, d := range diffs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.Chart, d.Version, d.Kind, d.DigestA, d.DigestB)
+		}
+		_ = w.Flush()
+		return fmt.Errorf("%d chart versions differ between %s and %s", len(diffs), args[0], args[1])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+}
@@ -0,0 +1,204 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+// Outcomes of a doctor check.
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// doctorCheck is the outcome of a check of doctor, with the fix of the problem found.
+type doctorCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor [repository]",
+	Short: "check the access to a repository and suggest fixes",
+	Long: `This command checks the setup of a repository given by helm name or gs:// URL: the credentials
+resolve to an access token, the bucket exists, the caller is granted the permissions to read and
+update the repository, and its index file is readable and valid. Each problem found is reported
+with how to fix it.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := jsonOutput(); err != nil {
+			return err
+		}
+		checks := runDoctor(cmd.Context(), args[0])
+		failed := 0
+		for _, c := range checks {
+			if c.Status == checkFail {
+				failed++
+			}
+		}
+		if asJSON, _ := jsonOutput(); asJSON {
+			if err := printJSON(checks); err != nil {
+				return err
+			}
+		} else {
+			for _, c := range checks {
+				fmt.Printf("[%s] %s: %s\n", c.Status, c.Name, c.Detail)
+				if c.Fix != "" {
+					fmt.Printf("       fix: %s\n", c.Fix)
+				}
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+		}
+		return nil
+	},
+}
+
+// runDoctor checks the repository given by helm name or gs:// URL. Checks depending on a
+// failed one are skipped.
+func runDoctor(ctx context.Context, nameOrURL string) []doctorCheck {
+	var checks []doctorCheck
+	add := func(c doctorCheck) {
+		checks = append(checks, c)
+	}
+
+	auth := repoAuth(nameOrURL)
+	creds, err := gcs.CheckCredentials(ctx, auth)
+	identity := "the caller"
+	if creds.Identity != "" {
+		identity = creds.Identity
+	}
+	if err != nil {
+		add(doctorCheck{
+			Name:   "credentials",
+			Status: checkFail,
+			Detail: fmt.Sprintf("%s: %s", creds.Source, err),
+			Fix:    "run \"gcloud auth application-default login\", or set --service-account or " + serviceAccountEnv + " to a credentials file",
+		})
+		return checks
+	}
+	add(doctorCheck{Name: "credentials", Status: checkOK, Detail: fmt.Sprintf("%s, as %s", creds.Source, identity)})
+
+	r, err := openRepo(nameOrURL, repoOptions()...)
+	if err != nil {
+		fix := ""
+		if !strings.Contains(nameOrURL, "://") {
+			fix = fmt.Sprintf("add the repository with \"helm repo add %s gs://your-bucket/path\"", nameOrURL)
+		}
+		add(doctorCheck{Name: "repository", Status: checkFail, Detail: err.Error(), Fix: fix})
+		return checks
+	}
+	add(doctorCheck{Name: "repository", Status: checkOK, Detail: r.URL()})
+
+	client, err := repoClient(r.URL() + "/index.yaml")
+	if err != nil {
+		add(doctorCheck{Name: "bucket", Status: checkFail, Detail: err.Error()})
+		return checks
+	}
+	bucket := strings.SplitN(strings.TrimPrefix(r.URL(), "gs://"), "/", 2)[0]
+	missing, err := gcs.MissingPermissions(ctx, client, r.URL(), append(gcs.ReadPermissions, gcs.WritePermissions...))
+	if errors.Is(err, storage.ErrBucketNotExist) {
+		add(doctorCheck{
+			Name:   "bucket",
+			Status: checkFail,
+			Detail: fmt.Sprintf("bucket %s does not exist", bucket),
+			Fix:    fmt.Sprintf("create it with \"helm gcs init --create-bucket --project your-project %s\"", r.URL()),
+		})
+		return checks
+	}
+	if err != nil {
+		add(doctorCheck{Name: "bucket", Status: checkFail, Detail: err.Error()})
+		return checks
+	}
+	add(doctorCheck{Name: "bucket", Status: checkOK, Detail: fmt.Sprintf("bucket %s exists", bucket)})
+	add(permissionsCheck(bucket, identity, creds, missing))
+
+	i, err := r.Index(ctx)
+	if err != nil {
+		fix := "check the permissions above, or restore a previous generation of the index file"
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			fix = fmt.Sprintf("initialize the repository with \"helm gcs init %s\"", r.URL())
+		}
+		add(doctorCheck{Name: "index", Status: checkFail, Detail: err.Error(), Fix: fix})
+		return checks
+	}
+	if problems := repo.ValidateIndex(i, nil); len(problems) > 0 {
+		add(doctorCheck{
+			Name:   "index",
+			Status: checkWarn,
+			Detail: fmt.Sprintf("%d invalid fields, the first one: %s", len(problems), problems[0]),
+			Fix:    fmt.Sprintf("review and fix the entries with \"helm gcs repair %s --dry-run\"", nameOrURL),
+		})
+		return checks
+	}
+	versions := 0
+	for _, vs := range i.Entries {
+		versions += len(vs)
+	}
+	add(doctorCheck{Name: "index", Status: checkOK, Detail: fmt.Sprintf("%d charts, %d versions", len(i.Entries), versions)})
+	return checks
+}
+
+// permissionsCheck reports the permissions missing to the identity on the bucket: the
+// repository can't be read without the read permissions, and can't be updated without
+// the write ones.
+func permissionsCheck(bucket, identity string, creds *gcs.Credentials, missing []string) doctorCheck {
+	if len(missing) == 0 {
+		return doctorCheck{Name: "permissions", Status: checkOK, Detail: "read and write access granted"}
+	}
+	member := "serviceAccount:" + identity
+	if creds.Identity == "" {
+		member = "user:your-email"
+	}
+	check := doctorCheck{
+		Name:   "permissions",
+		Status: checkWarn,
+		Detail: fmt.Sprintf("missing %s: push and rm will fail", strings.Join(missing, ", ")),
+		Fix:    fmt.Sprintf("gcloud storage buckets add-iam-policy-binding gs://%s --member=%s --role=roles/storage.objectAdmin", bucket, member),
+	}
+	for _, p := range missing {
+		for _, read := range gcs.ReadPermissions {
+			if p == read {
+				check.Status = checkFail
+				check.Detail = fmt.Sprintf("missing %s: the repository can't be read", strings.Join(missing, ", "))
+			}
+		}
+	}
+	return check
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+	addOutputFlag(doctorCmd)
+}
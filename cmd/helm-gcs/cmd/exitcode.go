@@ -0,0 +1,65 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"google.golang.org/api/googleapi"
+	helmrepo "helm.sh/helm/v3/pkg/repo"
+)
+
+// Exit codes of the CLI, and of the downloader run by helm, for scripts to branch on the
+// type of failure.
+const (
+	exitError    = 1
+	exitAuth     = 2
+	exitNotFound = 3
+	exitConflict = 4
+	exitInvalid  = 5
+)
+
+// exitCode returns the exit code of a command failing with err.
+func exitCode(err error) int {
+	var gerr *googleapi.Error
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, repo.ErrIndexOutOfDate):
+		return exitConflict
+	case gcs.IsAuthError(err):
+		return exitAuth
+	case errors.Is(err, repo.ErrNotFound),
+		errors.Is(err, storage.ErrObjectNotExist),
+		errors.Is(err, storage.ErrBucketNotExist),
+		errors.Is(err, helmrepo.ErrNoChartName),
+		errors.Is(err, helmrepo.ErrNoChartVersion),
+		errors.As(err, &gerr) && gerr.Code == http.StatusNotFound:
+		return exitNotFound
+	case errors.Is(err, repo.ErrInvalid):
+		return exitInvalid
+	}
+	return exitError
+}
@@ -0,0 +1,65 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+	"github.com/spf13/cobra"
+)
+
+var flagFallbacksClear bool
+
+var fallbacksCmd = &cobra.Command{
+	Use:   "fallbacks [repository|gs://bucket/path] [gs://fallback/path...]",
+	Short: "set the fallback buckets of a repository",
+	Long: `This command declares the fallback locations of a repository, e.g. replicas in another region,
+which reads done by helm through the plugin fail over to when the repository can't be read.
+They are kept in helm config directory and replace the previous ones. Without fallback arguments,
+the fallbacks of the repository are printed. HELM_GCS_FALLBACKS takes precedence over them.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repoURL, err := resolveRepoURL(args[0])
+		if err != nil {
+			return err
+		}
+		if len(args) == 1 && !flagFallbacksClear {
+			fallbacks, err := gcs.Fallbacks(repoURL)
+			if err != nil {
+				return err
+			}
+			for _, f := range fallbacks {
+				fmt.Println(f)
+			}
+			return nil
+		}
+		if flagFallbacksClear && len(args) > 1 {
+			return fmt.Errorf("--clear can't be used with fallbacks")
+		}
+		return gcs.SetFallbacks(repoURL, args[1:])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fallbacksCmd)
+	fallbacksCmd.Flags().BoolVar(&flagFallbacksClear, "clear", false, "remove the fallbacks of the repository")
+}
@@ -0,0 +1,99 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+var (
+	flagFetchVersion     string
+	flagFetchDevel       bool
+	flagFetchDestination string
+	flagFetchUntar       bool
+	flagFetchUntarDir    string
+)
+
+var fetchCmd = &cobra.Command{
+	Use:   "fetch [repository]/[chart]",
+	Short: "download a chart by name and version",
+	Long: `This command downloads a chart from a repository added to helm via "helm repo add".
+The chart is looked up in the index of the repository and its digest is verified.
+--version accepts an exact version, a semver constraint or a tag, the latest stable version is downloaded by default.
+With --untar, the chart is extracted once its digest is verified, and archive members
+are kept inside the destination directory.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repoName, chart, err := splitChartReference(args[0])
+		if err != nil {
+			return err
+		}
+		r, err := loadRepo(repoName, repoOptions()...)
+		if err != nil {
+			return err
+		}
+		if !flagFetchUntar {
+			_, err = r.FetchChart(cmd.Context(), chart, flagFetchVersion, flagFetchDevel, flagFetchDestination)
+			return err
+		}
+		return fetchUntar(cmd.Context(), r, chart)
+	},
+}
+
+// fetchUntar downloads the chart in a temporary directory and extracts it into the untar directory.
+func fetchUntar(ctx context.Context, r *repo.Repo, chart string) error {
+	dir := filepath.Join(flagFetchDestination, flagFetchUntarDir)
+	if _, err := os.Stat(filepath.Join(dir, chart)); err == nil {
+		return fmt.Errorf("failed to untar: a file or directory with the name %s already exists", filepath.Join(dir, chart))
+	}
+	tmp, err := os.MkdirTemp("", "helm-gcs-fetch")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	chartpath, err := r.FetchChart(ctx, chart, flagFetchVersion, flagFetchDevel, tmp)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := chartutil.ExpandFile(dir, chartpath); err != nil {
+		return fmt.Errorf("failed to untar: %w", err)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(fetchCmd)
+	fetchCmd.Flags().StringVar(&flagFetchVersion, "version", "", "version, semver constraint or tag of the chart")
+	fetchCmd.Flags().BoolVar(&flagFetchDevel, "devel", false, "include pre-release versions when looking for the latest version")
+	fetchCmd.Flags().StringVarP(&flagFetchDestination, "destination", "d", ".", "directory to write the chart to")
+	fetchCmd.Flags().BoolVar(&flagFetchUntar, "untar", false, "extract the chart after downloading it")
+	fetchCmd.Flags().StringVar(&flagFetchUntarDir, "untardir", ".", "used with --untar, directory relative to the destination to extract the chart into")
+}
@@ -0,0 +1,62 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var getCmd = &cobra.Command{
+	Use:   "get [chart] [repository]",
+	Short: "download a chart of a repository by name and version",
+	Long: `This command downloads a chart from a repository given by helm name or gs:// URL,
+without knowing the path of the chart in the bucket. The chart is looked up in the index
+of the repository and its digest is verified, like with fetch.
+The latest stable version is downloaded if --version is not set.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		chart, repoName := args[0], args[1]
+		r, err := openRepo(repoName, repoOptions()...)
+		if err != nil {
+			return err
+		}
+		if flagFetchUntar {
+			return fetchUntar(cmd.Context(), r, chart)
+		}
+		chartpath, err := r.FetchChart(cmd.Context(), chart, flagFetchVersion, flagFetchDevel, flagFetchDestination)
+		if err != nil {
+			return err
+		}
+		fmt.Println(chartpath)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(getCmd)
+	getCmd.Flags().StringVar(&flagFetchVersion, "version", "", "version, semver constraint or tag of the chart, the latest stable version if not set")
+	getCmd.Flags().BoolVar(&flagFetchDevel, "devel", false, "include pre-release versions when looking for the latest version")
+	getCmd.Flags().StringVarP(&flagFetchDestination, "destination", "d", ".", "directory to write the chart to")
+	getCmd.Flags().BoolVar(&flagFetchUntar, "untar", false, "extract the chart after downloading it")
+	getCmd.Flags().StringVar(&flagFetchUntarDir, "untardir", ".", "used with --untar, directory relative to the destination to extract the chart into")
+}
@@ -0,0 +1,59 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var htmlOptions repo.HTMLOptions
+
+var publishHTMLCmd = &cobra.Command{
+	Use:   "publish-html [repository]",
+	Short: "publish an HTML page listing the charts of a repository",
+	Long: `This command renders the index of a repository into a static HTML page, listing the charts with
+their versions and install snippets, and uploads it as index.html next to index.yaml, for public
+repositories to be browsed. Run it again after the repository changed to update the page.
+
+The "helm repo add" snippet shows the gs:// URL of the repository, or the URL of --url, e.g. the
+public https:// URL of the repository.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := openRepo(args[0], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		pageURL, err := r.PublishHTML(cmd.Context(), htmlOptions)
+		if err != nil {
+			return err
+		}
+		infof("published %s\n", pageURL)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(publishHTMLCmd)
+	publishHTMLCmd.Flags().StringVar(&htmlOptions.Title, "title", "", "title of the page")
+	publishHTMLCmd.Flags().StringVar(&htmlOptions.Name, "name", "", "name of the repository in the snippets, its name in helm by default")
+	publishHTMLCmd.Flags().StringVar(&htmlOptions.URL, "url", "", "URL of the repository in the \"helm repo add\" snippet, its gs:// URL by default")
+}
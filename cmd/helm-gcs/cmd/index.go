@@ -0,0 +1,276 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+	helmrepo "helm.sh/helm/v3/pkg/repo"
+)
+
+var (
+	flagIndexMerge       string
+	flagIndexURL         string
+	flagIndexUpload      bool
+	flagIndexRetry       bool
+	flagIndexMerged      bool
+	flagIndexDeferRender bool
+	flagIndexURLPrefix   string
+	flagIndexGCAge       time.Duration
+
+	indexVerifyRepos repoSelection
+)
+
+var indexCmd = &cobra.Command{
+	Use:   "index",
+	Short: "manage index files",
+}
+
+var indexBuildCmd = &cobra.Command{
+	Use:   "build [directory]",
+	Short: "generate an index file for local charts",
+	Long: `This command generates index entries for the chart archives (*.tgz) of a local directory.
+
+Without --merge, the index is written to index.yaml in the directory, like "helm repo index".
+With --merge gs://bucket/path/index.yaml, the entries are merged into the index of the repository,
+under optimistic locking. Use --upload to also upload the charts into the repository.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir := args[0]
+		if flagIndexMerge == "" {
+			i, err := repo.IndexDirectory(dir, flagIndexURL)
+			if err != nil {
+				return err
+			}
+			return i.WriteFile(filepath.Join(dir, "index.yaml"), 0o644)
+		}
+		r, err := newRepo(strings.TrimSuffix(flagIndexMerge, "index.yaml"), repoOptions()...)
+		if err != nil {
+			return err
+		}
+		return r.MergeDirectory(cmd.Context(), dir, flagIndexURL, flagIndexUpload, flagIndexRetry)
+	},
+}
+
+var indexMergeCmd = &cobra.Command{
+	Use:   "merge [repository] [index file]",
+	Short: "merge the entries of another repository index into the index of a repository",
+	Long: `This command merges the entries of the index file of another Helm repository, e.g. one hosted
+elsewhere, into the index of the repository, like "helm repo index --merge": the versions already
+indexed by the repository are kept, the other ones are added with their URLs.
+
+Relative chart URLs of the other index are resolved against --url-prefix, the URL the other index
+is served from. The charts themselves are not copied.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := loadRepo(args[0], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		other, err := helmrepo.LoadIndexFile(args[1])
+		if err != nil {
+			return err
+		}
+		added, err := r.MergeIndex(cmd.Context(), other, flagIndexURLPrefix, flagIndexRetry)
+		if err != nil {
+			return err
+		}
+		infof("%d versions merged into the index of %s\n", added, args[0])
+		return nil
+	},
+}
+
+var indexShowCmd = &cobra.Command{
+	Use:   "show [repository]",
+	Short: "print the index file of a repository",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := loadRepo(args[0], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		i, err := r.Index(cmd.Context())
+		if err != nil {
+			return err
+		}
+		b, err := yaml.Marshal(i)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(b)
+		return err
+	},
+}
+
+var indexVerifyCmd = &cobra.Command{
+	Use:   "verify [repository...]",
+	Short: "check the index file against the objects of a repository",
+	Long: `This command checks that every chart indexed by a repository exists and matches the digest of
+its entry, and reports duplicated entries. Nothing is changed, use "helm gcs repair" to fix the drift.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		names, err := indexVerifyRepos.resolve(args)
+		if err != nil {
+			return err
+		}
+		return forEachRepo(cmd.Context(), names, verifyIndex)
+	},
+}
+
+func verifyIndex(ctx context.Context, name string) error {
+	r, err := loadRepo(name, repoOptions()...)
+	if err != nil {
+		return err
+	}
+	drift, err := r.CheckIndex(ctx)
+	if err != nil {
+		return err
+	}
+	if len(drift) == 0 {
+		infof("index matches the repository\n")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHART\tVERSION\tFIX\tDETAIL")
+	for _, a := range drift {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", a.Chart, a.Version, a.Action, a.Detail)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return fmt.Errorf("%d index entries drifted from the repository", len(drift))
+}
+
+var indexShardCmd = &cobra.Command{
+	Use:   "shard [repository]",
+	Short: "split the index of a repository into one file per chart",
+	Long: `This command converts a very large repository to the sharded index layout: the index is split into
+one file per chart, under index/, listed by the small index/shards.yaml. Updates only write the files
+of the charts they change, instead of the whole index.
+
+A merged index.yaml is still rendered after each update for Helm clients, unless --merged-index=false,
+for repositories only read with the plugin. With --defer-render, updates don't render it: it is
+rendered by "helm gcs index render", e.g. on a schedule. Run the command again to change these settings.
+Every writer of the repository must support the layout.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := loadRepo(args[0], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		if err := r.ShardIndex(cmd.Context(), flagIndexMerged, flagIndexDeferRender); err != nil {
+			return err
+		}
+		infof("index of %s sharded\n", args[0])
+		return nil
+	},
+}
+
+var indexUnshardCmd = &cobra.Command{
+	Use:   "unshard [repository]",
+	Short: "merge the index of a sharded repository back into index.yaml",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := loadRepo(args[0], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		if err := r.UnshardIndex(cmd.Context()); err != nil {
+			return err
+		}
+		infof("index of %s merged into index.yaml\n", args[0])
+		return nil
+	},
+}
+
+var indexRenderCmd = &cobra.Command{
+	Use:   "render [repository]",
+	Short: "render the index.yaml of a sharded repository from its index files",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := loadRepo(args[0], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		if err := r.RenderIndex(cmd.Context()); err != nil {
+			return err
+		}
+		infof("index.yaml of %s rendered\n", args[0])
+		return nil
+	},
+}
+
+var indexGCCmd = &cobra.Command{
+	Use:   "gc [repository]",
+	Short: "delete the index files no longer used by a sharded repository",
+	Long: `This command deletes the index files of a sharded repository replaced by later updates.
+Files written less than --min-age ago are kept, for writers which have not committed them yet.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := loadRepo(args[0], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		sharded, err := r.Sharded(cmd.Context())
+		if err != nil {
+			return err
+		}
+		if !sharded {
+			return fmt.Errorf("the index of %s is not sharded", args[0])
+		}
+		n, err := r.GCShards(cmd.Context(), flagIndexGCAge)
+		if err != nil {
+			return err
+		}
+		infof("%d index files deleted\n", n)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(indexCmd)
+	indexCmd.AddCommand(indexShardCmd)
+	indexCmd.AddCommand(indexUnshardCmd)
+	indexCmd.AddCommand(indexGCCmd)
+	indexCmd.AddCommand(indexRenderCmd)
+	indexShardCmd.Flags().BoolVar(&flagIndexMerged, "merged-index", true, "render a merged index.yaml for Helm clients after each update")
+	indexShardCmd.Flags().BoolVar(&flagIndexDeferRender, "defer-render", false, "only render the merged index.yaml with \"helm gcs index render\", not after each update")
+	indexGCCmd.Flags().DurationVar(&flagIndexGCAge, "min-age", repo.DefaultShardsGCAge, "age of the unused index files deleted")
+	indexCmd.AddCommand(indexBuildCmd)
+	indexCmd.AddCommand(indexShowCmd)
+	indexCmd.AddCommand(indexMergeCmd)
+	indexCmd.AddCommand(indexVerifyCmd)
+	indexVerifyRepos.addFlags(indexVerifyCmd)
+	indexBuildCmd.Flags().StringVar(&flagIndexMerge, "merge", "", "URL of the index file of the repository to merge the entries into (gs://bucket/path/index.yaml)")
+	indexBuildCmd.Flags().StringVar(&flagIndexURL, "url", "", "base URL of the charts (default: the repository URL)")
+	indexBuildCmd.Flags().BoolVar(&flagIndexUpload, "upload", false, "used with --merge to upload the charts into the repository")
+	indexBuildCmd.Flags().BoolVar(&flagIndexRetry, "retry", false, "retry if the index changed")
+	indexMergeCmd.Flags().StringVar(&flagIndexURLPrefix, "url-prefix", "", "URL the relative chart URLs of the merged index are relative to")
+	indexMergeCmd.Flags().BoolVar(&flagIndexRetry, "retry", false, "retry if the index changed")
+}
@@ -21,24 +21,129 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
 	"github.com/hayorov/helm-gcs/pkg/repo"
 	"github.com/spf13/cobra"
 )
 
+var (
+	flagFromIndex  string
+	flagCopyCharts bool
+	flagInitForce  bool
+	flagInitYes    bool
+
+	flagCreateBucket  bool
+	flagBucketProject string
+	flagBucketRegion  string
+	flagUniformAccess bool
+	flagPublicBucket  bool
+)
+
 var initCmd = &cobra.Command{
 	Use:   "init gs://bucket/path",
 	Short: "init a repository",
-	Long:  `This command will initialize a new repository on a given GCS url (gs://bucket/path).`,
-	Args:  cobra.MinimumNArgs(1),
+	Long: `This command will initialize a new repository on a given GCS url (gs://bucket/path).
+With --from-index, the repository is pre-populated with the entries of an existing index file.
+With --force, the index file of an existing repository is replaced with an empty one, after
+a confirmation unless --yes is given. Chart files are left in the bucket.
+With --create-bucket, the bucket is created first in the project of --project if it doesn't
+exist, with the location of --location, uniform bucket-level access with --uniform-access,
+and public read access with --public.`,
+	Args: cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		r, err := repo.New(args[0], gcsClient)
+		asJSON, err := jsonOutput()
 		if err != nil {
 			return err
 		}
-		return repo.Create(r)
+		r, err := newRepo(args[0], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		if flagCreateBucket {
+			if err := createBucket(cmd.Context(), args[0]); err != nil {
+				return err
+			}
+		}
+		if err := initRepo(cmd.Context(), r, args[0]); err != nil {
+			if !flagCreateBucket {
+				if exists, _ := gcs.BucketExists(cmd.Context(), gcsClient, args[0]); !exists {
+					return fmt.Errorf("%w\nthe bucket doesn't exist: create it first, or use --create-bucket --project", err)
+				}
+			}
+			return err
+		}
+		if asJSON {
+			return printJSON(initResult{URL: r.URL(), IndexGeneration: r.IndexGeneration()})
+		}
+		return nil
 	},
 }
 
+// initResult is the result of init printed with --output json.
+type initResult struct {
+	URL             string `json:"url"`
+	IndexGeneration int64  `json:"indexGeneration"`
+}
+
+// createBucket creates the bucket of repoURL from the flags, if it doesn't exist.
+func createBucket(ctx context.Context, repoURL string) error {
+	created, err := gcs.CreateBucket(ctx, gcsClient, repoURL, gcs.BucketConfig{
+		Project:       flagBucketProject,
+		Location:      flagBucketRegion,
+		UniformAccess: flagUniformAccess,
+		Public:        flagPublicBucket,
+	})
+	if err != nil {
+		return err
+	}
+	if created && !flagQuiet {
+		fmt.Fprintf(os.Stderr, "bucket of %s created\n", repoURL)
+	}
+	return nil
+}
+
+// initRepo creates, bootstraps or resets the repository r.
+func initRepo(ctx context.Context, r *repo.Repo, repoURL string) error {
+	if flagInitForce {
+		if flagFromIndex != "" {
+			return errors.New("--force can't be used with --from-index")
+		}
+		if !flagInitYes && !confirm(fmt.Sprintf("Replace the index of %s with an empty one?", repoURL)) {
+			return errors.New("aborted")
+		}
+		return repo.Reset(ctx, r)
+	}
+	if flagFromIndex != "" {
+		return repo.CreateFromIndex(ctx, r, flagFromIndex, flagCopyCharts)
+	}
+	return repo.Create(ctx, r)
+}
+
+// confirm asks the user a yes/no question on the terminal, no by default.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
 func init() {
 	rootCmd.AddCommand(initCmd)
+	addOutputFlag(initCmd)
+	initCmd.Flags().StringVar(&flagFromIndex, "from-index", "", "local path or URL (gs://, https://) of an index.yaml to bootstrap the repository from")
+	initCmd.Flags().BoolVar(&flagInitForce, "force", false, "replace the index of an existing repository with an empty one")
+	initCmd.Flags().BoolVarP(&flagInitYes, "yes", "y", false, "used with --force to skip the confirmation")
+	initCmd.Flags().BoolVar(&flagCopyCharts, "copy-charts", false, "used with --from-index to copy the referenced charts into the repository")
+	initCmd.Flags().BoolVar(&flagCreateBucket, "create-bucket", false, "create the bucket if it doesn't exist")
+	initCmd.Flags().StringVar(&flagBucketProject, "project", os.Getenv("GOOGLE_CLOUD_PROJECT"), "used with --create-bucket, project the bucket is created in, GOOGLE_CLOUD_PROJECT if not set")
+	initCmd.Flags().StringVar(&flagBucketRegion, "location", "", "used with --create-bucket, region or multi-region of the bucket, e.g. \"europe-west1\" or \"EU\"")
+	initCmd.Flags().BoolVar(&flagUniformAccess, "uniform-access", false, "used with --create-bucket, enable uniform bucket-level access")
+	initCmd.Flags().BoolVar(&flagPublicBucket, "public", false, "used with --create-bucket, grant everyone read access to the charts, to serve the repository over HTTPS")
 }
@@ -0,0 +1,61 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagChannel     string
+	flagLatestDevel bool
+)
+
+var latestCmd = &cobra.Command{
+	Use:   "latest [repository]/[chart]",
+	Short: "print the latest version of a chart",
+	Long:  `This command prints the latest stable version of a chart, or the version mapped to a tag with --channel.`,
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repoName, chart, err := splitChartReference(args[0])
+		if err != nil {
+			return err
+		}
+		r, err := loadRepo(repoName)
+		if err != nil {
+			return err
+		}
+		cv, err := r.ResolveVersion(cmd.Context(), chart, flagChannel, flagLatestDevel)
+		if err != nil {
+			return err
+		}
+		fmt.Println(cv.Version)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(latestCmd)
+	latestCmd.Flags().StringVar(&flagChannel, "channel", "", "tag of the version to print")
+	latestCmd.Flags().BoolVar(&flagLatestDevel, "devel", false, "include pre-release versions")
+}
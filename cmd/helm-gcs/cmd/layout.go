@@ -0,0 +1,69 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagLayoutDeleteOld bool
+	flagLayoutRetry     bool
+)
+
+var layoutCmd = &cobra.Command{
+	Use:   "layout content-addressable [repository]",
+	Short: "convert a repository to the content-addressable layout",
+	Long: `This command converts a repository to the content-addressable layout: the charts are copied
+server-side under charts/<sha256>.tgz, named after their digest, and the index is rewritten to
+point to the copies. The layout policy of the repository is set, so later pushes store charts
+by content too: pushing a chart already stored uploads nothing, and versions with identical
+content share their object.
+
+The original objects are kept, unless --delete-old is given. Run "helm gcs policy [repository]
+layout=flat" to push charts with their name again, charts already stored by content are kept.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if args[0] != repo.LayoutContentAddressable {
+			return fmt.Errorf("unknown layout %q, repositories can only be converted to %q", args[0], repo.LayoutContentAddressable)
+		}
+		r, err := loadRepo(args[1], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		result, err := r.ConvertToContentAddressable(cmd.Context(), flagLayoutDeleteOld, flagLayoutRetry)
+		if err != nil {
+			return err
+		}
+		infof("copied %d charts (%d bytes), %s is content-addressable\n", result.Charts, result.Bytes, args[1])
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(layoutCmd)
+	layoutCmd.Flags().BoolVar(&flagLayoutDeleteOld, "delete-old", false, "delete the original chart objects once the index is updated")
+	layoutCmd.Flags().BoolVar(&flagLayoutRetry, "retry", false, "retry if the index changed")
+	layoutCmd.Flags().BoolVar(&flagChecksums, "checksums", false, "update the SHA256SUMS file of the repository")
+}
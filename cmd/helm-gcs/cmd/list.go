@@ -0,0 +1,99 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"text/tabwriter"
+
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagIncludeLibraries bool
+	flagListFilter       string
+	flagListLimit        int
+	flagListPageToken    string
+	listRepos            repoSelection
+)
+
+var listCmd = &cobra.Command{
+	Use:     "list [repository...]",
+	Aliases: []string{"ls"},
+	Short:   "list the charts of a repository",
+	Long: `This command lists the latest version of the charts of a repository that has been added to helm via "helm repo add".
+Library charts are hidden unless --include-libraries is set.
+Use --filter to list the charts whose name matches a regular expression, and --limit
+to list large repositories page by page: the token of the next page is printed after the list.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		names, err := listRepos.resolve(args)
+		if err != nil {
+			return err
+		}
+		return forEachRepo(cmd.Context(), names, listCharts)
+	},
+}
+
+func listCharts(ctx context.Context, name string) error {
+	r, err := loadRepo(name)
+	if err != nil {
+		return err
+	}
+	opts := repo.ListOptions{
+		IncludeLibraries: flagIncludeLibraries,
+		Limit:            flagListLimit,
+		PageToken:        flagListPageToken,
+	}
+	if flagListFilter != "" {
+		if opts.Filter, err = regexp.Compile(flagListFilter); err != nil {
+			return fmt.Errorf("invalid filter: %w", err)
+		}
+	}
+	charts, next, err := r.Charts(ctx, opts)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVERSION\tAPP VERSION\tDESCRIPTION")
+	for _, c := range charts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Name, c.Version, c.AppVersion, c.Description)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if next != "" {
+		fmt.Printf("\nnext page: --page-token %s\n", next)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+	listRepos.addFlags(listCmd)
+	listCmd.Flags().BoolVar(&flagIncludeLibraries, "include-libraries", false, "also list library charts")
+	listCmd.Flags().StringVar(&flagListFilter, "filter", "", "only list charts whose name matches this regular expression")
+	listCmd.Flags().IntVar(&flagListLimit, "limit", 0, "maximum number of charts to list")
+	listCmd.Flags().StringVar(&flagListPageToken, "page-token", "", "list the page following a previous listing")
+}
@@ -0,0 +1,117 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagMetricsTextfile string
+	flagMetricsListen   string
+	metricsRepos        repoSelection
+)
+
+var exportMetricsCmd = &cobra.Command{
+	Use:   "export-metrics [repository...]",
+	Short: "export the inventory of repositories as Prometheus metrics",
+	Long: `This command exports gauges about repositories (charts, versions, bytes, index generation,
+last push time) in the Prometheus text format: on stdout, to a file for the textfile collector
+of node_exporter with --textfile, or served on /metrics with --listen.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		names, err := metricsRepos.resolve(args)
+		if err != nil {
+			return err
+		}
+		if flagMetricsListen != "" {
+			http.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+				b, err := collectMetrics(req.Context(), names)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+				_, _ = w.Write(b)
+			})
+			return http.ListenAndServe(flagMetricsListen, nil)
+		}
+		b, err := collectMetrics(cmd.Context(), names)
+		if err != nil {
+			return err
+		}
+		if flagMetricsTextfile == "" {
+			_, err = os.Stdout.Write(b)
+			return err
+		}
+		return writeFileAtomic(flagMetricsTextfile, b)
+	},
+}
+
+func collectMetrics(ctx context.Context, names []string) ([]byte, error) {
+	metrics := map[string]*repo.Metrics{}
+	for _, name := range names {
+		r, err := loadRepo(name)
+		if err != nil {
+			return nil, err
+		}
+		if metrics[name], err = r.Metrics(ctx); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	var buf bytes.Buffer
+	err := repo.WritePrometheus(&buf, metrics)
+	return buf.Bytes(), err
+}
+
+// writeFileAtomic writes the file through a temporary file, so readers never see a partial file.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".helm-gcs-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func init() {
+	rootCmd.AddCommand(exportMetricsCmd)
+	metricsRepos.addFlags(exportMetricsCmd)
+	exportMetricsCmd.Flags().StringVar(&flagMetricsTextfile, "textfile", "", "write the metrics to this file, for the textfile collector of node_exporter")
+	exportMetricsCmd.Flags().StringVar(&flagMetricsListen, "listen", "", "serve the metrics on /metrics at this address, e.g. :9090")
+}
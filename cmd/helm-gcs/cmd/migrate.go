@@ -0,0 +1,56 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var flagMigrateServerSide bool
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate gs://old-bucket/path gs://new-bucket/path",
+	Short: "copy a repository to another bucket or path",
+	Long: `This command creates a new repository as a copy of an existing one: the chart archives, with their
+provenance and signature files, are copied and the index is rewritten to point to the copies.
+The source repository is not changed. Objects are copied server-side, unless --server-side=false
+is given to download and upload them again.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := newRepo(args[1], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		result, err := repo.Migrate(cmd.Context(), r, args[0], flagMigrateServerSide)
+		if err != nil {
+			return err
+		}
+		infof("migrated %d charts (%d bytes) to %s\n", result.Charts, result.Bytes, r.URL())
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+	migrateCmd.Flags().BoolVar(&flagMigrateServerSide, "server-side", true, "copy objects with GCS rewrites, without downloading them")
+	migrateCmd.Flags().BoolVar(&flagChecksums, "checksums", false, "write the SHA256SUMS file of the new repository")
+}
@@ -0,0 +1,113 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+	"github.com/spf13/cobra"
+	"google.golang.org/api/pubsub/v1"
+)
+
+var (
+	flagNotificationsProject      string
+	flagNotificationsTopic        string
+	flagNotificationsCreateTopic  bool
+	flagNotificationsSubscription string
+	flagNotificationsEvents       []string
+)
+
+var notificationsCmd = &cobra.Command{
+	Use:   "notifications",
+	Short: "manage the notifications of a repository",
+}
+
+var notificationsEnableCmd = &cobra.Command{
+	Use:   "enable [repository|gs://bucket/path]",
+	Short: "publish the events of a repository to Pub/Sub",
+	Long: `This command configures the bucket of a repository to publish the events of the repository objects
+(scoped to its path) to a Pub/Sub topic, optionally creating the topic and a pull subscription.
+The Cloud Storage service agent of the project is granted to publish to the topic.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repoURL, err := resolveRepoURL(args[0])
+		if err != nil {
+			return err
+		}
+		opts, err := gcs.ClientOptions(repoAuth(args[0]))
+		if err != nil {
+			return err
+		}
+		ps, err := pubsub.NewService(context.Background(), opts...)
+		if err != nil {
+			return err
+		}
+		client, err := repoClient(args[0])
+		if err != nil {
+			return err
+		}
+		setup, err := gcs.EnableNotifications(cmd.Context(), client, ps, repoURL, gcs.NotificationConfig{
+			Project:      flagNotificationsProject,
+			Topic:        flagNotificationsTopic,
+			CreateTopic:  flagNotificationsCreateTopic,
+			Subscription: flagNotificationsSubscription,
+			EventTypes:   flagNotificationsEvents,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println("notification:", setup.NotificationID)
+		fmt.Println("bucket:", setup.Bucket)
+		fmt.Println("prefix:", setup.Prefix)
+		fmt.Println("topic:", setup.Topic)
+		if setup.Subscription != "" {
+			fmt.Println("subscription:", setup.Subscription)
+		}
+		return nil
+	},
+}
+
+// resolveRepoURL returns the gs:// URL of a repository given by helm name or URL.
+func resolveRepoURL(nameOrURL string) (string, error) {
+	if strings.Contains(nameOrURL, "://") {
+		return nameOrURL, nil
+	}
+	r, err := loadRepo(nameOrURL)
+	if err != nil {
+		return "", err
+	}
+	return r.URL(), nil
+}
+
+func init() {
+	rootCmd.AddCommand(notificationsCmd)
+	notificationsCmd.AddCommand(notificationsEnableCmd)
+	notificationsEnableCmd.Flags().StringVar(&flagNotificationsProject, "project", "", "project of the Pub/Sub topic")
+	notificationsEnableCmd.Flags().StringVar(&flagNotificationsTopic, "topic", "", "ID of the Pub/Sub topic")
+	notificationsEnableCmd.Flags().BoolVar(&flagNotificationsCreateTopic, "create-topic", false, "create the topic if it does not exist")
+	notificationsEnableCmd.Flags().StringVar(&flagNotificationsSubscription, "subscription", "", "ID of a pull subscription to create on the topic")
+	notificationsEnableCmd.Flags().StringSliceVar(&flagNotificationsEvents, "events", []string{"OBJECT_FINALIZE", "OBJECT_DELETE"}, "event types to notify")
+	_ = notificationsEnableCmd.MarkFlagRequired("project")
+	_ = notificationsEnableCmd.MarkFlagRequired("topic")
+}
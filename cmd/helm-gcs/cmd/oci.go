@@ -0,0 +1,97 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagImportForce bool
+	flagImportRetry bool
+)
+
+var exportOCICmd = &cobra.Command{
+	Use:   "export-oci [chart] [version] [repository] [oci://registry/repository]",
+	Short: "push a chart of a repository to an OCI registry",
+	Long: `This command pushes a chart version of a repository to an OCI registry, e.g. Artifact Registry,
+with its provenance file, using the credentials of "helm registry login":
+
+  helm gcs export-oci my-chart 1.4.2 my-repository oci://europe-docker.pkg.dev/my-project/charts
+
+The digest of the chart is verified against the index before it is pushed. The version can also
+be a tag or a semver constraint. Like "helm push", the chart is pushed as <repository>/<chart>:<version>.`,
+	Args: cobra.ExactArgs(4),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := loadRepo(args[2], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		ref, err := r.ExportOCI(cmd.Context(), args[0], args[1], args[3])
+		if err != nil {
+			return err
+		}
+		infof("pushed %s\n", ref)
+		return nil
+	},
+}
+
+var importOCICmd = &cobra.Command{
+	Use:   "import-oci [oci://registry/repository/chart:version] [repository]",
+	Short: "push a chart of an OCI registry into a repository",
+	Long: `This command pulls a chart from an OCI registry, with its provenance file if it has one, using the
+credentials of "helm registry login", and pushes it into a repository:
+
+  helm gcs import-oci oci://europe-docker.pkg.dev/my-project/charts/my-chart:1.4.2 my-repository`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !repo.IsOCIReference(args[0]) {
+			return fmt.Errorf("invalid OCI reference %q, should be oci://registry/repository/chart:version", args[0])
+		}
+		r, err := loadRepo(args[1], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		chartpath, cleanup, err := repo.PullOCIChart(args[0])
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		result, err := r.PushChart(cmd.Context(), chartpath, flagImportForce, flagImportRetry, false, "", "", nil)
+		if err != nil {
+			return err
+		}
+		infof("imported %s-%s to %s\n", result.Name, result.Version, result.URL)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportOCICmd)
+	rootCmd.AddCommand(importOCICmd)
+	importOCICmd.Flags().BoolVar(&flagImportForce, "force", false, "import the chart even if already indexed")
+	importOCICmd.Flags().BoolVar(&flagImportRetry, "retry", false, "retry if the index changed")
+	importOCICmd.Flags().BoolVar(&flagChecksums, "checksums", false, "update the SHA256SUMS file of the repository")
+	importOCICmd.Flags().BoolVar(&flagChangelog, "changelog", false, "record the change in the CHANGELOG.ndjson file of the repository")
+}
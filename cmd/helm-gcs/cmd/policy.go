@@ -0,0 +1,88 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var flagPolicyRetry bool
+
+var policyCmd = &cobra.Command{
+	Use:   "policy [repository] [policy=value...]",
+	Short: "set the policies of a repository",
+	Long: `This command sets the policies enforced when pushing charts into a repository. They are stored in the index file.
+A policy is removed with "policy=". Without policy arguments, the policies of the repository are printed.
+
+Policies:
+  libraries=allow|reject                 accept or reject library charts (default: allow)
+  max-versions=N                         maximum number of versions kept per chart
+  max-versions.<channel>=N               maximum number of versions of a channel kept per chart, the channel is
+                                         "stable" or the first pre-release identifier (e.g. "rc" for 1.0.0-rc.1)
+  max-versions-action=reject|prune       reject pushes beyond max-versions (default), or prune the oldest versions
+  lint=off|errors|strict                 lint pushed charts, rejecting errors, or warnings too with strict (default: off)`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := loadRepo(args[0], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		if len(args) == 1 {
+			return printPolicies(cmd.Context(), r)
+		}
+		policies := map[string]string{}
+		for _, arg := range args[1:] {
+			name, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				return fmt.Errorf("invalid policy %q, should be policy=value", arg)
+			}
+			policies[name] = value
+		}
+		return r.SetPolicies(cmd.Context(), policies, flagPolicyRetry)
+	},
+}
+
+func printPolicies(ctx context.Context, r *repo.Repo) error {
+	policies, err := r.Policies(ctx)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s=%s\n", name, policies[name])
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(policyCmd)
+	policyCmd.Flags().BoolVar(&flagPolicyRetry, "retry", false, "retry if the index changed")
+}
@@ -0,0 +1,87 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagPromoteForce bool
+	flagPromoteRetry bool
+)
+
+var promoteCmd = &cobra.Command{
+	Use:   "promote [chart] [version] [source repository] [destination repository]",
+	Short: "promote a chart version from a repository to another",
+	Long: `This command promotes a chart version between environments, e.g. from a staging repository
+to a production one, given by helm name or gs:// URL:
+
+  helm gcs promote my-chart 1.4.2 staging production
+
+The chart archive, with its provenance and signature files, is copied server-side to the root of the
+destination repository, and indexed with the digest of the source entry: the promoted chart is the one
+which was tested. The source repository is not changed.`,
+	Args: cobra.ExactArgs(4),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := jsonOutput()
+		if err != nil {
+			return err
+		}
+		source, err := openRepo(args[2])
+		if err != nil {
+			return err
+		}
+		dest, err := openRepo(args[3], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		result, err := dest.Promote(cmd.Context(), source, args[0], args[1], flagPromoteForce, flagPromoteRetry)
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			return printJSON(result)
+		}
+		infof("promoted %s-%s to %s\n", result.Name, result.Version, result.URL)
+		return nil
+	},
+}
+
+// openRepo opens a repository given by helm name or gs:// URL.
+func openRepo(nameOrURL string, opts ...repo.Option) (*repo.Repo, error) {
+	if strings.Contains(nameOrURL, "://") {
+		return newRepo(nameOrURL, opts...)
+	}
+	return loadRepo(nameOrURL, opts...)
+}
+
+func init() {
+	rootCmd.AddCommand(promoteCmd)
+	promoteCmd.Flags().BoolVar(&flagPromoteForce, "force", false, "promote the chart even if already indexed by the destination repository")
+	promoteCmd.Flags().BoolVar(&flagPromoteRetry, "retry", false, "retry if the destination index changed")
+	promoteCmd.Flags().BoolVar(&flagChecksums, "checksums", false, "update the SHA256SUMS file of the destination repository")
+	promoteCmd.Flags().BoolVar(&flagChangelog, "changelog", false, "record the change in the CHANGELOG.ndjson file of the destination repository")
+	addOutputFlag(promoteCmd)
+}
@@ -0,0 +1,104 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagPruneKeep     int
+	flagPruneKeepDays int
+	flagPrunePattern  string
+	flagPruneDryRun   bool
+	flagPruneRetry    bool
+	pruneRepos        repoSelection
+)
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune [repository|gs://bucket/path...]",
+	Short: "remove old chart versions",
+	Long: `This command removes the old versions of the charts of a repository, e.g. the snapshots pushed by CI:
+the versions beyond the --keep newest ones of each chart, or older than --keep-days days, are removed
+from the index and their objects deleted. With both, versions are kept if they are among the newest
+or recent enough. Tagged versions are never removed.
+
+  helm gcs prune my-repository --keep 10 --pattern "*-snapshot"
+
+Use --dry-run to print what would be removed, without changing anything.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		names, err := pruneRepos.resolve(args)
+		if err != nil {
+			return err
+		}
+		return forEachRepo(cmd.Context(), names, prune)
+	},
+}
+
+func prune(ctx context.Context, nameOrURL string) error {
+	repoURL, err := resolveRepoURL(nameOrURL)
+	if err != nil {
+		return err
+	}
+	r, err := newRepo(repoURL, repoOptions()...)
+	if err != nil {
+		return err
+	}
+	removals, err := r.Prune(ctx, repo.PruneOptions{
+		Keep:    flagPruneKeep,
+		MaxAge:  time.Duration(flagPruneKeepDays) * 24 * time.Hour,
+		Pattern: flagPrunePattern,
+		DryRun:  flagPruneDryRun,
+	}, flagPruneRetry)
+	if err != nil {
+		return err
+	}
+	if flagPruneDryRun {
+		for _, removal := range removals {
+			fmt.Printf("would remove %s-%s\n", removal.Name, removal.Version)
+		}
+		fmt.Printf("%d chart versions would be removed\n", len(removals))
+		return nil
+	}
+	for _, removal := range removals {
+		infof("removed %s-%s\n", removal.Name, removal.Version)
+	}
+	infof("%d chart versions removed\n", len(removals))
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+	pruneRepos.addFlags(pruneCmd)
+	pruneCmd.Flags().IntVar(&flagPruneKeep, "keep", 0, "number of newest versions kept per chart")
+	pruneCmd.Flags().IntVar(&flagPruneKeepDays, "keep-days", 0, "age in days beyond which versions are removed")
+	pruneCmd.Flags().StringVar(&flagPrunePattern, "pattern", "", "only prune the charts whose name matches this shell pattern")
+	pruneCmd.Flags().BoolVar(&flagPruneDryRun, "dry-run", false, "print what would be removed, without removing anything")
+	pruneCmd.Flags().BoolVar(&flagPruneRetry, "retry", false, "retry if the index changed")
+	pruneCmd.Flags().BoolVar(&flagChecksums, "checksums", false, "update the SHA256SUMS file of the repository")
+	pruneCmd.Flags().IntVar(&flagConcurrency, "concurrency", 8, "number of chart files deleted in parallel")
+	pruneCmd.Flags().BoolVar(&flagChangelog, "changelog", false, "record the change in the CHANGELOG.ndjson file of the repository")
+}
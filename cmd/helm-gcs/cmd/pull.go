@@ -22,32 +22,304 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/hayorov/helm-gcs/pkg/gcs"
+	"github.com/hayorov/helm-gcs/pkg/repo"
 	"github.com/spf13/cobra"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+// Environment variables bounding the downloads of helm, which runs pull without flags.
+const (
+	getterTimeoutEnv = "HELM_GCS_GETTER_TIMEOUT"
+	getterRetriesEnv = "HELM_GCS_GETTER_RETRIES"
+)
+
+// Defaults of the downloads of pull: a stalled download is abandoned after
+// defaultGetterTimeout, and tried again defaultGetterRetries times.
+const (
+	defaultGetterTimeout = 5 * time.Minute
+	defaultGetterRetries = 2
+)
+
+var (
+	flagPullDestination string
+	flagPullUntar       bool
 )
 
 var pullCmd = &cobra.Command{
-	Use:   "pull gs://bucket/path",
+	Use:   "pull [certFile keyFile caFile] gs://bucket/path",
 	Short: "prints a file on stdout",
 	Long: `This command pull a file from GCS and prints it to stdout.
-Used by helm to fetch charts from GCS.`,
+Used by helm to fetch charts from GCS.
+
+Helm passes the certificate, key and CA files of the repository before the URL. A certificate or
+key which is Google credentials JSON, e.g. set with "helm repo add --cert-file sa.json", is used
+to authenticate against GCS, other files are ignored.
+
+With --destination, the file is written to the given directory instead, under its name in GCS.
+With --untar, a chart is extracted there.
+
+When HELM_GCS_VERIFY_INDEX is set ("gpg", "cosign" or "kms"), index files are only printed
+if their detached signature is valid for the key given by HELM_GCS_VERIFY_KEY.
+With HELM_GCS_VERIFY_CHARTS=true, charts are verified the same way.
+Keyless cosign signatures are verified, without HELM_GCS_VERIFY_KEY, against the certificate
+identity and OIDC issuer given by HELM_GCS_VERIFY_IDENTITY and HELM_GCS_VERIFY_OIDC_ISSUER.
+
+When HELM_GCS_CACHE_TTL is set (e.g. "5m"), index and provenance files are cached on disk,
+in $HELM_PLUGIN_CACHE or helm cache, and downloaded again only once they changed.
+They are read from the cache without any request for the given duration.
+
+Index files written gzip compressed (--gzip-index) are printed decompressed.
+
+Each download attempt is bounded by HELM_GCS_GETTER_TIMEOUT (default 5m, 0 for no limit), so that
+a stalled connection doesn't hang helm. Attempts which time out or fail with a transient error are
+retried HELM_GCS_GETTER_RETRIES times (default 2), with an exponential backoff. Attempts are written
+to a temporary file: nothing is written until the object is completely downloaded.`,
+	Args: cobra.MatchAll(cobra.MinimumNArgs(1), cobra.MaximumNArgs(4)),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		o, err := gcs.Object(gcsClient, args[0])
+		objectURL := args[len(args)-1]
+		for _, f := range args[:len(args)-1] {
+			if f != "" && gcs.IsCredentialsFile(f) {
+				downloaderCredentials = f
+				break
+			}
+		}
+		out, commit, err := pullOutput(objectURL)
 		if err != nil {
 			return err
 		}
-		r, err := o.NewReader(context.Background())
-		if err != nil {
+		return commit(pullWithRetries(cmd.Context(), objectURL, out))
+	},
+}
+
+// pullBackoff is the backoff between the attempts of pullWithRetries.
+var pullBackoff = gcs.DefaultRetryPolicy
+
+// pullWithRetries writes the object at objectURL to out, like pull, bounding each attempt
+// with HELM_GCS_GETTER_TIMEOUT and retrying it as set by HELM_GCS_GETTER_RETRIES.
+func pullWithRetries(ctx context.Context, objectURL string, out io.Writer) error {
+	timeout, retries, err := getterLimits()
+	if err != nil {
+		return err
+	}
+	return retryPull(ctx, objectURL, out, retries, func(ctx context.Context, w io.Writer) error {
+		return pullAttempt(ctx, objectURL, w, timeout)
+	})
+}
+
+// retryPull runs attempt until it succeeds, retrying it up to retries times when it fails
+// with a timeout or a retryable error. Each attempt is written to a temporary file, so that
+// out only receives a complete object without it being held in memory.
+func retryPull(ctx context.Context, objectURL string, out io.Writer, retries int, attempt func(context.Context, io.Writer) error) error {
+	tmp, err := os.CreateTemp("", ".helm-gcs-pull-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	backoff := pullBackoff.Initial
+	for n := 0; ; n++ {
+		if err := rewind(tmp, true); err != nil {
+			return err
+		}
+		err := attempt(ctx, tmp)
+		if err == nil {
+			if err := rewind(tmp, false); err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tmp)
+			return err
+		}
+		// the operation was canceled (SIGINT, SIGTERM) or timed out with --timeout
+		if ctx.Err() != nil || n >= retries {
+			return err
+		}
+		if !errors.Is(err, context.DeadlineExceeded) && !gcs.IsRetryable(err) {
 			return err
 		}
-		_, err = io.Copy(os.Stdout, r)
+		if !flagQuiet {
+			fmt.Fprintf(os.Stderr, "pull %s: %s, retrying in %s\n", objectURL, err, backoff)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > pullBackoff.Max {
+			backoff = pullBackoff.Max
+		}
+	}
+}
+
+// rewind moves back to the start of f, emptying it with truncate.
+func rewind(f *os.File, truncate bool) error {
+	if truncate {
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// pullAttempt writes the object at objectURL to out, in at most timeout if not 0.
+func pullAttempt(ctx context.Context, objectURL string, out io.Writer, timeout time.Duration) error {
+	if timeout <= 0 {
+		return pull(ctx, objectURL, out)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := pull(attemptCtx, objectURL, out)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return fmt.Errorf("download timed out after %s: %w", timeout, err)
+	}
+	return err
+}
+
+// getterLimits returns the timeout of a download attempt and the number of retries,
+// from HELM_GCS_GETTER_TIMEOUT and HELM_GCS_GETTER_RETRIES.
+func getterLimits() (time.Duration, int, error) {
+	timeout, retries := defaultGetterTimeout, defaultGetterRetries
+	if env := os.Getenv(getterTimeoutEnv); env != "" {
+		d, err := time.ParseDuration(env)
+		if err != nil || d < 0 {
+			return 0, 0, fmt.Errorf("invalid %s %q, should be a duration like \"2m\"", getterTimeoutEnv, env)
+		}
+		timeout = d
+	}
+	if env := os.Getenv(getterRetriesEnv); env != "" {
+		n, err := strconv.Atoi(env)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid %s %q, should be a number of retries", getterRetriesEnv, env)
+		}
+		retries = n
+	}
+	return timeout, retries, nil
+}
+
+// pull writes the object at objectURL to out, decompressing and verifying index files,
+// and verifying charts with HELM_GCS_VERIFY_CHARTS.
+func pull(ctx context.Context, objectURL string, out io.Writer) error {
+	open := gcs.NewReader
+	if isCacheable(objectURL) {
+		open = gcs.NewCachedReader
+	}
+	client, err := repoClient(objectURL)
+	if err != nil {
 		return err
-	},
+	}
+	r, err := open(ctx, client, objectURL)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	reader := repo.ProgressReader(r, progressReporter(), repo.PhaseDownload, objectURL, repo.ReaderSize(r))
+	method := os.Getenv("HELM_GCS_VERIFY_INDEX")
+	isIndex := strings.HasSuffix(objectURL, "/index.yaml")
+	verifyChart := method != "" && os.Getenv("HELM_GCS_VERIFY_CHARTS") == "true" && strings.HasSuffix(objectURL, ".tgz")
+	if !isIndex && !verifyChart {
+		_, err = io.Copy(out, reader)
+		return err
+	}
+	b, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	if isIndex {
+		// a gzip compressed index may not have been decompressed on the way
+		if b, err = gcs.Gunzip(b); err != nil {
+			return err
+		}
+	}
+	if method != "" {
+		if err := verifyPulledObject(ctx, objectURL, b, method); err != nil {
+			return err
+		}
+	}
+	_, err = out.Write(b)
+	return err
+}
+
+// verifyPulledObject verifies the object b, read at path, against its detached signature.
+func verifyPulledObject(ctx context.Context, path string, b []byte, method string) error {
+	key := os.Getenv("HELM_GCS_VERIFY_KEY")
+	var verifier repo.IndexVerifier
+	var err error
+	if method == repo.SignatureCosign && key == "" {
+		verifier, err = repo.NewCosignKeylessVerifier(os.Getenv("HELM_GCS_VERIFY_IDENTITY"), os.Getenv("HELM_GCS_VERIFY_OIDC_ISSUER"))
+	} else {
+		opts, optsErr := gcs.ClientOptions(repoAuth(path))
+		if optsErr != nil {
+			return optsErr
+		}
+		verifier, err = repo.NewIndexVerifier(method, key, opts...)
+	}
+	if err != nil {
+		return err
+	}
+	client, err := repoClient(path)
+	if err != nil {
+		return err
+	}
+	return repo.VerifyObject(ctx, client, path, b, verifier)
+}
+
+// pullOutput returns where the object at objectURL is written: stdout, or a temporary file
+// with --destination or --untar. The returned function completes the pull with its error:
+// the file is renamed to its final path, or the chart it holds is extracted.
+func pullOutput(objectURL string) (io.Writer, func(error) error, error) {
+	if flagPullDestination == "" && !flagPullUntar {
+		return os.Stdout, func(err error) error { return err }, nil
+	}
+	dir := flagPullDestination
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.CreateTemp(dir, ".helm-gcs-pull-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	commit := func(err error) error {
+		defer os.Remove(f.Name())
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if flagPullUntar {
+			if err := chartutil.ExpandFile(dir, f.Name()); err != nil {
+				return fmt.Errorf("untar %s: %w", objectURL, err)
+			}
+			return nil
+		}
+		return os.Rename(f.Name(), filepath.Join(dir, path.Base(objectURL)))
+	}
+	return f, commit, nil
+}
+
+// isCacheable reports whether the object at path is cached by pull: charts are
+// already cached by helm.
+func isCacheable(path string) bool {
+	return strings.HasSuffix(path, "/index.yaml") || strings.HasSuffix(path, ".prov")
 }
 
 func init() {
 	rootCmd.AddCommand(pullCmd)
+	pullCmd.Flags().StringVarP(&flagPullDestination, "destination", "d", "", "directory the file is written to, instead of stdout")
+	pullCmd.Flags().BoolVar(&flagPullUntar, "untar", false, "extract the chart in the destination directory, the current one if not set")
 }
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRetryPull(t *testing.T) {
+	pullBackoff.Initial, pullBackoff.Max = time.Millisecond, 2*time.Millisecond
+	flagQuiet = true
+	defer func() { flagQuiet = false }()
+
+	tests := []struct {
+		name         string
+		retries      int
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{name: "first attempt", retries: 2, wantAttempts: 1},
+		{name: "retryable failures", retries: 2, errs: []error{io.ErrUnexpectedEOF, context.DeadlineExceeded}, wantAttempts: 3},
+		{name: "retries exhausted", retries: 1, errs: []error{io.ErrUnexpectedEOF, io.ErrUnexpectedEOF}, wantAttempts: 2, wantErr: io.ErrUnexpectedEOF},
+		{name: "permanent failure", retries: 2, errs: []error{io.ErrClosedPipe}, wantAttempts: 1, wantErr: io.ErrClosedPipe},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			out := &bytes.Buffer{}
+			err := retryPull(context.Background(), "gs://bucket/repo/index.yaml", out, tt.retries, func(ctx context.Context, w io.Writer) error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					// a failed attempt leaves a partial object behind
+					io.WriteString(w, "partial object")
+					return tt.errs[attempts-1]
+				}
+				_, err := io.WriteString(w, "object")
+				return err
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("retryPull() error = %v, want %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			want := "object"
+			if tt.wantErr != nil {
+				want = ""
+			}
+			if out.String() != want {
+				t.Errorf("pulled %q, want %q", out.String(), want)
+			}
+		})
+	}
+}
+
+func TestRetryPullCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := retryPull(ctx, "gs://bucket/repo/index.yaml", io.Discard, 3, func(ctx context.Context, w io.Writer) error {
+		attempts++
+		cancel()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.Canceled) || attempts != 1 {
+		t.Errorf("retryPull() = %v after %d attempts, want canceled after 1", err, attempts)
+	}
+}
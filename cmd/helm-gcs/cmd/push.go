@@ -21,40 +21,382 @@
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/hayorov/helm-gcs/pkg/gcs"
 	"github.com/hayorov/helm-gcs/pkg/repo"
 	"github.com/spf13/cobra"
 )
 
 var (
-	flagForce      bool
-	flagRetry      bool
-	flagPublic     bool
-	flagPublicURL  string
-	flagBucketPath string
-	flagMetadata   map[string]string
+	flagForce              bool
+	flagRetry              bool
+	flagPublic             bool
+	flagPublicURL          string
+	flagBucketPath         string
+	flagMetadata           map[string]string
+	flagMetadataFile       string
+	flagCacheControl       string
+	flagContentDisposition string
+	flagContentType        string
+	flagResume             bool
+	flagChunkSize          string
+	flagGlob               string
+	flagNoBuildInfo        bool
+	flagProv               bool
+	flagSign               bool
+	flagKey                string
+	flagKeyring            string
+	flagPushClass          string
+	flagCustomTime         string
+	flagPushVersion        string
+	flagAppVersion         string
+	flagCosignKey          string
+	flagKeyless            bool
+	flagMirrorURLs         []string
+	flagLint               bool
+	flagLintStrict         bool
+	flagSkipLint           bool
+
+	flagRejectLibraries bool
+	flagRewriteDeps     map[string]string
+	flagCheckDeps       bool
+	flagSiblingRepos    []string
+	flagPushRepos       []string
 )
 
 var pushCmd = &cobra.Command{
-	Use:   "push [chart.tar.gz] [repository]",
+	Use:   "push [chart.tar.gz|chart directory|oci://registry/repo/chart:version...] [repository[,repository...]]",
 	Short: "push a chart into a repository",
-	Long:  `This command pushes a chart into a repository that has been added to helm via "helm repo add".`,
-	Args:  cobra.MinimumNArgs(2),
+	Long: `This command pushes a chart into a repository that has been added to helm via "helm repo add".
+An unpackaged chart directory is packaged before being pushed, its dependencies must be built.
+The provenance file of the chart (chart.tgz.prov) is uploaded next to it, for "helm install --verify":
+it is either found next to the chart, or created with --sign.
+The chart can be pulled from an OCI registry, using the credentials of "helm registry login".
+Several charts, given as arguments or matched by --glob, are pushed with a single update of the index.
+The charts can be pushed into several repositories at once, in parallel, given as a comma separated
+list or with --repo: a failing repository does not stop the others, the outcome of each one is reported.`,
+	Args: cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		chartpath, repoName := args[0], args[1]
-		r, err := repo.Load(repoName, gcsClient)
+		chartpaths, repoNames := pushTargets(args)
+		if flagGlob != "" {
+			matches, err := filepath.Glob(flagGlob)
+			if err != nil {
+				return err
+			}
+			chartpaths = append(chartpaths, matches...)
+		}
+		if len(chartpaths) == 0 {
+			return errors.New("no chart to push")
+		}
+		if len(repoNames) == 0 {
+			return errors.New("no repository to push to")
+		}
+		if _, err := jsonOutput(); err != nil {
+			return err
+		}
+		opts, err := pushOptions()
 		if err != nil {
 			return err
 		}
-		return r.PushChart(chartpath, flagForce, flagRetry, flagPublic, flagPublicURL, flagBucketPath, flagMetadata)
+		for n, chartpath := range chartpaths {
+			if !repo.IsOCIReference(chartpath) {
+				continue
+			}
+			var cleanup func()
+			chartpaths[n], cleanup, err = repo.PullOCIChart(chartpath)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+		}
+		if len(repoNames) > 1 {
+			return pushToRepos(cmd.Context(), repoNames, chartpaths, opts)
+		}
+		results, err := pushToRepo(cmd.Context(), repoNames[0], chartpaths, opts)
+		if err != nil {
+			return err
+		}
+		if asJSON, _ := jsonOutput(); asJSON {
+			return printJSON(results)
+		}
+		return nil
 	},
 }
 
+// pushTargets splits the arguments of push into the charts and the repositories: the
+// repositories of --repo, or the last argument, a comma separated list of repositories.
+func pushTargets(args []string) ([]string, []string) {
+	if len(flagPushRepos) > 0 {
+		return args, flagPushRepos
+	}
+	var repoNames []string
+	for _, name := range strings.Split(args[len(args)-1], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			repoNames = append(repoNames, name)
+		}
+	}
+	return args[:len(args)-1], repoNames
+}
+
+// pushOptions returns the options of the repositories pushed to, from the flags.
+func pushOptions() ([]repo.Option, error) {
+	opts := repoOptions()
+	opts = append(opts, repo.WithProvenance(flagProv))
+	if flagSign {
+		if flagKey == "" {
+			return nil, errors.New("--sign needs the name of the key to sign with, set --key")
+		}
+		opts = append(opts, repo.WithProvenanceSigning(flagKeyring, flagKey))
+	}
+	if flagCosignKey != "" || flagKeyless {
+		if flagCosignKey != "" && flagKeyless {
+			return nil, errors.New("--cosign-key and --cosign-keyless can't be used together")
+		}
+		signer, err := repo.NewIndexSigner(repo.SignatureCosign, flagCosignKey, "")
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, repo.WithChartSigner(signer))
+	}
+	chunkSize, err := parseSize(flagChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, repo.WithChunkSize(chunkSize))
+	lifecycleOpts, err := lifecycleOptions()
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, lifecycleOpts...)
+	opts = append(opts, repo.WithLint(lintMode()))
+	opts = append(opts, repo.WithChartHeaders(repo.ObjectHeaders{
+		CacheControl:       flagCacheControl,
+		ContentDisposition: flagContentDisposition,
+		ContentType:        flagContentType,
+	}))
+	opts = append(opts, repo.WithVersionOverrides(flagPushVersion, flagAppVersion))
+	for _, u := range flagMirrorURLs {
+		if err := repo.ValidateMirrorURL(u); err != nil {
+			return nil, err
+		}
+	}
+	opts = append(opts, repo.WithMirrorURLs(flagMirrorURLs...))
+	if !flagNoBuildInfo {
+		opts = append(opts, repo.WithBuildInfo(repo.DetectBuildInfo()))
+	}
+	return opts, nil
+}
+
+// pushToRepo pushes the charts into the repository repoName, with opts.
+func pushToRepo(ctx context.Context, repoName string, chartpaths []string, opts []repo.Option) ([]repo.PushResult, error) {
+	if flagResume {
+		uploader, err := gcs.NewUploader(repoAuth(repoName))
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts[:len(opts):len(opts)], repo.WithUploader(uploader))
+	}
+	r, err := loadRepo(repoName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return pushCharts(ctx, r, chartpaths)
+}
+
+// repoPush is the outcome of a push into one of several repositories.
+type repoPush struct {
+	Repository string            `json:"repository"`
+	Results    []repo.PushResult `json:"results,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// pushToRepos pushes the charts into several repositories in parallel, and reports the
+// outcome of each one: a failing repository does not stop the others.
+func pushToRepos(ctx context.Context, repoNames []string, chartpaths []string, opts []repo.Option) error {
+	pushes := make([]repoPush, len(repoNames))
+	var wg sync.WaitGroup
+	for n, name := range repoNames {
+		wg.Add(1)
+		go func(n int, name string) {
+			defer wg.Done()
+			pushes[n].Repository = name
+			results, err := pushToRepo(ctx, name, chartpaths, opts)
+			pushes[n].Results = results
+			if err != nil {
+				pushes[n].Error = err.Error()
+			}
+		}(n, name)
+	}
+	wg.Wait()
+
+	var failed []string
+	for _, p := range pushes {
+		if p.Error != "" {
+			failed = append(failed, p.Repository)
+		}
+	}
+	if asJSON, _ := jsonOutput(); asJSON {
+		if err := printJSON(pushes); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range pushes {
+			if p.Error != "" {
+				fmt.Printf("%s: Error: %s\n", p.Repository, p.Error)
+				continue
+			}
+			for _, result := range p.Results {
+				infof("%s: pushed %s-%s\n", p.Repository, result.Name, result.Version)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d repositories failed: %v", len(failed), len(repoNames), failed)
+	}
+	return nil
+}
+
+// pushCharts pushes the charts into r, with a single index update if there are several.
+func pushCharts(ctx context.Context, r *repo.Repo, chartpaths []string) ([]repo.PushResult, error) {
+	metadata, err := pushMetadata()
+	if err != nil {
+		return nil, err
+	}
+	if len(chartpaths) > 1 {
+		return r.PushCharts(ctx, chartpaths, flagForce, flagRetry, flagPublic, flagPublicURL, flagBucketPath, metadata)
+	}
+	result, err := r.PushChart(ctx, chartpaths[0], flagForce, flagRetry, flagPublic, flagPublicURL, flagBucketPath, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return []repo.PushResult{*result}, nil
+}
+
+// lintMode returns how the charts are linted from --lint, --strict and --skip-lint,
+// "" to apply the lint policy of the repository.
+func lintMode() string {
+	switch {
+	case flagSkipLint:
+		return repo.LintOff
+	case flagLintStrict:
+		return repo.LintStrict
+	case flagLint:
+		return repo.LintErrors
+	}
+	return ""
+}
+
+// lifecycleOptions returns the options setting the storage class and the custom time of the pushed charts.
+func lifecycleOptions() ([]repo.Option, error) {
+	if flagPushClass != "" && !repo.ValidStorageClass(flagPushClass) {
+		return nil, fmt.Errorf("unknown storage class %q", flagPushClass)
+	}
+	var customTime time.Time
+	if flagCustomTime != "" {
+		t, err := time.Parse(time.RFC3339, flagCustomTime)
+		if err != nil {
+			return nil, fmt.Errorf("invalid custom time: %w", err)
+		}
+		customTime = t
+	}
+	return []repo.Option{repo.WithStorageClass(flagPushClass), repo.WithCustomTime(customTime)}, nil
+}
+
+// pushMetadata returns the metadata of the chart objects: the map of --metadata-file,
+// a YAML or JSON file, overridden by --metadata.
+func pushMetadata() (map[string]string, error) {
+	if flagMetadataFile == "" {
+		return flagMetadata, nil
+	}
+	b, err := os.ReadFile(flagMetadataFile)
+	if err != nil {
+		return nil, fmt.Errorf("read metadata file: %w", err)
+	}
+	metadata := map[string]string{}
+	if err := yaml.Unmarshal(b, &metadata); err != nil {
+		return nil, fmt.Errorf("parse metadata file %s: %w", flagMetadataFile, err)
+	}
+	for k, v := range flagMetadata {
+		metadata[k] = v
+	}
+	return metadata, nil
+}
+
+// parseSize parses a size in bytes, which can be expressed with a binary unit, e.g. "16Mi" or "16MiB".
+func parseSize(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := 1
+	number := strings.TrimSuffix(s, "B")
+	for i, unit := range []string{"Ki", "Mi", "Gi"} {
+		if n, ok := strings.CutSuffix(number, unit); ok {
+			number, multiplier = n, 1<<(10*(i+1))
+			break
+		}
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// defaultKeyring returns the keyring used by "helm package --sign".
+func defaultKeyring() string {
+	if v, ok := os.LookupEnv("GNUPGHOME"); ok {
+		return filepath.Join(v, "pubring.gpg")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".gnupg", "pubring.gpg")
+}
+
 func init() {
 	rootCmd.AddCommand(pushCmd)
+	addOutputFlag(pushCmd)
 	pushCmd.Flags().BoolVar(&flagForce, "force", false, "upload the chart even if already indexed")
 	pushCmd.Flags().BoolVar(&flagRetry, "retry", false, "retry if the index changed")
+	pushCmd.Flags().StringArrayVar(&flagPushRepos, "repo", nil, "repository to push into, all the arguments are then charts (repeatable)")
 	pushCmd.Flags().BoolVar(&flagPublic, "public", false, "expose HTTP URL instead of default gs:// for public buckets")
 	pushCmd.Flags().StringVar(&flagPublicURL, "publicUrl", "", "used with --public to overwrite google storage default url")
-	pushCmd.Flags().StringVar(&flagBucketPath, "bucketPath", "", "path inside the google bucket")
+	pushCmd.Flags().StringVar(&flagPushVersion, "version", "", "override the version of the chart, which is repackaged")
+	pushCmd.Flags().StringVar(&flagAppVersion, "app-version", "", "override the appVersion of the chart, which is repackaged")
+	pushCmd.Flags().StringVar(&flagPushClass, "storage-class", "", "storage class of the chart objects: STANDARD, NEARLINE, COLDLINE or ARCHIVE, the bucket default if empty")
+	pushCmd.Flags().StringVar(&flagCustomTime, "custom-time", "", "CustomTime of the chart objects (RFC3339), for bucket lifecycle rules")
+	pushCmd.Flags().StringArrayVar(&flagMirrorURLs, "mirror-url", nil, "base URL of a mirror of the repository, whose chart URL is added to the index entry after the main one (repeatable)")
+	pushCmd.Flags().StringVar(&flagBucketPath, "bucketPath", "", "path inside the repository the chart is uploaded to and indexed at")
+	pushCmd.Flags().BoolVar(&flagRejectLibraries, "reject-libraries", false, "fail if the chart is a library chart")
+	pushCmd.Flags().StringToStringVar(&flagRewriteDeps, "rewrite-deps", nil, "comma separated dependency repository URLs to rewrite in the form of old=new")
+	pushCmd.Flags().BoolVar(&flagLint, "lint", false, "lint the charts like \"helm lint\" and fail on errors")
+	pushCmd.Flags().BoolVar(&flagLintStrict, "strict", false, "lint the charts and fail on warnings too")
+	pushCmd.Flags().BoolVar(&flagSkipLint, "skip-lint", false, "don't lint the charts, even if the repository policy requires it")
+	pushCmd.Flags().BoolVar(&flagCheckDeps, "check-deps", false, "fail if a dependency pinned in Chart.lock, or matching a version range of Chart.yaml without Chart.lock, is missing from the repository or its siblings")
+	pushCmd.Flags().StringSliceVar(&flagSiblingRepos, "sibling-repo", nil, "used with --check-deps to also check dependencies served by this repository (name or gs:// URL)")
 	pushCmd.Flags().StringToStringVar(&flagMetadata, "metadata", nil, "comma seperated object metadata in the form of key=value")
+	pushCmd.Flags().StringVar(&flagMetadataFile, "metadata-file", "", "YAML or JSON file of object metadata (key: value), overridden by --metadata")
+	pushCmd.Flags().StringVar(&flagCacheControl, "cache-control", "", "Cache-Control header of the chart objects, \""+repo.DefaultChartCacheControl+"\" by default, \""+repo.OverwrittenChartCacheControl+"\" for charts overwritten with --force")
+	pushCmd.Flags().StringVar(&flagContentDisposition, "content-disposition", "", "Content-Disposition header of the chart objects")
+	pushCmd.Flags().StringVar(&flagContentType, "content-type", "", "Content-Type header of the chart objects")
+	pushCmd.Flags().BoolVar(&flagChecksums, "checksums", false, "update the SHA256SUMS file of the repository")
+	pushCmd.Flags().BoolVar(&flagProv, "prov", false, "fail if the chart has no provenance file")
+	pushCmd.Flags().BoolVar(&flagSign, "sign", false, "sign the chart with a GPG key and upload its provenance file")
+	pushCmd.Flags().StringVar(&flagKey, "key", "", "used with --sign, name of the key to sign with")
+	pushCmd.Flags().StringVar(&flagKeyring, "keyring", defaultKeyring(), "used with --sign, location of the secret keyring")
+	pushCmd.Flags().StringVar(&flagCosignKey, "cosign-key", "", "sign the chart with this cosign key reference (file, KMS URI...) and upload the signature next to it")
+	pushCmd.Flags().BoolVar(&flagKeyless, "cosign-keyless", false, "sign the chart keyless with cosign, with the OIDC identity of the caller")
+	pushCmd.Flags().BoolVar(&flagNoBuildInfo, "no-build-info", false, "do not record the CI build (commit, pipeline URL, builder) publishing the chart")
+	pushCmd.Flags().BoolVar(&flagResume, "resume", false, "upload the chart with a resumable session, continuing an interrupted upload of the same chart")
+	pushCmd.Flags().StringVar(&flagGlob, "glob", "", "push the charts matching this pattern too, e.g. \"dist/*.tgz\"")
+	pushCmd.Flags().StringVar(&flagChunkSize, "chunk-size", "", "size of the chunks the chart is uploaded in, e.g. 32Mi: a failed chunk is retried on its own")
+	pushCmd.Flags().BoolVar(&flagChangelog, "changelog", false, "record the change in the CHANGELOG.ndjson file of the repository")
 }
@@ -0,0 +1,81 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagReindexRetry bool
+	reindexRepos     repoSelection
+)
+
+var reindexCmd = &cobra.Command{
+	Use:   "reindex [repository|gs://bucket/path...]",
+	Short: "rebuild the index of a repository from the charts in the bucket",
+	Long: `This command rebuilds the index file of a repository, e.g. when it is corrupted or lost:
+every chart archive under the repository path is loaded and its digest computed.
+The annotations of the current index (policies, tags...) are kept if it can still be read.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		names, err := reindexRepos.resolve(args)
+		if err != nil {
+			return err
+		}
+		return forEachRepo(cmd.Context(), names, reindex)
+	},
+}
+
+func reindex(ctx context.Context, nameOrURL string) error {
+	repoURL, err := resolveRepoURL(nameOrURL)
+	if err != nil {
+		return err
+	}
+	r, err := newRepo(repoURL, repoOptions()...)
+	if err != nil {
+		return err
+	}
+	result, err := r.Reindex(ctx, flagReindexRetry)
+	if err != nil {
+		return err
+	}
+	skipped := make([]string, 0, len(result.Skipped))
+	for u := range result.Skipped {
+		skipped = append(skipped, u)
+	}
+	sort.Strings(skipped)
+	for _, u := range skipped {
+		fmt.Printf("%s: SKIPPED (%s)\n", u, result.Skipped[u])
+	}
+	infof("%d charts indexed, %d objects skipped\n", result.Indexed, len(skipped))
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(reindexCmd)
+	reindexRepos.addFlags(reindexCmd)
+	reindexCmd.Flags().BoolVar(&flagReindexRetry, "retry", false, "retry if the index changed")
+	reindexCmd.Flags().BoolVar(&flagChecksums, "checksums", false, "update the SHA256SUMS file of the repository")
+}
@@ -0,0 +1,78 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagRepairDryRun bool
+	flagRepairRetry  bool
+)
+
+var repairCmd = &cobra.Command{
+	Use:   "repair [repository]",
+	Short: "fix the inconsistencies of the index of a repository",
+	Long: `This command fixes the index file of a repository: it removes duplicated entries and entries
+pointing at missing charts, recomputes wrong digests and normalizes chart URLs to the scheme
+(gs:// or https://) used by most of them. Use --dry-run to only print the fixes.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		r, err := loadRepo(args[0], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		actions, err := r.Repair(cmd.Context(), flagRepairDryRun, flagRepairRetry)
+		if err != nil {
+			return err
+		}
+		if len(actions) == 0 {
+			infof("index is consistent, nothing to repair\n")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "CHART\tVERSION\tACTION\tDETAIL")
+		for _, a := range actions {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", a.Chart, a.Version, a.Action, a.Detail)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if flagRepairDryRun {
+			fmt.Printf("%d fixes to apply (dry run)\n", len(actions))
+		} else {
+			infof("%d fixes applied\n", len(actions))
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(repairCmd)
+	repairCmd.Flags().BoolVar(&flagRepairDryRun, "dry-run", false, "print the fixes without updating the index")
+	repairCmd.Flags().BoolVar(&flagRepairRetry, "retry", false, "retry if the index changed")
+	repairCmd.Flags().BoolVar(&flagChecksums, "checksums", false, "update the SHA256SUMS file of the repository")
+}
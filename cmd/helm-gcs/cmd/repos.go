@@ -0,0 +1,82 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+// repoSelection selects the repositories a maintenance command runs on,
+// either from its arguments or from the --repos and --all-repos flags.
+type repoSelection struct {
+	all   bool
+	names []string
+}
+
+func (s *repoSelection) addFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&s.all, "all-repos", false, "run on every GCS repository added to helm")
+	cmd.Flags().StringSliceVar(&s.names, "repos", nil, "comma separated repositories to run on")
+}
+
+// resolve returns the names of the selected repositories.
+func (s *repoSelection) resolve(args []string) ([]string, error) {
+	names := append(append([]string{}, args...), s.names...)
+	if s.all {
+		all, err := repo.GCSRepositories()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, all...)
+	}
+	if len(names) == 0 {
+		return nil, errors.New("a repository, --repos or --all-repos is required")
+	}
+	return names, nil
+}
+
+// forEachRepo runs fn on each repository, with a header before the output of each one
+// when there are several. A failing repository does not stop the others,
+// failures are reported at the end.
+func forEachRepo(ctx context.Context, names []string, fn func(ctx context.Context, name string) error) error {
+	if len(names) == 1 {
+		return fn(ctx, names[0])
+	}
+	var failed []string
+	for i, name := range names {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("==> %s <==\n", name)
+		if err := fn(ctx, name); err != nil {
+			fmt.Printf("Error: %s\n", err)
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d repositories failed: %v", len(failed), len(names), failed)
+	}
+	return nil
+}
@@ -21,34 +21,145 @@
 package cmd
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
 	"github.com/hayorov/helm-gcs/pkg/repo"
 	"github.com/spf13/cobra"
 )
 
 var (
-	flagVersion string
-	flagRmRetry bool
+	flagVersion  string
+	flagRmRetry  bool
+	flagRmDryRun bool
+
+	flagVersionConstraint string
+	flagRmFromFile        string
+
+	flagConcurrency int
 )
 
 var rmCmd = &cobra.Command{
-	Use:     "rm [chart] [repository]",
+	Use:     "rm [chart...] [repository]",
 	Aliases: []string{"remove"},
 	Short:   "remove a chart",
 	Long: `This command removes a chart into a repository that has been added to helm via "helm repo add".
-If no specific version is given, all versions will be removed.`,
-	Args: cobra.MinimumNArgs(2),
+If no specific version is given, all versions will be removed.
+With --version-constraint, the versions matching a semver constraint, e.g. "<1.0.0", are
+removed in a single update of the index.
+Several charts, given as arguments or listed one per line in the file of --from-file, are
+removed with all their versions in a single update of the index: nothing is removed if one
+of them isn't indexed.
+Use --dry-run to print the index entries and the objects which would be deleted, without changing anything.`,
+	Args: cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		chart, repoName := args[0], args[1]
-		r, err := repo.Load(repoName, gcsClient)
+		if err := checkVersionShorthand(args); err != nil {
+			return err
+		}
+		charts, repoName := args[:len(args)-1], args[len(args)-1]
+		if flagRmFromFile != "" {
+			listed, err := readChartList(flagRmFromFile)
+			if err != nil {
+				return err
+			}
+			charts = append(charts, listed...)
+		}
+		if len(charts) == 0 {
+			return errors.New("no chart to remove")
+		}
+		asJSON, err := jsonOutput()
+		if err != nil {
+			return err
+		}
+		r, err := loadRepo(repoName, repoOptions()...)
 		if err != nil {
 			return err
 		}
-		return r.RemoveChart(chart, flagVersion, flagRmRetry)
+		var removals []repo.Removal
+		if len(charts) > 1 {
+			if flagVersion != "" || flagVersionConstraint != "" {
+				return errors.New("--version and --version-constraint can't be used to remove several charts")
+			}
+			removals, err = r.RemoveCharts(cmd.Context(), charts, flagRmRetry, flagRmDryRun)
+		} else if chart := charts[0]; flagVersionConstraint != "" {
+			if flagVersion != "" {
+				return errors.New("--version can't be used with --version-constraint")
+			}
+			removals, err = r.RemoveChartVersions(cmd.Context(), chart, flagVersionConstraint, flagRmRetry, flagRmDryRun)
+		} else {
+			removals, err = r.RemoveChart(cmd.Context(), chart, flagVersion, flagRmRetry, flagRmDryRun)
+		}
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			return printJSON(removals)
+		}
+		if !flagRmDryRun {
+			return nil
+		}
+		for _, removal := range removals {
+			fmt.Printf("would remove %s-%s\n", removal.Name, removal.Version)
+			for _, u := range removal.Objects {
+				fmt.Printf("  would delete %s\n", u)
+			}
+		}
+		return nil
 	},
 }
 
+// checkVersionShorthand rejects "rm chart repository -v 1.2.3": -v used to be the
+// shorthand of --version, it is now the verbosity and would leave the version as the
+// repository name.
+func checkVersionShorthand(args []string) error {
+	if flagVerbose == 0 || flagVersion != "" || len(args) < 2 {
+		return nil
+	}
+	last := args[len(args)-1]
+	if _, err := semver.StrictNewVersion(strings.TrimPrefix(last, "v")); err != nil {
+		return nil
+	}
+	return fmt.Errorf("-v is the verbosity, not the version of the chart: use --version %s", last)
+}
+
+// readChartList reads the chart names listed one per line in a file, "-" for stdin.
+// Empty lines and lines starting with "#" are ignored.
+func readChartList(path string) ([]string, error) {
+	f := os.Stdin
+	if path != "-" {
+		var err error
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+	var charts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			charts = append(charts, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return charts, nil
+}
+
 func init() {
 	rootCmd.AddCommand(rmCmd)
-	rmCmd.Flags().StringVarP(&flagVersion, "version", "v", "", "version of the chart to remove")
+	addOutputFlag(rmCmd)
+	rmCmd.Flags().StringVar(&flagVersion, "version", "", "version of the chart to remove")
+	rmCmd.Flags().StringVar(&flagVersionConstraint, "version-constraint", "", "semver constraint of the versions of the chart to remove, e.g. \"<1.0.0\" or \"1.2.x\"")
+	rmCmd.Flags().StringVar(&flagRmFromFile, "from-file", "", "file listing the charts to remove, one per line, \"-\" for stdin")
 	rmCmd.Flags().BoolVar(&flagRmRetry, "retry", false, "retry if the index changed")
+	rmCmd.Flags().BoolVar(&flagRmDryRun, "dry-run", false, "print what would be removed, without removing anything")
+	rmCmd.Flags().BoolVar(&flagChecksums, "checksums", false, "update the SHA256SUMS file of the repository")
+	rmCmd.Flags().IntVar(&flagConcurrency, "concurrency", 8, "number of chart files deleted in parallel")
+	rmCmd.Flags().BoolVar(&flagChangelog, "changelog", false, "record the change in the CHANGELOG.ndjson file of the repository")
 }
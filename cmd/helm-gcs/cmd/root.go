@@ -21,8 +21,16 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/hayorov/helm-gcs/pkg/gcs"
@@ -33,8 +41,36 @@ import (
 var (
 	gcsClient *storage.Client
 
-	flagServiceAccount string
-	flagDebug          bool
+	flagServiceAccount  string
+	flagCredentialsType string
+	flagImpersonate     string
+	flagAnonymous       bool
+	flagDebug           bool
+	flagVerbose         int
+	flagQuiet           bool
+	flagSignIndex       string
+	flagSignKey         string
+	flagSignKeyID       string
+	flagSignCharts      bool
+	flagProgress        string
+	flagTimeout         time.Duration
+	flagMaxRetries      int
+	flagEncryptionKMS   string
+	flagEncryptionKey   string
+	flagLock            bool
+	flagLockTTL         time.Duration
+	flagGzipIndex       bool
+	flagOutput          string
+	flagEndpoint        string
+	flagProxy           string
+	flagBillingProject  string
+	flagStats           bool
+	flagStrictIndex     bool
+
+	indexSigner repo.IndexSigner
+
+	// cancelTimeout releases the context bounding the operation with --timeout.
+	cancelTimeout context.CancelFunc = func() {}
 )
 
 var rootCmd = &cobra.Command{
@@ -43,25 +79,262 @@ var rootCmd = &cobra.Command{
 	Long:  ``,
 }
 
-// Execute executes the CLI
+// Execute executes the CLI. SIGINT and SIGTERM cancel the operation in progress, e.g. a
+// download of helm stalled on a dead connection.
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	cmd, err := rootCmd.ExecuteContextC(ctx)
+	interrupted := ctx.Err() != nil
+	stop()
+	cancelTimeout()
+	reportStats(cmd)
+	if errors.Is(err, context.DeadlineExceeded) && flagTimeout > 0 {
+		err = fmt.Errorf("operation timed out after %s: %w", flagTimeout, err)
+	}
+	if err != nil && interrupted {
+		err = fmt.Errorf("operation interrupted: %w", err)
+	}
+	var conflict *repo.IndexConflictError
+	if errors.As(err, &conflict) {
+		err = fmt.Errorf("%w\nanother writer updated the index meanwhile: use --retry to apply the change again, or --lock to serialize the writers", err)
+	}
+	if gcs.IsRequesterPays(err) && flagBillingProject == "" {
+		err = fmt.Errorf("%w\nthe bucket is requester-pays: set the project billed for the requests with --billing-project or %s", err, gcs.BillingProjectEnv)
+	}
+	if gcs.IsUnauthenticated(err) && flagAnonymous {
+		err = fmt.Errorf("%w\nanonymous access is read-only: unset --anonymous or %s to write with credentials", err, gcs.AnonymousEnv)
+	}
+	if gcs.IsAuthError(err) && !flagAnonymous {
+		err = fmt.Errorf("%w\nrun \"helm gcs doctor\" with the repository to check the credentials and the permissions", err)
+	}
+	if err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
+	}
+}
+
+// repoOptions returns the repository options set by flags.
+func repoOptions() []repo.Option {
+	var lockTTL time.Duration
+	if flagLock {
+		lockTTL = flagLockTTL
+	}
+	return []repo.Option{
+		repo.WithChecksums(flagChecksums),
+		repo.WithChangelog(flagChangelog),
+		repo.WithRejectLibraries(flagRejectLibraries),
+		repo.WithDependencyRewrites(flagRewriteDeps),
+		repo.WithCheckDependencies(flagCheckDeps, flagSiblingRepos...),
+		repo.WithIndexSigner(indexSigner),
+		repo.WithChartSigning(flagSignCharts),
+		repo.WithProgress(progressReporter()),
+		repo.WithConcurrency(flagConcurrency),
+		repo.WithLock(lockTTL),
+		repo.WithGzipIndex(flagGzipIndex),
+		repo.WithStats(stats),
+		repo.WithStrictIndex(flagStrictIndex),
+	}
+}
+
+// gcsAuth returns the authentication set by flags, with the credentials file of
+// HELM_GCS_SERVICE_ACCOUNT when --service-account is not set.
+func gcsAuth() gcs.Auth {
+	serviceAccount := flagServiceAccount
+	if serviceAccount == "" {
+		serviceAccount = os.Getenv(serviceAccountEnv)
+	}
+	return gcs.Auth{
+		ServiceAccountPath:        serviceAccount,
+		CredentialsType:           flagCredentialsType,
+		ImpersonateServiceAccount: flagImpersonate,
+		Anonymous:                 flagAnonymous,
 	}
 }
 
+// setRetryPolicy sets the retry policy of GCS operations from --max-retries,
+// or HELM_GCS_MAX_RETRIES when the flag is not set.
+func setRetryPolicy(cmd *cobra.Command) error {
+	if env := os.Getenv(gcs.MaxRetriesEnv); env != "" && !cmd.Flags().Changed("max-retries") {
+		n, err := strconv.Atoi(env)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", gcs.MaxRetriesEnv, err)
+		}
+		flagMaxRetries = n
+	}
+	if flagMaxRetries < 0 {
+		return fmt.Errorf("invalid number of retries %d", flagMaxRetries)
+	}
+	policy := gcs.DefaultRetryPolicy
+	policy.MaxRetries = flagMaxRetries
+	gcs.SetRetryPolicy(policy)
+	return nil
+}
+
+// setEncryption sets the encryption of the objects written from --kms-key and --encryption-key.
+func setEncryption() error {
+	e := gcs.Encryption{KMSKeyName: flagEncryptionKMS}
+	if flagEncryptionKey != "" {
+		key, err := gcs.ParseEncryptionKey(flagEncryptionKey)
+		if err != nil {
+			return err
+		}
+		e.Key = key
+	}
+	return gcs.SetEncryption(e)
+}
+
+// setTransport sets how GCS is reached from --gcs-endpoint and --proxy.
+func setTransport() error {
+	if flagProxy != "" {
+		if err := gcs.SetProxy(flagProxy); err != nil {
+			return err
+		}
+	}
+	return gcs.SetEndpoint(flagEndpoint)
+}
+
+// addOutputFlag adds the --output flag to a command printing its result.
+func addOutputFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&flagOutput, "output", "o", "text", "output format of the result: \"text\" or \"json\"")
+}
+
+// jsonOutput reports whether the result is printed as JSON, and fails on an unknown format.
+func jsonOutput() (bool, error) {
+	switch flagOutput {
+	case "", "text":
+		return false, nil
+	case "json":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown output format %q", flagOutput)
+}
+
+// printJSON prints v as indented JSON on stdout.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// verbosity returns the verbosity level set by -v, --debug and --quiet.
+func verbosity() (int, error) {
+	if flagQuiet {
+		if flagVerbose > 0 {
+			return 0, errors.New("--quiet and --verbose can't be used together")
+		}
+		return repo.VerbosityQuiet, nil
+	}
+	if flagDebug && flagVerbose < repo.VerbosityDebug {
+		return repo.VerbosityDebug, nil
+	}
+	return flagVerbose, nil
+}
+
+// infof prints a status message on stdout, unless --quiet. The results asked for, such as
+// listings, reports and JSON output, are printed in any case.
+func infof(format string, a ...interface{}) {
+	if !flagQuiet {
+		fmt.Printf(format, a...)
+	}
+}
+
+// progressReporter returns the reporter selected by --progress, nil if progress is not reported.
+// Progress bars are only rendered when stderr is a terminal, and progress is not reported
+// with --quiet.
+func progressReporter() repo.ProgressReporter {
+	if flagQuiet {
+		return nil
+	}
+	switch flagProgress {
+	case "json":
+		return repo.JSONProgress(os.Stderr)
+	case "bar":
+		if isTerminal(os.Stderr) {
+			return repo.BarProgress(os.Stderr)
+		}
+	}
+	return nil
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// isOffline reports whether the command runs without network access.
+func isOffline(cmd *cobra.Command) bool {
+	f := cmd.Flags().Lookup("offline")
+	return f != nil && f.Value.String() == "true"
+}
+
 func init() {
-	cobra.OnInitialize(func() {
-		var err error
-		gcsClient, err = gcs.NewClient(flagServiceAccount)
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		v, err := verbosity()
 		if err != nil {
-			panic(err)
+			return err
+		}
+		repo.SetVerbosity(v)
+		startStats()
+		if flagProgress != "" && flagProgress != "json" && flagProgress != "bar" {
+			return fmt.Errorf("unknown progress format %q", flagProgress)
 		}
-		if flagDebug {
-			repo.Debug = true
+		if flagTimeout > 0 {
+			ctx, cancel := context.WithTimeout(cmd.Context(), flagTimeout)
+			cancelTimeout = cancel
+			cmd.SetContext(ctx)
 		}
-	})
-	rootCmd.PersistentFlags().StringVar(&flagServiceAccount, "service-account", "", "service account to use for GCS")
-	rootCmd.PersistentFlags().BoolVar(&flagDebug, "debug", false, "activate debug")
+		if isOffline(cmd) {
+			return nil
+		}
+		if err := setRetryPolicy(cmd); err != nil {
+			return err
+		}
+		if err := setEncryption(); err != nil {
+			return err
+		}
+		if err := setTransport(); err != nil {
+			return err
+		}
+		gcs.SetBillingProject(flagBillingProject)
+		if !gcs.ValidCredentialsType(flagCredentialsType) {
+			return fmt.Errorf("unknown credentials type %q", flagCredentialsType)
+		}
+		if flagSignIndex != "" {
+			opts, err := gcs.ClientOptions(gcsAuth())
+			if err != nil {
+				return err
+			}
+			indexSigner, err = repo.NewIndexSigner(flagSignIndex, flagSignKey, flagSignKeyID, opts...)
+			if err != nil {
+				return err
+			}
+		}
+		gcsClient, err = gcs.NewClient(gcsAuth())
+		return err
+	}
+	rootCmd.PersistentFlags().StringVar(&flagServiceAccount, "service-account", "", "credentials file to use for GCS: service account key or workload identity federation configuration, HELM_GCS_SERVICE_ACCOUNT if not set")
+	rootCmd.PersistentFlags().StringVar(&flagCredentialsType, "credentials-type", os.Getenv("HELM_GCS_CREDENTIALS_TYPE"), "expected type of the credentials: \"service_account\", \"authorized_user\", \"external_account\" (workload identity federation) or \"impersonated_service_account\"")
+	rootCmd.PersistentFlags().StringVar(&flagImpersonate, "impersonate-service-account", os.Getenv("HELM_GCS_IMPERSONATE_SERVICE_ACCOUNT"), "email of a service account to impersonate with the credentials")
+	rootCmd.PersistentFlags().BoolVar(&flagAnonymous, "anonymous", os.Getenv(gcs.AnonymousEnv) == "true", "read public buckets without credentials, even if some are found")
+	rootCmd.PersistentFlags().CountVarP(&flagVerbose, "verbose", "v", "log more details on stderr: -v logs the operations, -vv also the generations and preconditions of the objects")
+	rootCmd.PersistentFlags().BoolVarP(&flagQuiet, "quiet", "q", os.Getenv("HELM_GCS_QUIET") == "true", "only print errors and the results asked for, no status messages, warnings or progress")
+	rootCmd.PersistentFlags().BoolVar(&flagDebug, "debug", strings.ToLower(os.Getenv("HELM_GCS_DEBUG")) == "true", "same as -v")
+	rootCmd.PersistentFlags().DurationVar(&flagTimeout, "timeout", 0, "bound the whole operation, e.g. \"5m\", no timeout if 0")
+	rootCmd.PersistentFlags().IntVar(&flagMaxRetries, "max-retries", gcs.DefaultRetryPolicy.MaxRetries, "number of retries of GCS operations failing with a transient error (429, 5xx...), with exponential backoff")
+	rootCmd.PersistentFlags().StringVar(&flagEncryptionKMS, "kms-key", os.Getenv(gcs.KMSKeyEnv), "Cloud KMS key the charts and index files written are encrypted with")
+	rootCmd.PersistentFlags().StringVar(&flagEncryptionKey, "encryption-key", os.Getenv(gcs.EncryptionKeyEnv), "base64 encoded customer-supplied AES-256 key the charts and index files are encrypted with")
+	rootCmd.PersistentFlags().BoolVar(&flagLock, "lock", os.Getenv("HELM_GCS_LOCK") == "true", "serialize the updates of the index with a lock object, instead of retrying on concurrent updates")
+	rootCmd.PersistentFlags().DurationVar(&flagLockTTL, "lock-ttl", repo.DefaultLockTTL, "used with --lock, time after which a lock which isn't extended by its holder, e.g. a crashed writer, is stolen")
+	rootCmd.PersistentFlags().BoolVar(&flagStrictIndex, "strict-index", os.Getenv("HELM_GCS_STRICT_INDEX") == "true", "fail on invalid index entries, instead of printing a warning for each of them")
+	rootCmd.PersistentFlags().BoolVar(&flagGzipIndex, "gzip-index", os.Getenv("HELM_GCS_GZIP_INDEX") == "true", "write the index file gzip compressed, with \"Content-Encoding: gzip\"")
+	rootCmd.PersistentFlags().StringVar(&flagEndpoint, "gcs-endpoint", os.Getenv(gcs.EndpointEnv), "base URL of GCS, e.g. a regional or Private Service Connect endpoint")
+	rootCmd.PersistentFlags().StringVar(&flagProxy, "proxy", os.Getenv(gcs.ProxyEnv), "URL of the proxy GCS is reached through, HTTPS_PROXY and NO_PROXY are honored otherwise")
+	rootCmd.PersistentFlags().StringVar(&flagBillingProject, "billing-project", os.Getenv(gcs.BillingProjectEnv), "project billed for the requests to requester-pays buckets")
+	rootCmd.PersistentFlags().BoolVar(&flagStats, "stats", os.Getenv("HELM_GCS_STATS") == "true", "print a summary of the timings of the operations on stderr")
+	rootCmd.PersistentFlags().StringVar(&flagProgress, "progress", os.Getenv("HELM_GCS_PROGRESS"), "report the progress of long operations on stderr: \"bar\" for progress bars on a terminal, \"json\" for JSON lines events")
+	rootCmd.PersistentFlags().StringVar(&flagSignIndex, "sign-index", os.Getenv("HELM_GCS_SIGN_INDEX"), "sign the index file on every write, with \"gpg\", \"cosign\" or \"kms\"")
+	rootCmd.PersistentFlags().StringVar(&flagSignKey, "sign-key", os.Getenv("HELM_GCS_SIGN_KEY"), "signing key: GPG secret keyring, cosign key reference or Cloud KMS key version")
+	rootCmd.PersistentFlags().BoolVar(&flagSignCharts, "sign-charts", os.Getenv("HELM_GCS_SIGN_CHARTS") == "true", "also sign uploaded charts with the key of --sign-index")
+	rootCmd.PersistentFlags().StringVar(&flagSignKeyID, "sign-key-id", os.Getenv("HELM_GCS_SIGN_KEY_ID"), "name of the GPG key in the keyring")
 }
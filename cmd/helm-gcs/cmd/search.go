@@ -0,0 +1,83 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagSearchVersions bool
+	flagSearchDevel    bool
+)
+
+var searchCmd = &cobra.Command{
+	Use:   "search [repository|gs://bucket/path] [keyword]",
+	Short: "search the charts of a repository",
+	Long: `This command searches the index of a repository, given by helm name or gs:// URL, without adding it to helm.
+Charts whose name, description or keywords contain the keyword are listed, with their latest stable version.
+Use --versions to list all the matching versions, and --devel to include pre-release versions.
+Without keyword, every chart is listed.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		asJSON, err := jsonOutput()
+		if err != nil {
+			return err
+		}
+		r, err := openRepo(args[0])
+		if err != nil {
+			return err
+		}
+		var keyword string
+		if len(args) == 2 {
+			keyword = args[1]
+		}
+		charts, err := r.Search(cmd.Context(), keyword, repo.SearchOptions{Versions: flagSearchVersions, Devel: flagSearchDevel})
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			return printJSON(charts)
+		}
+		if len(charts) == 0 {
+			infof("no results found\n")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tVERSION\tAPP VERSION\tDESCRIPTION")
+		for _, c := range charts {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Name, c.Version, c.AppVersion, c.Description)
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(searchCmd)
+	addOutputFlag(searchCmd)
+	searchCmd.Flags().BoolVar(&flagSearchVersions, "versions", false, "list all the matching versions of the charts, not only the latest one")
+	searchCmd.Flags().BoolVar(&flagSearchDevel, "devel", false, "include pre-release versions")
+}
@@ -0,0 +1,102 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+// Pushgateway the timings of the commands are pushed to, if set.
+const (
+	pushgatewayURLEnv = "HELM_GCS_PUSHGATEWAY_URL"
+	pushgatewayJobEnv = "HELM_GCS_PUSHGATEWAY_JOB"
+)
+
+var (
+	// stats records the timings of the operations, with --stats or a Pushgateway.
+	stats      *repo.Stats
+	statsStart time.Time
+)
+
+// startStats starts recording the timings of the operations, if they are reported.
+func startStats() {
+	if flagStats || os.Getenv(pushgatewayURLEnv) != "" {
+		stats = repo.NewStats()
+		statsStart = time.Now()
+	}
+}
+
+// reportStats prints the timings of the operations of cmd with --stats, and pushes them
+// to the Pushgateway, if set. Failures to push are only printed.
+func reportStats(cmd *cobra.Command) {
+	if stats == nil || cmd == nil {
+		return
+	}
+	duration := time.Since(statsStart)
+	if flagStats {
+		fmt.Fprintf(os.Stderr, "%s took %s\n", cmd.CommandPath(), duration.Round(time.Millisecond))
+		_ = stats.WriteSummary(os.Stderr, gcs.Retries())
+	}
+	if gateway := os.Getenv(pushgatewayURLEnv); gateway != "" {
+		if err := pushStats(gateway, cmd.Name(), duration); err != nil {
+			fmt.Fprintf(os.Stderr, "push stats to %s: %s\n", gateway, err)
+		}
+	}
+}
+
+// pushStats pushes the timings of the command to the Pushgateway at gateway, replacing the
+// metrics of its previous run.
+func pushStats(gateway, command string, duration time.Duration) error {
+	var buf bytes.Buffer
+	if err := stats.WritePrometheus(&buf, command, duration, gcs.Retries()); err != nil {
+		return err
+	}
+	job := os.Getenv(pushgatewayJobEnv)
+	if job == "" {
+		job = "helm-gcs"
+	}
+	endpoint := fmt.Sprintf("%s/metrics/job/%s/command/%s", strings.TrimSuffix(gateway, "/"), url.PathEscape(job), url.PathEscape(command))
+	req, err := http.NewRequest(http.MethodPut, endpoint, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var flagTagRetry bool
+
+var tagCmd = &cobra.Command{
+	Use:   "tag [repository]/[chart] [tag=version...]",
+	Short: "map tags to versions of a chart",
+	Long: `This command maps tags (channels such as "stable" or "canary") to versions of a chart, e.g.:
+
+  helm gcs tag my-repository/my-chart stable=1.4.2 canary=1.5.0-rc.1
+
+A tag is removed with "tag-". Without tag arguments, the tags of the chart are printed.
+Tags can be used instead of versions by the latest and fetch commands.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repoName, chart, err := splitChartReference(args[0])
+		if err != nil {
+			return err
+		}
+		r, err := loadRepo(repoName, repoOptions()...)
+		if err != nil {
+			return err
+		}
+		if len(args) == 1 {
+			return printTags(cmd.Context(), r, chart)
+		}
+		tags := map[string]string{}
+		for _, arg := range args[1:] {
+			if tag, ok := strings.CutSuffix(arg, "-"); ok && !strings.Contains(arg, "=") {
+				tags[tag] = ""
+				continue
+			}
+			tag, version, ok := strings.Cut(arg, "=")
+			if !ok || tag == "" || version == "" {
+				return fmt.Errorf("invalid tag %q, should be tag=version or tag-", arg)
+			}
+			tags[tag] = version
+		}
+		return r.TagChart(cmd.Context(), chart, tags, flagTagRetry)
+	},
+}
+
+func printTags(ctx context.Context, r *repo.Repo, chart string) error {
+	tags, err := r.Tags(ctx, chart)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(tags))
+	for tag := range tags {
+		names = append(names, tag)
+	}
+	sort.Strings(names)
+	for _, tag := range names {
+		fmt.Printf("%s=%s\n", tag, tags[tag])
+	}
+	return nil
+}
+
+// splitChartReference splits a "repository/chart" reference.
+func splitChartReference(ref string) (string, string, error) {
+	repoName, chart, ok := strings.Cut(ref, "/")
+	if !ok || repoName == "" || chart == "" {
+		return "", "", fmt.Errorf("invalid chart reference %q, should be repository/chart", ref)
+	}
+	return repoName, chart, nil
+}
+
+func init() {
+	rootCmd.AddCommand(tagCmd)
+	tagCmd.Flags().BoolVar(&flagTagRetry, "retry", false, "retry if the index changed")
+}
@@ -0,0 +1,100 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagTierOlderThan string
+	flagTierTo        string
+	flagTierDryRun    bool
+)
+
+var tierCmd = &cobra.Command{
+	Use:   "tier [repository] --older-than 180d --to NEARLINE",
+	Short: "move old chart versions to a colder storage class",
+	Long: `This command rewrites, server-side, the objects of the chart versions older than --older-than
+to a cheaper storage class (NEARLINE, COLDLINE or ARCHIVE). URLs and the index don't change,
+charts can still be pulled, at the retrieval cost of the storage class.
+The projected monthly savings are estimated from list prices.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		olderThan, err := parseAge(flagTierOlderThan)
+		if err != nil {
+			return err
+		}
+		r, err := loadRepo(args[0], repoOptions()...)
+		if err != nil {
+			return err
+		}
+		results, err := r.Tier(cmd.Context(), olderThan, flagTierTo, flagTierDryRun)
+		printTierResults(results)
+		return err
+	},
+}
+
+func printTierResults(results []repo.TierResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHART\tVERSION\tFROM\tSIZE")
+	var before, after float64
+	var size int64
+	for _, result := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", result.Chart, result.Version, result.From, result.Size)
+		before += repo.MonthlyStorageCost(result.From, result.Size)
+		after += repo.MonthlyStorageCost(flagTierTo, result.Size)
+		size += result.Size
+	}
+	_ = w.Flush()
+	verb := "moved"
+	if flagTierDryRun {
+		verb = "to move (dry run)"
+	}
+	infof("%d objects (%d bytes) %s to %s, projected savings: $%.2f/month\n", len(results), size, verb, strings.ToUpper(flagTierTo), before-after)
+}
+
+// parseAge parses a duration which can be expressed in days, e.g. "180d".
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func init() {
+	rootCmd.AddCommand(tierCmd)
+	tierCmd.Flags().StringVar(&flagTierOlderThan, "older-than", "180d", "age of the chart versions to move, e.g. 180d or 720h")
+	tierCmd.Flags().StringVar(&flagTierTo, "to", "NEARLINE", "storage class to move the charts to")
+	tierCmd.Flags().BoolVar(&flagTierDryRun, "dry-run", false, "only list the charts to move")
+}
@@ -0,0 +1,134 @@
+// Copyright © 2018 Valentin Tjoncke <valtjo@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+	"github.com/hayorov/helm-gcs/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagOffline     bool
+	flagVerifyIndex string
+	flagKMSKey      string
+	flagVerifyChart string
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify ([chart] [repository] | --offline --index [index.yaml] [chart.tgz|directory...] | --kms-key [key version] [file...])",
+	Short: "verify charts against an index",
+	Long: `This command verifies that chart files match the digest recorded for their version in an index file.
+Given a chart and a repository, the chart objects of every version, or of --version, are downloaded
+and their sha256 digest compared with the index of the repository, to detect corrupted or tampered charts.
+With --offline, the index file is a local copy (e.g. exported with "helm gcs pull gs://bucket/path/index.yaml")
+and no network access is done, for air-gapped acceptance processes.
+With --kms-key, local charts or index files are verified against their detached signature
+(the file with a ".sig" suffix) made with a Cloud KMS asymmetric key.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if flagKMSKey != "" {
+			return verifyKMSSignatures(cmd.Context(), args)
+		}
+		if !flagOffline {
+			return verifyRepoCharts(cmd.Context(), args)
+		}
+		if flagVerifyIndex == "" {
+			return errors.New("verify --offline requires --index")
+		}
+		results, err := repo.VerifyOffline(flagVerifyIndex, args)
+		if err != nil {
+			return err
+		}
+		return printVerifyResults(results)
+	},
+}
+
+func verifyRepoCharts(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return errors.New("verify requires a chart and a repository, or --offline or --kms-key")
+	}
+	r, err := loadRepo(args[1], repoOptions()...)
+	if err != nil {
+		return err
+	}
+	results, err := r.VerifyCharts(ctx, args[0], flagVerifyChart)
+	if err != nil {
+		return err
+	}
+	return printVerifyResults(results)
+}
+
+func verifyKMSSignatures(ctx context.Context, files []string) error {
+	opts, err := gcs.ClientOptions(gcsAuth())
+	if err != nil {
+		return err
+	}
+	verifier, err := repo.NewIndexVerifier(repo.SignatureKMS, flagKMSKey, opts...)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, f := range files {
+		if err := repo.VerifyFile(ctx, f, verifier); err != nil {
+			failed++
+			fmt.Printf("%s: FAILED (%s)\n", f, err)
+			continue
+		}
+		infof("%s: OK\n", f)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d signatures failed verification", failed, len(files))
+	}
+	return nil
+}
+
+func printVerifyResults(results []repo.VerifyResult) error {
+	failed := 0
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			failed++
+			fmt.Printf("%s: FAILED (%s)\n", result.File, result.Err)
+		case !result.OK():
+			failed++
+			fmt.Printf("%s: FAILED (%s-%s digest mismatch)\n", result.File, result.Chart, result.Version)
+		default:
+			infof("%s: OK (%s-%s)\n", result.File, result.Chart, result.Version)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d charts failed verification", failed, len(results))
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().BoolVar(&flagOffline, "offline", false, "verify without network access, against a local index file")
+	verifyCmd.Flags().StringVar(&flagVerifyIndex, "index", "", "path of the index file to verify against")
+	verifyCmd.Flags().StringVar(&flagVerifyChart, "version", "", "version of the chart to verify in the repository, all versions if empty")
+	verifyCmd.Flags().StringVar(&flagKMSKey, "kms-key", "", "verify detached signatures made with this Cloud KMS key version")
+}
@@ -0,0 +1,56 @@
+package gcs
+
+import (
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+// BillingProjectEnv is the environment variable setting the project billed for the requests
+// to requester-pays buckets, see SetBillingProject.
+const BillingProjectEnv = "HELM_GCS_BILLING_PROJECT"
+
+var billingProject string
+
+// SetBillingProject sets the project billed for the requests made by this package, which
+// requester-pays buckets require. The caller needs serviceusage.services.use on it.
+// Requests to other buckets are billed to the project too when it is set.
+func SetBillingProject(project string) {
+	billingProject = project
+}
+
+// bucket returns the handle of a bucket, with the retry policy and the billing project.
+func bucket(client *storage.Client, name string) *storage.BucketHandle {
+	b := client.Bucket(name).Retryer(retryPolicy.retryer()...)
+	if billingProject != "" {
+		b = b.UserProject(billingProject)
+	}
+	return b
+}
+
+// setBillingProject adds the billing project to the query of requests made without the
+// storage client, for both the JSON and the XML APIs.
+func setBillingProject(u *url.URL) {
+	if billingProject == "" {
+		return
+	}
+	q := u.Query()
+	q.Set("userProject", billingProject)
+	u.RawQuery = q.Encode()
+}
+
+// IsRequesterPays reports whether err is the failure of a request to a requester-pays bucket
+// made without billing project.
+func IsRequesterPays(err error) bool {
+	if err == nil {
+		return false
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code != 400 {
+		return false
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "requester pays")
+}
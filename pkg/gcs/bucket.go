@@ -0,0 +1,72 @@
+package gcs
+
+import (
+	"context"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+// BucketConfig configures the bucket created by CreateBucket.
+type BucketConfig struct {
+	// Project is the ID of the project the bucket is created in.
+	Project string
+	// Location is the region or multi-region of the bucket, GCS default (US) if empty.
+	Location string
+	// UniformAccess enables uniform bucket-level access: access is only granted with IAM.
+	UniformAccess bool
+	// Public grants everyone read access to the objects, for repositories served over HTTPS.
+	Public bool
+}
+
+// BucketExists reports whether the bucket of path exists.
+func BucketExists(ctx context.Context, client *storage.Client, path string) (bool, error) {
+	bucketName, _, err := splitPath(path)
+	if err != nil {
+		return false, errors.Wrap(err, "split path")
+	}
+	_, err = bucket(client, bucketName).Attrs(ctx)
+	if err == storage.ErrBucketNotExist {
+		return false, nil
+	}
+	return err == nil, errors.Wrap(err, "bucket attrs")
+}
+
+// CreateBucket creates the bucket of path, unless it already exists, and reports whether
+// it was created.
+func CreateBucket(ctx context.Context, client *storage.Client, path string, config BucketConfig) (bool, error) {
+	exists, err := BucketExists(ctx, client, path)
+	if err != nil || exists {
+		return false, err
+	}
+	if config.Project == "" {
+		return false, errors.New("a project is required to create the bucket")
+	}
+	bucketName, _, _ := splitPath(path)
+	b := bucket(client, bucketName)
+	attrs := &storage.BucketAttrs{
+		Location:                 config.Location,
+		UniformBucketLevelAccess: storage.UniformBucketLevelAccess{Enabled: config.UniformAccess},
+	}
+	if err := b.Create(ctx, config.Project, attrs); err != nil {
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == http.StatusConflict {
+			return false, errors.Errorf("bucket %s already exists in another project, bucket names are global", bucketName)
+		}
+		return false, errors.Wrap(err, "create bucket")
+	}
+	if !config.Public {
+		return true, nil
+	}
+	policy, err := b.IAM().Policy(ctx)
+	if err != nil {
+		return true, errors.Wrap(err, "get bucket IAM policy")
+	}
+	policy.Add("allUsers", "roles/storage.objectViewer")
+	if err := b.IAM().SetPolicy(ctx, policy); err != nil {
+		return true, errors.Wrap(err, "grant public read access")
+	}
+	return true, nil
+}
@@ -0,0 +1,160 @@
+package gcs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/helmpath"
+)
+
+// Environment variables configuring the cache of objects read by NewCachedReader.
+// The cache is enabled by setting HELM_GCS_CACHE_TTL, e.g. "5m" or "0s", see NewCachedReader.
+// It is stored in $HELM_PLUGIN_CACHE, or in helm cache when it is not set.
+const (
+	CacheTTLEnv = "HELM_GCS_CACHE_TTL"
+	CacheDirEnv = "HELM_PLUGIN_CACHE"
+)
+
+// cacheEntry describes a cached object, the content is stored next to it in a file
+// named after the generation.
+type cacheEntry struct {
+	URL        string    `json:"url"`
+	Generation int64     `json:"generation"`
+	Checked    time.Time `json:"checked"`
+}
+
+type objectCache struct {
+	dir string
+	key string
+}
+
+// NewCachedReader opens the object at path for reading, through an on-disk cache
+// keyed by the generation of the object.
+// An object cached for less than HELM_GCS_CACHE_TTL is read from the cache without
+// any request. Otherwise its generation is checked, and the object is downloaded only
+// if it changed. Without HELM_GCS_CACHE_TTL, or when the generation can't be checked,
+// the object is read as with NewReader.
+func NewCachedReader(ctx context.Context, client *storage.Client, path string) (io.ReadCloser, error) {
+	ttl, ok := cacheTTL()
+	if _, hmac := hmacKeysFromEnv(); !ok || hmac {
+		return NewReader(ctx, client, path)
+	}
+	c := newObjectCache(path)
+	entry, cached := c.load()
+	if cached && time.Since(entry.Checked) < ttl {
+		if f, err := os.Open(c.dataPath(entry.Generation)); err == nil {
+			return f, nil
+		}
+	}
+
+	o, err := Object(client, path)
+	if err != nil {
+		return nil, errors.Wrap(err, "object")
+	}
+	attrs, err := o.Attrs(ctx)
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			return nil, err
+		}
+		return NewReader(ctx, client, path)
+	}
+	if _, err := os.Stat(c.dataPath(attrs.Generation)); err != nil || entry.Generation != attrs.Generation {
+		if err := c.fetch(ctx, o.Generation(attrs.Generation), entry.Generation); err != nil {
+			return NewReader(ctx, client, path)
+		}
+	}
+	entry = cacheEntry{URL: path, Generation: attrs.Generation, Checked: time.Now()}
+	c.save(entry)
+	return os.Open(c.dataPath(entry.Generation))
+}
+
+// cacheTTL returns the duration objects are read from the cache without checking
+// their generation, and whether the cache is enabled.
+func cacheTTL() (time.Duration, bool) {
+	env := os.Getenv(CacheTTLEnv)
+	if env == "" {
+		return 0, false
+	}
+	// an invalid TTL disables the cache rather than failing reads
+	ttl, err := time.ParseDuration(env)
+	return ttl, err == nil && ttl >= 0
+}
+
+func newObjectCache(path string) objectCache {
+	dir := helmpath.CachePath("helm-gcs", "objects")
+	if env := os.Getenv(CacheDirEnv); env != "" {
+		dir = filepath.Join(env, "objects")
+	}
+	sum := sha256.Sum256([]byte(path))
+	return objectCache{dir: dir, key: hex.EncodeToString(sum[:])}
+}
+
+func (c objectCache) entryPath() string {
+	return filepath.Join(c.dir, c.key+".json")
+}
+
+func (c objectCache) dataPath(generation int64) string {
+	return filepath.Join(c.dir, c.key+"-"+strconv.FormatInt(generation, 10))
+}
+
+func (c objectCache) load() (cacheEntry, bool) {
+	var entry cacheEntry
+	b, err := os.ReadFile(c.entryPath())
+	if err != nil {
+		return entry, false
+	}
+	if err := json.Unmarshal(b, &entry); err != nil {
+		return entry, false
+	}
+	return entry, true
+}
+
+// save records entry, failing silently as the object is downloaded again if the entry is lost.
+func (c objectCache) save(entry cacheEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	_ = os.WriteFile(c.entryPath(), b, 0o644)
+}
+
+// fetch downloads the generation of the object read by o, and removes the previous
+// generation from the cache.
+func (c objectCache) fetch(ctx context.Context, o *storage.ObjectHandle, previous int64) error {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return err
+	}
+	r, err := o.NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tmp, err := os.CreateTemp(c.dir, c.key+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.dataPath(r.Attrs.Generation)); err != nil {
+		return err
+	}
+	if previous != 0 && previous != r.Attrs.Generation {
+		_ = os.Remove(c.dataPath(previous))
+	}
+	return nil
+}
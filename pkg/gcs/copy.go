@@ -0,0 +1,119 @@
+package gcs
+
+import (
+	"context"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+)
+
+// maxRewriteResumes bounds how many times an interrupted rewrite is resumed.
+const maxRewriteResumes = 5
+
+// Copy copies the object at src to dst using a server-side rewrite, so the
+// content never transits through the caller, even across buckets.
+// Large objects need several rewrite calls: when one of them fails with a
+// transient error, the copy is resumed from the last rewrite token.
+// Object metadata, content type and cache control of src are preserved.
+func Copy(ctx context.Context, client *storage.Client, src, dst string) (*storage.ObjectAttrs, error) {
+	return copyObject(ctx, client, src, dst, nil)
+}
+
+// CopyIfNotExist is like Copy, but fails with a precondition error if dst already exists.
+func CopyIfNotExist(ctx context.Context, client *storage.Client, src, dst string) (*storage.ObjectAttrs, error) {
+	return copyObject(ctx, client, src, dst, &storage.Conditions{DoesNotExist: true})
+}
+
+func copyObject(ctx context.Context, client *storage.Client, src, dst string, conds *storage.Conditions) (*storage.ObjectAttrs, error) {
+	srcObject, err := Object(client, src)
+	if err != nil {
+		return nil, errors.Wrap(err, "source object")
+	}
+	dstObject, err := Object(client, dst)
+	if err != nil {
+		return nil, errors.Wrap(err, "destination object")
+	}
+	if conds != nil {
+		dstObject = dstObject.If(*conds)
+	}
+
+	attrs, err := run(ctx, dstObject.CopierFrom(srcObject))
+	return attrs, errors.Wrapf(err, "copy %s to %s", src, dst)
+}
+
+// Move moves the object at src to dst, server-side: dst is written under conds, with the
+// content, metadata and storage class of src, then src is deleted.
+func Move(ctx context.Context, client *storage.Client, src, dst string, conds storage.Conditions) (*storage.ObjectAttrs, error) {
+	srcObject, err := Object(client, src)
+	if err != nil {
+		return nil, errors.Wrap(err, "source object")
+	}
+	dstObject, err := Object(client, dst)
+	if err != nil {
+		return nil, errors.Wrap(err, "destination object")
+	}
+	srcAttrs, err := srcObject.Attrs(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "source attrs")
+	}
+	srcObject = srcObject.If(storage.Conditions{GenerationMatch: srcAttrs.Generation})
+	copier := dstObject.If(conds).CopierFrom(srcObject)
+	// the storage class of a rewritten object defaults to the one of the bucket, and the
+	// attributes of the destination replace the ones of the source
+	copier.StorageClass = srcAttrs.StorageClass
+	copier.ContentType = srcAttrs.ContentType
+	copier.ContentEncoding = srcAttrs.ContentEncoding
+	copier.ContentDisposition = srcAttrs.ContentDisposition
+	copier.ContentLanguage = srcAttrs.ContentLanguage
+	copier.CacheControl = srcAttrs.CacheControl
+	copier.CustomTime = srcAttrs.CustomTime
+	copier.Metadata = srcAttrs.Metadata
+	attrs, err := run(ctx, copier)
+	if err != nil {
+		return nil, errors.Wrapf(err, "copy %s to %s", src, dst)
+	}
+	if err := srcObject.Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+		return attrs, errors.Wrapf(err, "delete %s", src)
+	}
+	return attrs, nil
+}
+
+// SetStorageClass rewrites the object at path, server-side, to the given storage class.
+// The object keeps its name, content and metadata. The rewrite fails if the object
+// changes meanwhile.
+func SetStorageClass(ctx context.Context, client *storage.Client, path, class string) (*storage.ObjectAttrs, error) {
+	o, err := Object(client, path)
+	if err != nil {
+		return nil, errors.Wrap(err, "object")
+	}
+	attrs, err := o.Attrs(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "attrs")
+	}
+	o = o.If(storage.Conditions{GenerationMatch: attrs.Generation})
+	copier := o.CopierFrom(o)
+	copier.StorageClass = class
+	// the attributes of the destination replace the ones of the source
+	copier.ContentType = attrs.ContentType
+	copier.ContentEncoding = attrs.ContentEncoding
+	copier.ContentDisposition = attrs.ContentDisposition
+	copier.ContentLanguage = attrs.ContentLanguage
+	copier.CacheControl = attrs.CacheControl
+	copier.Metadata = attrs.Metadata
+	attrs, err = run(ctx, copier)
+	return attrs, errors.Wrapf(err, "rewrite %s to %s", path, class)
+}
+
+// run runs a rewrite, resuming it on transient errors.
+func run(ctx context.Context, copier *storage.Copier) (*storage.ObjectAttrs, error) {
+	copier.DestinationKMSKeyName = encryption.KMSKeyName
+	for resumes := 0; ; resumes++ {
+		attrs, err := copier.Run(ctx)
+		if err == nil {
+			return attrs, nil
+		}
+		if copier.RewriteToken == "" || !isTransient(err) || ctx.Err() != nil || resumes == maxRewriteResumes {
+			return nil, err
+		}
+	}
+}
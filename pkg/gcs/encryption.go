@@ -0,0 +1,72 @@
+package gcs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+)
+
+// Environment variables configuring the encryption of the objects written, see Encryption.
+const (
+	KMSKeyEnv        = "HELM_GCS_KMS_KEY"
+	EncryptionKeyEnv = "HELM_GCS_ENCRYPTION_KEY"
+)
+
+// Encryption configures the keys objects are encrypted with, Google-managed keys if empty.
+type Encryption struct {
+	// KMSKeyName is the Cloud KMS key (CMEK) the objects written are encrypted with,
+	// e.g. "projects/p/locations/l/keyRings/r/cryptoKeys/k". Objects are read as usual.
+	KMSKeyName string
+	// Key is a customer-supplied AES-256 key (CSEK), which encrypts the objects written
+	// and must be given to read them, helm included.
+	Key []byte
+}
+
+var encryption Encryption
+
+// SetEncryption sets the encryption of the objects written by this package, and the key
+// they are read with.
+func SetEncryption(e Encryption) error {
+	if e.KMSKeyName != "" && len(e.Key) > 0 {
+		return errors.New("a KMS key and a customer-supplied encryption key can't be used together")
+	}
+	if len(e.Key) > 0 && len(e.Key) != 32 {
+		return errors.Errorf("customer-supplied encryption key must be 32 bytes long, got %d", len(e.Key))
+	}
+	if e.KMSKeyName != "" && !strings.Contains(e.KMSKeyName, "/cryptoKeys/") {
+		return errors.Errorf("invalid KMS key %q, should be the resource name of a key", e.KMSKeyName)
+	}
+	encryption = e
+	return nil
+}
+
+// ParseEncryptionKey decodes a base64 encoded customer-supplied encryption key.
+func ParseEncryptionKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	return key, errors.Wrap(err, "decode encryption key")
+}
+
+// NewWriter returns a writer of the object, which encrypts it with the KMS key if set.
+// The customer-supplied key, if set, is carried by the handles returned by Object.
+func NewWriter(ctx context.Context, o *storage.ObjectHandle) *storage.Writer {
+	w := o.NewWriter(ctx)
+	w.KMSKeyName = encryption.KMSKeyName
+	return w
+}
+
+// setEncryptionHeaders sets the headers of the customer-supplied key on requests made
+// without the storage client, for both the JSON and the XML APIs.
+func setEncryptionHeaders(h http.Header) {
+	if len(encryption.Key) == 0 {
+		return
+	}
+	sum := sha256.Sum256(encryption.Key)
+	h.Set("x-goog-encryption-algorithm", "AES256")
+	h.Set("x-goog-encryption-key", base64.StdEncoding.EncodeToString(encryption.Key))
+	h.Set("x-goog-encryption-key-sha256", base64.StdEncoding.EncodeToString(sum[:]))
+}
@@ -0,0 +1,112 @@
+package gcs
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/option"
+)
+
+// Environment variables configuring how GCS is reached, see SetEndpoint and SetProxy.
+// HTTPS_PROXY and NO_PROXY are honored too, unless HELM_GCS_PROXY is set.
+const (
+	EndpointEnv = "HELM_GCS_ENDPOINT"
+	ProxyEnv    = "HELM_GCS_PROXY"
+	// EmulatorHostEnv is the address of a GCS emulator such as fake-gcs-server, e.g.
+	// "localhost:4443": clients then reach it without authentication, see NewClient.
+	// STORAGE_EMULATOR_HOST is honored too.
+	EmulatorHostEnv = "HELM_GCS_EMULATOR_HOST"
+)
+
+const defaultEndpoint = "https://storage.googleapis.com"
+
+var customEndpoint string
+
+// SetEndpoint sets the base URL of GCS, e.g. the regional endpoint
+// "https://storage.europe-west1.rep.googleapis.com" or a Private Service Connect endpoint,
+// for the clients created afterwards. Empty restores the default endpoint, or the
+// emulator at HELM_GCS_EMULATOR_HOST or STORAGE_EMULATOR_HOST if set.
+func SetEndpoint(e string) error {
+	if e != "" {
+		u, err := url.Parse(e)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return errors.Errorf("invalid endpoint %q, should be an URL like https://storage.europe-west1.rep.googleapis.com", e)
+		}
+	}
+	customEndpoint = strings.TrimSuffix(e, "/")
+	return nil
+}
+
+// SetProxy makes every HTTP request go through the proxy at proxyURL, instead of the
+// proxy set by HTTPS_PROXY and NO_PROXY. It must be called before clients are created.
+func SetProxy(proxyURL string) error {
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Host == "" {
+		return errors.Errorf("invalid proxy URL %q", proxyURL)
+	}
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return errors.New("unsupported HTTP transport")
+	}
+	// Google API clients clone the default transport
+	transport.Proxy = http.ProxyURL(u)
+	return nil
+}
+
+// baseEndpoint returns the base URL of GCS requests made without the storage client.
+func baseEndpoint() string {
+	// like NewClient, an emulator takes precedence
+	if host, ok := emulatorHost(); ok {
+		return host
+	}
+	if customEndpoint != "" {
+		return customEndpoint
+	}
+	return defaultEndpoint
+}
+
+// emulatorHost returns the URL of the GCS emulator, if one is configured.
+func emulatorHost() (string, bool) {
+	host := os.Getenv(EmulatorHostEnv)
+	if host == "" {
+		host = os.Getenv("STORAGE_EMULATOR_HOST")
+	}
+	if host == "" {
+		return "", false
+	}
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	return strings.TrimSuffix(host, "/"), true
+}
+
+// xmlAPIEndpoint returns the endpoint of the XML API.
+func xmlAPIEndpoint() string {
+	return baseEndpoint()
+}
+
+// uploadEndpoint returns the endpoint of the JSON API uploads.
+func uploadEndpoint() string {
+	return baseEndpoint() + "/upload/storage/v1"
+}
+
+// endpointOptions returns the options pointing the storage client at the endpoint.
+func endpointOptions() []option.ClientOption {
+	if customEndpoint == "" {
+		return nil
+	}
+	return []option.ClientOption{option.WithEndpoint(customEndpoint + "/storage/v1/")}
+}
+
+// emulatorOptions returns the options of clients of the GCS emulator, if one is configured:
+// an emulator doesn't need any credentials.
+func emulatorOptions() ([]option.ClientOption, bool) {
+	host, ok := emulatorHost()
+	if !ok {
+		return nil, false
+	}
+	return []option.ClientOption{option.WithEndpoint(host + "/storage/v1/"), option.WithoutAuthentication()}, true
+}
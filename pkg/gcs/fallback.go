@@ -0,0 +1,302 @@
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	"helm.sh/helm/v3/pkg/helmpath"
+)
+
+// FallbacksEnv is the environment variable declaring fallback locations for
+// repositories, in the form "gs://primary/path=gs://dr1/path,gs://dr2/path".
+// Several primaries can be declared by separating them with ";".
+// It takes precedence over the fallbacks declared per repository with SetFallbacks.
+const FallbacksEnv = "HELM_GCS_FALLBACKS"
+
+// stallTimeout is how long a read can wait for data before it is considered stalled.
+var stallTimeout = 30 * time.Second
+
+// errStalled is returned by reads that received no data for stallTimeout.
+var errStalled = errors.New("read stalled")
+
+// NewReader opens the object at path for reading.
+// When fallback locations are declared for path, they are tried in the order given by the
+// read strategy if the read fails with a server error or a timeout, when opening the object
+// or partway through, or if it stalls.
+func NewReader(ctx context.Context, client *storage.Client, path string) (io.ReadCloser, error) {
+	primary, replicas := replicasOf(path)
+	if len(replicas) == 1 {
+		return openReader(ctx, client, path)
+	}
+
+	stats := loadReplicaStats(primary)
+	f := &failoverReader{
+		ctx: ctx,
+		open: func(ctx context.Context, replica string) (io.ReadCloser, error) {
+			return openReader(ctx, client, replica+strings.TrimPrefix(path, primary))
+		},
+		replicas: stats.order(replicas),
+		stats:    stats,
+	}
+	if err := f.next(); err != nil {
+		stats.save()
+		return nil, err
+	}
+	return f, nil
+}
+
+// openReader opens the object at path, through the XML API when HMAC keys are configured.
+func openReader(ctx context.Context, client *storage.Client, path string) (io.ReadCloser, error) {
+	if keys, ok := hmacKeysFromEnv(); ok {
+		return keys.get(ctx, path)
+	}
+	o, err := Object(client, path)
+	if err != nil {
+		return nil, errors.Wrap(err, "object")
+	}
+	return o.NewReader(ctx)
+}
+
+// failoverReader reads an object from the first of its replicas which can be opened. When a
+// read fails partway through with a transient error or stalls, the object is opened on the
+// next replica, and the part already read is skipped.
+type failoverReader struct {
+	ctx      context.Context
+	open     func(ctx context.Context, replica string) (io.ReadCloser, error)
+	replicas []string
+	stats    *replicaStats
+
+	replica string
+	r       io.ReadCloser
+	cancel  context.CancelFunc
+	offset  int64
+}
+
+func (f *failoverReader) Read(p []byte) (int, error) {
+	n, err := f.read(p)
+	f.offset += int64(n)
+	if err == nil || err == io.EOF || !f.canFailover(err) {
+		return n, err
+	}
+	f.stats.observe(f.replica, 0, err)
+	f.close()
+	if err := f.next(); err != nil {
+		return n, err
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return f.Read(p)
+}
+
+// read reads from the current replica, which is canceled if no data comes for stallTimeout.
+func (f *failoverReader) read(p []byte) (int, error) {
+	if f.r == nil {
+		return 0, os.ErrClosed
+	}
+	cancel := f.cancel
+	timer := time.AfterFunc(stallTimeout, cancel)
+	n, err := f.r.Read(p)
+	if !timer.Stop() {
+		return n, errors.Wrapf(errStalled, "%s: no data for %s", f.replica, stallTimeout)
+	}
+	return n, err
+}
+
+// canFailover reports whether a read failing with err can be carried on from another replica.
+func (f *failoverReader) canFailover(err error) bool {
+	if len(f.replicas) == 0 || f.ctx.Err() != nil {
+		return false
+	}
+	return errors.Is(err, errStalled) || isTransient(err) || isRetryable(err)
+}
+
+// next opens the object on the next replicas until one succeeds, and skips the part already
+// read on the previous ones.
+func (f *failoverReader) next() error {
+	var lastErr error
+	for len(f.replicas) > 0 {
+		f.replica, f.replicas = f.replicas[0], f.replicas[1:]
+		ctx, cancel := context.WithCancel(f.ctx)
+		start := time.Now()
+		r, err := f.open(ctx, f.replica)
+		if err == nil && f.offset > 0 {
+			if _, err = io.CopyN(io.Discard, r, f.offset); err != nil {
+				r.Close()
+				err = errors.Wrapf(err, "%s: skip the %d bytes already read", f.replica, f.offset)
+			}
+		}
+		f.stats.observe(f.replica, time.Since(start), err)
+		if err == nil {
+			f.r, f.cancel = r, cancel
+			return nil
+		}
+		cancel()
+		// once a part was read, the replicas which can't serve the rest are skipped
+		if f.ctx.Err() != nil || (f.offset == 0 && !isTransient(err)) {
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+func (f *failoverReader) close() error {
+	if f.r == nil {
+		return nil
+	}
+	err := f.r.Close()
+	f.cancel()
+	f.r = nil
+	return err
+}
+
+func (f *failoverReader) Close() error {
+	defer f.stats.save()
+	return f.close()
+}
+
+// replicasOf returns the primary location path belongs to, followed by its replicas.
+// If no fallbacks are declared for path, the only replica is path itself.
+// When several primaries contain path, the most specific one is used.
+func replicasOf(path string) (string, []string) {
+	// a broken fallbacks file doesn't prevent reads from the primary
+	declared, _ := loadFallbacks()
+	if declared == nil {
+		declared = map[string][]string{}
+	}
+	for primary, fallbacks := range parseFallbacks(os.Getenv(FallbacksEnv)) {
+		declared[primary] = fallbacks
+	}
+	found := ""
+	for primary := range declared {
+		if (path == primary || strings.HasPrefix(path, primary+"/")) && len(primary) > len(found) {
+			found = primary
+		}
+	}
+	if found == "" {
+		return path, []string{path}
+	}
+	return found, append([]string{found}, declared[found]...)
+}
+
+func parseFallbacks(s string) map[string][]string {
+	fallbacks := map[string][]string{}
+	for _, decl := range strings.Split(s, ";") {
+		primary, list, ok := strings.Cut(strings.TrimSpace(decl), "=")
+		if !ok {
+			continue
+		}
+		primary = strings.TrimSuffix(primary, "/")
+		for _, f := range strings.Split(list, ",") {
+			if f = strings.TrimSuffix(strings.TrimSpace(f), "/"); f != "" {
+				fallbacks[primary] = append(fallbacks[primary], f)
+			}
+		}
+	}
+	return fallbacks
+}
+
+// fallbacksPath returns the file declaring the fallback locations of repositories, a JSON
+// object mapping the URL of each repository to its fallbacks. It is kept in helm config
+// directory, next to the repositories added to helm.
+func fallbacksPath() string {
+	return helmpath.ConfigPath("helm-gcs", "fallbacks.json")
+}
+
+func loadFallbacks() (map[string][]string, error) {
+	fallbacks := map[string][]string{}
+	b, err := os.ReadFile(fallbacksPath())
+	if os.IsNotExist(err) {
+		return fallbacks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &fallbacks); err != nil {
+		return nil, errors.Wrapf(err, "parse %s", fallbacksPath())
+	}
+	return fallbacks, nil
+}
+
+// Fallbacks returns the fallback locations declared with SetFallbacks for the repository at
+// repoURL.
+func Fallbacks(repoURL string) ([]string, error) {
+	fallbacks, err := loadFallbacks()
+	if err != nil {
+		return nil, err
+	}
+	return fallbacks[strings.TrimSuffix(repoURL, "/")], nil
+}
+
+// SetFallbacks declares the fallback locations of the repository at repoURL, which reads of
+// its objects fail over to, replacing the previous ones. Without fallbacks, the declaration
+// is removed. Declarations are kept in helm config directory.
+func SetFallbacks(repoURL string, fallbacks []string) error {
+	declared, err := loadFallbacks()
+	if err != nil {
+		return err
+	}
+	repoURL = strings.TrimSuffix(repoURL, "/")
+	delete(declared, repoURL)
+	for _, f := range fallbacks {
+		if !strings.HasPrefix(f, "gs://") {
+			return fmt.Errorf("invalid fallback %q, should be a gs:// URL", f)
+		}
+		declared[repoURL] = append(declared[repoURL], strings.TrimSuffix(f, "/"))
+	}
+	b, err := json.MarshalIndent(declared, "", "  ")
+	if err != nil {
+		return err
+	}
+	p := fallbacksPath()
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, b, 0o644)
+}
+
+// writeFileAtomic writes the file through a temporary file renamed into place, so that
+// concurrent processes never read a partial file.
+func writeFileAtomic(path string, b []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".helm-gcs-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// isTransient reports whether err is a server side error or a timeout,
+// i.e. an error that may not happen on another bucket.
+func isTransient(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code >= 500
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,149 @@
+package gcs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const content = "0123456789abcdefghij"
+
+// replicaReader serves content, failing with err once it has served failAt bytes.
+// With err nil, it blocks there until its context is canceled.
+type replicaReader struct {
+	ctx    context.Context
+	r      io.Reader
+	failAt int
+	read   int
+	err    error
+}
+
+func (r *replicaReader) Read(p []byte) (int, error) {
+	if r.failAt >= 0 && r.read >= r.failAt {
+		if r.err == nil {
+			<-r.ctx.Done()
+			return 0, r.ctx.Err()
+		}
+		return 0, r.err
+	}
+	if r.failAt >= 0 && len(p) > r.failAt-r.read {
+		p = p[:r.failAt-r.read]
+	}
+	n, err := r.r.Read(p)
+	r.read += n
+	return n, err
+}
+
+func (r *replicaReader) Close() error { return nil }
+
+func failoverReaderOf(replicas map[string]*replicaReader, order ...string) *failoverReader {
+	return &failoverReader{
+		ctx: context.Background(),
+		open: func(ctx context.Context, replica string) (io.ReadCloser, error) {
+			r := replicas[replica]
+			r.ctx, r.r, r.read = ctx, strings.NewReader(content), 0
+			return r, nil
+		},
+		replicas: order,
+		stats:    &replicaStats{Latency: map[string]time.Duration{}},
+	}
+}
+
+func TestFailoverReader(t *testing.T) {
+	stallTimeout = 50 * time.Millisecond
+	defer func() { stallTimeout = 30 * time.Second }()
+
+	tests := []struct {
+		name     string
+		replicas map[string]*replicaReader
+		want     string
+		wantErr  error
+	}{
+		{
+			name:     "no failure",
+			replicas: map[string]*replicaReader{"a": {failAt: -1}, "b": {failAt: 0, err: io.ErrUnexpectedEOF}},
+			want:     content,
+		},
+		{
+			name:     "transient failure partway",
+			replicas: map[string]*replicaReader{"a": {failAt: 7, err: io.ErrUnexpectedEOF}, "b": {failAt: -1}},
+			want:     content,
+		},
+		{
+			name:     "stalled read",
+			replicas: map[string]*replicaReader{"a": {failAt: 5}, "b": {failAt: -1}},
+			want:     content,
+		},
+		{
+			name:     "permanent failure partway",
+			replicas: map[string]*replicaReader{"a": {failAt: 7, err: io.ErrClosedPipe}, "b": {failAt: -1}},
+			wantErr:  io.ErrClosedPipe,
+		},
+		{
+			name:     "every replica fails",
+			replicas: map[string]*replicaReader{"a": {failAt: 3, err: io.ErrUnexpectedEOF}, "b": {failAt: 12, err: io.ErrUnexpectedEOF}},
+			wantErr:  io.ErrUnexpectedEOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := failoverReaderOf(tt.replicas, "a", "b")
+			if err := f.next(); err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			got, err := io.ReadAll(f)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadAll() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && string(got) != tt.want {
+				t.Errorf("ReadAll() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplicasOf(t *testing.T) {
+	t.Setenv("HELM_CONFIG_HOME", t.TempDir())
+	t.Setenv(FallbacksEnv, "gs://env/repo=gs://env-dr/repo")
+	if err := SetFallbacks("gs://bucket/repo/", []string{"gs://dr/repo/", "gs://dr2/repo"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetFallbacks("gs://bucket/repo/nested", []string{"gs://dr/nested"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetFallbacks("gs://env/repo", []string{"gs://file-dr/repo"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetFallbacks("gs://bucket/removed", []string{"gs://dr/removed"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetFallbacks("gs://bucket/removed", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetFallbacks("gs://bucket/repo", []string{"https://dr.example.com"}); err == nil {
+		t.Error("SetFallbacks() accepted a fallback which isn't a gs:// URL")
+	}
+
+	tests := []struct {
+		path        string
+		wantPrimary string
+		want        []string
+	}{
+		{path: "gs://bucket/repo/index.yaml", wantPrimary: "gs://bucket/repo", want: []string{"gs://bucket/repo", "gs://dr/repo", "gs://dr2/repo"}},
+		{path: "gs://bucket/repo/nested/index.yaml", wantPrimary: "gs://bucket/repo/nested", want: []string{"gs://bucket/repo/nested", "gs://dr/nested"}},
+		{path: "gs://bucket/repository/index.yaml", wantPrimary: "gs://bucket/repository/index.yaml", want: []string{"gs://bucket/repository/index.yaml"}},
+		{path: "gs://env/repo/index.yaml", wantPrimary: "gs://env/repo", want: []string{"gs://env/repo", "gs://env-dr/repo"}},
+		{path: "gs://bucket/removed/index.yaml", wantPrimary: "gs://bucket/removed/index.yaml", want: []string{"gs://bucket/removed/index.yaml"}},
+	}
+	for _, tt := range tests {
+		primary, replicas := replicasOf(tt.path)
+		if primary != tt.wantPrimary || !reflect.DeepEqual(replicas, tt.want) {
+			t.Errorf("replicasOf(%q) = %q, %q, want %q, %q", tt.path, primary, replicas, tt.wantPrimary, tt.want)
+		}
+	}
+}
@@ -2,41 +2,280 @@ package gcs
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
 	"net/url"
 	"os"
+	"strings"
 
 	"cloud.google.com/go/storage"
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
+// Credentials types, as found in the "type" field of credentials JSON files.
+const (
+	CredentialsServiceAccount = "service_account"
+	CredentialsAuthorizedUser = "authorized_user"
+	// CredentialsExternalAccount is a workload identity federation configuration, which
+	// exchanges a token of another identity provider (AWS, Azure, OIDC...) for a Google one.
+	CredentialsExternalAccount = "external_account"
+	CredentialsImpersonated    = "impersonated_service_account"
+)
+
+// Auth configures how clients authenticate against Google APIs.
+type Auth struct {
+	// ServiceAccountPath is the path of a credentials file: a service account key,
+	// or any other credentials JSON such as a workload identity federation configuration.
+	ServiceAccountPath string
+	// CredentialsType, if set, is the expected type of the credentials JSON, e.g.
+	// "external_account": credentials of another type are rejected, rather than
+	// silently used for the wrong identity.
+	CredentialsType string
+	// ImpersonateServiceAccount, if set, is the email of a service account impersonated
+	// with the credentials, which must be granted roles/iam.serviceAccountTokenCreator on it.
+	ImpersonateServiceAccount string
+	// Anonymous makes clients unauthenticated, to read public buckets even where credentials
+	// that aren't granted access are found. Other credentials are ignored.
+	Anonymous bool
+}
+
+// AnonymousEnv is the environment variable making clients unauthenticated, see Auth.Anonymous.
+const AnonymousEnv = "HELM_GCS_ANONYMOUS"
+
 // NewClient creates a new gcs client.
 // Use Application Default Credentials if serviceAccount is empty.
-// Ignores ADC or serviceAccount when GOOGLE_OAUTH_ACCESS_TOKEN env variable is exported.
-func NewClient(serviceAccountPath string) (*storage.Client, error) {
+// Ignores ADC or serviceAccount when GOOGLE_OAUTH_ACCESS_TOKEN or HELM_GCS_TOKEN_COMMAND env variable is exported.
+// When only HMAC keys are configured, reads go through the XML API and the client is unauthenticated.
+// When no credentials can be found at all, or with auth.Anonymous, the client is unauthenticated,
+// to read public buckets.
+// The client reaches GCS at the endpoint set by SetEndpoint. When an emulator is configured
+// (HELM_GCS_EMULATOR_HOST or STORAGE_EMULATOR_HOST), the client reaches it without credentials.
+func NewClient(auth Auth) (*storage.Client, error) {
+	if opts, ok := emulatorOptions(); ok {
+		client, err := storage.NewClient(context.Background(), opts...)
+		return client, errors.Wrap(err, "new emulator client")
+	}
+	opts, err := ClientOptions(auth)
+	if err != nil {
+		return nil, err
+	}
+	client, err := storage.NewClient(context.Background(), append(opts, endpointOptions()...)...)
+	if err != nil && len(opts) == 0 {
+		// no credentials could be found: public buckets can still be read
+		client, err = storage.NewClient(context.Background(), append(endpointOptions(), option.WithoutAuthentication())...)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "new client")
+	}
+	return client, err
+}
+
+// ClientOptions returns the options to authenticate against Google APIs, see NewClient.
+// Credentials are looked up in this order:
+//   - the access token in GOOGLE_OAUTH_ACCESS_TOKEN,
+//   - the access tokens printed by the command in HELM_GCS_TOKEN_COMMAND, run again when they expire,
+//   - the service account key file at serviceAccountPath,
+//   - the JSON credentials in HELM_GCS_CREDENTIALS, HELM_GCS_CREDENTIALS_B64 (base64 encoded)
+//     or GOOGLE_CREDENTIALS (JSON or path of a file), for CI secret stores which can only inject env values.
+//
+// No options means Application Default Credentials.
+// The credentials are then used to impersonate auth.ImpersonateServiceAccount, if set.
+// With auth.Anonymous, the only option is to not authenticate.
+func ClientOptions(auth Auth) ([]option.ClientOption, error) {
+	if auth.Anonymous {
+		return []option.ClientOption{option.WithoutAuthentication()}, nil
+	}
+	opts, err := credentialsOptions(auth)
+	if err != nil {
+		return nil, &credentialsError{err}
+	}
+	if auth.ImpersonateServiceAccount != "" {
+		// unlike the impersonate package, this option gets the scopes of each client
+		// (storage, KMS, Pub/Sub), which share these options.
+		opts = append(opts, option.ImpersonateCredentials(auth.ImpersonateServiceAccount)) //nolint:staticcheck
+	}
+	return opts, nil
+}
+
+func credentialsOptions(auth Auth) ([]option.ClientOption, error) {
 	opts := []option.ClientOption{}
 	token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	_, hmac := hmacKeysFromEnv()
 	if token != "" {
+		if auth.CredentialsType != "" {
+			return nil, errors.Errorf("credentials of type %s expected, but GOOGLE_OAUTH_ACCESS_TOKEN is set", auth.CredentialsType)
+		}
 		token := &oauth2.Token{AccessToken: token}
-		opts = append(opts, option.WithTokenSource(oauth2.StaticTokenSource(token)))
-	} else if serviceAccountPath != "" {
-		opts = append(opts, option.WithCredentialsFile(serviceAccountPath))
+		return append(opts, option.WithTokenSource(oauth2.StaticTokenSource(token))), nil
+	}
+	if command := tokenCommand(); command != "" {
+		if auth.CredentialsType != "" {
+			return nil, errors.Errorf("credentials of type %s expected, but %s is set", auth.CredentialsType, TokenCommandEnv)
+		}
+		return append(opts, option.WithTokenSource(CommandTokenSource(command))), nil
 	}
-	client, err := storage.NewClient(context.Background(), opts...)
+	if auth.ServiceAccountPath != "" {
+		b, err := os.ReadFile(auth.ServiceAccountPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "read credentials file")
+		}
+		if err := checkCredentialsType(b, auth.CredentialsType); err != nil {
+			return nil, errors.Wrap(err, auth.ServiceAccountPath)
+		}
+		return append(opts, option.WithCredentialsFile(auth.ServiceAccountPath)), nil
+	}
+	creds, err := credentialsFromEnv()
 	if err != nil {
-		return nil, errors.Wrap(err, "new client")
+		return nil, err
 	}
-	return client, err
+	if creds != nil {
+		if err := checkCredentialsType(creds, auth.CredentialsType); err != nil {
+			return nil, errors.Wrap(err, "credentials from environment")
+		}
+		return append(opts, option.WithCredentialsJSON(creds)), nil
+	}
+	if auth.CredentialsType != "" {
+		// Application Default Credentials: only a credentials file can be checked
+		if p := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); p != "" {
+			b, err := os.ReadFile(p)
+			if err != nil {
+				return nil, errors.Wrap(err, "read GOOGLE_APPLICATION_CREDENTIALS")
+			}
+			if err := checkCredentialsType(b, auth.CredentialsType); err != nil {
+				return nil, errors.Wrap(err, p)
+			}
+		}
+	}
+	if hmac && os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" && auth.ImpersonateServiceAccount == "" {
+		opts = append(opts, option.WithoutAuthentication())
+	}
+	return opts, nil
+}
+
+// checkCredentialsType checks that the credentials JSON is of the expected type, if any.
+// Workload identity federation configurations are also checked to be complete, as the
+// token exchange otherwise fails with obscure errors.
+func checkCredentialsType(creds []byte, expected string) error {
+	var f struct {
+		Type             string          `json:"type"`
+		Audience         string          `json:"audience"`
+		SubjectTokenType string          `json:"subject_token_type"`
+		CredentialSource json.RawMessage `json:"credential_source"`
+	}
+	if err := json.Unmarshal(creds, &f); err != nil {
+		return errors.Wrap(err, "parse credentials")
+	}
+	if expected != "" && f.Type != expected {
+		return errors.Errorf("credentials of type %s expected, got %q", expected, f.Type)
+	}
+	if f.Type != CredentialsExternalAccount {
+		return nil
+	}
+	switch {
+	case f.Audience == "":
+		return errors.New("external account credentials without audience")
+	case f.SubjectTokenType == "":
+		return errors.New("external account credentials without subject_token_type")
+	case len(f.CredentialSource) == 0:
+		return errors.New("external account credentials without credential_source")
+	}
+	return nil
+}
+
+// IsCredentialsFile reports whether the file at path holds Google credentials JSON, e.g. a
+// service account key, rather than a TLS certificate or key.
+func IsCredentialsFile(path string) bool {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	var f struct {
+		Type string `json:"type"`
+	}
+	return json.Unmarshal(b, &f) == nil && ValidCredentialsType(f.Type) && f.Type != ""
+}
+
+// ValidCredentialsType reports whether t is a known credentials type, or empty.
+func ValidCredentialsType(t string) bool {
+	switch t {
+	case "", CredentialsServiceAccount, CredentialsAuthorizedUser, CredentialsExternalAccount, CredentialsImpersonated:
+		return true
+	}
+	return false
+}
+
+// credentialsFromEnv returns the JSON credentials set in the environment, nil if there are none.
+func credentialsFromEnv() ([]byte, error) {
+	if creds := os.Getenv("HELM_GCS_CREDENTIALS"); creds != "" {
+		return []byte(creds), nil
+	}
+	if creds := os.Getenv("HELM_GCS_CREDENTIALS_B64"); creds != "" {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(creds))
+		return b, errors.Wrap(err, "decode HELM_GCS_CREDENTIALS_B64")
+	}
+	creds := strings.TrimSpace(os.Getenv("GOOGLE_CREDENTIALS"))
+	if creds == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(creds, "{") {
+		return []byte(creds), nil
+	}
+	b, err := os.ReadFile(creds)
+	return b, errors.Wrap(err, "read GOOGLE_CREDENTIALS")
+}
+
+// IsUnauthenticated reports whether err is the failure of a request which requires credentials.
+func IsUnauthenticated(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusUnauthorized
+}
+
+// ErrCredentials matches, with errors.Is, the errors of credentials which can't be loaded.
+var ErrCredentials = errors.New("invalid credentials")
+
+type credentialsError struct {
+	err error
+}
+
+func (e *credentialsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *credentialsError) Unwrap() error {
+	return e.err
+}
+
+// Is makes the error match ErrCredentials.
+func (e *credentialsError) Is(target error) bool {
+	return target == ErrCredentials
+}
+
+// IsAuthError reports whether err is an authentication or authorization failure: credentials
+// which can't be loaded or exchanged for a token, or a request unauthenticated or forbidden.
+func IsAuthError(err error) bool {
+	var gerr *googleapi.Error
+	var rerr *oauth2.RetrieveError
+	return errors.Is(err, ErrCredentials) || errors.As(err, &rerr) ||
+		(errors.As(err, &gerr) && (gerr.Code == http.StatusUnauthorized || gerr.Code == http.StatusForbidden))
 }
 
 // Object retourne a new object handle for the given path
+// Operations on the handle are retried according to the retry policy, see SetRetryPolicy,
+// and billed to the billing project if set, see SetBillingProject.
 func Object(client *storage.Client, path string) (*storage.ObjectHandle, error) {
-	bucket, path, err := splitPath(path)
+	bucketName, path, err := splitPath(path)
 	if err != nil {
 		return nil, errors.Wrap(err, "split path")
 	}
-	return client.Bucket(bucket).Object(path), nil
+	o := bucket(client, bucketName).Object(path)
+	if len(encryption.Key) > 0 {
+		o = o.Key(encryption.Key)
+	}
+	return o, nil
 }
 
 func splitPath(gcsurl string) (bucket string, path string, err error) {
@@ -48,6 +287,6 @@ func splitPath(gcsurl string) (bucket string, path string, err error) {
 		return "", "", errors.New(`incorrect url, should be "gs://bucket/path"`)
 	}
 	bucket = u.Host
-	path = u.Path[1:]
+	path = strings.TrimPrefix(u.Path, "/")
 	return
 }
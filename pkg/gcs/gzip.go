@@ -0,0 +1,42 @@
+package gcs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Gunzip returns b decompressed if it is gzip compressed, b otherwise.
+// Objects stored with "Content-Encoding: gzip" are decompressed by GCS when they are read
+// (decompressive transcoding) or by the HTTP client, but not when they are read compressed
+// or were uploaded compressed without the encoding.
+func Gunzip(b []byte) ([]byte, error) {
+	if len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+		return b, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "gzip reader")
+	}
+	defer r.Close()
+	b, err = io.ReadAll(r)
+	return b, errors.Wrap(err, "decompress")
+}
+
+// Gzip compresses b.
+func Gzip(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, errors.Wrap(err, "compress")
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, "compress")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,34 @@
+package gcs
+
+import (
+	"context"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+)
+
+// ListObjects returns the attributes of the objects under the directory at path,
+// recursively.
+func ListObjects(ctx context.Context, client *storage.Client, path string) ([]*storage.ObjectAttrs, error) {
+	bucketName, prefix, err := splitPath(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "split path")
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	it := bucket(client, bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	var objects []*storage.ObjectAttrs
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "list objects")
+		}
+		objects = append(objects, attrs)
+	}
+}
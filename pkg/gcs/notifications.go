@@ -0,0 +1,143 @@
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/pubsub/v1"
+)
+
+// NotificationConfig configures the Pub/Sub notifications of the objects of a repository.
+type NotificationConfig struct {
+	// Project is the project of the topic.
+	Project string
+	// Topic is the ID of the topic the notifications are published to.
+	Topic string
+	// CreateTopic creates the topic if it does not exist.
+	CreateTopic bool
+	// Subscription, if not empty, is the ID of a pull subscription to create on the topic.
+	Subscription string
+	// EventTypes are the events notified, all events if empty.
+	EventTypes []string
+}
+
+// NotificationSetup describes the notifications configured for a repository.
+type NotificationSetup struct {
+	NotificationID string
+	Bucket         string
+	Prefix         string
+	Topic          string
+	Subscription   string
+}
+
+// EnableNotifications configures the bucket holding the repository at path to publish
+// the events of the repository objects to a Pub/Sub topic. It is idempotent.
+//
+// The topic is created if requested, and the Cloud Storage service agent of the
+// project is granted to publish to it.
+func EnableNotifications(ctx context.Context, client *storage.Client, ps *pubsub.Service, path string, cfg NotificationConfig) (*NotificationSetup, error) {
+	bucketName, prefix, err := splitPath(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "split path")
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	topic := fmt.Sprintf("projects/%s/topics/%s", cfg.Project, cfg.Topic)
+	setup := &NotificationSetup{Bucket: bucketName, Prefix: prefix, Topic: topic}
+
+	if cfg.CreateTopic {
+		if err := ensureTopic(ctx, ps, topic); err != nil {
+			return nil, err
+		}
+	}
+	if err := grantPublisher(ctx, client, ps, cfg.Project, topic); err != nil {
+		return nil, err
+	}
+
+	b := bucket(client, bucketName)
+	existing, err := b.Notifications(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list notifications")
+	}
+	for id, n := range existing {
+		if n.TopicProjectID == cfg.Project && n.TopicID == cfg.Topic && n.ObjectNamePrefix == prefix {
+			setup.NotificationID = id
+		}
+	}
+	if setup.NotificationID == "" {
+		n, err := b.AddNotification(ctx, &storage.Notification{
+			TopicProjectID:   cfg.Project,
+			TopicID:          cfg.Topic,
+			ObjectNamePrefix: prefix,
+			EventTypes:       cfg.EventTypes,
+			PayloadFormat:    storage.JSONPayload,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "add notification")
+		}
+		setup.NotificationID = n.ID
+	}
+
+	if cfg.Subscription != "" {
+		setup.Subscription = fmt.Sprintf("projects/%s/subscriptions/%s", cfg.Project, cfg.Subscription)
+		_, err := ps.Projects.Subscriptions.Create(setup.Subscription, &pubsub.Subscription{Topic: topic}).Context(ctx).Do()
+		if err != nil && !isHTTPStatus(err, http.StatusConflict) {
+			return nil, errors.Wrap(err, "create subscription")
+		}
+	}
+	return setup, nil
+}
+
+func ensureTopic(ctx context.Context, ps *pubsub.Service, topic string) error {
+	_, err := ps.Projects.Topics.Get(topic).Context(ctx).Do()
+	if err == nil {
+		return nil
+	}
+	if !isHTTPStatus(err, http.StatusNotFound) {
+		return errors.Wrap(err, "get topic")
+	}
+	_, err = ps.Projects.Topics.Create(topic, &pubsub.Topic{}).Context(ctx).Do()
+	if err != nil && !isHTTPStatus(err, http.StatusConflict) {
+		return errors.Wrap(err, "create topic")
+	}
+	return nil
+}
+
+// grantPublisher allows the Cloud Storage service agent of the project to publish to the topic.
+func grantPublisher(ctx context.Context, client *storage.Client, ps *pubsub.Service, project, topic string) error {
+	const role = "roles/pubsub.publisher"
+	sa, err := client.ServiceAccount(ctx, project)
+	if err != nil {
+		return errors.Wrap(err, "get storage service agent")
+	}
+	member := "serviceAccount:" + sa
+
+	policy, err := ps.Projects.Topics.GetIamPolicy(topic).Context(ctx).Do()
+	if err != nil {
+		return errors.Wrap(err, "get topic IAM policy")
+	}
+	for _, binding := range policy.Bindings {
+		if binding.Role != role {
+			continue
+		}
+		for _, m := range binding.Members {
+			if m == member {
+				return nil
+			}
+		}
+	}
+	policy.Bindings = append(policy.Bindings, &pubsub.Binding{Role: role, Members: []string{member}})
+	_, err = ps.Projects.Topics.SetIamPolicy(topic, &pubsub.SetIamPolicyRequest{Policy: policy}).Context(ctx).Do()
+	return errors.Wrap(err, "set topic IAM policy")
+}
+
+func isHTTPStatus(err error, code int) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == code
+}
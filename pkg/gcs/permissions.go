@@ -0,0 +1,106 @@
+package gcs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/api/option"
+	"google.golang.org/api/transport"
+)
+
+// Permissions needed to read and update a repository.
+var (
+	ReadPermissions  = []string{"storage.objects.get", "storage.objects.list"}
+	WritePermissions = []string{"storage.objects.create", "storage.objects.delete"}
+)
+
+// Credentials describes the credentials clients authenticate with.
+type Credentials struct {
+	// Source is where the credentials were found, e.g. "GOOGLE_OAUTH_ACCESS_TOKEN".
+	Source string
+	// Identity is the email of the service account authenticated, if known.
+	Identity string
+}
+
+// CheckCredentials resolves the credentials of auth, in the order of ClientOptions, and
+// checks that an access token can be obtained with them.
+func CheckCredentials(ctx context.Context, auth Auth) (*Credentials, error) {
+	c := &Credentials{Source: credentialsSource(auth), Identity: auth.ImpersonateServiceAccount}
+	if auth.Anonymous {
+		return c, nil
+	}
+	opts, err := ClientOptions(auth)
+	if err != nil {
+		return c, err
+	}
+	creds, err := transport.Creds(ctx, append(opts, option.WithScopes(storage.ScopeFullControl))...)
+	if err != nil {
+		return c, errors.Wrap(err, "find credentials")
+	}
+	if c.Identity == "" && len(creds.JSON) > 0 {
+		var f struct {
+			ClientEmail string `json:"client_email"`
+		}
+		if json.Unmarshal(creds.JSON, &f) == nil {
+			c.Identity = f.ClientEmail
+		}
+	}
+	if _, err := creds.TokenSource.Token(); err != nil {
+		return c, errors.Wrap(err, "get access token")
+	}
+	return c, nil
+}
+
+// credentialsSource returns where the credentials of auth are looked up.
+func credentialsSource(auth Auth) string {
+	switch {
+	case auth.Anonymous:
+		return "anonymous"
+	case os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN") != "":
+		return "GOOGLE_OAUTH_ACCESS_TOKEN"
+	case tokenCommand() != "":
+		return TokenCommandEnv
+	case auth.ServiceAccountPath != "":
+		return auth.ServiceAccountPath
+	case os.Getenv("HELM_GCS_CREDENTIALS") != "":
+		return "HELM_GCS_CREDENTIALS"
+	case os.Getenv("HELM_GCS_CREDENTIALS_B64") != "":
+		return "HELM_GCS_CREDENTIALS_B64"
+	case os.Getenv("GOOGLE_CREDENTIALS") != "":
+		return "GOOGLE_CREDENTIALS"
+	case os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") != "":
+		return "GOOGLE_APPLICATION_CREDENTIALS (" + os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") + ")"
+	}
+	return "application default credentials"
+}
+
+// MissingPermissions returns the permissions the caller lacks on the bucket of path,
+// among permissions. It fails with storage.ErrBucketNotExist if the bucket doesn't exist.
+func MissingPermissions(ctx context.Context, client *storage.Client, path string, permissions []string) ([]string, error) {
+	bucketName, _, err := splitPath(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "split path")
+	}
+	granted, err := bucket(client, bucketName).IAM().TestPermissions(ctx, permissions)
+	if isHTTPStatus(err, http.StatusNotFound) {
+		return nil, storage.ErrBucketNotExist
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "test IAM permissions")
+	}
+	has := map[string]bool{}
+	for _, p := range granted {
+		has[p] = true
+	}
+	var missing []string
+	for _, p := range permissions {
+		if !has[p] {
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
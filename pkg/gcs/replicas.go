@@ -0,0 +1,114 @@
+package gcs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"helm.sh/helm/v3/pkg/helmpath"
+)
+
+// ReadStrategyEnv is the environment variable selecting how replicas of a
+// repository are picked for reads:
+//   - "failover" (default): always read the primary first, then the fallbacks in order.
+//   - "round-robin": rotate the first replica between reads.
+//   - "latency": read the replica with the lowest observed latency first.
+const ReadStrategyEnv = "HELM_GCS_READ_STRATEGY"
+
+// failedLatency is the latency recorded for a replica that failed to serve a read,
+// so it is tried last until it recovers.
+const failedLatency = time.Minute
+
+// replicaStats keeps track of reads done on the replicas of a repository.
+// Each read is done by a new process, so stats are persisted in helm cache.
+type replicaStats struct {
+	primary  string
+	strategy string
+
+	Next    int                      `json:"next"`
+	Latency map[string]time.Duration `json:"latency"`
+}
+
+type replicaStatsFile map[string]*replicaStats
+
+func replicaStatsPath() string {
+	return helmpath.CachePath("helm-gcs", "replicas.json")
+}
+
+func loadReplicaStats(primary string) *replicaStats {
+	strategy := strings.ToLower(os.Getenv(ReadStrategyEnv))
+	s := &replicaStats{primary: primary, strategy: strategy, Latency: map[string]time.Duration{}}
+	if strategy == "" || strategy == "failover" {
+		return s
+	}
+	if stored := readReplicaStatsFile()[primary]; stored != nil && stored.Latency != nil {
+		s.Next, s.Latency = stored.Next, stored.Latency
+	}
+	return s
+}
+
+// readReplicaStatsFile reads the stats of all the repositories. A file which can't be read
+// or parsed, e.g. written by another version, is ignored: the stats are collected again.
+func readReplicaStatsFile() replicaStatsFile {
+	b, err := os.ReadFile(replicaStatsPath())
+	if err != nil {
+		return replicaStatsFile{}
+	}
+	f := replicaStatsFile{}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return replicaStatsFile{}
+	}
+	return f
+}
+
+// order returns replicas in the order they should be read.
+func (s *replicaStats) order(replicas []string) []string {
+	ordered := append([]string{}, replicas...)
+	switch s.strategy {
+	case "round-robin":
+		n := s.Next % len(ordered)
+		ordered = append(ordered[n:], ordered[:n]...)
+		s.Next = (n + 1) % len(ordered)
+	case "latency":
+		// replicas never read have no latency and are tried first, so they get measured
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return s.Latency[ordered[i]] < s.Latency[ordered[j]]
+		})
+	}
+	return ordered
+}
+
+// observe records the outcome of a read on replica.
+// Latencies are smoothed with an exponentially weighted moving average.
+func (s *replicaStats) observe(replica string, d time.Duration, err error) {
+	if err != nil {
+		d = failedLatency
+	}
+	if prev, ok := s.Latency[replica]; ok {
+		d = (prev*7 + d*3) / 10
+	}
+	s.Latency[replica] = d
+}
+
+// save persists stats, failing silently as they are only a hint for next reads.
+// The file is replaced atomically, as other processes may read or save it concurrently:
+// the stats saved meanwhile by another process may be lost, but never corrupt the file.
+func (s *replicaStats) save() {
+	if s.strategy == "" || s.strategy == "failover" {
+		return
+	}
+	p := replicaStatsPath()
+	f := readReplicaStatsFile()
+	f[s.primary] = s
+	b, err := json.Marshal(f)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return
+	}
+	_ = writeFileAtomic(p, b, 0o644)
+}
@@ -0,0 +1,50 @@
+package gcs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplicaStatsFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HELM_CACHE_HOME", dir)
+	t.Setenv(ReadStrategyEnv, "latency")
+	p := replicaStatsPath()
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, content := range []string{`{"gs://bucket/repo": {"latency": {"gs://bucket/re`, `{"gs://bucket/repo": null}`, `[]`} {
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		s := loadReplicaStats("gs://bucket/repo")
+		if len(s.Latency) != 0 {
+			t.Errorf("stats loaded from %q: %v", content, s.Latency)
+		}
+		s.observe("gs://dr/repo", time.Second, nil)
+		s.save()
+
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := replicaStatsFile{}
+		if err := json.Unmarshal(b, &f); err != nil {
+			t.Fatalf("stats saved over %q: %s", content, err)
+		}
+		if got := loadReplicaStats("gs://bucket/repo").Latency["gs://dr/repo"]; got != time.Second {
+			t.Errorf("latency saved over %q = %s, want 1s", content, got)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Dir(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("files left in the cache: %d, want 1", len(entries))
+	}
+}
@@ -0,0 +1,331 @@
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+	"helm.sh/helm/v3/pkg/helmpath"
+)
+
+const (
+	// resumableChunkSize is the default size of the chunks committed by resumable uploads.
+	resumableChunkSize = 8 << 20
+	// chunkAlignment is the size chunks must be a multiple of.
+	chunkAlignment = 256 << 10
+	// resumableSessionTTL is how long GCS keeps an upload session alive.
+	resumableSessionTTL = 7 * 24 * time.Hour
+)
+
+// Uploader uploads files with resumable upload sessions.
+// Session URIs are persisted in helm cache, so an interrupted upload of the same file
+// to the same object continues from the last committed chunk, even from another process.
+type Uploader struct {
+	client *http.Client
+
+	// ChunkSize is the size of the chunks committed, rounded up to a multiple of 256 KiB,
+	// 8 MiB if not set. Larger chunks are faster, smaller ones lose less on failures.
+	ChunkSize int
+
+	// StorageClass and CustomTime, if set, are set on the uploaded objects.
+	StorageClass string
+	CustomTime   time.Time
+
+	// CacheControl, ContentDisposition and ContentType, if set, are set on the uploaded objects.
+	CacheControl       string
+	ContentDisposition string
+	ContentType        string
+
+	// OnProgress, if set, is called with the number of bytes committed after each chunk.
+	OnProgress func(committed, total int64)
+}
+
+// uploadSession is a persisted resumable upload session.
+type uploadSession struct {
+	URI     string    `json:"uri"`
+	Created time.Time `json:"created"`
+}
+
+// NewUploader creates an uploader authenticated like NewClient.
+func NewUploader(auth Auth) (*Uploader, error) {
+	if _, ok := emulatorHost(); ok {
+		return &Uploader{client: http.DefaultClient}, nil
+	}
+	opts, err := ClientOptions(auth)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, option.WithScopes(storage.ScopeReadWrite))
+	client, _, err := htransport.NewClient(context.Background(), opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "new http client")
+	}
+	return &Uploader{client: client}, nil
+}
+
+// Upload uploads the file at src to the object at path, with the given custom metadata.
+// Only the DoesNotExist and GenerationMatch conditions are supported.
+func (u *Uploader) Upload(ctx context.Context, src, path string, metadata map[string]string, conds storage.Conditions) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "open")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "stat")
+	}
+	digest, err := fileDigest(f)
+	if err != nil {
+		return errors.Wrap(err, "digest")
+	}
+	key := path + "@" + digest
+
+	sessions := loadUploadSessions()
+	session, ok := sessions[key]
+	if !ok || time.Since(session.Created) > resumableSessionTTL {
+		var uri string
+		err := retryPolicy.do(ctx, func() (err error) {
+			uri, err = u.startSession(ctx, path, info.Size(), metadata, conds)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		session = uploadSession{URI: uri, Created: time.Now()}
+		sessions[key] = session
+		sessions.save()
+	}
+
+	err = u.send(ctx, session.URI, f, info.Size())
+	if isExpiredSession(err) {
+		delete(sessions, key)
+		sessions.save()
+		return u.Upload(ctx, src, path, metadata, conds)
+	}
+	if err == nil {
+		delete(sessions, key)
+		sessions.save()
+	}
+	return err
+}
+
+// startSession initiates a resumable upload and returns the session URI.
+func (u *Uploader) startSession(ctx context.Context, path string, size int64, metadata map[string]string, conds storage.Conditions) (string, error) {
+	bucket, name, err := splitPath(path)
+	if err != nil {
+		return "", errors.Wrap(err, "split path")
+	}
+	resource := map[string]interface{}{"name": name, "metadata": metadata}
+	if u.StorageClass != "" {
+		resource["storageClass"] = u.StorageClass
+	}
+	if !u.CustomTime.IsZero() {
+		resource["customTime"] = u.CustomTime.UTC().Format(time.RFC3339)
+	}
+	for field, value := range map[string]string{
+		"cacheControl":       u.CacheControl,
+		"contentDisposition": u.ContentDisposition,
+		"contentType":        u.ContentType,
+	} {
+		if value != "" {
+			resource[field] = value
+		}
+	}
+	body, err := json.Marshal(resource)
+	if err != nil {
+		return "", errors.Wrap(err, "marshal")
+	}
+	endpoint := fmt.Sprintf("%s/b/%s/o?uploadType=resumable&name=%s", uploadEndpoint(), url.PathEscape(bucket), url.QueryEscape(name))
+	switch {
+	case conds.DoesNotExist:
+		endpoint += "&ifGenerationMatch=0"
+	case conds.GenerationMatch != 0:
+		endpoint += "&ifGenerationMatch=" + strconv.FormatInt(conds.GenerationMatch, 10)
+	}
+	if encryption.KMSKeyName != "" {
+		endpoint += "&kmsKeyName=" + url.QueryEscape(encryption.KMSKeyName)
+	}
+	if billingProject != "" {
+		endpoint += "&userProject=" + url.QueryEscape(billingProject)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Length", strconv.FormatInt(size, 10))
+	setEncryptionHeaders(req.Header)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "start upload session")
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return "", errors.Wrap(err, "start upload session")
+	}
+	return resp.Header.Get("Location"), nil
+}
+
+// send uploads the chunks of f not yet committed in the session.
+// A chunk failing with a transient error is retried according to the retry policy.
+func (u *Uploader) send(ctx context.Context, uri string, f io.ReaderAt, size int64) error {
+	offset, done, err := u.status(ctx, uri, size)
+	if err != nil || done {
+		return err
+	}
+	backoff := retryPolicy.backoff()
+	chunkSize := u.chunkSize()
+	for retries := 0; ; {
+		end := offset + chunkSize
+		if end > size {
+			end = size
+		}
+		offset, done, err = u.put(ctx, uri, io.NewSectionReader(f, offset, end-offset), offset, end, size)
+		if u.OnProgress != nil {
+			u.OnProgress(offset, size)
+		}
+		if done {
+			return nil
+		}
+		if err == nil {
+			retries = 0
+			continue
+		}
+		if !isRetryableUpload(err) || retries >= retryPolicy.MaxRetries {
+			return err
+		}
+		retries++
+		retried.Add(1)
+		if err := gax.Sleep(ctx, backoff.Pause()); err != nil {
+			return err
+		}
+		if offset, done, err = u.status(ctx, uri, size); err != nil || done {
+			return err
+		}
+	}
+}
+
+func (u *Uploader) chunkSize() int64 {
+	if u.ChunkSize <= 0 {
+		return resumableChunkSize
+	}
+	return (int64(u.ChunkSize) + chunkAlignment - 1) / chunkAlignment * chunkAlignment
+}
+
+// status returns the number of bytes committed in the session.
+func (u *Uploader) status(ctx context.Context, uri string, size int64) (int64, bool, error) {
+	return u.put(ctx, uri, nil, 0, 0, size)
+}
+
+// put sends the bytes [start, end) of the object, or queries the session status when body is nil.
+// It returns the number of bytes committed and whether the upload is complete.
+func (u *Uploader) put(ctx context.Context, uri string, body io.Reader, start, end, size int64) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, uri, body)
+	if err != nil {
+		return 0, false, err
+	}
+	if body == nil {
+		req.ContentLength = 0
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+	} else {
+		req.ContentLength = end - start
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+	}
+	setEncryptionHeaders(req.Header)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return start, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return size, true, nil
+	case http.StatusPermanentRedirect:
+		// Range is "bytes=0-N" once some bytes are committed
+		committed := int64(0)
+		if r := resp.Header.Get("Range"); r != "" {
+			last, err := strconv.ParseInt(r[strings.LastIndex(r, "-")+1:], 10, 64)
+			if err != nil {
+				return start, false, errors.Wrapf(err, "parse range %q", r)
+			}
+			committed = last + 1
+		}
+		return committed, false, nil
+	}
+	return start, false, googleapi.CheckResponse(resp)
+}
+
+// isRetryableUpload reports whether a chunk can be sent again after err:
+// connection failures are retried too, as the session keeps the committed bytes,
+// unless the context of the upload is done.
+func isRetryableUpload(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code >= 500 || gerr.Code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+func isExpiredSession(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && (gerr.Code == http.StatusNotFound || gerr.Code == http.StatusGone)
+}
+
+func fileDigest(f io.ReadSeeker) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type uploadSessions map[string]uploadSession
+
+func uploadSessionsPath() string {
+	return helmpath.CachePath("helm-gcs", "uploads.json")
+}
+
+func loadUploadSessions() uploadSessions {
+	s := uploadSessions{}
+	if b, err := os.ReadFile(uploadSessionsPath()); err == nil {
+		_ = json.Unmarshal(b, &s)
+	}
+	return s
+}
+
+// save persists sessions, failing silently: an unsaved session only means the upload restarts from zero.
+func (s uploadSessions) save() {
+	p := uploadSessionsPath()
+	b, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return
+	}
+	_ = os.WriteFile(p, b, 0o600)
+}
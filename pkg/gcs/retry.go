@@ -0,0 +1,119 @@
+package gcs
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+// MaxRetriesEnv is the environment variable setting how many times a failed
+// operation is retried, see RetryPolicy.
+const MaxRetriesEnv = "HELM_GCS_MAX_RETRIES"
+
+// RetryPolicy configures how operations failing with a transient error
+// (429, 5xx, connection reset, timeout...) are retried.
+// Retries are delayed with an exponential backoff with full jitter: the delay before
+// a retry is a random duration up to the current backoff, which starts at Initial
+// and is multiplied by Multiplier after each retry, up to Max.
+type RetryPolicy struct {
+	// MaxRetries is the maximum number of retries of an operation, 0 disables retries.
+	MaxRetries int
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+}
+
+// DefaultRetryPolicy is the retry policy used unless SetRetryPolicy is called.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 3,
+	Initial:    time.Second,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+}
+
+var retryPolicy = DefaultRetryPolicy
+
+// retried counts the retries of all the operations of this package.
+var retried atomic.Int64
+
+// Retries returns how many times operations of this package were retried, since the start
+// of the process.
+func Retries() int64 {
+	return retried.Load()
+}
+
+// SetRetryPolicy sets the retry policy of the operations of this package.
+func SetRetryPolicy(p RetryPolicy) {
+	retryPolicy = p
+}
+
+func (p RetryPolicy) backoff() *gax.Backoff {
+	return &gax.Backoff{Initial: p.Initial, Max: p.Max, Multiplier: p.Multiplier}
+}
+
+// retryer returns the retry options of an object handle. Retries are counted
+// per handle, which is used for a single operation or a few related ones.
+func (p RetryPolicy) retryer() []storage.RetryOption {
+	var mu sync.Mutex
+	retries := 0
+	return []storage.RetryOption{
+		storage.WithBackoff(*p.backoff()),
+		// writes of the plugin are either conditional or overwrite the object
+		// with the same content, so they can be retried
+		storage.WithPolicy(storage.RetryAlways),
+		storage.WithErrorFunc(func(err error) bool {
+			if !isRetryable(err) {
+				return false
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if retries >= p.MaxRetries {
+				return false
+			}
+			retries++
+			retried.Add(1)
+			return true
+		}),
+	}
+}
+
+// do runs fn until it succeeds, fails with an error which isn't transient,
+// or the retries of the policy are exhausted.
+func (p RetryPolicy) do(ctx context.Context, fn func() error) error {
+	backoff := p.backoff()
+	for retries := 0; ; retries++ {
+		err := fn()
+		if err == nil || !isRetryable(err) || retries >= p.MaxRetries {
+			return err
+		}
+		retried.Add(1)
+		if err := gax.Sleep(ctx, backoff.Pause()); err != nil {
+			return err
+		}
+	}
+}
+
+// IsRetryable reports whether an operation failing with err can be retried: the error is
+// transient, like the ones retried by the retry policy.
+func IsRetryable(err error) bool {
+	return isRetryable(err)
+}
+
+// isRetryable reports whether an operation failing with err can be retried.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusInternalServerError {
+		return true
+	}
+	return storage.ShouldRetry(err)
+}
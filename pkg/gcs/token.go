@@ -0,0 +1,86 @@
+package gcs
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// TokenCommandEnv is the environment variable holding a command printing an access token,
+// e.g. "gcloud auth print-access-token", see CommandTokenSource.
+const TokenCommandEnv = "HELM_GCS_TOKEN_COMMAND"
+
+// commandTokenTTL is how long a token printed without expiry is used before the command
+// is run again.
+const commandTokenTTL = 5 * time.Minute
+
+// CommandTokenSource returns a token source running command, through the shell, whenever
+// a fresh token is needed. The command prints either the access token alone, or JSON with
+// "access_token" and "expires_in" (seconds) or "expiry" (RFC 3339), like the token endpoint.
+// Tokens printed alone are used for 5 minutes. Tokens are reused until shortly before
+// they expire, so long operations never use an expired token.
+func CommandTokenSource(command string) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, commandTokenSource{command: command})
+}
+
+type commandTokenSource struct {
+	command string
+}
+
+func (s commandTokenSource) Token() (*oauth2.Token, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", s.command)
+	} else {
+		cmd = exec.Command("sh", "-c", s.command)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: %s", TokenCommandEnv, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return parseCommandToken(out, time.Now())
+}
+
+// parseCommandToken parses the output of a token command, run at now.
+func parseCommandToken(out []byte, now time.Time) (*oauth2.Token, error) {
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 {
+		return nil, errors.Errorf("%s printed no token", TokenCommandEnv)
+	}
+	if out[0] != '{' {
+		return &oauth2.Token{AccessToken: string(out), Expiry: now.Add(commandTokenTTL)}, nil
+	}
+	var t struct {
+		AccessToken string    `json:"access_token"`
+		ExpiresIn   int64     `json:"expires_in"`
+		Expiry      time.Time `json:"expiry"`
+	}
+	if err := json.Unmarshal(out, &t); err != nil {
+		return nil, errors.Wrapf(err, "parse output of %s", TokenCommandEnv)
+	}
+	if t.AccessToken == "" {
+		return nil, errors.Errorf("%s printed no access_token", TokenCommandEnv)
+	}
+	token := &oauth2.Token{AccessToken: t.AccessToken, Expiry: t.Expiry}
+	switch {
+	case t.ExpiresIn > 0:
+		token.Expiry = now.Add(time.Duration(t.ExpiresIn) * time.Second)
+	case token.Expiry.IsZero():
+		token.Expiry = now.Add(commandTokenTTL)
+	}
+	return token, nil
+}
+
+// tokenCommand returns the token command set in the environment, "" if there is none.
+func tokenCommand() string {
+	return strings.TrimSpace(os.Getenv(TokenCommandEnv))
+}
@@ -0,0 +1,329 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// pushedChart is a chart of a batch push.
+type pushedChart struct {
+	chart  *chart.Chart
+	path   string
+	hash   string
+	upload *chartUpload
+}
+
+// PushCharts adds several charts into the repository with a single update of the index
+// file, rather than one per chart, which would conflict with each other in CI.
+// All the charts are loaded and checked first, as by PushChart, and uploaded to temporary
+// objects by r.concurrency workers, then the index is updated and the charts are moved to
+// their final objects. The options apply to every chart.
+// The pushed charts are described by the returned results, in the order of chartpaths.
+func (r Repo) PushCharts(ctx context.Context, chartpaths []string, force, retry bool, public bool, publicURL string, bucketPath string, metadata map[string]string) ([]PushResult, error) {
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	charts, cleanup, err := r.loadCharts(chartpaths)
+	defer cleanup()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, c := range charts {
+		names = append(names, pushedCharts(c.chart)...)
+	}
+	i, err := r.shallowIndexFile(ctx, names...)
+	if err != nil {
+		return nil, errors.Wrap(err, "load index file")
+	}
+	if bucketPath, err = r.useLayout(i, bucketPath); err != nil {
+		return nil, err
+	}
+	chartBaseURL, urls, err := r.chartBaseURLs(bucketPath, public, publicURL)
+	if err != nil {
+		return nil, err
+	}
+	cleanupStaged, err := r.checkCharts(ctx, i, charts, chartBaseURL, force)
+	defer cleanupStaged()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.stageCharts(ctx, charts, chartBaseURL, r.buildMetadata(metadata), force); err != nil {
+		return nil, err
+	}
+	i, pruned, err := r.addChartsToIndexFile(ctx, i, charts, urls, force, retry)
+	if err != nil {
+		r.abortUploads(ctx, charts)
+		return nil, errors.Wrap(err, "update index file")
+	}
+	if err := r.commitCharts(ctx, i, charts); err != nil {
+		return nil, err
+	}
+	pushed := make([]*chart.Chart, 0, len(charts))
+	for _, c := range charts {
+		pushed = append(pushed, c.chart)
+	}
+	if err := r.afterPush(ctx, i, pruned, pushed...); err != nil {
+		return nil, err
+	}
+	return r.pushResults(charts, chartBaseURL)
+}
+
+// RemoveCharts removes all the versions of several charts from the repository with a single
+// update of the index file, rather than one per chart, which would conflict with each other.
+// Nothing is removed if one of the charts isn't indexed. With retry, the charts are removed
+// again from the index if it changed meanwhile. See RemoveChart for dryRun.
+func (r Repo) RemoveCharts(ctx context.Context, names []string, retry, dryRun bool) ([]Removal, error) {
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	for {
+		i, err := r.shallowIndexFile(ctx, names...)
+		if err != nil {
+			return nil, errors.Wrap(err, "load index file")
+		}
+		var removed repo.ChartVersions
+		seen := map[string]bool{}
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			vs, ok := i.Entries[name]
+			if !ok {
+				return nil, notFoundf("chart \"%s\" not found", name)
+			}
+			log.Debugf("all versions of %s will be deleted", name)
+			removed = append(removed, vs...)
+			delete(i.Entries, name)
+		}
+		if dryRun {
+			return r.removals(ctx, removed)
+		}
+		err = r.uploadIndexFile(ctx, i)
+		if errors.Is(err, ErrIndexOutOfDate) && retry {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return r.afterRemove(ctx, i, removed)
+	}
+}
+
+// loadCharts loads the charts of a batch push.
+func (r Repo) loadCharts(chartpaths []string) ([]pushedChart, func(), error) {
+	var cleanups []func()
+	cleanup := func() {
+		for _, c := range cleanups {
+			c()
+		}
+	}
+	seen := map[string]string{}
+	var charts []pushedChart
+	for _, p := range chartpaths {
+		log.Debugf("load chart \"%s\"", p)
+		c, path, cleanupChart, err := r.loadChart(p)
+		if err != nil {
+			return nil, cleanup, errors.Wrap(err, p)
+		}
+		cleanups = append(cleanups, cleanupChart)
+
+		ref := c.Metadata.Name + "-" + c.Metadata.Version
+		if other, ok := seen[ref]; ok {
+			return nil, cleanup, fmt.Errorf("chart %s is pushed twice, by %s and %s", ref, other, p)
+		}
+		seen[ref] = p
+		charts = append(charts, pushedChart{chart: c, path: path})
+	}
+	return charts, cleanup, nil
+}
+
+// checkCharts checks the charts of a batch push against the index i, as PushChart does, and
+// computes their digest. In a content-addressable repository, the charts are replaced with
+// their staged copy, removed by the returned cleanup function.
+func (r Repo) checkCharts(ctx context.Context, i *repo.IndexFile, charts []pushedChart, chartBaseURL string, force bool) (func(), error) {
+	var cleanups []func()
+	cleanup := func() {
+		for _, c := range cleanups {
+			c()
+		}
+	}
+	for n := range charts {
+		c := &charts[n]
+		if err := r.checkLibrary(i, c.chart); err != nil {
+			return cleanup, err
+		}
+		if err := r.checkDependencies(ctx, i, c.chart); err != nil {
+			return cleanup, err
+		}
+		if err := r.lintChart(i, c.chart, c.path); err != nil {
+			return cleanup, err
+		}
+		if i.Has(c.chart.Metadata.Name, c.chart.Metadata.Version) && !force {
+			return cleanup, fmt.Errorf("chart %s-%s already indexed. Use --force to still upload the chart", c.chart.Metadata.Name, c.chart.Metadata.Version)
+		}
+		hash, err := r.digestFile(c.path)
+		if err != nil {
+			return cleanup, errors.Wrap(err, "generate chart file digest")
+		}
+		path, cleanupStaged, err := r.stageChart(c.path, hash)
+		if err != nil {
+			return cleanup, err
+		}
+		cleanups = append(cleanups, cleanupStaged)
+		if err := r.checkChartObject(ctx, path, chartBaseURL, force); err != nil {
+			return cleanup, err
+		}
+		c.path, c.hash = path, hash
+	}
+	return cleanup, nil
+}
+
+// addChartsToIndexFile adds the staged charts of a batch push to the index i and uploads it,
+// as addToIndexFile does for a single chart. With retry, the index is reloaded and the charts
+// added again while it is updated concurrently.
+// It returns the uploaded index and the versions pruned by the max-versions policies.
+func (r *Repo) addChartsToIndexFile(ctx context.Context, i *repo.IndexFile, charts []pushedChart, urls []string, force, retry bool) (*repo.IndexFile, repo.ChartVersions, error) {
+	pruned, err := r.updateIndexFileCharts(ctx, i, charts, urls, force)
+	for errors.Is(err, ErrIndexOutOfDate) && retry {
+		if i, err = r.reloadIndexFile(ctx); err != nil {
+			return nil, nil, errors.Wrap(err, "load index file")
+		}
+		pruned, err = r.updateIndexFileCharts(ctx, i, charts, urls, force)
+	}
+	return i, pruned, err
+}
+
+// updateIndexFileCharts adds the charts of a batch push to the index i and uploads it.
+func (r *Repo) updateIndexFileCharts(ctx context.Context, i *repo.IndexFile, charts []pushedChart, urls []string, force bool) (repo.ChartVersions, error) {
+	pruned, err := r.addCharts(i, charts, urls, force)
+	if err != nil {
+		return nil, err
+	}
+	return pruned, r.uploadIndexFile(ctx, i)
+}
+
+// pushResults describes the charts of a batch push, pushed under baseURL.
+func (r Repo) pushResults(charts []pushedChart, baseURL string) ([]PushResult, error) {
+	results := make([]PushResult, 0, len(charts))
+	for _, c := range charts {
+		result, err := r.pushResult(c.chart, c.path, baseURL, c.hash)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, *result)
+	}
+	return results, nil
+}
+
+// addCharts adds the charts of a batch push to the index, and returns the versions pruned
+// by the max-versions policies.
+func (r Repo) addCharts(i *repo.IndexFile, charts []pushedChart, urls []string, force bool) (repo.ChartVersions, error) {
+	var pruned repo.ChartVersions
+	for _, c := range charts {
+		// the version may have been pushed concurrently
+		if i.Has(c.chart.Metadata.Name, c.chart.Metadata.Version) && !force {
+			return nil, fmt.Errorf("chart %s-%s already indexed. Use --force to still upload the chart", c.chart.Metadata.Name, c.chart.Metadata.Version)
+		}
+		p, err := r.indexUpload(i, c.upload, c.chart, urls, c.hash)
+		if err != nil {
+			return nil, err
+		}
+		pruned = append(pruned, p...)
+	}
+	return pruned, nil
+}
+
+// stageCharts uploads the charts of a batch push to temporary objects, see stageUpload.
+// The charts already staged are deleted if one of them fails.
+func (r Repo) stageCharts(ctx context.Context, charts []pushedChart, chartBaseURL string, metadata map[string]string, force bool) error {
+	err := r.forEachChart(charts, func(c *pushedChart) error {
+		u, err := r.stageUpload(ctx, c.path, chartBaseURL, metadata, force)
+		if err != nil {
+			return errors.Wrapf(err, "write chart %s", c.path)
+		}
+		c.upload = u
+		return nil
+	})
+	if err != nil {
+		r.abortUploads(ctx, charts)
+	}
+	return err
+}
+
+// commitCharts moves the staged charts of a batch push which are still indexed, i.e. which
+// were not pruned right away by the max-versions policies, to their final objects.
+// The other ones are deleted. The index entries of the charts which failed to be moved are
+// rolled back, see revertUploads.
+func (r *Repo) commitCharts(ctx context.Context, i *repo.IndexFile, charts []pushedChart) error {
+	err := r.forEachChart(charts, func(c *pushedChart) error {
+		if !i.Has(c.chart.Metadata.Name, c.chart.Metadata.Version) {
+			r.abortUpload(ctx, c.upload)
+			return nil
+		}
+		return errors.Wrapf(r.commitUpload(ctx, c.upload), "write chart %s", c.path)
+	})
+	if err == nil {
+		return nil
+	}
+	uploads := make([]*chartUpload, 0, len(charts))
+	for _, c := range charts {
+		uploads = append(uploads, c.upload)
+	}
+	return r.revertUploads(ctx, uploads, err)
+}
+
+// abortUploads deletes the temporary objects of the staged charts of a batch push.
+func (r Repo) abortUploads(ctx context.Context, charts []pushedChart) {
+	for _, c := range charts {
+		if c.upload != nil {
+			r.abortUpload(ctx, c.upload)
+		}
+	}
+}
+
+// forEachChart calls fn on the charts of a batch push, by r.concurrency workers.
+func (r Repo) forEachChart(charts []pushedChart, fn func(c *pushedChart) error) error {
+	jobs := make(chan *pushedChart)
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for n := 0; n < r.workers(); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				if err := fn(c); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for n := range charts {
+		jobs <- &charts[n]
+	}
+	close(jobs)
+	wg.Wait()
+	if len(errs) > 1 {
+		return errors.Wrapf(errs[0], "%d charts failed to upload", len(errs))
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/repo"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// CreateFromIndex creates a new repository on GCS pre-populated with the entries
+// of an existing index file. source can be a local file, a gs:// or an http(s) URL.
+// Relative chart URLs are resolved against the location of the source index.
+//
+// If copyCharts is true, the charts referenced by the source index are copied
+// into the new repository, keeping their path relative to the source index, and the
+// entries are updated to point to them. Otherwise, entries keep pointing to the original
+// charts, which can't be local files.
+func CreateFromIndex(ctx context.Context, r *Repo, source string, copyCharts bool) error {
+	log.Debugf("create a repository with index file at %s from %s", r.indexFileURL, source)
+
+	o, err := gcs.Object(r.gcs, r.indexFileURL)
+	if err != nil {
+		return errors.Wrap(err, "object")
+	}
+	_, err = o.Attrs(ctx)
+	if err == nil {
+		return fmt.Errorf("repository %s already exists", r.indexFileURL)
+	} else if err != storage.ErrObjectNotExist {
+		return errors.Wrap(err, "attrs")
+	}
+
+	i, err := loadIndexFrom(ctx, r.gcs, source)
+	if err != nil {
+		return errors.Wrap(err, "load source index")
+	}
+
+	sourceBase, err := indexLocation(source)
+	if err != nil {
+		return errors.Wrap(err, "source index location")
+	}
+	for _, versions := range i.Entries {
+		for _, v := range versions {
+			if len(v.URLs) == 0 {
+				continue
+			}
+			chartURL := absoluteURL(sourceBase, v.URLs[0])
+			if !copyCharts {
+				if isLocalPath(chartURL) {
+					return invalidf("chart %s-%s is a local file %s, it can only be copied into the repository", v.Name, v.Version, chartURL)
+				}
+				v.URLs[0] = chartURL
+				continue
+			}
+			dst, err := resolveReference(r.baseURL(), relativeChartPath(sourceBase, chartURL))
+			if err != nil {
+				return errors.Wrap(err, "resolve reference")
+			}
+			log.Debugf("copy chart %s to %s", chartURL, dst)
+			r.report(PhaseCopy, dst, 0, 0)
+			size, err := copyChart(ctx, r.gcs, chartURL, dst)
+			if err != nil {
+				return errors.Wrapf(err, "copy chart %s-%s", v.Name, v.Version)
+			}
+			r.report(PhaseCopy, dst, size, size)
+			v.URLs = []string{dst}
+		}
+	}
+
+	return r.createIndexFile(ctx, i)
+}
+
+// createIndexFile uploads the index i of a new repository, failing if the index file was
+// created meanwhile.
+func (r *Repo) createIndexFile(ctx context.Context, i *repo.IndexFile) error {
+	r.indexFileGeneration = indexDoesNotExist
+	err := r.uploadIndexFile(ctx, i)
+	if errors.Is(err, ErrIndexOutOfDate) {
+		return fmt.Errorf("repository %s already exists", r.indexFileURL)
+	}
+	return err
+}
+
+// indexLocation returns the location the relative chart URLs of the index at source are
+// resolved against, ending with "/": the directory of the index, as an absolute path with
+// slashes for a local file.
+func indexLocation(source string) (string, error) {
+	if !isLocalPath(source) {
+		return source[:strings.LastIndex(source, "/")+1], nil
+	}
+	dir, err := filepath.Abs(filepath.Dir(source))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(filepath.ToSlash(dir), "/") + "/", nil
+}
+
+// isLocalPath reports whether u is the path of a local file rather than a gs:// or http(s) URL.
+func isLocalPath(u string) bool {
+	for _, scheme := range []string{"gs://", "gcs://", "http://", "https://"} {
+		if strings.HasPrefix(u, scheme) {
+			return false
+		}
+	}
+	return true
+}
+
+// relativeChartPath returns the path of the copy of the chart at chartURL, relative to the
+// repository: its path under base, the location of the source index, so that charts of the
+// same name in different directories don't collide, or else its file name.
+func relativeChartPath(base, chartURL string) string {
+	if rel := strings.TrimPrefix(chartURL, base); rel != chartURL {
+		if rel = path.Clean(rel); rel != ".." && !strings.HasPrefix(rel, "../") {
+			return rel
+		}
+	}
+	return path.Base(chartURL)
+}
+
+// loadIndexFrom loads an index file from a local file, a gs:// or an http(s) URL.
+func loadIndexFrom(ctx context.Context, client *storage.Client, source string) (*repo.IndexFile, error) {
+	var b []byte
+	var err error
+	switch {
+	case strings.HasPrefix(source, "gs://") || strings.HasPrefix(source, "gcs://"):
+		var reader io.ReadCloser
+		reader, err = gcs.NewReader(ctx, client, source)
+		if err != nil {
+			return nil, errors.Wrap(err, "reader")
+		}
+		defer reader.Close()
+		b, err = io.ReadAll(reader)
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		b, err = httpGet(ctx, source)
+	default:
+		b, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read")
+	}
+	if b, err = gcs.Gunzip(b); err != nil {
+		return nil, err
+	}
+
+	i := &repo.IndexFile{}
+	if err := yaml.Unmarshal(b, i); err != nil {
+		return nil, errors.Wrap(err, "unmarshal")
+	}
+	if i.Entries == nil {
+		i.Entries = map[string]repo.ChartVersions{}
+	}
+	return i, nil
+}
+
+// copyChart copies a chart into the repository, server-side when the chart is on GCS,
+// and returns its size. src can also be an http(s) URL or the path of a local file.
+func copyChart(ctx context.Context, client *storage.Client, src, dst string) (int64, error) {
+	if gsURL, ok := toGCSURL(src); ok {
+		attrs, err := gcs.Copy(ctx, client, gsURL, dst)
+		if err != nil {
+			return 0, err
+		}
+		return attrs.Size, nil
+	}
+	var b []byte
+	var err error
+	if isLocalPath(src) {
+		b, err = os.ReadFile(filepath.FromSlash(src))
+	} else {
+		b, err = httpGet(ctx, src)
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "download")
+	}
+	o, err := gcs.Object(client, dst)
+	if err != nil {
+		return 0, errors.Wrap(err, "object")
+	}
+	w := gcs.NewWriter(ctx, o)
+	if _, err := w.Write(b); err != nil {
+		return 0, errors.Wrap(err, "write")
+	}
+	return int64(len(b)), errors.Wrap(w.Close(), "close")
+}
+
+// toGCSURL converts a chart URL to a gs:// URL, when the chart is on GCS.
+func toGCSURL(u string) (string, bool) {
+	if strings.HasPrefix(u, "gs://") || strings.HasPrefix(u, "gcs://") {
+		return u, true
+	}
+	const public = "https://storage.googleapis.com/"
+	if strings.HasPrefix(u, public) {
+		return "gs://" + strings.TrimPrefix(u, public), true
+	}
+	return "", false
+}
+
+// absoluteURL resolves a chart URL which may be relative to the index location.
+func absoluteURL(base, u string) string {
+	if parsed, err := url.Parse(u); err == nil && parsed.IsAbs() {
+		return u
+	}
+	return base + strings.TrimPrefix(u, "./")
+}
+
+func httpGet(ctx context.Context, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
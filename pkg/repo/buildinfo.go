@@ -0,0 +1,107 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// buildAnnotationPrefix prefixes the annotations recording the build of a chart version in the index.
+const buildAnnotationPrefix = "helm-gcs.build/"
+
+// BuildInfo describes the CI build publishing a chart.
+type BuildInfo struct {
+	System      string
+	Commit      string
+	PipelineURL string
+	Builder     string
+}
+
+// DetectBuildInfo returns the build running the current process, for GitHub Actions,
+// GitLab CI and Cloud Build. It returns nil outside of these CI systems.
+func DetectBuildInfo() *BuildInfo {
+	switch {
+	case os.Getenv("GITHUB_ACTIONS") == "true":
+		return &BuildInfo{
+			System:      "github-actions",
+			Commit:      os.Getenv("GITHUB_SHA"),
+			PipelineURL: fmt.Sprintf("%s/%s/actions/runs/%s", os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID")),
+			Builder:     os.Getenv("GITHUB_ACTOR"),
+		}
+	case os.Getenv("GITLAB_CI") == "true":
+		return &BuildInfo{
+			System:      "gitlab-ci",
+			Commit:      os.Getenv("CI_COMMIT_SHA"),
+			PipelineURL: os.Getenv("CI_PIPELINE_URL"),
+			Builder:     os.Getenv("GITLAB_USER_LOGIN"),
+		}
+	case os.Getenv("BUILD_ID") != "" && os.Getenv("PROJECT_ID") != "":
+		// Cloud Build only exposes these when mapped in the build step env
+		return &BuildInfo{
+			System:      "cloud-build",
+			Commit:      os.Getenv("COMMIT_SHA"),
+			PipelineURL: fmt.Sprintf("https://console.cloud.google.com/cloud-build/builds/%s?project=%s", os.Getenv("BUILD_ID"), os.Getenv("PROJECT_ID")),
+			Builder:     os.Getenv("SERVICE_ACCOUNT_EMAIL"),
+		}
+	}
+	return nil
+}
+
+// WithBuildInfo records the build publishing charts as annotations of their index entries
+// and as metadata of their objects.
+func WithBuildInfo(b *BuildInfo) Option {
+	return func(r *Repo) {
+		r.build = b
+	}
+}
+
+// values returns the non-empty fields of the build.
+func (b *BuildInfo) values() map[string]string {
+	values := map[string]string{}
+	for k, v := range map[string]string{
+		"system":       b.System,
+		"commit":       b.Commit,
+		"pipeline-url": b.PipelineURL,
+		"builder":      b.Builder,
+	} {
+		if v != "" {
+			values[k] = v
+		}
+	}
+	return values
+}
+
+// buildMetadata returns the object metadata of a pushed chart: metadata given by the user,
+// completed with the build info.
+func (r Repo) buildMetadata(metadata map[string]string) map[string]string {
+	if r.build == nil {
+		return metadata
+	}
+	merged := map[string]string{}
+	for k, v := range r.build.values() {
+		merged["ci-"+k] = v
+	}
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	return merged
+}
+
+// annotateBuild records the build info in the index entry of the pushed chart.
+func (r Repo) annotateBuild(i *repo.IndexFile, c *chart.Chart) {
+	if r.build == nil {
+		return
+	}
+	cv, err := i.Get(c.Metadata.Name, c.Metadata.Version)
+	if err != nil {
+		return
+	}
+	if cv.Annotations == nil {
+		cv.Annotations = map[string]string{}
+	}
+	for k, v := range r.build.values() {
+		cv.Annotations[buildAnnotationPrefix+k] = v
+	}
+}
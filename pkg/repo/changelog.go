@@ -0,0 +1,165 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	"helm.sh/helm/v3/pkg/repo"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// changelogFile is the name of the file recording the history of the repository,
+// one JSON object per line.
+const changelogFile = "CHANGELOG.ndjson"
+
+// maxChangelogAttempts bounds the attempts to append to the changelog
+// while other writers are appending to it.
+const maxChangelogAttempts = 10
+
+// Changelog actions.
+const (
+	ChangelogPush   = "push"
+	ChangelogRemove = "remove"
+)
+
+// ChangelogEntry records a change of the repository.
+type ChangelogEntry struct {
+	Action    string    `json:"action"`
+	Chart     string    `json:"chart"`
+	Version   string    `json:"version"`
+	Digest    string    `json:"digest,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func changelogEntries(action string, versions ...*repo.ChartVersion) []ChangelogEntry {
+	now := time.Now().UTC()
+	actor := changelogActor()
+	entries := []ChangelogEntry{}
+	for _, v := range versions {
+		if v == nil {
+			continue
+		}
+		entries = append(entries, ChangelogEntry{
+			Action:    action,
+			Chart:     v.Name,
+			Version:   v.Version,
+			Digest:    v.Digest,
+			Actor:     actor,
+			Timestamp: now,
+		})
+	}
+	return entries
+}
+
+// changelogActor identifies who is changing the repository,
+// from HELM_GCS_ACTOR or the usual CI and shell variables.
+func changelogActor() string {
+	for _, env := range []string{"HELM_GCS_ACTOR", "GITHUB_ACTOR", "GITLAB_USER_LOGIN", "BUILD_REQUESTED_FOR", "USER", "USERNAME"} {
+		if v := os.Getenv(env); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// appendChangelog appends entries to the changelog file.
+// GCS objects can't be appended to, so the file is rewritten with a
+// generation precondition and the append is retried if it changed meanwhile.
+func (r Repo) appendChangelog(ctx context.Context, entries ...ChangelogEntry) error {
+	if !r.changelog || len(entries) == 0 {
+		return nil
+	}
+	changelogURL, err := resolveReference(r.baseURL(), changelogFile)
+	if err != nil {
+		return errors.Wrap(err, "resolve reference")
+	}
+	o, err := gcs.Object(r.gcs, changelogURL)
+	if err != nil {
+		return errors.Wrap(err, "object")
+	}
+
+	lines := &bytes.Buffer{}
+	enc := json.NewEncoder(lines)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return errors.Wrap(err, "encode changelog entry")
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		content, generation, err := readObject(ctx, o)
+		if err != nil {
+			return errors.Wrap(err, "read changelog")
+		}
+		cond := storage.Conditions{GenerationMatch: generation}
+		if generation == 0 {
+			cond = storage.Conditions{DoesNotExist: true}
+		}
+		w := gcs.NewWriter(ctx, o.If(cond))
+		w.CacheControl = "no-cache, max-age=0, no-transform"
+		w.ContentType = "application/x-ndjson"
+		if _, err := w.Write(append(content, lines.Bytes()...)); err != nil {
+			return errors.Wrap(err, "write changelog")
+		}
+		err = w.Close()
+		gerr, ok := err.(*googleapi.Error)
+		if ok && gerr.Code == 412 && attempt < maxChangelogAttempts {
+			log.Debugf("changelog updated concurrently, retrying")
+			continue
+		}
+		return errors.Wrap(err, "close changelog")
+	}
+}
+
+// Changelog returns the entries of the changelog file, oldest first.
+func (r Repo) Changelog(ctx context.Context) ([]ChangelogEntry, error) {
+	changelogURL, err := resolveReference(r.baseURL(), changelogFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve reference")
+	}
+	reader, err := gcs.NewReader(ctx, r.gcs, changelogURL)
+	if err == storage.ErrObjectNotExist {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "read changelog")
+	}
+	defer reader.Close()
+
+	entries := []ChangelogEntry{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e ChangelogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, errors.Wrap(err, "decode changelog entry")
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// readObject reads a whole object and its generation.
+// A missing object is read as empty, with a zero generation.
+func readObject(ctx context.Context, o *storage.ObjectHandle) ([]byte, int64, error) {
+	reader, err := o.NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer reader.Close()
+	b, err := io.ReadAll(reader)
+	return b, reader.Attrs.Generation, err
+}
@@ -0,0 +1,144 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/repo"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// checksumsFile is the name of the file listing the digest of every chart,
+// in the format of the sha256sum utility.
+const checksumsFile = "SHA256SUMS"
+
+// ChecksumResult is the result of the verification of a chart file listed in SHA256SUMS.
+type ChecksumResult struct {
+	File     string
+	Expected string
+	Actual   string
+	Err      error
+}
+
+// OK reports whether the chart file matches its listed digest.
+func (c ChecksumResult) OK() bool {
+	return c.Err == nil && c.Expected == c.Actual
+}
+
+// updateChecksums rewrites SHA256SUMS from the digests recorded in the index file.
+func (r Repo) updateChecksums(ctx context.Context, i *repo.IndexFile) error {
+	if !r.checksums {
+		return nil
+	}
+
+	lines := []string{}
+	for _, versions := range i.Entries {
+		for _, v := range versions {
+			if v.Digest == "" || len(v.URLs) == 0 {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s  %s\n", v.Digest, r.chartFileName(v)))
+		}
+	}
+	sort.Strings(lines)
+
+	checksumsURL, err := resolveReference(r.baseURL(), checksumsFile)
+	if err != nil {
+		return errors.Wrap(err, "resolve reference")
+	}
+	log.Debugf("update checksums file %s", checksumsURL)
+	o, err := gcs.Object(r.gcs, checksumsURL)
+	if err != nil {
+		return errors.Wrap(err, "object")
+	}
+	w := gcs.NewWriter(ctx, o)
+	w.CacheControl = "no-cache, max-age=0, no-transform"
+	w.ContentType = "text/plain"
+	if _, err := io.WriteString(w, strings.Join(lines, "")); err != nil {
+		return errors.Wrap(err, "write checksums")
+	}
+	return errors.Wrap(w.Close(), "close checksums")
+}
+
+// VerifyChecksums downloads every chart file listed in SHA256SUMS and compares its digest.
+func (r Repo) VerifyChecksums(ctx context.Context) ([]ChecksumResult, error) {
+	checksumsURL, err := resolveReference(r.baseURL(), checksumsFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve reference")
+	}
+	reader, err := gcs.NewReader(ctx, r.gcs, checksumsURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "read checksums")
+	}
+	b, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "read checksums")
+	}
+
+	results := []ChecksumResult{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		expected, file, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok {
+			continue
+		}
+		result := ChecksumResult{File: file, Expected: expected}
+		result.Actual, result.Err = r.digestObject(ctx, file)
+		results = append(results, result)
+	}
+	return results, scanner.Err()
+}
+
+// digestObject computes the sha256 digest of a chart file of the repository, given by its
+// path relative to the repository or its URL on GCS.
+func (r Repo) digestObject(ctx context.Context, file string) (string, error) {
+	u, err := r.objectURL(file)
+	if err != nil {
+		return "", err
+	}
+	reader, err := gcs.NewReader(ctx, r.gcs, u)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r.withProgress(reader, PhaseVerify, u, ReaderSize(reader))); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// chartFileName returns the path of the chart object of cv relative to the repository,
+// or its gs:// URL when the chart is stored outside of the repository.
+// Charts indexed with URLs which aren't on GCS, e.g. of a CDN, are mapped back to their
+// object through the URLs of the mirrors, or else are assumed to be served under the same
+// path as in the repository.
+func (r Repo) chartFileName(cv *repo.ChartVersion) string {
+	for _, chartURL := range cv.URLs {
+		if u, err := r.objectURL(chartURL); err == nil {
+			return strings.TrimPrefix(u, r.baseURL())
+		}
+	}
+	for _, chartURL := range cv.URLs {
+		for _, mirror := range r.mirrorURLs {
+			if rel := strings.TrimPrefix(chartURL, strings.TrimSuffix(mirror, "/")+"/"); rel != chartURL {
+				return rel
+			}
+		}
+	}
+	if parsed, err := url.Parse(cv.URLs[0]); err == nil {
+		return strings.TrimPrefix(parsed.Path, "/")
+	}
+	return cv.URLs[0]
+}
@@ -0,0 +1,51 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// IndexConflictError is the error of an index update rejected because the index file was
+// written by someone else since it was read. It matches ErrIndexOutOfDate with errors.Is.
+type IndexConflictError struct {
+	// URL is the URL of the index file, or of the top-level index of a sharded repository.
+	URL string
+	// ExpectedGeneration is the generation of the index file the update was based on.
+	ExpectedGeneration int64
+	// ActualGeneration and Updated describe the index file written meanwhile,
+	// zero if they could not be read.
+	ActualGeneration int64
+	Updated          time.Time
+}
+
+func (e *IndexConflictError) Error() string {
+	msg := fmt.Sprintf("%s: %s was read at generation %d", ErrIndexOutOfDate, e.URL, e.ExpectedGeneration)
+	if e.ActualGeneration != 0 {
+		msg += fmt.Sprintf(", but is now at generation %d, written at %s", e.ActualGeneration, e.Updated.Format(time.RFC3339))
+	}
+	return msg
+}
+
+// Is makes the error match ErrIndexOutOfDate.
+func (e *IndexConflictError) Is(target error) bool {
+	return target == ErrIndexOutOfDate
+}
+
+// indexConflict returns the error of an update of the index file at url which conflicted,
+// with the current generation of the file when it can be read.
+func (r Repo) indexConflict(ctx context.Context, url string) error {
+	conflict := &IndexConflictError{URL: url, ExpectedGeneration: r.indexFileGeneration}
+	o, err := gcs.Object(r.gcs, url)
+	if err != nil {
+		return conflict
+	}
+	if attrs, err := o.Attrs(ctx); err == nil {
+		conflict.ActualGeneration = attrs.Generation
+		conflict.Updated = attrs.Updated
+	}
+	log.Debugf("index conflict: %s", conflict)
+	return conflict
+}
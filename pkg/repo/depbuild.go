@@ -0,0 +1,236 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+// BuiltDependency is a dependency downloaded by BuildDependencies.
+type BuiltDependency struct {
+	Name       string `json:"name"`
+	Alias      string `json:"alias,omitempty"`
+	Version    string `json:"version"`
+	Repository string `json:"repository"`
+	// Path is the path of the downloaded chart.
+	Path string `json:"path"`
+}
+
+// BuildDependencies downloads the dependencies of the chart in chartDir into its charts/
+// directory, from the GCS repositories of Chart.yaml: gs:// URLs, or names of repositories
+// added to helm ("@name" or "alias:name"). It does not rely on helm downloader plugins,
+// whose support varies across helm versions.
+//
+// The versions pinned in Chart.lock are downloaded while it matches Chart.yaml, like
+// "helm dependency build". Otherwise, or with update, the version ranges of Chart.yaml are
+// resolved against the indexes and Chart.lock is written, like "helm dependency update".
+// Dependencies served by other repositories are rejected: use helm for them.
+// Like helm, a chart is downloaded once under its own name, even if several dependencies
+// refer to it with an alias, which helm applies when it loads the chart.
+// Chart.yaml and Chart.lock are read and written through the filesystem set by WithFS.
+func BuildDependencies(ctx context.Context, chartDir string, client *storage.Client, update bool, opts ...Option) ([]BuiltDependency, error) {
+	r := &Repo{}
+	for _, opt := range opts {
+		opt(r)
+	}
+	metadata, err := r.loadChartfile(filepath.Join(chartDir, chartutil.ChartfileName))
+	if err != nil {
+		return nil, err
+	}
+	if metadata.APIVersion == chart.APIVersionV1 {
+		return nil, fmt.Errorf("chart %s has apiVersion v1, its requirements.yaml is not supported", metadata.Name)
+	}
+	deps := metadata.Dependencies
+	if len(deps) == 0 {
+		return nil, nil
+	}
+	var notGCS []string
+	for _, dep := range deps {
+		if !isGCSDependency(dep.Repository) {
+			notGCS = append(notGCS, fmt.Sprintf("%s (%s)", dep.Name, dep.Repository))
+		}
+	}
+	if len(notGCS) > 0 {
+		return nil, fmt.Errorf("dependencies not served by GCS, use \"helm dependency build\": %s", strings.Join(notGCS, ", "))
+	}
+
+	lockPath := filepath.Join(chartDir, "Chart.lock")
+	previous, err := r.loadChartLock(lockPath)
+	if err != nil {
+		return nil, err
+	}
+	var pinned []*chart.Dependency
+	if !update {
+		if pinned, err = pinnedVersions(deps, previous); err != nil {
+			return nil, err
+		}
+	}
+	destination := filepath.Join(chartDir, "charts")
+	built, locked, err := downloadDependencies(ctx, deps, pinned, destination, client, opts)
+	if err != nil {
+		return nil, err
+	}
+	if pinned != nil {
+		// the locked versions were downloaded
+		return built, nil
+	}
+	if err := r.writeChartLock(lockPath, deps, locked); err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		return built, removeStaleDependencies(destination, previous.Dependencies, locked)
+	}
+	return built, nil
+}
+
+// pinnedVersions returns the dependencies locked by lock, in the order of the dependencies
+// deps of Chart.yaml, or nil if there is no lock or it doesn't match Chart.yaml anymore.
+func pinnedVersions(deps []*chart.Dependency, lock *chart.Lock) ([]*chart.Dependency, error) {
+	if lock == nil {
+		return nil, nil
+	}
+	digest, err := hashDependencies(deps, lock.Dependencies)
+	if err != nil {
+		return nil, errors.Wrap(err, "digest dependencies")
+	}
+	if digest != lock.Digest || len(lock.Dependencies) != len(deps) {
+		log.Debugf("Chart.lock is out of sync with Chart.yaml, dependencies are resolved again")
+		return nil, nil
+	}
+	return lock.Dependencies, nil
+}
+
+// downloadDependencies downloads the dependencies deps into destination, at the versions
+// pinned for each of them if any, or at the latest version of their range, and returns them
+// along with the dependencies to lock.
+func downloadDependencies(ctx context.Context, deps, pinned []*chart.Dependency, destination string, client *storage.Client, opts []Option) ([]BuiltDependency, []*chart.Dependency, error) {
+	repos := map[string]*Repo{}
+	downloaded := map[string]string{}
+	var built []BuiltDependency
+	var locked []*chart.Dependency
+	for n, dep := range deps {
+		r, ok := repos[dep.Repository]
+		if !ok {
+			var err error
+			if r, err = dependencyRepo(dep.Repository, client, opts); err != nil {
+				return nil, nil, errors.Wrapf(err, "dependency %s", dep.Name)
+			}
+			repos[dep.Repository] = r
+		}
+		version := dep.Version
+		if pinned != nil {
+			version = pinned[n].Version
+		}
+		cv, err := r.ResolveVersion(ctx, dep.Name, version, false)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "resolve dependency %s %s", dep.Name, version)
+		}
+		ref := cv.Name + "-" + cv.Version + "@" + dep.Repository
+		path, ok := downloaded[ref]
+		if !ok {
+			if path, err = r.FetchChart(ctx, cv.Name, cv.Version, false, destination); err != nil {
+				return nil, nil, errors.Wrapf(err, "download dependency %s-%s", cv.Name, cv.Version)
+			}
+			log.Debugf("dependency %s-%s downloaded to %s", cv.Name, cv.Version, path)
+			downloaded[ref] = path
+		}
+		built = append(built, BuiltDependency{Name: cv.Name, Alias: dep.Alias, Version: cv.Version, Repository: dep.Repository, Path: path})
+		locked = append(locked, &chart.Dependency{Name: dep.Name, Version: cv.Version, Repository: dep.Repository})
+	}
+	return built, locked, nil
+}
+
+// writeChartLock writes the Chart.lock file at path, locking the dependencies deps of
+// Chart.yaml to the versions of locked.
+func (r Repo) writeChartLock(path string, deps, locked []*chart.Dependency) error {
+	digest, err := hashDependencies(deps, locked)
+	if err != nil {
+		return errors.Wrap(err, "digest dependencies")
+	}
+	b, err := yaml.Marshal(&chart.Lock{Generated: time.Now(), Digest: digest, Dependencies: locked})
+	if err != nil {
+		return errors.Wrap(err, "marshal Chart.lock")
+	}
+	return errors.Wrap(r.files().WriteFile(path, b, 0o644), "write Chart.lock")
+}
+
+// isGCSDependency reports whether a dependency repository may be a GCS repository: a gs://
+// URL, or the name of a repository added to helm.
+func isGCSDependency(repository string) bool {
+	return strings.HasPrefix(repository, "gs://") || strings.HasPrefix(repository, "@") || strings.HasPrefix(repository, "alias:")
+}
+
+// dependencyRepo returns the GCS repository of a dependency: a gs:// URL, or a repository
+// added to helm.
+func dependencyRepo(repository string, client *storage.Client, opts []Option) (*Repo, error) {
+	if strings.HasPrefix(repository, "gs://") {
+		return New(repository, client, opts...)
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(repository, "@"), "alias:")
+	entry, err := retrieveRepositoryEntry(name)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(entry.URL, "gs://") {
+		return nil, fmt.Errorf("repository %s (%s) is not on GCS, use \"helm dependency build\"", name, entry.URL)
+	}
+	return newRepo(entry, client, opts)
+}
+
+// loadChartfile reads the Chart.yaml file at path.
+func (r Repo) loadChartfile(path string) (*chart.Metadata, error) {
+	b, err := r.files().ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read Chart.yaml")
+	}
+	metadata := &chart.Metadata{}
+	if err := yaml.Unmarshal(b, metadata); err != nil {
+		return nil, errors.Wrap(err, "parse Chart.yaml")
+	}
+	return metadata, nil
+}
+
+// loadChartLock reads the Chart.lock file at path, nil if it doesn't exist.
+func (r Repo) loadChartLock(path string) (*chart.Lock, error) {
+	b, err := r.files().ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "read Chart.lock")
+	}
+	lock := &chart.Lock{}
+	if err := yaml.Unmarshal(b, lock); err != nil {
+		return nil, errors.Wrap(err, "parse Chart.lock")
+	}
+	return lock, nil
+}
+
+// removeStaleDependencies deletes from dir the archives of the previously locked
+// dependencies whose version changed.
+func removeStaleDependencies(dir string, previous, locked []*chart.Dependency) error {
+	current := map[string]bool{}
+	for _, dep := range locked {
+		current[dep.Name+"-"+dep.Version] = true
+	}
+	for _, dep := range previous {
+		if current[dep.Name+"-"+dep.Version] {
+			continue
+		}
+		stale := filepath.Join(dir, dep.Name+"-"+dep.Version+".tgz")
+		if err := os.Remove(stale); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove stale dependency")
+		}
+	}
+	return nil
+}
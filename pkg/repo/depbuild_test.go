@@ -0,0 +1,75 @@
+package repo
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/chart"
+)
+
+func TestPinnedVersions(t *testing.T) {
+	deps := []*chart.Dependency{
+		{Name: "mychart", Version: "~0.1.0", Repository: "gs://bucket/repo", Alias: "old"},
+		{Name: "mychart", Version: "^0.2.0", Repository: "gs://bucket/repo", Alias: "new"},
+	}
+	locked := []*chart.Dependency{
+		{Name: "mychart", Version: "0.1.3", Repository: "gs://bucket/repo"},
+		{Name: "mychart", Version: "0.2.1", Repository: "gs://bucket/repo"},
+	}
+	digest, err := hashDependencies(deps, locked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock := &chart.Lock{Digest: digest, Dependencies: locked}
+
+	// the versions are pinned per dependency, not per chart
+	pinned, err := pinnedVersions(deps, lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pinned, locked) {
+		t.Errorf("pinnedVersions() = %v, want %v", pinned, locked)
+	}
+
+	changed := []*chart.Dependency{deps[0], {Name: "mychart", Version: "^0.2.0", Repository: "gs://bucket/repo", Alias: "renamed"}}
+	for name, tt := range map[string]struct {
+		deps []*chart.Dependency
+		lock *chart.Lock
+	}{
+		"no lock":            {deps: deps},
+		"alias changed":      {deps: changed, lock: lock},
+		"dependency removed": {deps: deps[:1], lock: lock},
+	} {
+		if pinned, err := pinnedVersions(tt.deps, tt.lock); err != nil || pinned != nil {
+			t.Errorf("%s: pinnedVersions() = %v, %v, want nothing pinned", name, pinned, err)
+		}
+	}
+}
+
+func TestChartLock(t *testing.T) {
+	r, err := New("gs://bucket/repo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "Chart.lock")
+	if lock, err := r.loadChartLock(path); err != nil || lock != nil {
+		t.Fatalf("loadChartLock() without Chart.lock = %v, %v", lock, err)
+	}
+
+	deps := []*chart.Dependency{{Name: "mychart", Version: "^0.2.0", Repository: "gs://bucket/repo", Alias: "new"}}
+	locked := []*chart.Dependency{{Name: "mychart", Version: "0.2.1", Repository: "gs://bucket/repo"}}
+	if err := r.writeChartLock(path, deps, locked); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := r.loadChartLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lock.Dependencies, locked) {
+		t.Errorf("locked dependencies = %v, want %v", lock.Dependencies, locked)
+	}
+	if pinned, err := pinnedVersions(deps, lock); err != nil || pinned == nil {
+		t.Errorf("pinnedVersions() of the written lock = %v, %v", pinned, err)
+	}
+}
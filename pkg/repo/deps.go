@@ -0,0 +1,70 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// checkDependencies verifies that the dependencies of the chart which are served by the
+// repository, or by one of the sibling repositories, exist in their index. The versions
+// pinned in Chart.lock are checked, or without Chart.lock, the version ranges of Chart.yaml.
+func (r Repo) checkDependencies(ctx context.Context, i *repo.IndexFile, c *chart.Chart) error {
+	deps := c.Metadata.Dependencies
+	if c.Lock != nil {
+		deps = c.Lock.Dependencies
+	}
+	if !r.checkDeps || len(deps) == 0 {
+		return nil
+	}
+
+	indexes := map[string]*repo.IndexFile{}
+	addIndex := func(entry *repo.Entry, url string, index *repo.IndexFile) {
+		indexes[strings.TrimSuffix(url, "/")] = index
+		if entry.Name != "" {
+			indexes["@"+entry.Name] = index
+			indexes["alias:"+entry.Name] = index
+		}
+	}
+	addIndex(r.entry, r.baseURL(), i)
+	for _, sibling := range r.siblingRepos {
+		s, err := loadSibling(sibling, r)
+		if err != nil {
+			return errors.Wrapf(err, "load sibling repository %s", sibling)
+		}
+		si, err := s.indexFile(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "load index file of sibling repository %s", sibling)
+		}
+		addIndex(s.entry, s.baseURL(), si)
+	}
+
+	missing := []string{}
+	for _, dep := range deps {
+		index, ok := indexes[strings.TrimSuffix(dep.Repository, "/")]
+		if !ok {
+			log.Debugf("dependency %s-%s is not served by a checked repository (%s)", dep.Name, dep.Version, dep.Repository)
+			continue
+		}
+		// Get matches exact versions as well as ranges such as "~1.2.0"
+		if _, err := index.Get(dep.Name, dep.Version); err != nil {
+			missing = append(missing, fmt.Sprintf("%s-%s (%s)", dep.Name, dep.Version, dep.Repository))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("chart %s-%s has dependencies missing from their repository: %s", c.Metadata.Name, c.Metadata.Version, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// loadSibling loads a repository given by its helm name or its gs:// URL.
+func loadSibling(nameOrURL string, r Repo) (*Repo, error) {
+	if strings.Contains(nameOrURL, "://") {
+		return New(nameOrURL, r.gcs)
+	}
+	return Load(nameOrURL, r.gcs)
+}
@@ -0,0 +1,68 @@
+package repo
+
+import (
+	"sort"
+
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// Kinds of differences between two indexes.
+const (
+	DiffOnlyInA        = "only-in-a"
+	DiffOnlyInB        = "only-in-b"
+	DiffDigestMismatch = "digest-mismatch"
+)
+
+// Difference describes a chart version which differs between two indexes.
+type Difference struct {
+	Chart   string
+	Version string
+	Kind    string
+	// DigestA and DigestB are the digests of the chart version in each index, if indexed.
+	DigestA string
+	DigestB string
+}
+
+// Diff compares the indexes a and b, e.g. of a repository and its mirror, and returns
+// the chart versions indexed by only one of them or with different digests, sorted by
+// chart name and version. URLs are not compared, as they differ between mirrors.
+func Diff(a, b *repo.IndexFile) []Difference {
+	digestsA, digestsB := indexDigests(a), indexDigests(b)
+	var diffs []Difference
+	for key, digestA := range digestsA {
+		digestB, ok := digestsB[key]
+		switch {
+		case !ok:
+			diffs = append(diffs, Difference{Chart: key.name, Version: key.version, Kind: DiffOnlyInA, DigestA: digestA})
+		case digestA != digestB:
+			diffs = append(diffs, Difference{Chart: key.name, Version: key.version, Kind: DiffDigestMismatch, DigestA: digestA, DigestB: digestB})
+		}
+	}
+	for key, digestB := range digestsB {
+		if _, ok := digestsA[key]; !ok {
+			diffs = append(diffs, Difference{Chart: key.name, Version: key.version, Kind: DiffOnlyInB, DigestB: digestB})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Chart != diffs[j].Chart {
+			return diffs[i].Chart < diffs[j].Chart
+		}
+		return diffs[i].Version < diffs[j].Version
+	})
+	return diffs
+}
+
+type chartVersionKey struct {
+	name    string
+	version string
+}
+
+func indexDigests(i *repo.IndexFile) map[chartVersionKey]string {
+	digests := map[chartVersionKey]string{}
+	for name, versions := range i.Entries {
+		for _, cv := range versions {
+			digests[chartVersionKey{name: name, version: cv.Version}] = cv.Digest
+		}
+	}
+	return digests
+}
@@ -0,0 +1,12 @@
+// Package repo manages Helm chart repositories stored on Google Cloud Storage.
+//
+// It can be used by Go programs to push and remove charts without the CLI:
+//
+//	client, err := gcs.NewClient(gcs.Auth{})
+//	...
+//	r, err := repo.NewWithEntry("gs://bucket/charts", "charts", client, repo.WithChecksums(true))
+//	...
+//	_, err = r.PushChart(ctx, "mychart-0.1.0.tgz", false, true, false, "", "", nil)
+//
+// Load looks repositories up in the helm repository config file instead.
+package repo
@@ -0,0 +1,519 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/repo"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// The tests below run against fake-gcs-server, in the emulator CI job, and are skipped
+// unless HELM_GCS_EMULATOR_HOST is set. Each test uses a repository of its own in the
+// bucket HELM_GCS_TEST_BUCKET, "charts" by default, which must exist.
+
+// emulatorRepo creates a new repository on the emulator.
+func emulatorRepo(t *testing.T, opts ...Option) *Repo {
+	t.Helper()
+	if os.Getenv(gcs.EmulatorHostEnv) == "" {
+		t.Skip("no GCS emulator, set " + gcs.EmulatorHostEnv)
+	}
+	client, err := gcs.NewClient(gcs.Auth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	name := strings.ToLower(strings.ReplaceAll(t.Name(), "/", "-"))
+	u := fmt.Sprintf("gs://%s/%s-%d", envOr("HELM_GCS_TEST_BUCKET", "charts"), name, time.Now().UnixNano())
+	r, err := New(u, client, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Create(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// reopen returns a new Repo for the repository of r, as another process would see it.
+func reopen(t *testing.T, r *Repo, opts ...Option) *Repo {
+	t.Helper()
+	other, err := New(r.URL(), r.gcs, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return other
+}
+
+// testChart packages a chart and returns the path of its archive.
+func testChart(t *testing.T, name, version string) string {
+	t.Helper()
+	c := &chart.Chart{Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: name, Version: version, Type: "application"}}
+	chartpath, err := chartutil.Save(c, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chartpath
+}
+
+func objectExists(t *testing.T, r *Repo, u string) bool {
+	t.Helper()
+	o, err := gcs.Object(r.gcs, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = o.Attrs(context.Background())
+	if err == storage.ErrObjectNotExist {
+		return false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+func listObjects(t *testing.T, r *Repo, dir string) []string {
+	t.Helper()
+	objects, err := gcs.ListObjects(context.Background(), r.gcs, r.baseURL()+dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, attrs := range objects {
+		names = append(names, attrs.Name)
+	}
+	return names
+}
+
+func indexedURLs(t *testing.T, r *Repo, name, version string) []string {
+	t.Helper()
+	i, err := reopen(t, r).indexFile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cv, err := i.Get(name, version)
+	if err != nil {
+		t.Fatalf("%s-%s not indexed: %s", name, version, err)
+	}
+	return cv.URLs
+}
+
+func TestEmulatorPushBucketPath(t *testing.T) {
+	tests := []struct {
+		name       string
+		bucketPath string
+		public     bool
+		publicURL  string
+		object     string
+		indexed    string
+	}{
+		{name: "root", object: "mychart-0.1.0.tgz", indexed: "{base}mychart-0.1.0.tgz"},
+		{name: "nested", bucketPath: "charts/stable", object: "charts/stable/mychart-0.1.0.tgz", indexed: "{base}charts/stable/mychart-0.1.0.tgz"},
+		{name: "public URL", bucketPath: "charts", public: true, publicURL: "https://charts.example.com", object: "charts/mychart-0.1.0.tgz", indexed: "https://charts.example.com/charts/mychart-0.1.0.tgz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := emulatorRepo(t)
+			ctx := context.Background()
+			if _, err := r.PushChart(ctx, testChart(t, "mychart", "0.1.0"), false, false, tt.public, tt.publicURL, tt.bucketPath, nil); err != nil {
+				t.Fatal(err)
+			}
+			if !objectExists(t, r, r.baseURL()+tt.object) {
+				t.Errorf("chart object %s not found", tt.object)
+			}
+			want := strings.ReplaceAll(tt.indexed, "{base}", r.baseURL())
+			if urls := indexedURLs(t, r, "mychart", "0.1.0"); len(urls) != 1 || urls[0] != want {
+				t.Errorf("indexed URLs = %q, want %q", urls, want)
+			}
+			if uploads := listObjects(t, r, uploadsDir); len(uploads) > 0 {
+				t.Errorf("temporary objects left: %q", uploads)
+			}
+		})
+	}
+}
+
+func TestEmulatorPushRollsBackIndex(t *testing.T) {
+	r := emulatorRepo(t)
+	ctx := context.Background()
+	if _, err := r.PushChart(ctx, testChart(t, "mychart", "0.1.0"), false, false, false, "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the chart object is written by another push between the index update and the move
+	chartpath := testChart(t, "mychart", "0.2.0")
+	c, err := loader.Load(chartpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := r.digestFile(chartpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chartBaseURL, urls, err := r.chartBaseURLs("", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := r.stageUpload(ctx, chartpath, chartBaseURL, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.addToIndexFile(ctx, i, u, c, urls, hash, false, false); err != nil {
+		t.Fatal(err)
+	}
+	o, err := gcs.Object(r.gcs, u.chartURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gcs.NewWriter(ctx, o)
+	if _, err := w.Write([]byte("concurrent")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.commitUpload(ctx, u)
+	if err == nil {
+		t.Fatal("chart moved over an object written concurrently")
+	}
+	if err := r.revertUploads(ctx, []*chartUpload{u}, err); err == nil {
+		t.Fatal("revertUploads() returned no error")
+	}
+	i, err = reopen(t, r).indexFile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i.Has("mychart", "0.2.0") {
+		t.Error("index entry of the chart not moved was not rolled back")
+	}
+	if !i.Has("mychart", "0.1.0") {
+		t.Error("index entry of another version removed by the rollback")
+	}
+	if uploads := listObjects(t, r, uploadsDir); len(uploads) > 0 {
+		t.Errorf("temporary objects left: %q", uploads)
+	}
+}
+
+func TestEmulatorFlatRepositoryReads(t *testing.T) {
+	r := emulatorRepo(t)
+	ctx := context.Background()
+	stats := NewStats()
+	pusher := reopen(t, r, WithStats(stats))
+	if _, err := pusher.PushChart(ctx, testChart(t, "mychart", "0.1.0"), false, false, false, "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if reads := stats.Operations()[OpIndexRead].Count; reads != 1 {
+		t.Errorf("push to a flat repository read %d index objects, want 1", reads)
+	}
+	if sharded, err := reopen(t, r).Sharded(ctx); err != nil || sharded {
+		t.Errorf("Sharded() = %t, %v, want false", sharded, err)
+	}
+}
+
+func TestEmulatorShardedPush(t *testing.T) {
+	r := emulatorRepo(t)
+	ctx := context.Background()
+	for _, name := range []string{"mychart", "other"} {
+		if _, err := r.PushChart(ctx, testChart(t, name, "0.1.0"), false, false, false, "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reopen(t, r).ShardIndex(ctx, true, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// another process only reads the shard of the chart it pushes
+	pusher := reopen(t, r)
+	if _, err := pusher.PushChart(ctx, testChart(t, "mychart", "0.2.0"), false, false, false, "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if pusher.shards.index == nil {
+		t.Fatal("push to a sharded repository wrote a flat index")
+	}
+	if len(pusher.shards.loaded) != 1 || !pusher.shards.loaded["mychart"] {
+		t.Errorf("shards read by the push: %v, want mychart only", pusher.shards.loaded)
+	}
+
+	i, err := reopen(t, r).indexFile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct{ name, version string }{{"mychart", "0.1.0"}, {"mychart", "0.2.0"}, {"other", "0.1.0"}} {
+		if !i.Has(v.name, v.version) {
+			t.Errorf("%s-%s not indexed", v.name, v.version)
+		}
+	}
+	if _, _, err := reopen(t, r).readFlatIndexBytes(ctx); err != errShardedLayout {
+		t.Errorf("index.yaml of a sharded repository read as flat: %v", err)
+	}
+}
+
+func TestEmulatorPushChartsConflict(t *testing.T) {
+	r := emulatorRepo(t)
+	ctx := context.Background()
+	stats := NewStats()
+	pusher := reopen(t, r, WithStats(stats))
+	charts, cleanup, err := pusher.loadCharts([]string{testChart(t, "mychart", "0.1.0"), testChart(t, "other", "0.1.0")})
+	defer cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chartBaseURL, urls, err := pusher.chartBaseURLs("", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := make([]*repo.IndexFile, 2)
+	for n := range stale {
+		if stale[n], err = pusher.shallowIndexFile(ctx, "mychart", "other"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cleanupStaged, err := pusher.checkCharts(ctx, stale[0], charts, chartBaseURL, false)
+	defer cleanupStaged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pusher.stageCharts(ctx, charts, chartBaseURL, nil, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// another push updates the index read by the batch push
+	if _, err := r.PushChart(ctx, testChart(t, "third", "0.1.0"), false, false, false, "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = pusher.addChartsToIndexFile(ctx, stale[0], charts, urls, false, false)
+	var conflict *IndexConflictError
+	if !errors.As(err, &conflict) || !errors.Is(err, ErrIndexOutOfDate) {
+		t.Fatalf("update of an index out of date: %v, want an IndexConflictError", err)
+	}
+	if conflict.ActualGeneration == conflict.ExpectedGeneration {
+		t.Errorf("conflict with the generation read: %s", conflict)
+	}
+	i, _, err := pusher.addChartsToIndexFile(ctx, stale[1], charts, urls, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pusher.commitCharts(ctx, i, charts); err != nil {
+		t.Fatal(err)
+	}
+	if conflicts := stats.Operations()[OpIndexConflict].Count; conflicts != 2 {
+		t.Errorf("index conflicts = %d, want 2", conflicts)
+	}
+
+	i, err = reopen(t, r).indexFile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"mychart", "other", "third"} {
+		if !i.Has(name, "0.1.0") {
+			t.Errorf("%s-0.1.0 not indexed", name)
+		}
+	}
+	if uploads := listObjects(t, r, uploadsDir); len(uploads) > 0 {
+		t.Errorf("temporary objects left: %q", uploads)
+	}
+}
+
+func TestEmulatorLockExtended(t *testing.T) {
+	const ttl = 3 * time.Second
+	r := emulatorRepo(t, WithLock(ttl))
+	ctx := context.Background()
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// held for longer than the TTL, the lock is extended and not stolen
+	time.Sleep(ttl + time.Second)
+	other := reopen(t, r, WithLock(ttl))
+	waitCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if unlockOther, err := other.lock(waitCtx); err == nil {
+		unlockOther()
+		t.Fatal("lock acquired while it is held")
+	}
+
+	unlock()
+	if objectExists(t, r, r.baseURL()+lockFileName) {
+		t.Fatal("lock not released")
+	}
+	unlockOther, err := other.lock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockOther()
+}
+
+func TestEmulatorLockStolen(t *testing.T) {
+	r := emulatorRepo(t, WithLock(time.Hour))
+	ctx := context.Background()
+	// a lock left by a crashed writer, which expired
+	o, err := gcs.Object(r.gcs, r.baseURL()+lockFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gcs.NewWriter(ctx, o)
+	if err := json.NewEncoder(w).Encode(lockHolder{Owner: "crashed/1", Expires: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	unlock, err := r.lock(waitCtx)
+	if err != nil {
+		t.Fatalf("expired lock not stolen: %s", err)
+	}
+	unlock()
+}
+
+func TestEmulatorContentAddressablePush(t *testing.T) {
+	r := emulatorRepo(t)
+	ctx := context.Background()
+	if _, err := r.ConvertToContentAddressable(ctx, false, false); err != nil {
+		t.Fatal(err)
+	}
+	chartpath := testChart(t, "mychart", "0.1.0")
+	hash, err := r.digestFile(chartpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// pushing the same content again stores nothing new
+	for _, force := range []bool{false, true} {
+		if _, err := reopen(t, r).PushChart(ctx, chartpath, force, false, false, "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := r.baseURL() + contentDir + "/" + hash + ".tgz"
+	if urls := indexedURLs(t, r, "mychart", "0.1.0"); len(urls) != 1 || urls[0] != want {
+		t.Errorf("indexed URLs = %q, want %q", urls, want)
+	}
+	if objects := listObjects(t, r, contentDir); len(objects) != 1 {
+		t.Errorf("chart objects = %q, want one", objects)
+	}
+	if uploads := listObjects(t, r, uploadsDir); len(uploads) > 0 {
+		t.Errorf("temporary objects left: %q", uploads)
+	}
+}
+
+func TestEmulatorConvertToContentAddressable(t *testing.T) {
+	r := emulatorRepo(t)
+	ctx := context.Background()
+	hashes := map[string]string{}
+	for _, version := range []string{"0.1.0", "0.2.0"} {
+		result, err := reopen(t, r).PushChart(ctx, testChart(t, "mychart", version), false, false, false, "", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes[version] = result.Digest
+	}
+
+	result, err := reopen(t, r).ConvertToContentAddressable(ctx, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Charts != 2 {
+		t.Errorf("charts copied = %d, want 2", result.Charts)
+	}
+	for version, hash := range hashes {
+		want := r.baseURL() + contentDir + "/" + hash + ".tgz"
+		if urls := indexedURLs(t, r, "mychart", version); len(urls) != 1 || urls[0] != want {
+			t.Errorf("indexed URLs of %s = %q, want %q", version, urls, want)
+		}
+		if objectExists(t, r, r.baseURL()+"mychart-"+version+".tgz") {
+			t.Errorf("object of %s not deleted", version)
+		}
+	}
+	policies, err := reopen(t, r).Policies(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies[PolicyLayout] != LayoutContentAddressable {
+		t.Errorf("layout policy = %q, want %q", policies[PolicyLayout], LayoutContentAddressable)
+	}
+
+	// converting again copies nothing
+	if result, err := reopen(t, r).ConvertToContentAddressable(ctx, true, false); err != nil || result.Charts != 0 {
+		t.Errorf("second conversion: %+v, %v, want no chart copied", result, err)
+	}
+	if objects := listObjects(t, r, contentDir); len(objects) != 2 {
+		t.Errorf("chart objects = %q, want two", objects)
+	}
+}
+
+func TestEmulatorBuildDependencies(t *testing.T) {
+	r := emulatorRepo(t)
+	ctx := context.Background()
+	for _, version := range []string{"0.1.0", "0.2.0"} {
+		if _, err := reopen(t, r).PushChart(ctx, testChart(t, "mychart", version), false, false, false, "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	chartDir := t.TempDir()
+	metadata := &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "app", Version: "1.0.0", Dependencies: []*chart.Dependency{
+		{Name: "mychart", Version: "~0.1.0", Repository: r.URL(), Alias: "old"},
+		{Name: "mychart", Version: "^0.2.0", Repository: r.URL(), Alias: "new"},
+		{Name: "mychart", Version: "^0.2.0", Repository: r.URL(), Alias: "again"},
+	}}
+	if err := chartutil.SaveChartfile(filepath.Join(chartDir, chartutil.ChartfileName), metadata); err != nil {
+		t.Fatal(err)
+	}
+	archives := func() []string {
+		matches, err := filepath.Glob(filepath.Join(chartDir, "charts", "*.tgz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := range matches {
+			matches[n] = filepath.Base(matches[n])
+		}
+		return matches
+	}
+	build := func(update bool, want ...string) {
+		t.Helper()
+		built, err := BuildDependencies(ctx, chartDir, r.gcs, update)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, dep := range built {
+			got = append(got, dep.Alias+"="+dep.Version)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("built dependencies = %q, want %q", got, want)
+		}
+	}
+
+	build(false, "old=0.1.0", "new=0.2.0", "again=0.2.0")
+	if got, want := archives(), []string{"mychart-0.1.0.tgz", "mychart-0.2.0.tgz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("archives = %q, want %q", got, want)
+	}
+
+	if _, err := reopen(t, r).PushChart(ctx, testChart(t, "mychart", "0.2.1"), false, false, false, "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	// the versions of Chart.lock are kept until an update
+	build(false, "old=0.1.0", "new=0.2.0", "again=0.2.0")
+	build(true, "old=0.1.0", "new=0.2.1", "again=0.2.1")
+	if got, want := archives(), []string{"mychart-0.1.0.tgz", "mychart-0.2.1.tgz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("archives after update = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,40 @@
+package repo
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNotFound matches, with errors.Is, the errors of repositories, charts and versions
+	// which don't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrInvalid matches, with errors.Is, the errors of charts and index files rejected by
+	// a validation: lint, digest, provenance or index checks.
+	ErrInvalid = errors.New("invalid")
+)
+
+// kindError is an error message matching one of the error kinds above with errors.Is.
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// notFoundf formats an error matching ErrNotFound.
+func notFoundf(format string, args ...interface{}) error {
+	return &kindError{kind: ErrNotFound, msg: fmt.Sprintf(format, args...)}
+}
+
+// invalidf formats an error matching ErrInvalid.
+func invalidf(format string, args ...interface{}) error {
+	return &kindError{kind: ErrInvalid, msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,91 @@
+package repo
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/repo"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// FetchChart downloads a chart of the repository into the directory dest
+// and returns the path of the downloaded file.
+// version can be a tag, an exact version or a semver constraint, see ResolveVersion.
+// The digest of the downloaded file is verified against the one recorded in the index.
+func (r Repo) FetchChart(ctx context.Context, name, version string, devel bool, dest string) (string, error) {
+	cv, err := r.ResolveVersion(ctx, name, version, devel)
+	if err != nil {
+		return "", err
+	}
+	if len(cv.URLs) == 0 {
+		return "", fmt.Errorf("chart %s-%s has no URL", cv.Name, cv.Version)
+	}
+	chartURL, err := r.objectURL(cv.URLs[0])
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return "", errors.Wrap(err, "create destination")
+	}
+	target := filepath.Join(dest, path.Base(chartURL))
+	log.Debugf("fetch chart %s-%s from %s to %s", cv.Name, cv.Version, chartURL, target)
+	if err := downloadVerified(ctx, r, chartURL, target, cv); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// objectURL returns the gs:// URL of a chart URL recorded in the index,
+// which can be relative to the repository or a public URL.
+func (r Repo) objectURL(chartURL string) (string, error) {
+	if u, ok := toGCSURL(chartURL); ok {
+		return u, nil
+	}
+	if strings.Contains(chartURL, "://") {
+		return "", fmt.Errorf("chart URL %s is not on GCS", chartURL)
+	}
+	return resolveReference(r.baseURL(), chartURL)
+}
+
+// downloadVerified downloads the object at chartURL to target, through a temporary
+// file which is only renamed to target once its digest matches the index entry.
+func downloadVerified(ctx context.Context, r Repo, chartURL, target string, cv *repo.ChartVersion) error {
+	reader, err := gcs.NewReader(ctx, r.gcs, chartURL)
+	if err != nil {
+		return errors.Wrap(err, "reader")
+	}
+	defer reader.Close()
+
+	f, err := os.CreateTemp(filepath.Dir(target), ".helm-gcs-*")
+	if err != nil {
+		return errors.Wrap(err, "create file")
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r.withProgress(reader, PhaseDownload, chartURL, ReaderSize(reader)))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "download")
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	if cv.Digest == "" {
+		log.Warnf("chart %s-%s has no digest in index, it can't be verified", cv.Name, cv.Version)
+	} else if digest != cv.Digest {
+		return invalidf("digest mismatch for chart %s-%s: index has %s, downloaded file has %s", cv.Name, cv.Version, cv.Digest, digest)
+	}
+	return errors.Wrap(os.Rename(f.Name(), target), "rename")
+}
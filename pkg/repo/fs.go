@@ -0,0 +1,83 @@
+package repo
+
+import (
+	"io/fs"
+	"os"
+
+	"helm.sh/helm/v3/pkg/provenance"
+)
+
+// FS is the local filesystem the charts to push, their provenance files and the helm
+// repository config are read from, and the charts repackaged by pushes are written to.
+// Paths are native paths of the platform, e.g. C:\charts\my-chart-1.0.0.tgz or UNC
+// paths on Windows.
+type FS interface {
+	Open(name string) (fs.File, error)
+	Stat(name string) (fs.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	MkdirTemp(dir, pattern string) (string, error)
+	RemoveAll(path string) error
+}
+
+// OSFS returns the filesystem of the operating system, the default one.
+func OSFS() FS {
+	return osFS{}
+}
+
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (osFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (osFS) MkdirTemp(dir, pattern string) (string, error) {
+	return os.MkdirTemp(dir, pattern)
+}
+
+func (osFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+// hostFS is the filesystem of the helm repository config, and of the repositories
+// created without WithFS.
+var hostFS = OSFS()
+
+// WithFS sets the filesystem the charts to push are read from, e.g. an in-memory one.
+// Unpackaged chart directories are loaded by helm from the filesystem of the operating
+// system, as are the charts sent by resumable uploads and signed with WithProvenanceSigning.
+func WithFS(fsys FS) Option {
+	return func(r *Repo) {
+		r.fsys = fsys
+	}
+}
+
+// files returns the filesystem the charts to push are read from.
+func (r Repo) files() FS {
+	if r.fsys != nil {
+		return r.fsys
+	}
+	return hostFS
+}
+
+// digestFile returns the SHA256 digest of the chart at path, like provenance.DigestFile.
+func (r Repo) digestFile(path string) (string, error) {
+	f, err := r.files().Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return provenance.Digest(f)
+}
@@ -0,0 +1,71 @@
+package repo
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// helmEnvTimeout bounds how long the helm binary is asked for its configuration.
+const helmEnvTimeout = 5 * time.Second
+
+// repositoryConfigPaths returns the helm repository config files to look repositories up in.
+//
+// Helm 3 and helm 4 share the format of the file, and both set HELM_REPOSITORY_CONFIG when
+// running plugins, so "helm gcs" uses the file of the helm running it. Otherwise, e.g. when
+// helm-gcs is run on its own, the file of the helm config home is used, which honors
+// HELM_CONFIG_HOME and XDG_CONFIG_HOME like helm. If it doesn't exist, the helm binary of
+// HELM_BIN or the PATH, of either major version, is asked where its file is.
+func repositoryConfigPaths() []string {
+	if v, ok := os.LookupEnv("HELM_REPOSITORY_CONFIG"); ok {
+		return filepath.SplitList(v)
+	}
+	path := helmpath.ConfigPath("repositories.yaml")
+	if _, err := hostFS.Stat(path); err == nil {
+		return []string{path}
+	}
+	if p := helmEnv("HELM_REPOSITORY_CONFIG"); p != "" && p != path {
+		log.Debugf("helm repo file of %s: %s", helmBinary(), p)
+		return []string{p}
+	}
+	return []string{path}
+}
+
+// loadRepositoryFile loads the helm repository config file at path, like repo.LoadFile.
+func loadRepositoryFile(path string) (*repo.File, error) {
+	b, err := hostFS.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't load repositories file (%s)", path)
+	}
+	f := &repo.File{}
+	if err := yaml.Unmarshal(b, f); err != nil {
+		return nil, errors.Wrapf(err, "parse repositories file %s", path)
+	}
+	return f, nil
+}
+
+// helmBinary returns the helm binary: the one running the plugin, or helm on the PATH.
+func helmBinary() string {
+	return envOr("HELM_BIN", "helm")
+}
+
+// helmEnv returns the value of the helm environment variable name, as resolved by
+// "helm env" with the configuration of the user, or "" if helm can't be run.
+func helmEnv(name string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), helmEnvTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, helmBinary(), "env", name).Output()
+	if err != nil {
+		log.Debugf("run %s env: %s", helmBinary(), err)
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,178 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/repo"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// htmlIndexFile is the name of the HTML page listing the charts, next to the index file.
+const htmlIndexFile = "index.html"
+
+// HTMLOptions configures the HTML page rendered by PublishHTML.
+type HTMLOptions struct {
+	// Title of the page, the name of the repository by default.
+	Title string
+	// Name is the name of the repository in the install snippets, the name of the
+	// repository in helm by default.
+	Name string
+	// URL is the URL of the repository in the "helm repo add" snippet, its gs:// URL by default.
+	URL string
+}
+
+// htmlChart is a chart listed by the HTML page, with its versions newest first.
+type htmlChart struct {
+	Name        string
+	Description string
+	Icon        string
+	Latest      *repo.ChartVersion
+	Versions    []htmlVersion
+}
+
+type htmlVersion struct {
+	Version    string
+	AppVersion string
+	Created    time.Time
+	// Link is a browsable URL of the chart archive.
+	Link string
+}
+
+var htmlTemplate = template.Must(template.New(htmlIndexFile).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body{font-family:sans-serif;max-width:960px;margin:2em auto;padding:0 1em;color:#222}
+pre{background:#f4f4f4;padding:.6em;overflow-x:auto}
+.chart{border:1px solid #ddd;border-radius:6px;padding:1em;margin:1em 0}
+.chart img{width:48px;height:48px;float:right}
+table{border-collapse:collapse}td,th{padding:.2em .8em;text-align:left}
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<pre>helm repo add {{.Name}} {{.URL}}</pre>
+<p>{{len .Charts}} charts, generated {{.Generated.Format "2006-01-02 15:04 MST"}}.</p>
+{{- range .Charts}}
+<div class="chart" id="{{.Name}}">
+{{- if .Icon}}<img src="{{.Icon}}" alt="">{{end}}
+<h2>{{.Name}}</h2>
+<p>{{.Description}}</p>
+<pre>helm install {{.Name}} {{$.Name}}/{{.Name}} --version {{.Latest.Version}}</pre>
+<details><summary>{{len .Versions}} versions</summary>
+<table>
+<tr><th>Version</th><th>App version</th><th>Created</th></tr>
+{{- range .Versions}}
+<tr><td>{{if .Link}}<a href="{{.Link}}">{{.Version}}</a>{{else}}{{.Version}}{{end}}</td><td>{{.AppVersion}}</td><td>{{if not .Created.IsZero}}{{.Created.Format "2006-01-02"}}{{end}}</td></tr>
+{{- end}}
+</table>
+</details>
+</div>
+{{- end}}
+</body>
+</html>
+`))
+
+// PublishHTML renders the index of the repository into a static HTML page, listing the charts
+// with their versions and install snippets, and uploads it as index.html next to the index file,
+// for public repositories to be browsed. It returns the URL of the page.
+func (r Repo) PublishHTML(ctx context.Context, opts HTMLOptions) (string, error) {
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "load index file")
+	}
+	if opts.Name == "" {
+		opts.Name = r.Name()
+	}
+	if opts.Name == "" {
+		opts.Name = "my-repo"
+	}
+	if opts.Title == "" {
+		opts.Title = opts.Name + " Helm charts"
+	}
+	if opts.URL == "" {
+		opts.URL = r.URL()
+	}
+	b, err := renderHTML(i, opts)
+	if err != nil {
+		return "", err
+	}
+
+	pageURL, err := resolveReference(r.baseURL(), htmlIndexFile)
+	if err != nil {
+		return "", errors.Wrap(err, "resolve reference")
+	}
+	log.Debugf("upload HTML index %s", pageURL)
+	o, err := gcs.Object(r.gcs, pageURL)
+	if err != nil {
+		return "", errors.Wrap(err, "object")
+	}
+	w := gcs.NewWriter(ctx, o)
+	w.CacheControl = "no-cache, max-age=0"
+	w.ContentType = "text/html; charset=utf-8"
+	if _, err := w.Write(b); err != nil {
+		return "", errors.Wrap(err, "write")
+	}
+	if err := w.Close(); err != nil {
+		return "", errors.Wrap(err, "close HTML index")
+	}
+	return pageURL, nil
+}
+
+// renderHTML renders the HTML page of the index i.
+func renderHTML(i *repo.IndexFile, opts HTMLOptions) ([]byte, error) {
+	i.SortEntries()
+	names := make([]string, 0, len(i.Entries))
+	for name := range i.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	charts := make([]htmlChart, 0, len(names))
+	for _, name := range names {
+		versions := i.Entries[name]
+		if len(versions) == 0 {
+			continue
+		}
+		latest := versions[0]
+		c := htmlChart{Name: name, Description: latest.Description, Icon: latest.Icon, Latest: latest}
+		for _, cv := range versions {
+			v := htmlVersion{Version: cv.Version, AppVersion: cv.AppVersion, Created: cv.Created}
+			if len(cv.URLs) > 0 {
+				v.Link = browsableURL(cv.URLs[0])
+			}
+			c.Versions = append(c.Versions, v)
+		}
+		charts = append(charts, c)
+	}
+
+	var buf bytes.Buffer
+	err := htmlTemplate.Execute(&buf, struct {
+		HTMLOptions
+		Charts    []htmlChart
+		Generated time.Time
+	}{opts, charts, time.Now()})
+	return buf.Bytes(), errors.Wrap(err, "render HTML index")
+}
+
+// browsableURL returns the URL of a chart for browsers: gs:// URLs are served by
+// storage.googleapis.com, relative URLs are relative to the page.
+func browsableURL(chartURL string) string {
+	if !strings.HasPrefix(chartURL, "gs://") && !strings.HasPrefix(chartURL, "gcs://") {
+		return chartURL
+	}
+	u, err := getURL(chartURL, true, "")
+	if err != nil {
+		return ""
+	}
+	return u
+}
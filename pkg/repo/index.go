@@ -0,0 +1,160 @@
+package repo
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// IndexDirectory generates an index file for the chart archives (*.tgz) of a local
+// directory, the same way "helm repo index" does, with URLs relative to baseURL.
+func IndexDirectory(dir, baseURL string) (*repo.IndexFile, error) {
+	i, err := repo.IndexDirectory(dir, baseURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "index directory")
+	}
+	i.SortEntries()
+	return i, nil
+}
+
+// Index returns the index file of the repository.
+func (r Repo) Index(ctx context.Context) (*repo.IndexFile, error) {
+	return r.indexFile(ctx)
+}
+
+// MergeDirectory indexes the chart archives of a local directory and merges them into
+// the index of the repository, like "helm repo index --merge" does: entries of the
+// local charts replace the existing ones with the same name and version.
+// Charts are indexed with URLs relative to baseURL, or to the repository when empty.
+// The charts are uploaded into the repository first if upload is true.
+// The index is updated under the generation precondition, see PushChart for retry.
+func (r Repo) MergeDirectory(ctx context.Context, dir, baseURL string, upload, retry bool) error {
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if baseURL == "" {
+		baseURL = strings.TrimSuffix(r.baseURL(), "/")
+	}
+	local, err := IndexDirectory(dir, baseURL)
+	if err != nil {
+		return err
+	}
+
+	if upload {
+		files, err := filepath.Glob(filepath.Join(dir, "*.tgz"))
+		if err != nil {
+			return errors.Wrap(err, "list charts")
+		}
+		nested, err := filepath.Glob(filepath.Join(dir, "**/*.tgz"))
+		if err != nil {
+			return errors.Wrap(err, "list charts")
+		}
+		for _, f := range append(files, nested...) {
+			rel, err := filepath.Rel(dir, f)
+			if err != nil {
+				return errors.Wrap(err, "relative path")
+			}
+			chartBaseURL, err := resolveReference(r.baseURL(), path.Dir(filepath.ToSlash(rel)))
+			if err != nil {
+				return errors.Wrap(err, "resolve reference")
+			}
+			log.Debugf("upload %s to %s", f, chartBaseURL)
+			// local charts win over remote ones, see below
+			if err := r.uploadChart(ctx, f, chartBaseURL, nil, true); err != nil {
+				return errors.Wrapf(err, "upload %s", f)
+			}
+		}
+	}
+
+	// local charts win over remote ones
+	_, err = r.mergeIndex(ctx, local, true, retry)
+	return err
+}
+
+// MergeIndex merges the entries of the index of another Helm repository into the index of
+// the repository, to absorb charts hosted elsewhere, like "helm repo index --merge" does:
+// versions already indexed by the repository are kept, the other ones are added.
+// Relative chart URLs of other are resolved against urlPrefix, the URL the other index is
+// served from, and can't be merged without it. It returns the number of versions added.
+// The index is updated under the generation precondition, see PushChart for retry.
+func (r Repo) MergeIndex(ctx context.Context, other *repo.IndexFile, urlPrefix string, retry bool) (int, error) {
+	if err := resolveChartURLs(other, urlPrefix); err != nil {
+		return 0, err
+	}
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	return r.mergeIndex(ctx, other, false, retry)
+}
+
+// mergeIndex merges the index i into the index of the repository, its versions replacing
+// the indexed ones with replace, and returns the number of versions of i which were not
+// indexed.
+func (r Repo) mergeIndex(ctx context.Context, i *repo.IndexFile, replace, retry bool) (int, error) {
+	for {
+		remote, err := r.indexFile(ctx)
+		if err != nil {
+			return 0, errors.Wrap(err, "load index file")
+		}
+		added := 0
+		for name, versions := range i.Entries {
+			for _, cv := range versions {
+				if !remote.Has(name, cv.Version) {
+					added++
+				}
+			}
+		}
+		merged := repo.NewIndexFile()
+		merged.Annotations = remote.Annotations
+		if replace {
+			merged.Merge(i)
+			merged.Merge(remote)
+		} else {
+			merged.Merge(remote)
+			merged.Merge(i)
+		}
+		merged.SortEntries()
+
+		err = r.uploadIndexFile(ctx, merged)
+		if errors.Is(err, ErrIndexOutOfDate) && retry {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return added, r.updateChecksums(ctx, merged)
+	}
+}
+
+// resolveChartURLs resolves the relative chart URLs of the index i against urlPrefix.
+func resolveChartURLs(i *repo.IndexFile, urlPrefix string) error {
+	for _, versions := range i.Entries {
+		for _, cv := range versions {
+			for n, u := range cv.URLs {
+				parsed, err := url.Parse(u)
+				if err != nil {
+					return invalidf("chart %s-%s has an invalid URL %q", cv.Name, cv.Version, u)
+				}
+				if parsed.IsAbs() {
+					continue
+				}
+				if urlPrefix == "" {
+					return invalidf("chart %s-%s has a relative URL %q, set the URL prefix of the index to merge", cv.Name, cv.Version, u)
+				}
+				if cv.URLs[n], err = resolveReference(urlPrefix, u); err != nil {
+					return errors.Wrap(err, "resolve reference")
+				}
+			}
+		}
+	}
+	return nil
+}
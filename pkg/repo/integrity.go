@@ -0,0 +1,80 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5" //nolint:gosec // checksum computed by GCS, not used for security
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+)
+
+// checkUploadIntegrity compares the CRC32C and MD5 checksums computed by GCS for an
+// uploaded chart with the ones of the local file, to detect a corruption on the way.
+// Composite objects have no MD5, only their CRC32C is compared.
+func (r Repo) checkUploadIntegrity(attrs *storage.ObjectAttrs, chartpath string) error {
+	if attrs == nil || (attrs.CRC32C == 0 && len(attrs.MD5) == 0) {
+		return nil
+	}
+	f, err := r.files().Open(chartpath)
+	if err != nil {
+		return errors.Wrap(err, "open")
+	}
+	defer f.Close()
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	sum := md5.New() //nolint:gosec
+	if _, err := io.Copy(io.MultiWriter(crc, sum), f); err != nil {
+		return errors.Wrap(err, "checksum")
+	}
+	object := fmt.Sprintf("gs://%s/%s", attrs.Bucket, attrs.Name)
+	if crc.Sum32() != attrs.CRC32C {
+		return fmt.Errorf("uploaded chart %s is corrupted (CRC32C mismatch), push it again with --force", object)
+	}
+	if len(attrs.MD5) > 0 && !bytes.Equal(sum.Sum(nil), attrs.MD5) {
+		return fmt.Errorf("uploaded chart %s is corrupted (MD5 mismatch), push it again with --force", object)
+	}
+	log.Debugf("checksums of %s match the local file", object)
+	return nil
+}
+
+// VerifyCharts downloads the chart objects of the indexed versions of a chart, all of them
+// if version is empty, and compares their digest with the one recorded in the index,
+// to detect corrupted or tampered charts.
+func (r Repo) VerifyCharts(ctx context.Context, name, version string) ([]VerifyResult, error) {
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "load index file")
+	}
+	versions, ok := i.Entries[name]
+	if !ok {
+		return nil, notFoundf("chart %q not found", name)
+	}
+	var results []VerifyResult
+	for _, cv := range versions {
+		if version != "" && cv.Version != version {
+			continue
+		}
+		for n, u := range cv.URLs {
+			// mirrors not on GCS, e.g. a CDN, can't be verified
+			if _, onGCS := toGCSURL(u); n > 0 && !onGCS {
+				continue
+			}
+			result := VerifyResult{File: u, Chart: cv.Name, Version: cv.Version, Expected: cv.Digest}
+			objectURL, err := r.objectURL(u)
+			if err != nil {
+				result.Err = err
+			} else {
+				result.File = objectURL
+				result.Actual, result.Err = r.digestObject(ctx, objectURL)
+			}
+			results = append(results, result)
+		}
+	}
+	if len(results) == 0 {
+		return nil, notFoundf("chart %s-%s not found", name, version)
+	}
+	return results, nil
+}
@@ -0,0 +1,133 @@
+package repo
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256" // hash functions of KMS algorithms
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+// SignatureKMS signs with a Cloud KMS asymmetric key, so the private key never leaves KMS.
+const SignatureKMS = "kms"
+
+// kmsKey signs and verifies with a Cloud KMS asymmetric key version,
+// e.g. "projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1".
+// Signatures are base64 encoded, like cosign ones.
+type kmsKey struct {
+	service *cloudkms.Service
+	name    string
+	public  *cloudkms.PublicKey
+}
+
+func newKMSKey(name string, opts ...option.ClientOption) (*kmsKey, error) {
+	if !strings.Contains(name, "/cryptoKeyVersions/") {
+		return nil, fmt.Errorf("invalid KMS key %q, should be the resource name of a key version", name)
+	}
+	service, err := cloudkms.NewService(context.Background(), opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "new KMS service")
+	}
+	return &kmsKey{service: service, name: name}, nil
+}
+
+// publicKey returns the public key of the key version, fetched once.
+func (k *kmsKey) publicKey(ctx context.Context) (*cloudkms.PublicKey, error) {
+	if k.public != nil {
+		return k.public, nil
+	}
+	versions := k.service.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions
+	public, err := versions.GetPublicKey(k.name).Context(ctx).Do()
+	if err != nil {
+		return nil, errors.Wrap(err, "get KMS public key")
+	}
+	k.public = public
+	return public, nil
+}
+
+// digest hashes b with the hash function of the algorithm of the key.
+func (k *kmsKey) digest(ctx context.Context, b []byte) (crypto.Hash, []byte, error) {
+	public, err := k.publicKey(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	var h crypto.Hash
+	switch {
+	case strings.HasSuffix(public.Algorithm, "_SHA256"):
+		h = crypto.SHA256
+	case strings.HasSuffix(public.Algorithm, "_SHA384"):
+		h = crypto.SHA384
+	case strings.HasSuffix(public.Algorithm, "_SHA512"):
+		h = crypto.SHA512
+	default:
+		return 0, nil, fmt.Errorf("unsupported KMS key algorithm %s", public.Algorithm)
+	}
+	hasher := h.New()
+	hasher.Write(b)
+	return h, hasher.Sum(nil), nil
+}
+
+func (k *kmsKey) Sign(ctx context.Context, b []byte) ([]byte, error) {
+	h, digest, err := k.digest(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(digest)
+	d := &cloudkms.Digest{}
+	switch h {
+	case crypto.SHA256:
+		d.Sha256 = encoded
+	case crypto.SHA384:
+		d.Sha384 = encoded
+	default:
+		d.Sha512 = encoded
+	}
+	versions := k.service.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions
+	resp, err := versions.AsymmetricSign(k.name, &cloudkms.AsymmetricSignRequest{Digest: d}).Context(ctx).Do()
+	if err != nil {
+		return nil, errors.Wrap(err, "KMS asymmetric sign")
+	}
+	return []byte(resp.Signature), nil
+}
+
+func (k *kmsKey) Verify(ctx context.Context, b, signature []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return errors.Wrap(err, "decode signature")
+	}
+	h, digest, err := k.digest(ctx, b)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode([]byte(k.public.Pem))
+	if block == nil {
+		return errors.New("invalid KMS public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return errors.Wrap(err, "parse KMS public key")
+	}
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if strings.Contains(k.public.Algorithm, "_PSS_") {
+			return rsa.VerifyPSS(key, h, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		return rsa.VerifyPKCS1v15(key, h, digest, sig)
+	}
+	return fmt.Errorf("unsupported KMS public key %T", key)
+}
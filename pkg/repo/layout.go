@@ -0,0 +1,254 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	"helm.sh/helm/v3/pkg/repo"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// Content-addressable layout.
+//
+// Repositories with the layout policy set to "content-addressable" store the charts under
+// charts/<sha256>.tgz, named after their digest, and index them at this path. Pushing a chart
+// whose content is already stored uploads nothing, and versions with identical content share
+// their object, which is only deleted along with the last version referencing it.
+const (
+	// PolicyLayout controls where pushed charts are stored: "flat" (default) or "content-addressable".
+	PolicyLayout = "layout"
+
+	LayoutFlat               = "flat"
+	LayoutContentAddressable = "content-addressable"
+
+	// contentDir is the directory of the charts of a content-addressable repository.
+	contentDir = "charts"
+)
+
+// useLayout sets the layout of r from the policy of the index i, and returns the bucket path
+// charts are pushed under: the charts/ directory of a content-addressable repository, where
+// no other bucket path can be set.
+func (r *Repo) useLayout(i *repo.IndexFile, bucketPath string) (string, error) {
+	r.contentAddressable = indexPolicy(i, PolicyLayout) == LayoutContentAddressable
+	if !r.contentAddressable {
+		return bucketPath, nil
+	}
+	if p := strings.Trim(bucketPath, "/"); p != "" && p != contentDir {
+		return "", fmt.Errorf("charts of a content-addressable repository are stored under %s/, a bucket path can't be set", contentDir)
+	}
+	return contentDir, nil
+}
+
+// stageChart returns the path of the chart to upload: in a content-addressable repository,
+// a copy of the chart named after its digest, with its provenance file.
+func (r Repo) stageChart(chartpath, hash string) (string, func(), error) {
+	if !r.contentAddressable {
+		return chartpath, func() {}, nil
+	}
+	dir, err := r.files().MkdirTemp("", "helm-gcs-")
+	if err != nil {
+		return "", func() {}, errors.Wrap(err, "create temporary directory")
+	}
+	cleanup := func() { r.files().RemoveAll(dir) }
+	staged := filepath.Join(dir, hash+".tgz")
+	if err := r.copyFile(chartpath, staged); err != nil {
+		cleanup()
+		return "", func() {}, errors.Wrap(err, "copy chart")
+	}
+	if err := r.copyFile(chartpath+provSuffix, staged+provSuffix); err != nil && !os.IsNotExist(err) {
+		cleanup()
+		return "", func() {}, errors.Wrap(err, "copy provenance file")
+	}
+	log.Debugf("chart %s staged as %s", chartpath, filepath.Base(staged))
+	return staged, cleanup, nil
+}
+
+func (r Repo) copyFile(src, dst string) error {
+	b, err := r.files().ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return r.files().WriteFile(dst, b, 0o644)
+}
+
+// unreferenced returns the versions removed from the index i whose chart object isn't
+// referenced by another version of i, and can be deleted.
+func (r Repo) unreferenced(i *repo.IndexFile, removed repo.ChartVersions) repo.ChartVersions {
+	referenced := map[string]bool{}
+	for _, vs := range i.Entries {
+		for _, cv := range vs {
+			if objects := r.chartObjects(cv); len(objects) > 0 {
+				referenced[objects[0]] = true
+			}
+		}
+	}
+	var versions repo.ChartVersions
+	for _, cv := range removed {
+		if objects := r.chartObjects(cv); len(objects) > 0 && referenced[objects[0]] {
+			log.Debugf("chart object of %s-%s is still referenced, it is kept", cv.Name, cv.Version)
+			continue
+		}
+		versions = append(versions, cv)
+	}
+	return versions
+}
+
+// ConvertToContentAddressable converts the repository to the content-addressable layout:
+// the charts are copied server-side under charts/<sha256>.tgz, with their provenance and
+// signature files, then the index entries are rewritten to point to the copies and the layout
+// policy is set, so later pushes use the layout too. URLs keep their form: relative, gs:// or
+// public https:// URLs. With deleteOld, the original objects inside the repository are deleted
+// once the index is updated. With retry, the index is updated again if it changed meanwhile.
+func (r Repo) ConvertToContentAddressable(ctx context.Context, deleteOld, retry bool) (*MigrateResult, error) {
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "load index file")
+	}
+
+	copies, result, err := r.copyToContentAddresses(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	if i, err = r.useContentAddresses(ctx, i, copies, retry); err != nil {
+		return nil, errors.Wrap(err, "update index file")
+	}
+	if deleteOld {
+		if err := r.deleteCopiedCharts(ctx, copies); err != nil {
+			return nil, err
+		}
+	}
+	return result, r.updateChecksums(ctx, i)
+}
+
+// copyToContentAddresses copies the charts of the index i to their content-addressed object,
+// and returns the object URL of the charts copied, mapped to the URL of their copy.
+func (r Repo) copyToContentAddresses(ctx context.Context, i *repo.IndexFile) (map[string]string, *MigrateResult, error) {
+	copies := map[string]string{}
+	result := &MigrateResult{}
+	for _, versions := range i.Entries {
+		for _, cv := range versions {
+			if len(cv.URLs) == 0 {
+				continue
+			}
+			if cv.Digest == "" {
+				return nil, nil, fmt.Errorf("chart %s-%s has no digest in index, it can't be stored by content", cv.Name, cv.Version)
+			}
+			src, err := r.objectURL(cv.URLs[0])
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "chart %s-%s", cv.Name, cv.Version)
+			}
+			dst := r.baseURL() + contentDir + "/" + cv.Digest + ".tgz"
+			if src == dst || copies[src] != "" {
+				continue
+			}
+			size, err := r.copyChartObjects(ctx, src, dst)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "copy chart %s-%s", cv.Name, cv.Version)
+			}
+			copies[src] = dst
+			result.Charts++
+			result.Bytes += size
+		}
+	}
+	return copies, result, nil
+}
+
+// useContentAddresses points the entries of the index i to the copies of their chart, sets
+// the layout policy and uploads the index. With retry, the index is reloaded and updated
+// again if it changed meanwhile: charts pushed meanwhile are left in the flat layout.
+func (r *Repo) useContentAddresses(ctx context.Context, i *repo.IndexFile, copies map[string]string, retry bool) (*repo.IndexFile, error) {
+	for {
+		for _, versions := range i.Entries {
+			for _, cv := range versions {
+				if len(cv.URLs) == 0 {
+					continue
+				}
+				// mirror URLs, after the first one, are kept as they are
+				if src, err := r.objectURL(cv.URLs[0]); err == nil && copies[src] != "" {
+					cv.URLs[0] = r.rewriteChartURL(cv.URLs[0], src, copies[src])
+				}
+			}
+		}
+		if i.Annotations == nil {
+			i.Annotations = map[string]string{}
+		}
+		i.Annotations[policyAnnotationPrefix+PolicyLayout] = LayoutContentAddressable
+		err := r.uploadIndexFile(ctx, i)
+		if !errors.Is(err, ErrIndexOutOfDate) || !retry {
+			return i, err
+		}
+		if i, err = r.indexFile(ctx); err != nil {
+			return nil, errors.Wrap(err, "load index file")
+		}
+	}
+}
+
+// deleteCopiedCharts deletes the objects of the charts copied to their content address,
+// with their provenance and signature files. Charts served from outside the repository are
+// left alone.
+func (r Repo) deleteCopiedCharts(ctx context.Context, copies map[string]string) error {
+	failures := &DeleteError{Failures: map[string]error{}}
+	for src := range copies {
+		if !strings.HasPrefix(src, r.baseURL()) {
+			continue
+		}
+		for _, u := range []string{src, src + provSuffix, src + signatureSuffix} {
+			if err := r.deleteObject(ctx, u); err != nil {
+				failures.Failures[u] = err
+			}
+		}
+	}
+	if len(failures.Failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+// copyChartObjects copies the chart object at src to dst, with its provenance and signature
+// files if they exist, and returns the size of the chart. A copy which already exists is kept:
+// it has the same content.
+func (r Repo) copyChartObjects(ctx context.Context, src, dst string) (int64, error) {
+	var size int64
+	for n, suffix := range []string{"", provSuffix, signatureSuffix} {
+		attrs, err := gcs.CopyIfNotExist(ctx, r.gcs, src+suffix, dst+suffix)
+		switch {
+		case isPreconditionFailed(err):
+			log.Debugf("%s already exists", dst+suffix)
+		case n > 0 && isNotFound(err):
+			// no provenance or signature file
+		case err != nil:
+			return 0, err
+		case n == 0:
+			size = attrs.Size
+		}
+	}
+	return size, nil
+}
+
+func isNotFound(err error) bool {
+	var gerr *googleapi.Error
+	return errors.Is(err, storage.ErrObjectNotExist) || (errors.As(err, &gerr) && gerr.Code == http.StatusNotFound)
+}
+
+// rewriteChartURL rewrites the index URL of the chart object src to point to dst, keeping
+// its form. URLs of objects outside the repository are replaced with the gs:// URL of dst.
+func (r Repo) rewriteChartURL(chartURL, src, dst string) string {
+	rel, ok := strings.CutPrefix(src, r.baseURL())
+	if !ok || !strings.HasSuffix(chartURL, rel) {
+		return dst
+	}
+	return strings.TrimSuffix(chartURL, rel) + strings.TrimPrefix(dst, r.baseURL())
+}
@@ -0,0 +1,28 @@
+package repo
+
+import "testing"
+
+func TestRewriteChartURL(t *testing.T) {
+	r, err := New("gs://bucket/repo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := "gs://bucket/repo/charts/abc.tgz"
+	tests := []struct {
+		chartURL string
+		src      string
+		want     string
+	}{
+		{chartURL: "gs://bucket/repo/mychart-0.1.0.tgz", src: "gs://bucket/repo/mychart-0.1.0.tgz", want: dst},
+		{chartURL: "gs://bucket/repo/stable/mychart-0.1.0.tgz", src: "gs://bucket/repo/stable/mychart-0.1.0.tgz", want: dst},
+		{chartURL: "mychart-0.1.0.tgz", src: "gs://bucket/repo/mychart-0.1.0.tgz", want: "charts/abc.tgz"},
+		{chartURL: "https://storage.googleapis.com/bucket/repo/mychart-0.1.0.tgz", src: "gs://bucket/repo/mychart-0.1.0.tgz", want: "https://storage.googleapis.com/bucket/repo/charts/abc.tgz"},
+		{chartURL: "https://charts.example.com/stable/mychart-0.1.0.tgz", src: "gs://bucket/repo/stable/mychart-0.1.0.tgz", want: "https://charts.example.com/charts/abc.tgz"},
+		{chartURL: "gs://other/mychart-0.1.0.tgz", src: "gs://other/mychart-0.1.0.tgz", want: dst},
+	}
+	for _, tt := range tests {
+		if got := r.rewriteChartURL(tt.chartURL, tt.src, dst); got != tt.want {
+			t.Errorf("rewriteChartURL(%q, %q) = %q, want %q", tt.chartURL, tt.src, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package repo
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/lint"
+	"helm.sh/helm/v3/pkg/lint/support"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// PolicyLint makes pushes lint the charts, like "helm lint": "errors" rejects the charts
+// with errors, "strict" the charts with warnings too, "off" (default) doesn't lint them.
+const PolicyLint = "lint"
+
+// Lint modes, see PolicyLint.
+const (
+	LintOff    = "off"
+	LintErrors = "errors"
+	LintStrict = "strict"
+)
+
+// WithLint sets how pushed charts are linted: LintOff, LintErrors or LintStrict.
+// Empty applies the lint policy of the repository.
+func WithLint(mode string) Option {
+	return func(r *Repo) {
+		r.lintMode = mode
+	}
+}
+
+// lintChart lints the chart c, archived at chartpath, according to the lint mode of the
+// repository or its policy, and fails if it has errors, or warnings in strict mode.
+func (r Repo) lintChart(i *repo.IndexFile, c *chart.Chart, chartpath string) error {
+	mode := r.lintMode
+	if mode == "" {
+		mode = indexPolicy(i, PolicyLint)
+	}
+	if mode == "" || mode == LintOff {
+		return nil
+	}
+	dir, err := os.MkdirTemp("", "helm-gcs-lint-")
+	if err != nil {
+		return errors.Wrap(err, "create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	if err := chartutil.ExpandFile(dir, chartpath); err != nil {
+		return errors.Wrap(err, "expand chart")
+	}
+
+	log.Debugf("lint %s-%s (%s)", c.Metadata.Name, c.Metadata.Version, mode)
+	tolerance := support.ErrorSev
+	if mode == LintStrict {
+		tolerance = support.WarningSev
+	}
+	linter := lint.All(filepath.Join(dir, c.Metadata.Name), nil, "", false)
+	var failures []string
+	for _, msg := range linter.Messages {
+		if msg.Severity >= tolerance {
+			failures = append(failures, msg.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return invalidf("chart %s-%s failed lint (%s), use --skip-lint to push it anyway:\n%s", c.Metadata.Name, c.Metadata.Version, mode, strings.Join(failures, "\n"))
+	}
+	return nil
+}
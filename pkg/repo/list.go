@@ -0,0 +1,98 @@
+package repo
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// chartTypeLibrary is the type of library charts, which can't be installed.
+const chartTypeLibrary = "library"
+
+// ListOptions filters and paginates listings of charts.
+type ListOptions struct {
+	// IncludeLibraries also lists library charts.
+	IncludeLibraries bool
+	// Filter, if set, only lists charts whose name matches.
+	Filter *regexp.Regexp
+	// Limit is the maximum number of charts listed, 0 for no limit.
+	Limit int
+	// PageToken continues a previous listing, see Charts.
+	PageToken string
+}
+
+// Charts returns the latest version of the charts of the repository, sorted by name.
+// When there are more charts than opts.Limit, the returned token continues
+// the listing on the next call, it is empty on the last page.
+//
+// Charts are visited in name order, and only the ones of the requested page are
+// picked, so listing huge repositories doesn't build every result.
+func (r Repo) Charts(ctx context.Context, opts ListOptions) ([]*repo.ChartVersion, string, error) {
+	after, err := decodePageToken(opts.PageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "load index file")
+	}
+	names := make([]string, 0, len(i.Entries))
+	for name := range i.Entries {
+		if name > after {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	charts := []*repo.ChartVersion{}
+	for _, name := range names {
+		versions := i.Entries[name]
+		if len(versions) == 0 || (opts.Filter != nil && !opts.Filter.MatchString(name)) {
+			continue
+		}
+		// entries are sorted, latest version first
+		latest := versions[0]
+		if latest.Type == chartTypeLibrary && !opts.IncludeLibraries {
+			continue
+		}
+		if opts.Limit > 0 && len(charts) == opts.Limit {
+			return charts, encodePageToken(charts[len(charts)-1].Name), nil
+		}
+		charts = append(charts, latest)
+	}
+	return charts, "", nil
+}
+
+// page tokens are the name of the last chart of the previous page.
+func encodePageToken(last string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(last))
+}
+
+func decodePageToken(token string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid page token")
+	}
+	return string(b), nil
+}
+
+// checkLibrary rejects library charts if the repository or the caller don't allow them.
+func (r Repo) checkLibrary(i *repo.IndexFile, c *chart.Chart) error {
+	if c.Metadata.Type != chartTypeLibrary {
+		return nil
+	}
+	if r.rejectLibraries {
+		return fmt.Errorf("chart %s-%s is a library chart, library charts are rejected", c.Metadata.Name, c.Metadata.Version)
+	}
+	if indexPolicy(i, PolicyLibraries) == "reject" {
+		return fmt.Errorf("chart %s-%s is a library chart, the repository policy rejects library charts", c.Metadata.Name, c.Metadata.Version)
+	}
+	log.Debugf("chart %s-%s is a library chart", c.Metadata.Name, c.Metadata.Version)
+	return nil
+}
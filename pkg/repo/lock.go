@@ -0,0 +1,186 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/googleapis/gax-go/v2"
+	"github.com/pkg/errors"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// DefaultLockTTL is the duration after which a lock which isn't extended is considered stale,
+// see WithLock.
+const DefaultLockTTL = 5 * time.Minute
+
+// lockFileName is the name of the lock object, next to the index file.
+const lockFileName = "index.yaml.lock"
+
+// lockHolder is the content of the lock object, which identifies its holder.
+type lockHolder struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// WithLock makes the updates of the index acquire an advisory lock first, serializing the
+// writers of the repository instead of letting them race and retry on the index generation.
+// The lock is an object created next to the index file, only if it does not exist, which
+// expires after ttl and is extended by its holder while held. An expired lock, e.g. left by
+// a crashed writer, is stolen. 0 disables the lock.
+func WithLock(ttl time.Duration) Option {
+	return func(r *Repo) {
+		r.lockTTL = ttl
+	}
+}
+
+// lock acquires the lock of the repository, waiting for its holder to release it.
+// It returns the function releasing it, which does nothing without WithLock. Until it is
+// released, the lock is extended regularly, so that it doesn't become stale while held.
+func (r Repo) lock(ctx context.Context) (func(), error) {
+	if r.lockTTL <= 0 {
+		return func() {}, nil
+	}
+	lockURL, err := resolveReference(r.baseURL(), lockFileName)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve reference")
+	}
+	o, err := gcs.Object(r.gcs, lockURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "object")
+	}
+	backoff := gax.Backoff{Initial: 500 * time.Millisecond, Max: 10 * time.Second, Multiplier: 1.5}
+	for {
+		generation, err := r.writeLock(ctx, o.If(storage.Conditions{DoesNotExist: true}))
+		if err == nil {
+			log.Debugf("lock %s acquired", lockURL)
+			l := &heldLock{r: r, o: o, generation: generation, stop: make(chan struct{}), done: make(chan struct{})}
+			go l.refresh()
+			return l.release, nil
+		}
+		if !isPreconditionFailed(err) {
+			return nil, errors.Wrap(err, "create lock")
+		}
+		if stolen, err := r.stealStaleLock(ctx, o); err != nil {
+			return nil, err
+		} else if stolen {
+			continue
+		}
+		log.Debugf("lock %s is held, waiting", lockURL)
+		if err := gax.Sleep(ctx, backoff.Pause()); err != nil {
+			return nil, errors.Wrapf(err, "wait for lock %s", lockURL)
+		}
+	}
+}
+
+// writeLock writes the lock object, expiring after the TTL, with the conditions of o, and
+// returns its generation.
+func (r Repo) writeLock(ctx context.Context, o *storage.ObjectHandle) (int64, error) {
+	owner, _ := os.Hostname()
+	b, err := json.Marshal(lockHolder{
+		Owner:   fmt.Sprintf("%s/%d", owner, os.Getpid()),
+		Expires: time.Now().Add(r.lockTTL),
+	})
+	if err != nil {
+		return 0, err
+	}
+	w := gcs.NewWriter(ctx, o)
+	w.ContentType = "application/json"
+	w.CacheControl = "no-cache, max-age=0, no-transform"
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return w.Attrs().Generation, nil
+}
+
+// heldLock is a lock acquired by this process.
+type heldLock struct {
+	r          Repo
+	o          *storage.ObjectHandle
+	generation int64
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+// refresh extends the lock every third of the TTL, until it is released.
+func (l *heldLock) refresh() {
+	defer close(l.done)
+	interval := l.r.lockTTL / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		generation, err := l.r.writeLock(ctx, l.o.If(storage.Conditions{GenerationMatch: l.generation}))
+		cancel()
+		switch {
+		case isPreconditionFailed(err):
+			log.Warnf("lock %s was stolen, the index is still protected by generation checks", l.o.ObjectName())
+			return
+		case err != nil:
+			// retried at the next tick, the lock expires later
+			log.Debugf("extend lock: %s", err)
+		default:
+			l.generation = generation
+		}
+	}
+}
+
+// release stops extending the lock, then releases it.
+func (l *heldLock) release() {
+	close(l.stop)
+	<-l.done
+	l.r.unlock(l.o, l.generation)
+}
+
+// stealStaleLock deletes the lock object if it expired, and reports whether it did.
+// The lock is only deleted if it wasn't replaced meanwhile, e.g. extended by its holder.
+func (r Repo) stealStaleLock(ctx context.Context, o *storage.ObjectHandle) (bool, error) {
+	reader, err := o.NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		// released meanwhile
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "read lock")
+	}
+	var holder lockHolder
+	err = json.NewDecoder(reader).Decode(&holder)
+	reader.Close()
+	if err != nil || holder.Expires.IsZero() {
+		// unknown content, the lock expires after the TTL
+		holder.Expires = reader.Attrs.LastModified.Add(r.lockTTL)
+	}
+	if time.Now().Before(holder.Expires) {
+		return false, nil
+	}
+	log.Debugf("steal stale lock of %s, expired at %s", holder.Owner, holder.Expires)
+	err = o.If(storage.Conditions{GenerationMatch: reader.Attrs.Generation}).Delete(ctx)
+	if err == nil || err == storage.ErrObjectNotExist || isPreconditionFailed(err) {
+		return true, nil
+	}
+	return false, errors.Wrap(err, "delete stale lock")
+}
+
+// unlock releases the lock, unless it was stolen meanwhile.
+// It is released even if the operation was canceled, the lock would otherwise be held until it is stale.
+func (r Repo) unlock(o *storage.ObjectHandle, generation int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := o.If(storage.Conditions{GenerationMatch: generation}).Delete(ctx)
+	if err != nil {
+		log.Debugf("release lock: %s", err)
+	}
+}
@@ -0,0 +1,87 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// Metrics is the inventory of a repository.
+type Metrics struct {
+	Charts          int
+	Versions        int
+	Objects         int
+	Bytes           int64
+	IndexGeneration int64
+	LastPush        time.Time
+}
+
+// Metrics returns the inventory of the repository, from its index and the objects of its directory.
+func (r *Repo) Metrics(ctx context.Context) (*Metrics, error) {
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "load index file")
+	}
+	m := &Metrics{Charts: len(i.Entries), IndexGeneration: r.indexFileGeneration}
+	for _, versions := range i.Entries {
+		m.Versions += len(versions)
+		for _, cv := range versions {
+			if cv.Created.After(m.LastPush) {
+				m.LastPush = cv.Created
+			}
+		}
+	}
+	objects, err := gcs.ListObjects(ctx, r.gcs, r.baseURL())
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range objects {
+		m.Objects++
+		m.Bytes += o.Size
+	}
+	return m, nil
+}
+
+// WritePrometheus writes the metrics of repositories, by name, in the Prometheus text format.
+func WritePrometheus(w io.Writer, metrics map[string]*Metrics) error {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(m *Metrics) float64
+	}{
+		{"helm_gcs_charts_total", "Number of charts in the repository.", func(m *Metrics) float64 { return float64(m.Charts) }},
+		{"helm_gcs_versions_total", "Number of chart versions in the repository.", func(m *Metrics) float64 { return float64(m.Versions) }},
+		{"helm_gcs_objects_total", "Number of objects in the repository directory.", func(m *Metrics) float64 { return float64(m.Objects) }},
+		{"helm_gcs_repo_bytes", "Size of the objects in the repository directory.", func(m *Metrics) float64 { return float64(m.Bytes) }},
+		{"helm_gcs_index_generation", "Generation of the index file object.", func(m *Metrics) float64 { return float64(m.IndexGeneration) }},
+		{"helm_gcs_last_push_timestamp_seconds", "Creation time of the latest chart version.", func(m *Metrics) float64 {
+			if m.LastPush.IsZero() {
+				return 0
+			}
+			return float64(m.LastPush.Unix())
+		}},
+	}
+	for _, g := range gauges {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name); err != nil {
+			return err
+		}
+		for _, name := range names {
+			if _, err := fmt.Fprintf(w, "%s{repo=%q} %g\n", g.name, name, g.value(metrics[name])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// MigrateResult summarizes a migration.
+type MigrateResult struct {
+	Charts int
+	Bytes  int64
+}
+
+// Migrate creates the repository r as a copy of the repository at source (gs://bucket/path):
+// the chart archives, with their provenance and signature files, are copied into r and
+// the index entries are rewritten to point to the copies.
+// Charts keep their path relative to the repository, and URLs their form: relative,
+// gs:// or public https:// URLs. Charts served from outside the source repository
+// are copied at the root of r.
+//
+// With serverSide, objects are copied with GCS rewrites and never transit through the
+// caller; otherwise they are downloaded and uploaded again.
+// The repository r must not exist yet.
+func Migrate(ctx context.Context, r *Repo, source string, serverSide bool) (*MigrateResult, error) {
+	source = strings.TrimSuffix(source, "/")
+	if source+"/" == r.baseURL() {
+		return nil, errors.New("source and destination repositories are the same")
+	}
+	o, err := gcs.Object(r.gcs, r.indexFileURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "object")
+	}
+	_, err = o.Attrs(ctx)
+	if err == nil {
+		return nil, fmt.Errorf("repository %s already exists", r.indexFileURL)
+	} else if err != storage.ErrObjectNotExist {
+		return nil, errors.Wrap(err, "attrs")
+	}
+
+	sourceIndexURL, err := resolveReference(source, "index.yaml")
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve index reference")
+	}
+	i, err := loadIndexFrom(ctx, r.gcs, sourceIndexURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "load source index")
+	}
+
+	result := &MigrateResult{}
+	for _, versions := range i.Entries {
+		for _, cv := range versions {
+			// mirror URLs, after the first one, are kept as they are
+			if len(cv.URLs) == 0 {
+				continue
+			}
+			migrated, size, err := r.migrateChart(ctx, source+"/", cv.URLs[0], serverSide)
+			if err != nil {
+				return nil, errors.Wrapf(err, "copy chart %s-%s", cv.Name, cv.Version)
+			}
+			cv.URLs[0] = migrated
+			result.Charts++
+			result.Bytes += size
+		}
+	}
+
+	if err := r.createIndexFile(ctx, i); err != nil {
+		return nil, err
+	}
+	return result, r.updateChecksums(ctx, i)
+}
+
+// migrateChart copies the chart at chartURL, an URL of the index at sourceBase, into the
+// repository. It returns the URL of the copy for the index, and the size of the chart.
+func (r Repo) migrateChart(ctx context.Context, sourceBase, chartURL string, serverSide bool) (string, int64, error) {
+	src := absoluteURL(sourceBase, chartURL)
+	gsURL, onGCS := toGCSURL(src)
+	rel := path.Base(src)
+	if onGCS {
+		rel = relativeChartPath(sourceBase, gsURL)
+	}
+	dst, err := resolveReference(r.baseURL(), rel)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "resolve reference")
+	}
+
+	log.Debugf("copy chart %s to %s", src, dst)
+	r.report(PhaseCopy, dst, 0, 0)
+	var size int64
+	if onGCS && !serverSide {
+		size, err = r.streamObject(ctx, gsURL, dst)
+	} else {
+		size, err = copyChart(ctx, r.gcs, src, dst)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	r.report(PhaseCopy, dst, size, size)
+	if onGCS {
+		if err := r.migrateSidecars(ctx, gsURL, dst, serverSide); err != nil {
+			return "", 0, err
+		}
+	}
+
+	return indexedURL(chartURL, rel, dst), size, nil
+}
+
+// indexedURL returns the URL indexing the copy dst of a chart, in the form of the URL
+// chartURL it was indexed with: rel if it was relative, public https:// or gs:// otherwise.
+func indexedURL(chartURL, rel, dst string) string {
+	switch {
+	case !strings.Contains(chartURL, "://"):
+		return rel
+	case strings.HasPrefix(chartURL, publicURLPrefix):
+		return publicURLPrefix + strings.TrimPrefix(dst, "gs://")
+	}
+	return dst
+}
+
+// migrateSidecars copies the provenance and signature files of a chart, if they exist.
+func (r Repo) migrateSidecars(ctx context.Context, src, dst string, serverSide bool) error {
+	for _, suffix := range []string{provSuffix, signatureSuffix} {
+		var err error
+		if serverSide {
+			_, err = gcs.Copy(ctx, r.gcs, src+suffix, dst+suffix)
+		} else {
+			_, err = r.streamObject(ctx, src+suffix, dst+suffix)
+		}
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "copy %s", src+suffix)
+		}
+	}
+	return nil
+}
+
+// streamObject copies the object at src to dst through the caller, and returns its size.
+func (r Repo) streamObject(ctx context.Context, src, dst string) (int64, error) {
+	reader, err := gcs.NewReader(ctx, r.gcs, src)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	o, err := gcs.Object(r.gcs, dst)
+	if err != nil {
+		return 0, errors.Wrap(err, "object")
+	}
+	w := gcs.NewWriter(ctx, o)
+	size, err := io.Copy(w, reader)
+	if err != nil {
+		w.Close()
+		return 0, errors.Wrap(err, "copy")
+	}
+	return size, errors.Wrap(w.Close(), "close")
+}
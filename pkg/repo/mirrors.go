@@ -0,0 +1,53 @@
+package repo
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// WithMirrorURLs makes the index entries of pushed charts list alternate URLs after the main
+// one, e.g. of regional buckets or of a CDN serving replicas of the repository: one per base URL,
+// where the chart must be available under the same path as in the repository.
+// Copying the charts to the mirrors is up to the caller, e.g. with bucket replication.
+func WithMirrorURLs(urls ...string) Option {
+	return func(r *Repo) {
+		r.mirrorURLs = urls
+	}
+}
+
+// ValidateMirrorURL checks that u can be used as the base URL of a mirror.
+func ValidateMirrorURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return errors.Wrapf(err, "invalid mirror URL %q", u)
+	}
+	if !parsed.IsAbs() || parsed.Host == "" || strings.ContainsAny(u, "?#") {
+		return errors.Errorf("invalid mirror URL %q, should be an absolute base URL such as https://charts.example.com/stable", u)
+	}
+	return nil
+}
+
+// addMirrorURLs appends the URLs of the chart file fname under mirrors to its index entry.
+func addMirrorURLs(i *repo.IndexFile, c *chart.Chart, fname string, mirrors []string) error {
+	if len(mirrors) == 0 {
+		return nil
+	}
+	for _, cv := range i.Entries[c.Metadata.Name] {
+		if cv.Version != c.Metadata.Version {
+			continue
+		}
+		for _, mirror := range mirrors {
+			u, err := resolveReference(mirror, fname)
+			if err != nil {
+				return errors.Wrap(err, "resolve mirror reference")
+			}
+			cv.URLs = append(cv.URLs, u)
+		}
+		return nil
+	}
+	return nil
+}
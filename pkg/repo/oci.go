@@ -0,0 +1,155 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/registry"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// IsOCIReference reports whether ref is a chart reference on an OCI registry (oci://).
+func IsOCIReference(ref string) bool {
+	return registry.IsOCI(ref)
+}
+
+// newRegistryClient returns a client of OCI registries, using the credentials of "helm registry login".
+func newRegistryClient() (*registry.Client, error) {
+	client, err := registry.NewClient(
+		registry.ClientOptDebug(log.Logger.IsLevelEnabled(logrus.DebugLevel)),
+		registry.ClientOptWriter(io.Discard),
+		registry.ClientOptCredentialsFile(envOr("HELM_REGISTRY_CONFIG", helmpath.ConfigPath("registry/config.json"))),
+	)
+	return client, errors.Wrap(err, "registry client")
+}
+
+// PullOCIChart pulls a chart from an OCI registry (oci://registry/repo/chart:version),
+// using the credentials of "helm registry login", into a temporary directory.
+// Its provenance file, if the registry has one, is written next to it.
+// It returns the path of the chart archive, to be removed with cleanup.
+func PullOCIChart(ref string) (chartpath string, cleanup func(), err error) {
+	cleanup = func() {}
+	client, err := newRegistryClient()
+	if err != nil {
+		return "", cleanup, err
+	}
+
+	log.Debugf("pull chart %s", ref)
+	result, err := client.Pull(strings.TrimPrefix(ref, fmt.Sprintf("%s://", registry.OCIScheme)),
+		registry.PullOptWithProv(true), registry.PullOptIgnoreMissingProv(true))
+	if err != nil {
+		return "", cleanup, errors.Wrapf(err, "pull %s", ref)
+	}
+
+	dir, err := os.MkdirTemp("", "helm-gcs-")
+	if err != nil {
+		return "", cleanup, errors.Wrap(err, "create temporary directory")
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	chartpath = filepath.Join(dir, fmt.Sprintf("%s-%s.tgz", result.Chart.Meta.Name, result.Chart.Meta.Version))
+	if err := os.WriteFile(chartpath, result.Chart.Data, 0o644); err != nil {
+		cleanup()
+		return "", func() {}, errors.Wrap(err, "write chart")
+	}
+	if result.Prov != nil && len(result.Prov.Data) > 0 {
+		if err := os.WriteFile(chartpath+provSuffix, result.Prov.Data, 0o644); err != nil {
+			cleanup()
+			return "", func() {}, errors.Wrap(err, "write provenance file")
+		}
+	}
+	log.Debugf("chart %s pulled as %s", ref, chartpath)
+	return chartpath, cleanup, nil
+}
+
+// PushOCIChart pushes the chart archive at chartpath, with its provenance file if there is
+// one next to it, to an OCI registry, under ref (oci://registry/repo) as "helm push" does:
+// the chart is tagged with its version in the repository named after it.
+// It returns the reference of the pushed chart.
+func PushOCIChart(chartpath, ref string) (string, error) {
+	c, err := loader.Load(chartpath)
+	if err != nil {
+		return "", errors.Wrap(err, "load chart")
+	}
+	b, err := os.ReadFile(chartpath)
+	if err != nil {
+		return "", errors.Wrap(err, "read chart")
+	}
+	var opts []registry.PushOption
+	if prov, err := os.ReadFile(chartpath + provSuffix); err == nil {
+		opts = append(opts, registry.PushOptProvData(prov))
+	} else if !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "read provenance file")
+	}
+	client, err := newRegistryClient()
+	if err != nil {
+		return "", err
+	}
+	target := fmt.Sprintf("%s:%s", path.Join(strings.TrimPrefix(ref, fmt.Sprintf("%s://", registry.OCIScheme)), c.Metadata.Name), c.Metadata.Version)
+	log.Debugf("push chart %s to %s", chartpath, target)
+	result, err := client.Push(b, target, opts...)
+	if err != nil {
+		return "", errors.Wrapf(err, "push %s", target)
+	}
+	return fmt.Sprintf("%s://%s", registry.OCIScheme, result.Ref), nil
+}
+
+// ExportOCI pushes a chart of the repository to an OCI registry, under ref (oci://registry/repo),
+// with its provenance file if it has one, e.g. to migrate to Artifact Registry gradually.
+// version can be a tag, an exact version or a semver constraint, see ResolveVersion.
+// The digest of the chart is verified against the index before it is pushed.
+// It returns the reference of the pushed chart.
+func (r Repo) ExportOCI(ctx context.Context, name, version, ref string) (string, error) {
+	if !IsOCIReference(ref) {
+		return "", fmt.Errorf("invalid OCI reference %q, should be oci://registry/repository", ref)
+	}
+	dir, err := os.MkdirTemp("", "helm-gcs-")
+	if err != nil {
+		return "", errors.Wrap(err, "create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	cv, err := r.ResolveVersion(ctx, name, version, false)
+	if err != nil {
+		return "", err
+	}
+	chartpath, err := r.FetchChart(ctx, name, cv.Version, false, dir)
+	if err != nil {
+		return "", err
+	}
+	chartURL, err := r.objectURL(cv.URLs[0])
+	if err != nil {
+		return "", err
+	}
+	if err := r.downloadProvenance(ctx, chartURL, chartpath); err != nil {
+		return "", err
+	}
+	return PushOCIChart(chartpath, ref)
+}
+
+// downloadProvenance downloads the provenance file of the chart at chartURL next to chartpath,
+// if it has one.
+func (r Repo) downloadProvenance(ctx context.Context, chartURL, chartpath string) error {
+	reader, err := gcs.NewReader(ctx, r.gcs, chartURL+provSuffix)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "read provenance file")
+	}
+	defer reader.Close()
+	b, err := io.ReadAll(reader)
+	if err != nil {
+		return errors.Wrap(err, "read provenance file")
+	}
+	return errors.Wrap(os.WriteFile(chartpath+provSuffix, b, 0o644), "write provenance file")
+}
@@ -0,0 +1,194 @@
+package repo
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/provenance"
+)
+
+// loadChart loads the chart to push, an archive or an unpackaged chart directory,
+// and applies the changes requested on the repository options. If the chart is
+// a directory or is changed, it is packaged into a temporary archive whose path
+// is returned, to be removed with cleanup.
+func (r Repo) loadChart(chartpath string) (c *chart.Chart, path string, cleanup func(), err error) {
+	cleanup = func() {}
+	info, err := r.files().Stat(chartpath)
+	if err != nil {
+		return nil, "", cleanup, errors.Wrap(err, "stat chart")
+	}
+	if info.IsDir() {
+		c, err = loader.LoadDir(chartpath)
+	} else {
+		c, err = r.loadArchive(chartpath)
+	}
+	if err != nil {
+		return nil, "", cleanup, errors.Wrap(err, "load chart")
+	}
+	if info.IsDir() {
+		if err := c.Validate(); err != nil {
+			return nil, "", cleanup, errors.Wrap(err, "validate chart")
+		}
+		if err := checkDependenciesBuilt(c); err != nil {
+			return nil, "", cleanup, err
+		}
+	}
+
+	changed, err := rewriteDependencies(c, r.dependencyRewrites)
+	if err != nil {
+		return nil, "", cleanup, errors.Wrap(err, "rewrite dependencies")
+	}
+	overridden, err := r.overrideVersions(c)
+	if err != nil {
+		return nil, "", cleanup, err
+	}
+	changed = changed || overridden
+	if err := r.checkProvenance(chartpath, changed); err != nil {
+		return nil, "", cleanup, err
+	}
+	if !changed && !info.IsDir() {
+		return c, chartpath, cleanup, nil
+	}
+
+	dir, err := r.files().MkdirTemp("", "helm-gcs-")
+	if err != nil {
+		return nil, "", cleanup, errors.Wrap(err, "create temporary directory")
+	}
+	cleanup = func() { r.files().RemoveAll(dir) }
+	path, err = r.saveChart(c, dir)
+	if err != nil {
+		cleanup()
+		return nil, "", func() {}, errors.Wrap(err, "repackage chart")
+	}
+	log.Debugf("chart packaged as %s", path)
+	return c, path, cleanup, nil
+}
+
+// loadArchive loads the chart archive at chartpath.
+func (r Repo) loadArchive(chartpath string) (*chart.Chart, error) {
+	f, err := r.files().Open(chartpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return loader.LoadArchive(f)
+}
+
+// saveChart packages the chart into dir, and returns the path of the archive.
+func (r Repo) saveChart(c *chart.Chart, dir string) (string, error) {
+	if _, ok := r.files().(osFS); ok {
+		return chartutil.Save(c, dir)
+	}
+	// helm only writes archives to the filesystem of the operating system
+	tmp, err := os.MkdirTemp("", "helm-gcs-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	saved, err := chartutil.Save(c, tmp)
+	if err != nil {
+		return "", err
+	}
+	b, err := os.ReadFile(saved)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, filepath.Base(saved))
+	return path, r.files().WriteFile(path, b, 0o644)
+}
+
+// overrideVersions sets the version and the appVersion of the chart to the overrides
+// of the repository options, if any. It reports whether the chart changed.
+func (r Repo) overrideVersions(c *chart.Chart) (bool, error) {
+	changed := false
+	if r.versionOverride != "" && r.versionOverride != c.Metadata.Version {
+		log.Debugf("override version %s with %s", c.Metadata.Version, r.versionOverride)
+		c.Metadata.Version = r.versionOverride
+		changed = true
+	}
+	if r.appVersionOverride != "" && r.appVersionOverride != c.Metadata.AppVersion {
+		log.Debugf("override appVersion %s with %s", c.Metadata.AppVersion, r.appVersionOverride)
+		c.Metadata.AppVersion = r.appVersionOverride
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+	// the version must still be a valid semver
+	return true, errors.Wrap(c.Metadata.Validate(), "override versions")
+}
+
+// checkDependenciesBuilt checks that the dependencies of an unpackaged chart are in its
+// charts/ directory, as "helm package" does.
+func checkDependenciesBuilt(c *chart.Chart) error {
+	built := map[string]bool{}
+	for _, dep := range c.Dependencies() {
+		built[dep.Name()] = true
+	}
+	var missing []string
+	for _, dep := range c.Metadata.Dependencies {
+		if !built[dep.Name] {
+			missing = append(missing, dep.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("found in Chart.yaml, but missing in charts/ directory: %s, run \"helm dependency build\"", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// rewriteDependencies replaces the repository URLs of the dependencies of the chart,
+// in both Chart.yaml and Chart.lock, according to rewrites which maps old URLs
+// (or URL prefixes) to new ones. It reports whether the chart changed.
+func rewriteDependencies(c *chart.Chart, rewrites map[string]string) (bool, error) {
+	if len(rewrites) == 0 {
+		return false, nil
+	}
+	changed := rewriteRepositories(c.Metadata.Dependencies, rewrites)
+	if c.Lock != nil && rewriteRepositories(c.Lock.Dependencies, rewrites) {
+		// Chart.lock digest covers the repositories, it must be recomputed
+		// for helm not to report the lock file as out of sync.
+		digest, err := hashDependencies(c.Metadata.Dependencies, c.Lock.Dependencies)
+		if err != nil {
+			return false, err
+		}
+		c.Lock.Digest = digest
+		changed = true
+	}
+	return changed, nil
+}
+
+func rewriteRepositories(deps []*chart.Dependency, rewrites map[string]string) bool {
+	changed := false
+	for _, dep := range deps {
+		for old, replacement := range rewrites {
+			old = strings.TrimSuffix(old, "/")
+			if dep.Repository != old && !strings.HasPrefix(dep.Repository, old+"/") {
+				continue
+			}
+			repository := strings.TrimSuffix(replacement, "/") + strings.TrimPrefix(dep.Repository, old)
+			log.Debugf("rewrite repository of dependency %s from %s to %s", dep.Name, dep.Repository, repository)
+			dep.Repository = repository
+			changed = true
+			break
+		}
+	}
+	return changed
+}
+
+// hashDependencies computes the digest of Chart.lock the same way helm does.
+func hashDependencies(req, lock []*chart.Dependency) (string, error) {
+	data, err := json.Marshal([2][]*chart.Dependency{req, lock})
+	if err != nil {
+		return "", err
+	}
+	s, err := provenance.Digest(bytes.NewBuffer(data))
+	return "sha256:" + s, err
+}
@@ -0,0 +1,106 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// policyAnnotationPrefix prefixes the index annotations holding the policies of a repository.
+const policyAnnotationPrefix = "helm-gcs.policy/"
+
+// Policies enforced on push.
+const (
+	// PolicyLibraries controls library charts: "allow" (default) or "reject".
+	PolicyLibraries = "libraries"
+)
+
+var policyValues = map[string][]string{
+	PolicyLibraries:         {"allow", "reject"},
+	PolicyMaxVersionsAction: {"reject", "prune"},
+	PolicyLint:              {LintOff, LintErrors, LintStrict},
+	PolicyLayout:            {LayoutFlat, LayoutContentAddressable},
+}
+
+// SetPolicies sets policies of the repository, stored in the index file annotations.
+// A policy set to an empty value is removed.
+func (r Repo) SetPolicies(ctx context.Context, policies map[string]string, retry bool) error {
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for name, value := range policies {
+		if err := validatePolicy(name, value); err != nil {
+			return err
+		}
+	}
+	for {
+		i, err := r.indexFile(ctx)
+		if err != nil {
+			return errors.Wrap(err, "load index file")
+		}
+		if i.Annotations == nil {
+			i.Annotations = map[string]string{}
+		}
+		for name, value := range policies {
+			if value == "" {
+				delete(i.Annotations, policyAnnotationPrefix+name)
+			} else {
+				i.Annotations[policyAnnotationPrefix+name] = value
+			}
+		}
+		err = r.uploadIndexFile(ctx, i)
+		if errors.Is(err, ErrIndexOutOfDate) && retry {
+			continue
+		}
+		return err
+	}
+}
+
+// Policies returns the policies set on the repository.
+func (r Repo) Policies(ctx context.Context) (map[string]string, error) {
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "load index file")
+	}
+	policies := map[string]string{}
+	for k, v := range i.Annotations {
+		if name, ok := strings.CutPrefix(k, policyAnnotationPrefix); ok {
+			policies[name] = v
+		}
+	}
+	return policies, nil
+}
+
+func validatePolicy(name, value string) error {
+	if name == PolicyMaxVersions || strings.HasPrefix(name, PolicyMaxVersions+".") {
+		return validateMaxVersions(value)
+	}
+	values, ok := policyValues[name]
+	if !ok {
+		known := []string{PolicyMaxVersions + "[.<channel>]"}
+		for k := range policyValues {
+			known = append(known, k)
+		}
+		sort.Strings(known)
+		return fmt.Errorf("unknown policy %q, should be one of %s", name, strings.Join(known, ", "))
+	}
+	if value == "" {
+		return nil
+	}
+	for _, v := range values {
+		if v == value {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid value %q for policy %s, should be one of %s", value, name, strings.Join(values, ", "))
+}
+
+func indexPolicy(i *repo.IndexFile, name string) string {
+	return i.Annotations[policyAnnotationPrefix+name]
+}
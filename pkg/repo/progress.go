@@ -0,0 +1,161 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// Phases of the progress events.
+const (
+	PhaseUpload   = "upload"
+	PhaseDownload = "download"
+	PhaseCopy     = "copy"
+	PhaseIndex    = "index"
+	PhaseVerify   = "verify"
+)
+
+// progressStep is the number of bytes between two events when the total size is unknown.
+const progressStep = 4 << 20
+
+// ProgressEvent reports the progress of a transfer.
+// Total and Percent are zero when the size of the object is unknown.
+type ProgressEvent struct {
+	Phase   string  `json:"phase"`
+	Object  string  `json:"object"`
+	Bytes   int64   `json:"bytes"`
+	Total   int64   `json:"total,omitempty"`
+	Percent float64 `json:"percent,omitempty"`
+}
+
+// ProgressReporter receives the progress events of long operations.
+type ProgressReporter func(ProgressEvent)
+
+// WithProgress makes the repository report the progress of uploads, downloads and copies.
+func WithProgress(p ProgressReporter) Option {
+	return func(r *Repo) {
+		r.progress = p
+	}
+}
+
+// JSONProgress returns a reporter writing events to w as JSON lines.
+func JSONProgress(w io.Writer) ProgressReporter {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(e ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = enc.Encode(e)
+	}
+}
+
+// BarProgress returns a reporter rendering a progress line per object on w, a terminal.
+func BarProgress(w io.Writer) ProgressReporter {
+	var mu sync.Mutex
+	return func(e ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		name := path.Base(e.Object)
+		if e.Total <= 0 {
+			fmt.Fprintf(w, "\r%s %s %s", e.Phase, name, formatBytes(e.Bytes))
+			return
+		}
+		width := 30
+		done := int(e.Bytes * int64(width) / e.Total)
+		fmt.Fprintf(w, "\r%s %s [%s%s] %3.0f%% %s/%s", e.Phase, name,
+			strings.Repeat("=", done), strings.Repeat(" ", width-done), e.Percent, formatBytes(e.Bytes), formatBytes(e.Total))
+		if e.Bytes >= e.Total {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// formatBytes formats a number of bytes with a binary unit, e.g. "1.5 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// report sends an event, if the repository reports progress.
+func (r Repo) report(phase, object string, bytes, total int64) {
+	reportProgress(r.progress, phase, object, bytes, total)
+}
+
+func reportProgress(p ProgressReporter, phase, object string, bytes, total int64) {
+	if p == nil {
+		return
+	}
+	e := ProgressEvent{Phase: phase, Object: object, Bytes: bytes, Total: total}
+	if total > 0 {
+		e.Percent = float64(bytes*10000/total) / 100
+	}
+	p(e)
+}
+
+// progressReader reports the bytes read through it, at each percent or every progressStep bytes.
+type progressReader struct {
+	io.Reader
+	progress ProgressReporter
+	phase    string
+	object   string
+	total    int64
+	read     int64
+	last     int64
+}
+
+// withProgress wraps reader so that reading it reports progress, and sends the start event.
+func (r Repo) withProgress(reader io.Reader, phase, object string, total int64) io.Reader {
+	return ProgressReader(reader, r.progress, phase, object, total)
+}
+
+// ProgressReader wraps reader so that reading it reports progress to p, and sends the start
+// event. total is the size read, 0 if unknown. reader is returned as is if p is nil.
+func ProgressReader(reader io.Reader, p ProgressReporter, phase, object string, total int64) io.Reader {
+	if p == nil {
+		return reader
+	}
+	reportProgress(p, phase, object, 0, total)
+	return &progressReader{Reader: reader, progress: p, phase: phase, object: object, total: total}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	p.read += int64(n)
+	step := int64(progressStep)
+	if p.total > 0 {
+		step = p.total / 100
+	}
+	if p.read-p.last >= step || (err == io.EOF && p.read != p.last) {
+		p.last = p.read
+		reportProgress(p.progress, p.phase, p.object, p.read, p.total)
+	}
+	return n, err
+}
+
+// ReaderSize returns the size of the object read by reader, a GCS reader or a cached
+// file, 0 if unknown.
+func ReaderSize(reader io.Reader) int64 {
+	switch r := reader.(type) {
+	case *storage.Reader:
+		return r.Attrs.Size
+	case *os.File:
+		if fi, err := r.Stat(); err == nil {
+			return fi.Size()
+		}
+	}
+	return 0
+}
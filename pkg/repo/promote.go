@@ -0,0 +1,142 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// Promote copies a chart version of the repository source into r, e.g. from a staging
+// repository to a production one. The chart archive, with its provenance and signature
+// files, is copied server-side, at the root of r, and indexed with the metadata and the
+// digest of the source index entry, so the promoted chart is byte for byte the one tested.
+// The URL of the new entry keeps the form of the source one: relative, gs:// or public https://.
+//
+// The promotion fails if r already indexes the version, or already has its chart object,
+// unless force is set.
+func (r *Repo) Promote(ctx context.Context, source *Repo, name, version string, force, retry bool) (*PushResult, error) {
+	if source.baseURL() == r.baseURL() {
+		return nil, errors.New("source and destination repositories are the same")
+	}
+	cv, src, err := source.promotedChart(ctx, name, version)
+	if err != nil {
+		return nil, err
+	}
+	rel := path.Base(src)
+	dst, err := resolveReference(r.baseURL(), rel)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve reference")
+	}
+
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "load index file")
+	}
+	if i.Has(name, version) && !force {
+		return nil, fmt.Errorf("chart %s-%s already indexed. Use --force to still promote the chart", name, version)
+	}
+	if err := r.copyChartObject(ctx, src, dst, force); err != nil {
+		return nil, err
+	}
+
+	promoted := *cv
+	promoted.URLs = []string{indexedURL(cv.URLs[0], rel, dst)}
+	c := &chart.Chart{Metadata: cv.Metadata}
+	i, pruned, err := r.addPromotedToIndexFile(ctx, i, c, &promoted, force, retry)
+	if err != nil {
+		return nil, errors.Wrap(err, "update index file")
+	}
+	if err := r.afterPush(ctx, i, pruned, c); err != nil {
+		return nil, err
+	}
+	return &PushResult{
+		Name:            name,
+		Version:         version,
+		Digest:          cv.Digest,
+		URL:             dst,
+		IndexGeneration: r.indexFileGeneration,
+	}, nil
+}
+
+// promotedChart returns the entry of a chart version indexed by the repository, and the gs:// URL
+// of its chart object.
+func (r *Repo) promotedChart(ctx context.Context, name, version string) (*repo.ChartVersion, string, error) {
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "load source index file")
+	}
+	cv, err := i.Get(name, version)
+	if err != nil || cv.Version != version {
+		return nil, "", notFoundf("chart %s-%s not found in %s", name, version, r.baseURL())
+	}
+	if len(cv.URLs) == 0 {
+		return nil, "", fmt.Errorf("chart %s-%s has no URL", name, version)
+	}
+	src, onGCS := toGCSURL(absoluteURL(r.baseURL(), cv.URLs[0]))
+	if !onGCS {
+		return nil, "", fmt.Errorf("chart %s-%s is not stored on GCS: %s", name, version, cv.URLs[0])
+	}
+	return cv, src, nil
+}
+
+// copyChartObject copies the chart object at src to dst with its sidecar files, server-side.
+// It fails if dst already exists, unless force is set.
+func (r Repo) copyChartObject(ctx context.Context, src, dst string, force bool) error {
+	log.Debugf("copy chart %s to %s", src, dst)
+	r.report(PhaseCopy, dst, 0, 0)
+	copyObject := gcs.CopyIfNotExist
+	if force {
+		copyObject = gcs.Copy
+	}
+	attrs, err := copyObject(ctx, r.gcs, src, dst)
+	if isPreconditionFailed(err) {
+		return chartConflict(dst, force)
+	}
+	if err != nil {
+		return err
+	}
+	r.report(PhaseCopy, dst, attrs.Size, attrs.Size)
+	return r.migrateSidecars(ctx, src, dst, true)
+}
+
+// addPromotedToIndexFile adds the promoted chart version cv to the index i and uploads it.
+// With retry, the index is reloaded and the version added again while it is updated concurrently.
+// It returns the uploaded index and the versions pruned by the max-versions policies.
+func (r *Repo) addPromotedToIndexFile(ctx context.Context, i *repo.IndexFile, c *chart.Chart, cv *repo.ChartVersion, force, retry bool) (*repo.IndexFile, repo.ChartVersions, error) {
+	pruned, err := r.addPromoted(ctx, i, c, cv)
+	for errors.Is(err, ErrIndexOutOfDate) && retry {
+		i, err = r.indexFile(ctx)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "load index file")
+		}
+		// the version may have been pushed concurrently
+		if i.Has(cv.Name, cv.Version) && !force {
+			return nil, nil, fmt.Errorf("chart %s-%s already indexed. Use --force to still promote the chart", cv.Name, cv.Version)
+		}
+		pruned, err = r.addPromoted(ctx, i, c, cv)
+	}
+	return i, pruned, err
+}
+
+// addPromoted replaces the version of the promoted chart in the index i, applies the
+// max-versions policies and uploads the index. It returns the versions pruned.
+func (r *Repo) addPromoted(ctx context.Context, i *repo.IndexFile, c *chart.Chart, cv *repo.ChartVersion) (repo.ChartVersions, error) {
+	removeVersion(i, c.Metadata.Name, c.Metadata.Version)
+	pruned, err := enforceMaxVersions(i, c)
+	if err != nil {
+		return nil, err
+	}
+	i.Entries[c.Metadata.Name] = append(i.Entries[c.Metadata.Name], cv)
+	return pruned, r.uploadIndexFile(ctx, i)
+}
@@ -0,0 +1,96 @@
+package repo
+
+import (
+	"context"
+	"os"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/provenance"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// provSuffix is appended to the name of a chart to name its provenance file.
+const provSuffix = ".prov"
+
+// WithProvenance requires pushed charts to come with a provenance file
+// (chart.tgz.prov, next to the chart), for "helm install --verify" to work.
+// Provenance files found next to pushed charts are uploaded in any case.
+func WithProvenance(required bool) Option {
+	return func(r *Repo) {
+		r.requireProv = required
+	}
+}
+
+// WithProvenanceSigning makes pushed charts signed like "helm package --sign" does,
+// with the GPG key named name in keyring. The passphrase of an encrypted key is
+// read from HELM_GCS_SIGN_PASSPHRASE.
+func WithProvenanceSigning(keyring, name string) Option {
+	return func(r *Repo) {
+		r.provKeyring, r.provKey = keyring, name
+	}
+}
+
+// provSigner loads the key signing provenance files, nil if charts are not signed.
+func (r Repo) provSigner() (*provenance.Signatory, error) {
+	if r.provKey == "" {
+		return nil, nil
+	}
+	s, err := provenance.NewFromKeyring(r.provKeyring, r.provKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "load keyring")
+	}
+	err = s.DecryptKey(func(string) ([]byte, error) {
+		return []byte(os.Getenv("HELM_GCS_SIGN_PASSPHRASE")), nil
+	})
+	return s, errors.Wrap(err, "decrypt key")
+}
+
+// checkProvenance checks, before anything is pushed, that the provenance file of the chart
+// will be available: the chart can be signed, or an existing provenance file still matches it.
+// A key which can't be loaded or decrypted thus fails the push before the index is updated.
+func (r Repo) checkProvenance(chartpath string, repackaged bool) error {
+	if r.provKey != "" {
+		_, err := r.provSigner()
+		return err
+	}
+	_, err := r.files().Stat(chartpath + provSuffix)
+	exists := err == nil
+	if exists && repackaged {
+		return invalidf("provenance file %s doesn't match the repackaged chart, sign the chart instead", chartpath+provSuffix)
+	}
+	if !exists && r.requireProv {
+		return invalidf("provenance file %s not found", chartpath+provSuffix)
+	}
+	return nil
+}
+
+// uploadProvenance uploads the provenance file of the chart next to it, signing the chart if requested.
+func (r Repo) uploadProvenance(ctx context.Context, chartpath, chartURL string) error {
+	signer, err := r.provSigner()
+	if err != nil {
+		return err
+	}
+	var prov []byte
+	if signer != nil {
+		sig, err := signer.ClearSign(chartpath)
+		if err != nil {
+			return errors.Wrap(err, "sign chart")
+		}
+		prov = []byte(sig)
+	} else if prov, err = r.files().ReadFile(chartpath + provSuffix); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "read provenance file")
+	}
+	log.Debugf("upload provenance file to %s", chartURL+provSuffix)
+	o, err := gcs.Object(r.gcs, chartURL+provSuffix)
+	if err != nil {
+		return errors.Wrap(err, "object")
+	}
+	w := gcs.NewWriter(ctx, o)
+	if _, err := w.Write(prov); err != nil {
+		return errors.Wrap(err, "write")
+	}
+	return errors.Wrap(w.Close(), "close provenance file")
+}
@@ -0,0 +1,120 @@
+package repo
+
+import (
+	"context"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// PruneOptions selects the chart versions removed by Prune.
+// With both Keep and MaxAge, a version is kept if it is one of the Keep newest ones,
+// or if it is younger than MaxAge.
+type PruneOptions struct {
+	// Keep is the number of newest versions kept per chart, by semver precedence.
+	Keep int
+	// MaxAge is the age beyond which versions are pruned, from their creation in the index.
+	MaxAge time.Duration
+	// Pattern, if set, restricts the pruning to the charts whose name matches this
+	// shell pattern, e.g. "snapshot-*".
+	Pattern string
+	// DryRun only returns what would be removed.
+	DryRun bool
+}
+
+func (o PruneOptions) validate() error {
+	if o.Keep < 0 || o.MaxAge < 0 {
+		return errors.New("the number of versions and the age kept can't be negative")
+	}
+	if o.Keep == 0 && o.MaxAge == 0 {
+		return errors.New("nothing would be kept: a number of versions or an age to keep is required")
+	}
+	if _, err := path.Match(o.Pattern, ""); err != nil {
+		return errors.Wrapf(err, "invalid pattern %q", o.Pattern)
+	}
+	return nil
+}
+
+// Prune removes the chart versions beyond the retention options from the index, then
+// deletes their objects, e.g. the snapshots pushed by CI. Tagged versions are never pruned.
+// It returns the versions removed, or which would be removed with DryRun.
+func (r Repo) Prune(ctx context.Context, opts PruneOptions, retry bool) ([]Removal, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	for {
+		i, err := r.indexFile(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "load index file")
+		}
+		pruned, err := prunedVersions(i, opts, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if opts.DryRun || len(pruned) == 0 {
+			return r.removals(ctx, pruned)
+		}
+		for _, cv := range pruned {
+			removeVersion(i, cv.Name, cv.Version)
+			if len(i.Entries[cv.Name]) == 0 {
+				delete(i.Entries, cv.Name)
+			}
+		}
+		err = r.uploadIndexFile(ctx, i)
+		if errors.Is(err, ErrIndexOutOfDate) && retry {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return r.afterRemove(ctx, i, pruned)
+	}
+}
+
+// prunedVersions returns the versions of the index i beyond the retention options, by chart
+// name, newest first.
+func prunedVersions(i *repo.IndexFile, opts PruneOptions, now time.Time) (repo.ChartVersions, error) {
+	names := make([]string, 0, len(i.Entries))
+	for name := range i.Entries {
+		if matched, _ := path.Match(opts.Pattern, name); opts.Pattern == "" || matched {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var pruned repo.ChartVersions
+	for _, name := range names {
+		tags, err := indexTags(i, name)
+		if err != nil {
+			return nil, err
+		}
+		tagged := map[string]bool{}
+		for _, version := range tags {
+			tagged[version] = true
+		}
+		// newest first
+		versions := append(repo.ChartVersions{}, i.Entries[name]...)
+		sort.Sort(sort.Reverse(versions))
+		for n, cv := range versions {
+			if tagged[cv.Version] || (opts.Keep > 0 && n < opts.Keep) {
+				continue
+			}
+			// versions without creation date are of unknown age, and kept
+			if opts.MaxAge > 0 && (cv.Created.IsZero() || now.Sub(cv.Created) < opts.MaxAge) {
+				continue
+			}
+			log.Debugf("prune %s-%s", cv.Name, cv.Version)
+			pruned = append(pruned, cv)
+		}
+	}
+	return pruned, nil
+}
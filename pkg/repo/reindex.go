@@ -0,0 +1,135 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/repo"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// ReindexResult reports the charts found by Reindex, and the objects which could not be indexed.
+type ReindexResult struct {
+	Indexed int
+	Skipped map[string]error
+}
+
+// Reindex rebuilds the index file from the charts stored under the repository directory,
+// e.g. when the index is corrupted or lost. Every .tgz object is loaded and its digest computed.
+// The annotations of the current index (policies, tags...) are kept when it can still be read.
+// The new index replaces the current one only if it did not change meanwhile:
+// use "retry" to reindex again a repository updated at the same time.
+func (r Repo) Reindex(ctx context.Context, retry bool) (*ReindexResult, error) {
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	for {
+		current, err := r.indexFile(ctx)
+		if err != nil {
+			log.Warnf("current index file can't be read, its annotations are lost: %s", err)
+		}
+		i, result, err := r.indexObjects(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if current != nil {
+			i.Annotations = current.Annotations
+		}
+		err = r.uploadIndexFile(ctx, i)
+		if errors.Is(err, ErrIndexOutOfDate) && retry {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return result, r.updateChecksums(ctx, i)
+	}
+}
+
+// indexObjects indexes the charts under the repository directory, by r.concurrency workers.
+func (r Repo) indexObjects(ctx context.Context) (*repo.IndexFile, *ReindexResult, error) {
+	objects, err := gcs.ListObjects(ctx, r.gcs, r.baseURL())
+	if err != nil {
+		return nil, nil, err
+	}
+	i := repo.NewIndexFile()
+	result := &ReindexResult{Skipped: map[string]error{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	jobs := make(chan string)
+	for n := 0; n < r.workers(); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range jobs {
+				err := r.indexObject(ctx, i, &mu, u)
+				mu.Lock()
+				if err != nil {
+					result.Skipped[u] = err
+				} else {
+					result.Indexed++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, o := range objects {
+		u := "gs://" + o.Bucket + "/" + o.Name
+		// charts of pushes in progress, or interrupted, are not indexed
+		if strings.HasSuffix(o.Name, ".tgz") && !strings.HasPrefix(u, r.baseURL()+uploadsDir) {
+			jobs <- u
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	i.SortEntries()
+	return i, result, nil
+}
+
+// indexObject loads the chart at u and adds it to the index.
+func (r Repo) indexObject(ctx context.Context, i *repo.IndexFile, mu *sync.Mutex, u string) error {
+	reader, err := gcs.NewReader(ctx, r.gcs, u)
+	if err != nil {
+		return errors.Wrap(err, "reader")
+	}
+	defer reader.Close()
+	b, err := io.ReadAll(r.withProgress(reader, PhaseDownload, u, ReaderSize(reader)))
+	if err != nil {
+		return errors.Wrap(err, "read")
+	}
+	c, err := loader.LoadArchive(bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "load chart")
+	}
+	sum := sha256.Sum256(b)
+	var created time.Time
+	if sr, ok := reader.(*storage.Reader); ok {
+		created = sr.Attrs.LastModified
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if i.Has(c.Metadata.Name, c.Metadata.Version) {
+		return errors.Errorf("chart %s-%s is already indexed from another object", c.Metadata.Name, c.Metadata.Version)
+	}
+	if err := i.MustAdd(c.Metadata, path.Base(u), u[:strings.LastIndex(u, "/")], hex.EncodeToString(sum[:])); err != nil {
+		return err
+	}
+	if cv, err := i.Get(c.Metadata.Name, c.Metadata.Version); err == nil && !created.IsZero() {
+		cv.Created = created
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package repo
+
+import (
+	"context"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/repo"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// Repair actions.
+const (
+	RepairRemoveDuplicate = "remove-duplicate"
+	RepairRemoveMissing   = "remove-missing"
+	RepairFixDigest       = "fix-digest"
+	RepairNormalizeURL    = "normalize-url"
+)
+
+// publicURLPrefix is the prefix of the public HTTP URLs of GCS objects.
+const publicURLPrefix = "https://storage.googleapis.com/"
+
+// RepairAction describes an inconsistency of the index and how it is fixed.
+type RepairAction struct {
+	Chart   string
+	Version string
+	Action  string
+	Detail  string
+}
+
+// Repair fixes the inconsistencies of the index file:
+//   - duplicated entries of the same chart version are removed,
+//   - entries pointing at missing objects are removed,
+//   - wrong digests are replaced by the digest of the chart object,
+//   - chart URLs are normalized to the scheme most used by the repository (gs:// or https://).
+//
+// Unless dryRun is true, the repaired index is uploaded, under the same optimistic
+// locking as pushes: use "retry" to repair again a repository updated at the same time.
+func (r Repo) Repair(ctx context.Context, dryRun, retry bool) ([]RepairAction, error) {
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	for {
+		i, err := r.indexFile(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "load index file")
+		}
+		actions, err := r.repairEntries(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, normalizeURLs(i)...)
+
+		if dryRun || len(actions) == 0 {
+			return actions, nil
+		}
+		err = r.uploadIndexFile(ctx, i)
+		if errors.Is(err, ErrIndexOutOfDate) && retry {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return actions, r.updateChecksums(ctx, i)
+	}
+}
+
+// CheckIndex reports the drift between the index file and the objects of the repository:
+// duplicated entries, entries pointing at missing objects and wrong digests, as the
+// repair actions which would fix them. Nothing is changed, see Repair.
+func (r Repo) CheckIndex(ctx context.Context) ([]RepairAction, error) {
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "load index file")
+	}
+	return r.repairEntries(ctx, i)
+}
+
+// repairEntries removes the duplicated entries and the entries pointing at missing objects
+// from the index, and fixes the wrong digests.
+func (r Repo) repairEntries(ctx context.Context, i *repo.IndexFile) ([]RepairAction, error) {
+	actions := dedupeEntries(i)
+	for name, versions := range i.Entries {
+		kept := versions[:0]
+		for _, cv := range versions {
+			action, err := r.repairEntry(ctx, cv)
+			if err != nil {
+				return nil, errors.Wrapf(err, "check %s-%s", cv.Name, cv.Version)
+			}
+			if action != nil {
+				actions = append(actions, *action)
+			}
+			if action == nil || action.Action != RepairRemoveMissing {
+				kept = append(kept, cv)
+			}
+		}
+		if len(kept) == 0 {
+			delete(i.Entries, name)
+		} else {
+			i.Entries[name] = kept
+		}
+	}
+	return actions, nil
+}
+
+// dedupeEntries removes the entries of a chart version indexed several times, keeping the first one.
+func dedupeEntries(i *repo.IndexFile) []RepairAction {
+	var actions []RepairAction
+	for name, versions := range i.Entries {
+		seen := map[string]bool{}
+		kept := versions[:0]
+		for _, cv := range versions {
+			if seen[cv.Version] {
+				actions = append(actions, RepairAction{Chart: name, Version: cv.Version, Action: RepairRemoveDuplicate})
+				continue
+			}
+			seen[cv.Version] = true
+			kept = append(kept, cv)
+		}
+		i.Entries[name] = kept
+	}
+	return actions
+}
+
+// repairEntry checks the chart object of an entry and fixes its digest.
+// It returns a RepairRemoveMissing action when the object does not exist.
+// Charts which are not served by GCS can't be checked and are left untouched.
+func (r Repo) repairEntry(ctx context.Context, cv *repo.ChartVersion) (*RepairAction, error) {
+	if len(cv.URLs) == 0 {
+		return &RepairAction{Chart: cv.Name, Version: cv.Version, Action: RepairRemoveMissing, Detail: "no URL"}, nil
+	}
+	u, err := r.objectURL(cv.URLs[0])
+	if err != nil {
+		log.Debugf("skip %s-%s: %s", cv.Name, cv.Version, err)
+		return nil, nil
+	}
+	o, err := gcs.Object(r.gcs, u)
+	if err != nil {
+		return nil, errors.Wrap(err, "object")
+	}
+	if _, err := o.Attrs(ctx); err == storage.ErrObjectNotExist {
+		return &RepairAction{Chart: cv.Name, Version: cv.Version, Action: RepairRemoveMissing, Detail: u}, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "attrs")
+	}
+	digest, err := r.digestObject(ctx, u)
+	if err != nil {
+		return nil, errors.Wrap(err, "digest")
+	}
+	if digest == cv.Digest {
+		return nil, nil
+	}
+	action := &RepairAction{Chart: cv.Name, Version: cv.Version, Action: RepairFixDigest, Detail: cv.Digest + " -> " + digest}
+	cv.Digest = digest
+	return action, nil
+}
+
+// normalizeURLs rewrites the absolute chart URLs of the index to the scheme used by most of them.
+func normalizeURLs(i *repo.IndexFile) []RepairAction {
+	gs, public := 0, 0
+	for _, versions := range i.Entries {
+		for _, cv := range versions {
+			for _, u := range cv.URLs {
+				switch {
+				case strings.HasPrefix(u, "gs://"):
+					gs++
+				case strings.HasPrefix(u, publicURLPrefix):
+					public++
+				}
+			}
+		}
+	}
+	from, to := publicURLPrefix, "gs://"
+	if public > gs {
+		from, to = to, from
+	}
+
+	var actions []RepairAction
+	for _, versions := range i.Entries {
+		for _, cv := range versions {
+			for n, u := range cv.URLs {
+				if !strings.HasPrefix(u, from) {
+					continue
+				}
+				cv.URLs[n] = to + strings.TrimPrefix(u, from)
+				actions = append(actions, RepairAction{Chart: cv.Name, Version: cv.Version, Action: RepairNormalizeURL, Detail: u + " -> " + cv.URLs[n]})
+			}
+		}
+	}
+	return actions
+}
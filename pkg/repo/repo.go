@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -12,14 +13,12 @@ import (
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/Masterminds/semver/v3"
 	"github.com/ghodss/yaml"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/api/googleapi"
 	"helm.sh/helm/v3/pkg/chart"
-	"helm.sh/helm/v3/pkg/chart/loader"
-	"helm.sh/helm/v3/pkg/helmpath"
-	"helm.sh/helm/v3/pkg/provenance"
 	"helm.sh/helm/v3/pkg/repo"
 
 	"github.com/hayorov/helm-gcs/pkg/gcs"
@@ -30,9 +29,19 @@ var (
 	// that is being updated at the same time.
 	ErrIndexOutOfDate = errors.New("index is out-of-date")
 
-	// Debug is used to activate log output
-	Debug bool
-	log   = logger()
+	log = logger()
+)
+
+// Verbosity levels of the log output, see SetVerbosity.
+const (
+	// VerbosityQuiet only logs errors.
+	VerbosityQuiet = -1
+	// VerbosityNormal logs informational messages and warnings, the default.
+	VerbosityNormal = 0
+	// VerbosityDebug logs the operations on the repository.
+	VerbosityDebug = 1
+	// VerbosityTrace also logs the generations and preconditions of the objects read and written.
+	VerbosityTrace = 2
 )
 
 // Repo manages Helm repositories on Google Cloud Storage.
@@ -41,44 +50,227 @@ type Repo struct {
 	indexFileURL        string
 	indexFileGeneration int64
 	gcs                 *storage.Client
+	checksums           bool
+	changelog           bool
+	rejectLibraries     bool
+	dependencyRewrites  map[string]string
+	checkDeps           bool
+	siblingRepos        []string
+	signer              IndexSigner
+	signCharts          bool
+	chartSigner         IndexSigner
+	mirrorURLs          []string
+	requireProv         bool
+	provKeyring         string
+	provKey             string
+	concurrency         int
+	chunkSize           int
+	lockTTL             time.Duration
+	gzipIndex           bool
+	versionOverride     string
+	appVersionOverride  string
+	storageClass        string
+	customTime          time.Time
+	chartHeaders        ObjectHeaders
+	lintMode            string
+	stats               *Stats
+	uploader            *gcs.Uploader
+	progress            ProgressReporter
+	build               *BuildInfo
+	shards              *shardState
+	strictIndex         bool
+	fsys                FS
+	// contentAddressable is set by pushes to a repository with the content-addressable layout.
+	contentAddressable bool
 }
 
-// New creates a new Repo object
-func New(path string, gcs *storage.Client) (*Repo, error) {
-	indexFileURL, err := resolveReference(path, "index.yaml")
-	if err != nil {
-		return nil, errors.Wrap(err, "resolve index reference")
+// Option configures optional behaviours of a Repo.
+type Option func(*Repo)
+
+// WithChecksums makes the repository maintain a SHA256SUMS file,
+// listing the digest of every chart, on each push and removal.
+func WithChecksums(enabled bool) Option {
+	return func(r *Repo) {
+		r.checksums = enabled
+	}
+}
+
+// WithChangelog makes the repository record every push and removal
+// in a CHANGELOG.ndjson file.
+func WithChangelog(enabled bool) Option {
+	return func(r *Repo) {
+		r.changelog = enabled
+	}
+}
+
+// WithRejectLibraries makes the push of library charts fail, whatever the policy of the repository.
+func WithRejectLibraries(reject bool) Option {
+	return func(r *Repo) {
+		r.rejectLibraries = reject
+	}
+}
+
+// WithDependencyRewrites rewrites the repository URLs of the dependencies of pushed charts,
+// in Chart.yaml and Chart.lock. rewrites maps old URLs (or URL prefixes) to new ones.
+func WithDependencyRewrites(rewrites map[string]string) Option {
+	return func(r *Repo) {
+		r.dependencyRewrites = rewrites
+	}
+}
+
+// WithCheckDependencies makes the push of a chart fail if a dependency pinned in its Chart.lock,
+// or without Chart.lock matching a version range of its Chart.yaml, is missing from the repository,
+// or from one of the sibling repositories given by helm name or gs:// URL.
+func WithCheckDependencies(enabled bool, siblings ...string) Option {
+	return func(r *Repo) {
+		r.checkDeps = enabled
+		r.siblingRepos = siblings
+	}
+}
+
+// WithUploader makes the repository upload charts with resumable upload sessions,
+// so an interrupted push of a large chart continues from the last committed chunk.
+func WithUploader(u *gcs.Uploader) Option {
+	return func(r *Repo) {
+		r.uploader = u
+	}
+}
+
+// defaultConcurrency is the number of objects handled in parallel by default.
+const defaultConcurrency = 8
+
+// WithConcurrency sets the number of objects handled in parallel, e.g. when deleting charts.
+func WithConcurrency(n int) Option {
+	return func(r *Repo) {
+		r.concurrency = n
+	}
+}
+
+// WithChunkSize sets the size of the chunks charts are uploaded in, rounded up to a multiple
+// of 256 KiB. A failed chunk is retried on its own, according to the retry policy of the gcs
+// package, rather than the whole upload. 0 keeps the default size.
+// It applies to resumable uploads too, see WithUploader.
+func WithChunkSize(size int) Option {
+	return func(r *Repo) {
+		r.chunkSize = size
+	}
+}
+
+// WithStorageClass sets the storage class of the pushed charts, e.g. "NEARLINE" for archival
+// repositories, the default class of the bucket if empty.
+func WithStorageClass(class string) Option {
+	return func(r *Repo) {
+		r.storageClass = strings.ToUpper(class)
+	}
+}
+
+// WithCustomTime sets the CustomTime of the pushed charts, which bucket lifecycle rules
+// can act on (daysSinceCustomTime). The zero time leaves it unset.
+func WithCustomTime(t time.Time) Option {
+	return func(r *Repo) {
+		r.customTime = t
 	}
-	return &Repo{
-		entry:        nil,
-		indexFileURL: indexFileURL,
-		gcs:          gcs,
-	}, nil
+}
+
+// Cache-Control of the chart objects when none is set with WithChartHeaders: an archive is
+// never changed once pushed, unless it is overwritten with force, which must not be cached.
+const (
+	DefaultChartCacheControl     = "public, max-age=31536000, immutable"
+	OverwrittenChartCacheControl = "no-cache, max-age=0"
+)
+
+// ObjectHeaders are the HTTP headers served with the chart objects. Empty values keep the
+// defaults: DefaultChartCacheControl, or OverwrittenChartCacheControl for charts overwritten with force.
+type ObjectHeaders struct {
+	CacheControl       string
+	ContentDisposition string
+	ContentType        string
+}
+
+// WithChartHeaders sets the HTTP headers served with the pushed charts, e.g. a long
+// Cache-Control for public repositories behind a CDN.
+func WithChartHeaders(h ObjectHeaders) Option {
+	return func(r *Repo) {
+		r.chartHeaders = h
+	}
+}
+
+// WithStrictIndex makes loading an index file with invalid entries fail, rather than
+// only log a warning for each of them, see IndexValidationError.
+func WithStrictIndex(strict bool) Option {
+	return func(r *Repo) {
+		r.strictIndex = strict
+	}
+}
+
+// WithGzipIndex makes the repository write its index file gzip compressed, with
+// "Content-Encoding: gzip", which makes huge indexes several times faster to transfer.
+// Readers get the index decompressed, by GCS or their HTTP client.
+func WithGzipIndex(enabled bool) Option {
+	return func(r *Repo) {
+		r.gzipIndex = enabled
+	}
+}
+
+// WithVersionOverrides makes pushes set the version and the appVersion of the charts,
+// e.g. to stamp a build number, repackaging them with the rewritten Chart.yaml.
+// Empty values keep the versions of the charts.
+func WithVersionOverrides(version, appVersion string) Option {
+	return func(r *Repo) {
+		r.versionOverride = version
+		r.appVersionOverride = appVersion
+	}
+}
+
+func (r Repo) workers() int {
+	if r.concurrency < 1 {
+		return defaultConcurrency
+	}
+	return r.concurrency
+}
+
+// New creates a new Repo object
+func New(path string, gcs *storage.Client, opts ...Option) (*Repo, error) {
+	return newRepo(&repo.Entry{URL: path}, gcs, opts)
+}
+
+// NewWithEntry creates a Repo object for the repository at url (gs://bucket/path), known
+// by name, without looking it up in the helm repository config file: Go programs can
+// manage repositories the same way as the CLI, without helm being set up.
+func NewWithEntry(url, name string, gcs *storage.Client, opts ...Option) (*Repo, error) {
+	return newRepo(&repo.Entry{Name: name, URL: url}, gcs, opts)
 }
 
 // Load loads an existing repository known by Helm.
 // Returns ErrNotFound if the repository is not found in helm repository entries.
-func Load(name string, gcs *storage.Client) (*Repo, error) {
+func Load(name string, gcs *storage.Client, opts ...Option) (*Repo, error) {
 	entry, err := retrieveRepositoryEntry(name)
 	if err != nil {
 		return nil, errors.Wrap(err, "repo entry")
 	}
+	return newRepo(entry, gcs, opts)
+}
 
+func newRepo(entry *repo.Entry, gcs *storage.Client, opts []Option) (*Repo, error) {
 	indexFileURL, err := resolveReference(entry.URL, "index.yaml")
 	if err != nil {
 		return nil, errors.Wrap(err, "resolve index reference")
 	}
-
-	return &Repo{
+	r := &Repo{
 		entry:        entry,
 		indexFileURL: indexFileURL,
 		gcs:          gcs,
-	}, nil
+		shards:       &shardState{cache: map[string][]byte{}},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r, nil
 }
 
 // Create creates a new repository on GCS by uploading a blank index.yaml file.
 // This function is idempotent.
-func Create(r *Repo) error {
+func Create(ctx context.Context, r *Repo) error {
 	log.Debugf("create a repository with index file at %s", r.indexFileURL)
 
 	o, err := gcs.Object(r.gcs, r.indexFileURL)
@@ -86,248 +278,667 @@ func Create(r *Repo) error {
 		return errors.Wrap(err, "object")
 	}
 
-	_, err = o.NewReader(context.Background())
+	attrs, err := o.Attrs(ctx)
 	if err == storage.ErrObjectNotExist {
 		i := repo.NewIndexFile()
-		return r.uploadIndexFile(i)
+		return r.uploadIndexFile(ctx, i)
 	} else if err == nil {
 		log.Debugf("file %s already exists", r.indexFileURL)
+		r.indexFileGeneration = attrs.Generation
 		return nil
 	}
 	return err
 }
 
+// Reset replaces the index file of the repository with an empty one, creating the
+// repository if it doesn't exist. The chart files are left in the bucket.
+func Reset(ctx context.Context, r *Repo) error {
+	log.Debugf("reset the repository with index file at %s", r.indexFileURL)
+	// a sharded repository stays sharded, the index of a flat one may be invalid
+	_, _, err := r.readFlatIndexBytes(ctx)
+	if errors.Is(err, errShardedLayout) || errors.Is(err, storage.ErrObjectNotExist) {
+		_, _, err = r.loadShardsIndex(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	r.indexFileGeneration = 0
+	return r.uploadIndexFile(ctx, repo.NewIndexFile())
+}
+
 // PushChart adds a chart into the repository.
 //
 // The index file on GCS will be updated and the file at "chartpath" will be uploaded to GCS.
+// The pushed chart is described by the returned result.
 // If the version of the chart is already indexed, it won't be uploaded unless "force" is set to true.
 // The push will fail if the repository is updated at the same time, use "retry" to automatically reload
 // the index of the repository.
-func (r Repo) PushChart(chartpath string, force, retry bool, public bool, publicURL string, bucketPath string, metadata map[string]string) error {
-	i, err := r.indexFile()
+func (r Repo) PushChart(ctx context.Context, chartpath string, force, retry bool, public bool, publicURL string, bucketPath string, metadata map[string]string) (*PushResult, error) {
+	unlock, err := r.lock(ctx)
 	if err != nil {
-		return errors.Wrap(err, "load index file")
+		return nil, err
 	}
+	defer unlock()
 
 	log.Debugf("load chart \"%s\" (force=%t, retry=%t, public=%t)", chartpath, force, retry, public)
-	chart, err := loader.Load(chartpath)
+	chart, chartpath, cleanup, err := r.loadChart(chartpath)
 	if err != nil {
-		return errors.Wrap(err, "load chart")
+		return nil, err
 	}
+	defer cleanup()
 
 	log.Debugf("chart loaded: %s-%s", chart.Metadata.Name, chart.Metadata.Version)
+	i, err := r.shallowIndexFile(ctx, pushedCharts(chart)...)
+	if err != nil {
+		return nil, errors.Wrap(err, "load index file")
+	}
+	if err := r.checkLibrary(i, chart); err != nil {
+		return nil, err
+	}
+	if err := r.checkDependencies(ctx, i, chart); err != nil {
+		return nil, err
+	}
+	if err := r.lintChart(i, chart, chartpath); err != nil {
+		return nil, err
+	}
 	if i.Has(chart.Metadata.Name, chart.Metadata.Version) && !force {
-		return fmt.Errorf("chart %s-%s already indexed. Use --force to still upload the chart", chart.Metadata.Name, chart.Metadata.Version)
+		return nil, fmt.Errorf("chart %s-%s already indexed. Use --force to still upload the chart", chart.Metadata.Name, chart.Metadata.Version)
 	}
 
-	err = r.updateIndexFile(i, chartpath, chart, public, publicURL, bucketPath)
-	if err == ErrIndexOutOfDate && retry {
-		for err == ErrIndexOutOfDate {
-			i, err = r.indexFile()
-			if err != nil {
-				return errors.Wrap(err, "load index file")
-			}
-			err = r.updateIndexFile(i, chartpath, chart, public, publicURL, bucketPath)
-		}
+	// computed once, as they don't change when the index update is retried
+	hash, err := r.digestFile(chartpath)
+	if err != nil {
+		return nil, errors.Wrap(err, "generate chart file digest")
 	}
+	if bucketPath, err = r.useLayout(i, bucketPath); err != nil {
+		return nil, err
+	}
+	chartpath, cleanupStaged, err := r.stageChart(chartpath, hash)
 	if err != nil {
-		return errors.Wrap(err, "update index file")
+		return nil, err
+	}
+	defer cleanupStaged()
+	chartBaseURL, urls, err := r.chartBaseURLs(bucketPath, public, publicURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.checkChartObject(ctx, chartpath, chartBaseURL, force); err != nil {
+		return nil, err
 	}
 
+	// the chart is uploaded before the index points to it, and only moved to its final
+	// object afterwards: a failed push leaves at most a temporary object behind
 	log.Debugf("upload file to GCS")
-	err = r.uploadChart(chartpath, metadata)
+	upload, err := r.stageUpload(ctx, chartpath, chartBaseURL, r.buildMetadata(metadata), force)
 	if err != nil {
-		return errors.Wrap(err, "write chart")
+		return nil, errors.Wrap(err, "write chart")
 	}
-	return nil
+	i, pruned, err := r.addToIndexFile(ctx, i, upload, chart, urls, hash, force, retry)
+	if err != nil {
+		r.abortUpload(ctx, upload)
+		return nil, errors.Wrap(err, "update index file")
+	}
+	if err := r.commitUpload(ctx, upload); err != nil {
+		return nil, errors.Wrap(r.revertUploads(ctx, []*chartUpload{upload}, err), "write chart")
+	}
+	if err := r.afterPush(ctx, i, pruned, chart); err != nil {
+		return nil, err
+	}
+	return r.pushResult(chart, chartpath, chartBaseURL, hash)
+}
+
+// addToIndexFile adds the staged chart u to the index i and uploads it. With retry, the index
+// is reloaded and the chart added again while it is updated concurrently.
+// It returns the uploaded index and the versions pruned by the max-versions policies.
+func (r *Repo) addToIndexFile(ctx context.Context, i *repo.IndexFile, u *chartUpload, chart *chart.Chart, urls []string, hash string, force, retry bool) (*repo.IndexFile, repo.ChartVersions, error) {
+	pruned, err := r.updateIndexFile(ctx, i, u, chart, urls, hash)
+	for errors.Is(err, ErrIndexOutOfDate) && retry {
+		i, err = r.reloadIndexFile(ctx)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "load index file")
+		}
+		// the version may have been pushed concurrently
+		if i.Has(chart.Metadata.Name, chart.Metadata.Version) && !force {
+			return nil, nil, fmt.Errorf("chart %s-%s already indexed. Use --force to still upload the chart", chart.Metadata.Name, chart.Metadata.Version)
+		}
+		pruned, err = r.updateIndexFile(ctx, i, u, chart, urls, hash)
+	}
+	return i, pruned, err
+}
+
+// pushedCharts returns the charts whose index entries are read to push c: c and the
+// dependencies it may check.
+func pushedCharts(c *chart.Chart) []string {
+	names := []string{c.Metadata.Name}
+	for _, dep := range c.Metadata.Dependencies {
+		names = append(names, dep.Name)
+	}
+	if c.Lock != nil {
+		for _, dep := range c.Lock.Dependencies {
+			names = append(names, dep.Name)
+		}
+	}
+	return names
+}
+
+// pushResult describes the chart at chartpath, pushed under baseURL.
+func (r Repo) pushResult(c *chart.Chart, chartpath, baseURL, hash string) (*PushResult, error) {
+	chartURL, err := resolveReference(baseURL, filepath.Base(chartpath))
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve reference")
+	}
+	return &PushResult{
+		Name:            c.Metadata.Name,
+		Version:         c.Metadata.Version,
+		Digest:          hash,
+		URL:             chartURL,
+		IndexGeneration: r.indexFileGeneration,
+	}, nil
+}
+
+// chartBaseURLs returns the URL of the directory charts are uploaded to, and the base URLs
+// they are indexed with: the main one, then the mirrors of WithMirrorURLs. bucketPath, relative
+// to the repository, applies to all of them so the index entries always point to the uploaded
+// objects, e.g. with bucketPath "charts/stable" and publicURL "https://charts.example.com",
+// charts are uploaded to <repository>/charts/stable/ and indexed as
+// https://charts.example.com/charts/stable/<chart>.tgz.
+func (r Repo) chartBaseURLs(bucketPath string, public bool, publicURL string) (string, []string, error) {
+	bucketPath, err := cleanBucketPath(bucketPath)
+	if err != nil {
+		return "", nil, err
+	}
+	objectURL, err := resolveReference(r.baseURL(), bucketPath)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "resolve reference")
+	}
+	var indexURL string
+	if public && publicURL != "" {
+		indexURL, err = resolveReference(publicURL, bucketPath)
+		err = errors.Wrap(err, "resolve reference")
+	} else {
+		indexURL, err = getURL(objectURL, public, "")
+		err = errors.Wrap(err, "get chart base url")
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	indexURLs := []string{indexURL}
+	for _, mirror := range r.mirrorURLs {
+		mirrorURL, err := resolveReference(mirror, bucketPath)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "resolve mirror reference")
+		}
+		indexURLs = append(indexURLs, mirrorURL)
+	}
+	return objectURL, indexURLs, nil
+}
+
+// cleanBucketPath normalizes a path relative to the repository, which must stay inside it.
+// Backslashes are separators too, as in paths typed on Windows.
+func cleanBucketPath(bucketPath string) (string, error) {
+	bucketPath = strings.ReplaceAll(bucketPath, `\`, "/")
+	for _, segment := range strings.Split(bucketPath, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("invalid bucket path %q, it must be inside the repository", bucketPath)
+		}
+	}
+	return strings.Trim(path.Clean("/"+bucketPath), "/"), nil
+}
+
+// afterPush deletes the charts pruned by the push of charts, then updates the checksums and
+// the changelog.
+func (r Repo) afterPush(ctx context.Context, i *repo.IndexFile, pruned repo.ChartVersions, charts ...*chart.Chart) error {
+	if r.needsFullIndex(i) {
+		var err error
+		if i, err = r.fullIndexFile(ctx, i); err != nil {
+			return errors.Wrap(err, "load index file")
+		}
+	}
+	if err := r.deleteChartObjects(ctx, r.unreferenced(i, pruned)); err != nil {
+		return errors.Wrap(err, "prune charts")
+	}
+	if err := r.updateChecksums(ctx, i); err != nil {
+		return err
+	}
+	var entries []ChangelogEntry
+	for _, c := range charts {
+		pushed, _ := i.Get(c.Metadata.Name, c.Metadata.Version)
+		entries = append(entries, changelogEntries(ChangelogPush, pushed)...)
+	}
+	return r.appendChangelog(ctx, append(entries, changelogEntries(ChangelogRemove, pruned...)...)...)
+}
+
+// Removal describes a chart version removed from the repository, with its objects.
+type Removal struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Objects []string `json:"objects"`
+	// IndexGeneration is the generation of the index file written by the removal.
+	IndexGeneration int64 `json:"indexGeneration,omitempty"`
+}
+
+// PushResult describes a chart pushed into the repository.
+type PushResult struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Digest  string `json:"digest"`
+	// URL is the gs:// URL of the chart object.
+	URL string `json:"url"`
+	// IndexGeneration is the generation of the index file written by the push.
+	IndexGeneration int64 `json:"indexGeneration"`
 }
 
 // RemoveChart removes a chart from the repository
 // If version is empty, all version will be deleted.
-func (r Repo) RemoveChart(name, version string, retry bool) error {
+// With dryRun, nothing is changed: the removals are only returned, with the objects
+// which exist and would be deleted.
+func (r Repo) RemoveChart(ctx context.Context, name, version string, retry, dryRun bool) ([]Removal, error) {
 	log.Debugf("removing chart %s-%s", name, version)
+	removals, err := r.removeChart(ctx, name, func(v *repo.ChartVersion) bool {
+		return version == "" || version == v.Version
+	}, retry, dryRun)
+	if errors.Is(err, errNoVersionRemoved) {
+		return nil, notFoundf("chart \"%s-%s\" not found", name, version)
+	}
+	return removals, err
+}
+
+// RemoveChartVersions removes the versions of a chart matching a semver constraint,
+// e.g. "<1.0.0" or "1.2.x", in a single update of the index. Versions which aren't
+// valid semver never match. See RemoveChart for dryRun.
+func (r Repo) RemoveChartVersions(ctx context.Context, name, constraint string, retry, dryRun bool) ([]Removal, error) {
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid version constraint %q", constraint)
+	}
+	log.Debugf("removing chart %s versions %s", name, constraint)
+	removals, err := r.removeChart(ctx, name, func(v *repo.ChartVersion) bool {
+		sv, err := semver.NewVersion(v.Version)
+		return err == nil && c.Check(sv)
+	}, retry, dryRun)
+	if errors.Is(err, errNoVersionRemoved) {
+		return nil, notFoundf("no version of chart %q matches %s", name, constraint)
+	}
+	return removals, err
+}
+
+// errNoVersionRemoved is returned by removeChart when no version matches.
+var errNoVersionRemoved = errors.New("no version removed")
+
+// removeChart removes the versions of a chart for which match returns true.
+func (r Repo) removeChart(ctx context.Context, name string, match func(*repo.ChartVersion) bool, retry, dryRun bool) ([]Removal, error) {
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
 removeChart:
-	index, err := r.indexFile()
+	index, err := r.shallowIndexFile(ctx, name)
 	if err != nil {
-		return errors.Wrap(err, "index")
+		return nil, errors.Wrap(err, "index")
 	}
 
 	vs, ok := index.Entries[name]
 	if !ok {
-		return fmt.Errorf("chart \"%s\" not found", name)
+		return nil, notFoundf("chart \"%s\" not found", name)
 	}
 
-	urls := []string{}
-	for i, v := range vs {
-		if version == "" || version == v.Version {
+	removed, kept := repo.ChartVersions{}, repo.ChartVersions{}
+	for _, v := range vs {
+		if match(v) {
 			log.Debugf("%s-%s will be deleted", name, v.Version)
-			urls = append(urls, v.URLs...)
-		}
-		if version == v.Version {
-			vs[i] = vs[len(vs)-1]
-			vs[len(vs)-1] = nil
-			index.Entries[name] = vs[:len(vs)-1]
-			break
+			removed = append(removed, v)
+		} else {
+			kept = append(kept, v)
 		}
 	}
-	if version == "" || len(index.Entries[name]) == 0 {
+	if len(removed) == 0 {
+		return nil, errNoVersionRemoved
+	}
+	if len(kept) == 0 {
 		delete(index.Entries, name)
+	} else {
+		index.Entries[name] = kept
+	}
+	if dryRun {
+		return r.removals(ctx, removed)
 	}
 
-	err = r.uploadIndexFile(index)
-	if err == ErrIndexOutOfDate && retry {
+	err = r.uploadIndexFile(ctx, index)
+	if errors.Is(err, ErrIndexOutOfDate) && retry {
 		goto removeChart
 	}
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Delete charts from GCS
-	for _, url := range urls {
-		o, err := gcs.Object(r.gcs, url)
-		if err != nil {
-			return errors.Wrap(err, "object")
+	return r.afterRemove(ctx, index, removed)
+}
+
+// afterRemove deletes the objects of the versions removed from the index i, and updates
+// the checksums and the changelog.
+func (r Repo) afterRemove(ctx context.Context, i *repo.IndexFile, removed repo.ChartVersions) ([]Removal, error) {
+	if r.needsFullIndex(i) {
+		var err error
+		if i, err = r.fullIndexFile(ctx, i); err != nil {
+			return nil, errors.Wrap(err, "load index file")
 		}
+	}
+	if err := r.deleteChartObjects(ctx, r.unreferenced(i, removed)); err != nil {
+		return nil, err
+	}
+	if err := r.updateChecksums(ctx, i); err != nil {
+		return nil, err
+	}
+	removals := make([]Removal, 0, len(removed))
+	for _, cv := range removed {
+		removals = append(removals, Removal{Name: cv.Name, Version: cv.Version, Objects: r.chartObjects(cv), IndexGeneration: r.indexFileGeneration})
+	}
+	return removals, r.appendChangelog(ctx, changelogEntries(ChangelogRemove, removed...)...)
+}
 
-		log.Debugf("delete gcs file %s", url)
-		err = o.Delete(context.Background())
-		if err != nil {
-			return errors.Wrap(err, "delete")
+// removals returns the removals of versions, with their objects which exist.
+func (r Repo) removals(ctx context.Context, versions repo.ChartVersions) ([]Removal, error) {
+	removals := make([]Removal, 0, len(versions))
+	for _, cv := range versions {
+		removal := Removal{Name: cv.Name, Version: cv.Version}
+		for _, u := range r.chartObjects(cv) {
+			o, err := gcs.Object(r.gcs, u)
+			if err != nil {
+				return nil, errors.Wrap(err, "object")
+			}
+			_, err = o.Attrs(ctx)
+			if err == storage.ErrObjectNotExist {
+				continue
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "attrs of %s", u)
+			}
+			removal.Objects = append(removal.Objects, u)
 		}
+		removals = append(removals, removal)
 	}
-	return nil
+	return removals, nil
 }
 
 // uploadIndexFile update the index file on GCS.
-func (r Repo) uploadIndexFile(i *repo.IndexFile) error {
+func (r *Repo) uploadIndexFile(ctx context.Context, i *repo.IndexFile) error {
 	log.Debugf("push index file")
 
 	i.SortEntries()
 	i.Generated = time.Now()
+	if r.shards.index != nil {
+		return r.uploadShardedIndexFile(ctx, i)
+	}
 
-	o, err := gcs.Object(r.gcs, r.indexFileURL)
-	if r.indexFileGeneration != 0 {
-		log.Debugf("update condition: if generation = %d", r.indexFileGeneration)
-		o = o.If(storage.Conditions{GenerationMatch: r.indexFileGeneration})
+	b, err := yaml.Marshal(i)
+	if err != nil {
+		return errors.Wrap(err, "marshal")
+	}
+	start := time.Now()
+	generation, err := r.writeIndexObject(ctx, r.indexFileURL, b, r.indexFileGeneration)
+	if errors.Is(err, errPreconditionFailed) {
+		r.stats.since(OpIndexConflict, start)
+		// the repository may have been sharded meanwhile
+		r.shards.checked = false
+		return r.indexConflict(ctx, r.indexFileURL)
+	}
+	if err != nil {
+		return err
 	}
+	r.indexFileGeneration = generation
+	if r.signer != nil {
+		return r.uploadSignature(ctx, r.signer, r.indexFileURL, b)
+	}
+	return nil
+}
+
+// errPreconditionFailed is returned by writeIndexObject when the object changed.
+var errPreconditionFailed = errors.New("precondition failed")
+
+// indexDoesNotExist is the generation writeIndexObject is given to create an index file
+// which must not exist yet.
+const indexDoesNotExist int64 = -1
 
-	w := o.NewWriter(context.Background())
+// writeIndexObject writes b, an index file in YAML, at url, only if the object is at this
+// generation, unless generation is 0, or doesn't exist with indexDoesNotExist.
+// It returns the generation of the new object.
+func (r *Repo) writeIndexObject(ctx context.Context, url string, b []byte, generation int64) (int64, error) {
+	defer r.stats.since(OpIndexWrite, time.Now())
+	o, err := gcs.Object(r.gcs, url)
 	if err != nil {
-		return errors.Wrap(err, "writer")
+		return 0, errors.Wrap(err, "object")
 	}
+	switch generation {
+	case 0:
+	case indexDoesNotExist:
+		log.Tracef("update condition: if the object does not exist")
+		o = o.If(storage.Conditions{DoesNotExist: true})
+	default:
+		log.Tracef("update condition: if generation = %d", generation)
+		o = o.If(storage.Conditions{GenerationMatch: generation})
+	}
+
+	w := gcs.NewWriter(ctx, o)
 	// ensure index.yaml is not cached by GCS
 	w.CacheControl = "no-cache, max-age=0, no-transform"
 
 	// set the correct Content-Type ("text/yaml") for index.yaml file (solves issue #92)
 	w.ContentType = "text/yaml"
 
-	b, err := yaml.Marshal(i)
-	if err != nil {
-		return errors.Wrap(err, "marshal")
+	body := b
+	if r.gzipIndex {
+		if body, err = gcs.Gzip(b); err != nil {
+			return 0, err
+		}
+		// GCS decompresses the index for clients which don't accept gzip,
+		// unless the cache control forbids transformations
+		w.ContentEncoding = "gzip"
+		w.CacheControl = "no-cache, max-age=0"
 	}
-	_, err = w.Write(b)
+	r.report(PhaseIndex, url, 0, int64(len(body)))
+	_, err = w.Write(body)
 	if err != nil {
-		return errors.Wrap(err, "write")
+		return 0, errors.Wrap(err, "write")
 	}
 	err = w.Close()
+	if err == nil {
+		r.report(PhaseIndex, url, int64(len(body)), int64(len(body)))
+	}
 	if err != nil {
-		gerr, ok := err.(*googleapi.Error)
-		if ok && gerr.Code == 412 {
-			return ErrIndexOutOfDate
+		if isPreconditionFailed(err) {
+			return 0, errPreconditionFailed
 		}
-		return errors.Wrap(err, "close")
+		return 0, errors.Wrap(err, "close")
 	}
-	return nil
+	return w.Attrs().Generation, nil
 }
 
 // indexFile retrieves the index file from GCS.
 // It will also retrieve the generation number of the file, for optimistic locking.
-func (r *Repo) indexFile() (*repo.IndexFile, error) {
-	log.Debugf("load index file \"%s\"", r.indexFileURL)
+// The index of a sharded repository is assembled from its shards.
+func (r *Repo) indexFile(ctx context.Context) (*repo.IndexFile, error) {
+	return r.readIndex(ctx, nil)
+}
 
-	// retrieve index file generation
-	o, err := gcs.Object(r.gcs, r.indexFileURL)
+// flatIndexFile reads the index.yaml of a repository which isn't sharded. It returns
+// errShardedLayout if the repository is sharded, see readFlatIndexBytes.
+func (r *Repo) flatIndexFile(ctx context.Context) (*repo.IndexFile, error) {
+	log.Debugf("load index file \"%s\"", r.indexFileURL)
+	b, generation, err := r.readFlatIndexBytes(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "object")
+		return nil, err
+	}
+	r.shards.checked, r.shards.index = true, nil
+	i := &repo.IndexFile{}
+	if err := yaml.Unmarshal(b, i); err != nil {
+		return nil, errors.Wrap(err, "unmarshal")
 	}
-	attrs, err := o.Attrs(context.Background())
+	r.indexFileGeneration = generation
+	log.Tracef("index file generation: %d", r.indexFileGeneration)
+	// before sorting, to report the entries in the order of the file
+	if err := r.validateIndex(i, b); err != nil {
+		return nil, err
+	}
+	i.SortEntries()
+	return i, nil
+}
+
+// readIndexObject reads the YAML object at url, possibly gzip compressed, into v.
+// It returns the generation of the object.
+func (r *Repo) readIndexObject(ctx context.Context, url string, v interface{}) (int64, error) {
+	b, generation, err := r.readIndexBytes(ctx, url)
 	if err != nil {
-		return nil, errors.Wrap(err, "attrs")
+		return 0, err
+	}
+	if err := yaml.Unmarshal(b, v); err != nil {
+		return 0, errors.Wrap(err, "unmarshal")
 	}
-	r.indexFileGeneration = attrs.Generation
-	log.Debugf("index file generation: %d", r.indexFileGeneration)
+	return generation, nil
+}
 
-	// get file
-	reader, err := o.NewReader(context.Background())
+// readIndexBytes reads the object at url, decompressed if it is gzip compressed, and returns
+// its content with its generation.
+func (r *Repo) readIndexBytes(ctx context.Context, url string) ([]byte, int64, error) {
+	defer r.stats.since(OpIndexRead, time.Now())
+	o, err := gcs.Object(r.gcs, url)
 	if err != nil {
-		return nil, errors.Wrap(err, "reader")
+		return nil, 0, errors.Wrap(err, "object")
 	}
-	b, err := io.ReadAll(reader)
+	reader, err := o.NewReader(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "read")
+		return nil, 0, errors.Wrap(err, "reader")
 	}
 	defer reader.Close()
 
-	i := &repo.IndexFile{}
-	if err := yaml.Unmarshal(b, i); err != nil {
-		return nil, errors.Wrap(err, "unmarshal")
+	b, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "read")
 	}
-	i.SortEntries()
-	return i, nil
+	if b, err = gcs.Gunzip(b); err != nil {
+		return nil, 0, err
+	}
+	// the reader carries the generation of the file it reads,
+	// no need for a separate attrs request.
+	return b, reader.Attrs.Generation, nil
 }
 
-// uploadChart pushes a chart into the repository.
-func (r Repo) uploadChart(chartpath string, metadata map[string]string) error {
-	f, err := os.Open(chartpath)
+// uploadChart uploads the chart under baseURL, through a temporary object, see stageUpload.
+func (r Repo) uploadChart(ctx context.Context, chartpath, baseURL string, metadata map[string]string, force bool) error {
+	u, err := r.stageUpload(ctx, chartpath, baseURL, metadata, force)
 	if err != nil {
-		return errors.Wrap(err, "open")
+		return err
 	}
-	_, fname := filepath.Split(chartpath)
-	chartURL, err := resolveReference(r.entry.URL, fname)
-	if err != nil {
-		return errors.Wrap(err, "resolve reference")
+	if err := r.commitUpload(ctx, u); err != nil {
+		r.abortUpload(ctx, u)
+		return err
 	}
-	log.Debugf("upload file %s to gcs path %s", fname, chartURL)
-	o, err := gcs.Object(r.gcs, chartURL)
+	return nil
+}
+
+// signChart uploads the provenance file and the signature of the chart, if charts are signed.
+func (r Repo) signChart(ctx context.Context, chartpath, chartURL string) error {
+	if err := r.uploadProvenance(ctx, chartpath, chartURL); err != nil {
+		return err
+	}
+	signer := r.chartSigner
+	if signer == nil && r.signCharts {
+		signer = r.signer
+	}
+	if signer == nil {
+		return nil
+	}
+	b, err := r.files().ReadFile(chartpath)
 	if err != nil {
-		return errors.Wrap(err, "object")
+		return errors.Wrap(err, "read chart")
 	}
+	return r.uploadSignature(ctx, signer, chartURL, b)
+}
 
-	w := o.NewWriter(context.Background())
-
-	w.Metadata = metadata
+// chartCacheControl returns the Cache-Control of a chart object written with conds: the one
+// set with WithChartHeaders, or the default of new or overwritten objects.
+func (r Repo) chartCacheControl(conds storage.Conditions) string {
+	switch {
+	case r.chartHeaders.CacheControl != "":
+		return r.chartHeaders.CacheControl
+	case conds.GenerationMatch != 0:
+		return OverwrittenChartCacheControl
+	}
+	return DefaultChartCacheControl
+}
 
-	_, err = io.Copy(w, f)
+// chartWriteConditions returns the precondition of a chart write: the object must not exist,
+// unless force is set, in which case it must still be at the generation checked now.
+func chartWriteConditions(ctx context.Context, o *storage.ObjectHandle, force bool) (storage.Conditions, error) {
+	if !force {
+		return storage.Conditions{DoesNotExist: true}, nil
+	}
+	attrs, err := o.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return storage.Conditions{DoesNotExist: true}, nil
+	}
 	if err != nil {
-		return errors.Wrap(err, "copy")
+		return storage.Conditions{}, errors.Wrap(err, "attrs")
 	}
+	return storage.Conditions{GenerationMatch: attrs.Generation}, nil
+}
 
-	err = w.Close()
-	if err != nil {
-		return errors.Wrap(err, "close")
+// chartConflict returns the error of a chart write whose precondition failed.
+func chartConflict(chartURL string, force bool) error {
+	if force {
+		return fmt.Errorf("chart object %s was written concurrently", chartURL)
 	}
-	return nil
+	return fmt.Errorf("chart object %s already exists. Use --force to overwrite it", chartURL)
 }
 
-func (r Repo) updateIndexFile(i *repo.IndexFile, chartpath string, chart *chart.Chart, public bool, publicURL string, bucketPath string) error {
-	hash, err := provenance.DigestFile(chartpath)
+// checkChartObject fails if the chart object of chartpath already exists under baseURL,
+// before the index is updated to point to it, unless force is set or the repository is
+// content-addressable.
+func (r Repo) checkChartObject(ctx context.Context, chartpath, baseURL string, force bool) error {
+	if force || r.contentAddressable {
+		return nil
+	}
+	chartURL, err := resolveReference(baseURL, filepath.Base(chartpath))
 	if err != nil {
-		return errors.Wrap(err, "generate chart file digest")
+		return errors.Wrap(err, "resolve reference")
 	}
-
-	if bucketPath != "" {
-		r.entry.URL = fmt.Sprintf("%s/%s", r.entry.URL, bucketPath)
+	o, err := gcs.Object(r.gcs, chartURL)
+	if err != nil {
+		return errors.Wrap(err, "object")
+	}
+	_, err = o.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "attrs")
 	}
+	return chartConflict(chartURL, false)
+}
 
-	url, err := getURL(r.entry.URL, public, publicURL)
+func isPreconditionFailed(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed
+}
+
+// updateIndexFile adds the staged chart u to the index and uploads it.
+// It returns the versions pruned by the max-versions policies.
+func (r *Repo) updateIndexFile(ctx context.Context, i *repo.IndexFile, u *chartUpload, chart *chart.Chart, urls []string, hash string) (repo.ChartVersions, error) {
+	pruned, err := r.indexUpload(i, u, chart, urls, hash)
 	if err != nil {
-		return errors.Wrap(err, "get chart base url")
+		return nil, err
 	}
+	return pruned, r.uploadIndexFile(ctx, i)
+}
 
+// addToIndex adds the chart to the index, replacing the entry of the same version.
+// It returns the versions pruned by the max-versions policies.
+func (r Repo) addToIndex(i *repo.IndexFile, chartpath string, chart *chart.Chart, urls []string, hash string) (repo.ChartVersions, error) {
 	_, fname := filepath.Split(chartpath)
-	log.Debugf("indexing chart '%s-%s' as '%s' (base url: %s)", chart.Metadata.Name, chart.Metadata.Version, fname, url)
+	log.Debugf("indexing chart '%s-%s' as '%s' (base urls: %v)", chart.Metadata.Name, chart.Metadata.Version, fname, urls)
 
 	// Need to remove current version of chart if there is any
 	currentChart, _ := i.Get(chart.Metadata.Name, chart.Metadata.Version)
@@ -343,10 +954,18 @@ func (r Repo) updateIndexFile(i *repo.IndexFile, chartpath string, chart *chart.
 		}
 	}
 
-	if err := i.MustAdd(chart.Metadata, fname, url, hash); err != nil {
-		return errors.Wrap(err, fmt.Sprintf("invalid entry for chart %q %q from %s", chart.Metadata.Name, chart.Metadata.Version, fname))
+	pruned, err := enforceMaxVersions(i, chart)
+	if err != nil {
+		return nil, err
+	}
+	if err := i.MustAdd(chart.Metadata, fname, urls[0], hash); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("invalid entry for chart %q %q from %s", chart.Metadata.Name, chart.Metadata.Version, fname))
 	}
-	return r.uploadIndexFile(i)
+	if err := addMirrorURLs(i, chart, fname, urls[1:]); err != nil {
+		return nil, err
+	}
+	r.annotateBuild(i, chart)
+	return pruned, nil
 }
 
 func getURL(base string, public bool, publicURL string) (string, error) {
@@ -357,11 +976,32 @@ func getURL(base string, public bool, publicURL string) (string, error) {
 	if public && publicURL != "" {
 		return publicURL, nil
 	} else if public {
-		return fmt.Sprintf("https://storage.googleapis.com/%s/%s", baseURL.Host, baseURL.Path), nil
+		return fmt.Sprintf("https://storage.googleapis.com/%s/%s", baseURL.Host, strings.TrimPrefix(baseURL.Path, "/")), nil
 	}
 	return baseURL.String(), nil
 }
 
+// IndexGeneration returns the generation of the index file last read or written by r,
+// e.g. by Create.
+func (r Repo) IndexGeneration() int64 {
+	return r.indexFileGeneration
+}
+
+// Name returns the name of the repository in helm, empty if it was created from its URL.
+func (r Repo) Name() string {
+	return r.entry.Name
+}
+
+// URL returns the gs:// URL of the repository.
+func (r Repo) URL() string {
+	return strings.TrimSuffix(r.baseURL(), "/")
+}
+
+// baseURL returns the URL of the directory holding the index file.
+func (r Repo) baseURL() string {
+	return strings.TrimSuffix(r.indexFileURL, "index.yaml")
+}
+
 func resolveReference(base, p string) (string, error) {
 	baseURL, err := url.Parse(base)
 	if err != nil {
@@ -371,31 +1011,112 @@ func resolveReference(base, p string) (string, error) {
 	return baseURL.String(), nil
 }
 
-func retrieveRepositoryEntry(name string) (*repo.Entry, error) {
-	repoFilePath := envOr("HELM_REPOSITORY_CONFIG", helmpath.ConfigPath("repositories.yaml"))
-	log.Debugf("helm repo file: %s", repoFilePath)
+// GCSRepositories returns the names of the repositories added to helm which are served by GCS.
+func GCSRepositories() ([]string, error) {
+	entries, err := repositoryEntries()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, r := range entries {
+		if strings.HasPrefix(r.URL, "gs://") || strings.HasPrefix(r.URL, "gcs://") {
+			names = append(names, r.Name)
+		}
+	}
+	return names, nil
+}
 
-	repoFile, err := repo.LoadFile(repoFilePath)
+// RepositoryName returns the name of the repository added to helm which holds the object
+// at objectURL, the one with the longest URL if they are nested, or "" if there is none.
+func RepositoryName(objectURL string) (string, error) {
+	entries, err := repositoryEntries()
 	if err != nil {
-		return nil, errors.Wrap(err, "load repo file")
+		return "", err
+	}
+	name, longest := "", 0
+	for _, r := range entries {
+		base := strings.TrimSuffix(r.URL, "/") + "/"
+		if strings.HasPrefix(objectURL, base) && len(base) > longest {
+			name, longest = r.Name, len(base)
+		}
 	}
+	return name, nil
+}
 
-	for _, r := range repoFile.Repositories {
+func retrieveRepositoryEntry(name string) (*repo.Entry, error) {
+	entries, err := repositoryEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range entries {
 		if r.Name == name {
 			return r, nil
 		}
 	}
 
-	return nil, fmt.Errorf("repository \"%s\" does not exist", name)
+	return nil, notFoundf("repository \"%s\" does not exist", name)
+}
+
+// repositoryEntries returns the repositories added to helm.
+// HELM_REPOSITORY_CONFIG can list several files separated by ":", ";" on Windows (e.g. a shared
+// organization file and a personal one): their entries are merged, the first file
+// defining a repository wins. Files which don't exist are skipped.
+// Without HELM_REPOSITORY_CONFIG, the file is found as described by repositoryConfigPaths.
+func repositoryEntries() ([]*repo.Entry, error) {
+	paths := repositoryConfigPaths()
+	var entries []*repo.Entry
+	seen := map[string]bool{}
+	loaded := 0
+	for _, p := range paths {
+		log.Debugf("helm repo file: %s", p)
+		repoFile, err := loadRepositoryFile(p)
+		if os.IsNotExist(errors.Cause(err)) && len(paths) > 1 {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "load repo file")
+		}
+		loaded++
+		for _, r := range repoFile.Repositories {
+			if !seen[r.Name] {
+				seen[r.Name] = true
+				entries = append(entries, r)
+			}
+		}
+	}
+	if loaded == 0 {
+		return nil, fmt.Errorf("no helm repository config file found in %s", strings.Join(paths, ", "))
+	}
+	return entries, nil
+}
+
+// SetVerbosity sets the level of the log output, written on stderr: VerbosityNormal by
+// default, or VerbosityDebug with HELM_GCS_DEBUG=true. Levels above VerbosityTrace are
+// the same as VerbosityTrace.
+func SetVerbosity(level int) {
+	log.Logger.SetLevel(logLevel(level))
+}
+
+// logLevel returns the logrus level of a verbosity level.
+func logLevel(verbosity int) logrus.Level {
+	switch {
+	case verbosity <= VerbosityQuiet:
+		return logrus.ErrorLevel
+	case verbosity == VerbosityNormal:
+		return logrus.InfoLevel
+	case verbosity == VerbosityDebug:
+		return logrus.DebugLevel
+	}
+	return logrus.TraceLevel
 }
 
 func logger() *logrus.Entry {
 	l := logrus.New()
-	level := logrus.InfoLevel
-	if Debug || strings.ToLower(os.Getenv("HELM_GCS_DEBUG")) == "true" {
-		level = logrus.DebugLevel
+	verbosity := VerbosityNormal
+	if strings.ToLower(os.Getenv("HELM_GCS_DEBUG")) == "true" {
+		verbosity = VerbosityDebug
 	}
-	l.SetLevel(level)
+	l.SetLevel(logLevel(verbosity))
 	l.Formatter = &logrus.TextFormatter{}
 	return logrus.NewEntry(l)
 }
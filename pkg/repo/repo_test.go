@@ -0,0 +1,181 @@
+package repo
+
+import (
+	"reflect"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+func TestCleanBucketPath(t *testing.T) {
+	tests := []struct {
+		bucketPath string
+		want       string
+		wantErr    bool
+	}{
+		{bucketPath: "", want: ""},
+		{bucketPath: "/", want: ""},
+		{bucketPath: "charts", want: "charts"},
+		{bucketPath: "charts/stable", want: "charts/stable"},
+		{bucketPath: "/charts/stable/", want: "charts/stable"},
+		{bucketPath: "charts//stable", want: "charts/stable"},
+		{bucketPath: "./charts/./stable", want: "charts/stable"},
+		{bucketPath: `charts\stable`, want: "charts/stable"},
+		{bucketPath: `\charts\stable\`, want: "charts/stable"},
+		{bucketPath: "..", wantErr: true},
+		{bucketPath: "../charts", wantErr: true},
+		{bucketPath: "charts/../../other", wantErr: true},
+		{bucketPath: `charts\..\other`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := cleanBucketPath(tt.bucketPath)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("cleanBucketPath(%q) error = %v, wantErr %t", tt.bucketPath, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("cleanBucketPath(%q) = %q, want %q", tt.bucketPath, got, tt.want)
+		}
+	}
+}
+
+func TestChartBaseURLs(t *testing.T) {
+	tests := []struct {
+		name       string
+		mirrors    []string
+		bucketPath string
+		public     bool
+		publicURL  string
+		wantObject string
+		wantIndex  []string
+		wantErr    bool
+	}{
+		{
+			name:       "repository root",
+			wantObject: "gs://bucket/repo",
+			wantIndex:  []string{"gs://bucket/repo"},
+		},
+		{
+			name:       "nested bucket path",
+			bucketPath: "charts/stable",
+			wantObject: "gs://bucket/repo/charts/stable",
+			wantIndex:  []string{"gs://bucket/repo/charts/stable"},
+		},
+		{
+			name:       "windows bucket path",
+			bucketPath: `charts\stable\`,
+			wantObject: "gs://bucket/repo/charts/stable",
+			wantIndex:  []string{"gs://bucket/repo/charts/stable"},
+		},
+		{
+			name:       "public",
+			bucketPath: "charts",
+			public:     true,
+			wantObject: "gs://bucket/repo/charts",
+			wantIndex:  []string{"https://storage.googleapis.com/bucket/repo/charts"},
+		},
+		{
+			name:       "public URL",
+			bucketPath: "charts/stable",
+			public:     true,
+			publicURL:  "https://charts.example.com",
+			wantObject: "gs://bucket/repo/charts/stable",
+			wantIndex:  []string{"https://charts.example.com/charts/stable"},
+		},
+		{
+			name:       "public URL without public",
+			publicURL:  "https://charts.example.com",
+			wantObject: "gs://bucket/repo",
+			wantIndex:  []string{"gs://bucket/repo"},
+		},
+		{
+			name:       "mirrors",
+			mirrors:    []string{"https://mirror.example.com/stable", "gs://replica/repo"},
+			bucketPath: "charts",
+			wantObject: "gs://bucket/repo/charts",
+			wantIndex:  []string{"gs://bucket/repo/charts", "https://mirror.example.com/stable/charts", "gs://replica/repo/charts"},
+		},
+		{
+			name:       "outside the repository",
+			bucketPath: "../other",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New("gs://bucket/repo", nil, WithMirrorURLs(tt.mirrors...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			object, index, err := r.chartBaseURLs(tt.bucketPath, tt.public, tt.publicURL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("chartBaseURLs() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if object != tt.wantObject {
+				t.Errorf("chartBaseURLs() object URL = %q, want %q", object, tt.wantObject)
+			}
+			if !reflect.DeepEqual(index, tt.wantIndex) {
+				t.Errorf("chartBaseURLs() indexed URLs = %q, want %q", index, tt.wantIndex)
+			}
+		})
+	}
+}
+
+func TestAddToIndexURLs(t *testing.T) {
+	tests := []struct {
+		name       string
+		mirrors    []string
+		bucketPath string
+		public     bool
+		publicURL  string
+		want       []string
+	}{
+		{
+			name: "repository root",
+			want: []string{"gs://bucket/repo/mychart-0.1.0.tgz"},
+		},
+		{
+			name:       "nested bucket path",
+			bucketPath: "charts/stable",
+			want:       []string{"gs://bucket/repo/charts/stable/mychart-0.1.0.tgz"},
+		},
+		{
+			name:       "public URL",
+			bucketPath: "charts/stable",
+			public:     true,
+			publicURL:  "https://charts.example.com/",
+			want:       []string{"https://charts.example.com/charts/stable/mychart-0.1.0.tgz"},
+		},
+		{
+			name:       "mirrors",
+			mirrors:    []string{"https://mirror.example.com/stable"},
+			bucketPath: "charts",
+			want:       []string{"gs://bucket/repo/charts/mychart-0.1.0.tgz", "https://mirror.example.com/stable/charts/mychart-0.1.0.tgz"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New("gs://bucket/repo", nil, WithMirrorURLs(tt.mirrors...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, urls, err := r.chartBaseURLs(tt.bucketPath, tt.public, tt.publicURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			i := repo.NewIndexFile()
+			c := &chart.Chart{Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: "mychart", Version: "0.1.0"}}
+			if _, err := r.addToIndex(i, "/tmp/mychart-0.1.0.tgz", c, urls, "sha256"); err != nil {
+				t.Fatal(err)
+			}
+			cv, err := i.Get("mychart", "0.1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual([]string(cv.URLs), tt.want) {
+				t.Errorf("indexed URLs = %q, want %q", cv.URLs, tt.want)
+			}
+		})
+	}
+}
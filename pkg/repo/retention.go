@@ -0,0 +1,194 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// Retention policies.
+const (
+	// PolicyMaxVersions is the maximum number of versions kept per chart.
+	// It can be set per channel with "max-versions.<channel>", where the channel of a version
+	// is "stable" for releases, or the first identifier of its pre-release (e.g. "rc" for 1.0.0-rc.1).
+	PolicyMaxVersions = "max-versions"
+	// PolicyMaxVersionsAction is what to do when a push exceeds max-versions:
+	// "reject" (default) the push, or "prune" the oldest versions.
+	PolicyMaxVersionsAction = "max-versions-action"
+)
+
+// channelStable is the channel of versions without pre-release.
+const channelStable = "stable"
+
+// versionChannel returns the channel of a version.
+func versionChannel(version string) string {
+	version, _, _ = strings.Cut(version, "+")
+	_, pre, ok := strings.Cut(version, "-")
+	if !ok {
+		return channelStable
+	}
+	channel, _, _ := strings.Cut(pre, ".")
+	return channel
+}
+
+// validateMaxVersions validates the value of a max-versions policy.
+func validateMaxVersions(value string) error {
+	if value == "" {
+		return nil
+	}
+	if n, err := strconv.Atoi(value); err != nil || n < 1 {
+		return fmt.Errorf("invalid value %q for policy %s, should be a positive number", value, PolicyMaxVersions)
+	}
+	return nil
+}
+
+// enforceMaxVersions applies the max-versions policies of the repository to the chart
+// being pushed. Depending on the policy, the push is rejected or the oldest versions
+// beyond the limits are removed from the index and returned, for their objects to be deleted.
+// The pushed version itself is never pruned.
+func enforceMaxVersions(i *repo.IndexFile, c *chart.Chart) (repo.ChartVersions, error) {
+	channel := versionChannel(c.Metadata.Version)
+	scopes := map[string]string{
+		PolicyMaxVersions:                 "",
+		PolicyMaxVersions + "." + channel: channel,
+	}
+	var pruned repo.ChartVersions
+	for policy, scope := range scopes {
+		value := indexPolicy(i, policy)
+		if value == "" {
+			continue
+		}
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid policy %s", policy)
+		}
+		// versions in scope other than the pushed one, newest first
+		var others repo.ChartVersions
+		for _, cv := range i.Entries[c.Metadata.Name] {
+			if cv.Version != c.Metadata.Version && (scope == "" || versionChannel(cv.Version) == scope) {
+				others = append(others, cv)
+			}
+		}
+		if len(others) < limit {
+			continue
+		}
+		if indexPolicy(i, PolicyMaxVersionsAction) != "prune" {
+			return nil, fmt.Errorf("chart %s has %d versions, the repository policy %s=%s rejects more", c.Metadata.Name, len(others), policy, value)
+		}
+		sort.Sort(sort.Reverse(others))
+		for _, cv := range others[limit-1:] {
+			log.Debugf("prune %s-%s, beyond %s=%s", cv.Name, cv.Version, policy, value)
+			removeVersion(i, cv.Name, cv.Version)
+			pruned = append(pruned, cv)
+		}
+	}
+	return pruned, nil
+}
+
+// removeVersion removes a chart version from the index.
+func removeVersion(i *repo.IndexFile, name, version string) {
+	versions := i.Entries[name]
+	for n, cv := range versions {
+		if cv.Version == version {
+			i.Entries[name] = append(versions[:n:n], versions[n+1:]...)
+			return
+		}
+	}
+}
+
+// deleteChartObjects deletes the chart objects of versions removed from the index,
+// with their provenance and signature files, by r.concurrency workers.
+// Objects which are already gone are ignored. Failures are reported per object.
+func (r Repo) deleteChartObjects(ctx context.Context, versions repo.ChartVersions) error {
+	var urls []string
+	for _, cv := range versions {
+		urls = append(urls, r.chartObjects(cv)...)
+	}
+
+	jobs := make(chan string)
+	failures := &DeleteError{Failures: map[string]error{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for n := 0; n < r.workers(); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range jobs {
+				if err := r.deleteObject(ctx, u); err != nil {
+					mu.Lock()
+					failures.Failures[u] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, u := range urls {
+		jobs <- u
+	}
+	close(jobs)
+	wg.Wait()
+	if len(failures.Failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+// chartObjects returns the URLs of the chart objects of a version, with their
+// provenance and signature files, which may not exist.
+// Mirror URLs, after the first one, are left to the caller, see WithMirrorURLs.
+func (r Repo) chartObjects(cv *repo.ChartVersion) []string {
+	var urls []string
+	indexed := cv.URLs
+	if len(indexed) > 1 {
+		indexed = indexed[:1]
+	}
+	for _, u := range indexed {
+		objectURL, err := r.objectURL(u)
+		if err != nil {
+			log.Warnf("can't delete chart %s-%s: %s", cv.Name, cv.Version, err)
+			continue
+		}
+		urls = append(urls, objectURL, objectURL+provSuffix, objectURL+signatureSuffix)
+	}
+	return urls
+}
+
+func (r Repo) deleteObject(ctx context.Context, u string) error {
+	o, err := gcs.Object(r.gcs, u)
+	if err != nil {
+		return errors.Wrap(err, "object")
+	}
+	log.Debugf("delete gcs file %s", u)
+	if err := o.Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	return nil
+}
+
+// DeleteError reports the objects which could not be deleted.
+type DeleteError struct {
+	Failures map[string]error
+}
+
+func (e *DeleteError) Error() string {
+	urls := make([]string, 0, len(e.Failures))
+	for u := range e.Failures {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	msgs := make([]string, 0, len(urls))
+	for _, u := range urls {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", u, e.Failures[u]))
+	}
+	return fmt.Sprintf("failed to delete %d objects:\n  %s", len(urls), strings.Join(msgs, "\n  "))
+}
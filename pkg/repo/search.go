@@ -0,0 +1,71 @@
+package repo
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// SearchOptions selects the versions returned by Search.
+type SearchOptions struct {
+	// Versions returns every matching version, instead of the latest one of each chart.
+	Versions bool
+	// Devel includes pre-release versions.
+	Devel bool
+}
+
+// Search returns the charts whose name, description or keywords contain keyword, case
+// insensitively, sorted by name, latest version first. An empty keyword matches every chart.
+// Only the latest stable version of each chart is returned, unless opts say otherwise.
+func (r Repo) Search(ctx context.Context, keyword string, opts SearchOptions) ([]*repo.ChartVersion, error) {
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "load index file")
+	}
+	return searchIndex(i, keyword, opts), nil
+}
+
+func searchIndex(i *repo.IndexFile, keyword string, opts SearchOptions) []*repo.ChartVersion {
+	names := make([]string, 0, len(i.Entries))
+	for name := range i.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	keyword = strings.ToLower(keyword)
+	results := []*repo.ChartVersion{}
+	for _, name := range names {
+		versions := append(repo.ChartVersions{}, i.Entries[name]...)
+		sort.Sort(sort.Reverse(versions))
+		for _, cv := range versions {
+			if !opts.Devel && versionChannel(cv.Version) != channelStable {
+				continue
+			}
+			if matchesKeyword(cv, keyword) {
+				results = append(results, cv)
+			}
+			if !opts.Versions {
+				break
+			}
+		}
+	}
+	return results
+}
+
+// matchesKeyword reports whether the name, the description or a keyword of the chart
+// version contains keyword, which is lower case.
+func matchesKeyword(cv *repo.ChartVersion, keyword string) bool {
+	if keyword == "" || cv.Metadata == nil {
+		return true
+	}
+	fields := append([]string{cv.Name, cv.Description}, cv.Keywords...)
+	for _, field := range fields {
+		if strings.Contains(strings.ToLower(field), keyword) {
+			return true
+		}
+	}
+	return false
+}
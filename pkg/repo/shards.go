@@ -0,0 +1,692 @@
+package repo
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/repo"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// Sharded index layout.
+//
+// The index of a very large repository can be split into one index file per chart, the
+// shards, under index/, listed by a small top-level index, index/shards.yaml. The shards
+// are named after their content and never modified: an update writes the shards of the
+// charts which changed, then the top-level index, under optimistic locking. Updates are
+// therefore as cheap as the charts they change, and readers always see a consistent index.
+//
+// Helm only reads index.yaml: unless disabled, a merged index.yaml is still rendered
+// after each update, for Helm clients, or on demand only if its rendering is deferred.
+//
+// Push and rm only read the shards of the charts they update: see shallowIndexFile.
+const (
+	shardsDir       = "index/"
+	shardsIndexFile = shardsDir + "shards.yaml"
+
+	// layoutAnnotation marks the index.yaml rendered for a sharded repository.
+	layoutAnnotation = "helm-gcs.index/layout"
+	layoutSharded    = "sharded"
+
+	// maxShardReloads bounds how many times the index is read again when one of its
+	// shards disappears while it is read.
+	maxShardReloads = 3
+
+	// DefaultShardsGCAge is the age beyond which unreferenced shards are garbage collected.
+	// It leaves enough time to writers which wrote a shard to commit it.
+	DefaultShardsGCAge = time.Hour
+)
+
+// shardsIndex is the top-level index of a sharded repository.
+type shardsIndex struct {
+	APIVersion string    `json:"apiVersion"`
+	Generated  time.Time `json:"generated"`
+	// MergedIndex enables the rendering of a merged index.yaml for Helm clients.
+	MergedIndex bool `json:"mergedIndex"`
+	// DeferRender disables the rendering of the merged index.yaml by updates, it is
+	// only rendered by RenderIndex.
+	DeferRender bool                  `json:"deferRender,omitempty"`
+	Annotations map[string]string     `json:"annotations,omitempty"`
+	Shards      map[string]shardEntry `json:"shards"`
+}
+
+// shardEntry references the shard of a chart.
+type shardEntry struct {
+	// Object is the path of the shard, relative to the repository.
+	Object   string `json:"object"`
+	Versions int    `json:"versions"`
+	Latest   string `json:"latest,omitempty"`
+}
+
+// shardState is the sharding state of a repository, shared by the copies of a Repo.
+type shardState struct {
+	// checked is set once the layout of the repository is known.
+	checked bool
+	// index is the top-level index last read or written, nil if the repository isn't sharded.
+	index *shardsIndex
+	// loaded holds the charts whose shards were read by the last shallow read of the
+	// index, nil if the whole index was read.
+	loaded map[string]bool
+	mu     sync.Mutex
+	// cache holds the content of the shards read or written, by object: they never change.
+	cache map[string][]byte
+}
+
+func (r Repo) shardsIndexURL() string {
+	return r.baseURL() + shardsIndexFile
+}
+
+// Sharded reports whether the repository uses the sharded index layout.
+func (r *Repo) Sharded(ctx context.Context) (bool, error) {
+	s, _, err := r.loadShardsIndex(ctx)
+	return s != nil, err
+}
+
+// loadShardsIndex reads the top-level index of the repository, and returns it with its
+// generation. It returns nil if the repository is not sharded.
+func (r *Repo) loadShardsIndex(ctx context.Context) (*shardsIndex, int64, error) {
+	if r.shards.checked && r.shards.index == nil {
+		return nil, 0, nil
+	}
+	s := &shardsIndex{}
+	generation, err := r.readIndexObject(ctx, r.shardsIndexURL(), s)
+	// a forbidden read doesn't tell the layout: writing a flat index.yaml to a sharded
+	// repository would lose the update
+	notSharded := errors.Is(err, storage.ErrObjectNotExist)
+	r.shards.checked = err == nil || notSharded
+	if notSharded {
+		r.shards.index = nil
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "load shards index")
+	}
+	log.Debugf("sharded index, generation: %d", generation)
+	r.shards.index = s
+	return s, generation, nil
+}
+
+// shardedIndexFile assembles the index of a sharded repository from the top-level index s,
+// at generation, and its shards: all of them, or only the shards of the charts names if
+// names is not nil.
+func (r *Repo) shardedIndexFile(ctx context.Context, s *shardsIndex, generation int64, names []string) (*repo.IndexFile, error) {
+	for reloads := 0; ; reloads++ {
+		entries, err := r.loadShards(ctx, s.subset(names))
+		if errors.Is(err, storage.ErrObjectNotExist) && reloads < maxShardReloads {
+			// the shard was garbage collected since the top-level index was read
+			if s, generation, err = r.loadShardsIndex(ctx); err != nil {
+				return nil, err
+			}
+			if s == nil {
+				return r.indexFile(ctx)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.indexFileGeneration = generation
+		r.shards.loaded = nil
+		if names != nil {
+			r.shards.loaded = map[string]bool{}
+			for _, name := range names {
+				r.shards.loaded[name] = true
+			}
+			log.Debugf("shallow index read: %d of %d shards", len(entries), len(s.Shards))
+		}
+		i := &repo.IndexFile{APIVersion: s.APIVersion, Generated: s.Generated, Annotations: s.Annotations, Entries: entries}
+		if err := r.validateIndex(i, nil); err != nil {
+			return nil, err
+		}
+		i.SortEntries()
+		return i, nil
+	}
+}
+
+// subset returns the top-level index s with only the shards of the charts names,
+// or s if names is nil.
+func (s *shardsIndex) subset(names []string) *shardsIndex {
+	if names == nil {
+		return s
+	}
+	subset := &shardsIndex{Shards: map[string]shardEntry{}}
+	for _, name := range names {
+		if shard, ok := s.Shards[name]; ok {
+			subset.Shards[name] = shard
+		}
+	}
+	return subset
+}
+
+// shallowIndexFile returns the index of the repository with the entries of the charts names
+// only, and its annotations. Only the shards of these charts are read if the repository is
+// sharded, rather than the whole index, and uploading the returned index only writes them:
+// the shards of the other charts are kept. The whole index is returned otherwise.
+func (r *Repo) shallowIndexFile(ctx context.Context, names ...string) (*repo.IndexFile, error) {
+	return r.readIndex(ctx, names)
+}
+
+// readIndex returns the index of the repository, with the shards of the charts names only if
+// it is sharded and names is not nil. Unless the repository is known to be sharded, index.yaml
+// is read first: a flat repository costs a single read, and the layout annotation of the
+// index.yaml rendered for a sharded one stops the read before its entries.
+func (r *Repo) readIndex(ctx context.Context, names []string) (*repo.IndexFile, error) {
+	sharded := false
+	if r.shards.index == nil {
+		i, err := r.flatIndexFile(ctx)
+		if err == nil {
+			return i, nil
+		}
+		sharded = errors.Is(err, errShardedLayout)
+		// a sharded repository whose index.yaml wasn't rendered yet
+		missing := errors.Is(err, storage.ErrObjectNotExist) && !r.shards.checked
+		if !sharded && !missing {
+			return nil, err
+		}
+	}
+	s, generation, err := r.loadShardsIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil && sharded {
+		return nil, fmt.Errorf("%s is the index of a sharded repository, but %s doesn't exist", r.indexFileURL, r.shardsIndexURL())
+	}
+	if s == nil {
+		return r.flatIndexFile(ctx)
+	}
+	return r.shardedIndexFile(ctx, s, generation, names)
+}
+
+// errShardedLayout is returned by readFlatIndexBytes when index.yaml is the one rendered for
+// a sharded repository.
+var errShardedLayout = errors.New("sharded index layout")
+
+// maxIndexHead bounds the head of index.yaml, before its entries, read to detect the layout.
+const maxIndexHead = 64 << 10
+
+// readFlatIndexBytes reads index.yaml like readIndexBytes, unless the annotations at its head,
+// written before the entries, mark the index of a sharded repository: the read stops there
+// and errShardedLayout is returned.
+func (r *Repo) readFlatIndexBytes(ctx context.Context) ([]byte, int64, error) {
+	defer r.stats.since(OpIndexRead, time.Now())
+	o, err := gcs.Object(r.gcs, r.indexFileURL)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "object")
+	}
+	reader, err := o.NewReader(ctx)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "reader")
+	}
+	defer reader.Close()
+
+	content := bufio.NewReader(reader)
+	// a gzip compressed index may not have been decompressed on the way
+	if magic, _ := content.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(content)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "gzip reader")
+		}
+		defer gz.Close()
+		content = bufio.NewReader(gz)
+	}
+	var head []byte
+	for len(head) < maxIndexHead {
+		line, err := content.ReadBytes('\n')
+		if bytes.HasPrefix(line, []byte("entries:")) {
+			if shardedHead(head) {
+				log.Debugf("index file of a sharded repository")
+				r.shards.checked = false
+				return nil, 0, errShardedLayout
+			}
+			head = append(head, line...)
+			break
+		}
+		head = append(head, line...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "read")
+		}
+	}
+	rest, err := io.ReadAll(content)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "read")
+	}
+	// the reader carries the generation of the file it reads,
+	// no need for a separate attrs request.
+	return append(head, rest...), reader.Attrs.Generation, nil
+}
+
+// shardedHead reports whether head, the start of an index file before its entries, has the
+// annotation of the index.yaml rendered for a sharded repository.
+func shardedHead(head []byte) bool {
+	var i struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	return yaml.Unmarshal(head, &i) == nil && i.Annotations[layoutAnnotation] == layoutSharded
+}
+
+// reloadIndexFile reads again the index of the repository after a conflict, shallowly if
+// it was read shallowly.
+func (r *Repo) reloadIndexFile(ctx context.Context) (*repo.IndexFile, error) {
+	if r.shards.loaded == nil {
+		return r.indexFile(ctx)
+	}
+	names := make([]string, 0, len(r.shards.loaded))
+	for name := range r.shards.loaded {
+		names = append(names, name)
+	}
+	return r.shallowIndexFile(ctx, names...)
+}
+
+// fullIndexFile returns the index i, if it was read shallowly, completed with the entries of
+// the other charts of the repository, as of the top-level index last read or written.
+func (r *Repo) fullIndexFile(ctx context.Context, i *repo.IndexFile) (*repo.IndexFile, error) {
+	if r.shards.index == nil || r.shards.loaded == nil {
+		return i, nil
+	}
+	rest := &shardsIndex{Shards: map[string]shardEntry{}}
+	for name, shard := range r.shards.index.Shards {
+		if !r.shards.loaded[name] {
+			rest.Shards[name] = shard
+		}
+	}
+	entries, err := r.loadShards(ctx, rest)
+	if err != nil {
+		return nil, err
+	}
+	for name, versions := range i.Entries {
+		entries[name] = versions
+	}
+	full := &repo.IndexFile{APIVersion: i.APIVersion, Generated: i.Generated, Annotations: i.Annotations, Entries: entries}
+	full.SortEntries()
+	return full, nil
+}
+
+// needsFullIndex reports whether the updates of the index i need the entries of all the
+// charts, rather than of the charts updated only: to list the checksums of all the charts,
+// or to find whether a chart object of a content-addressable repository is still referenced.
+func (r Repo) needsFullIndex(i *repo.IndexFile) bool {
+	return r.checksums || indexPolicy(i, PolicyLayout) == LayoutContentAddressable
+}
+
+// loadShards reads the shards listed by the top-level index s, concurrently.
+func (r *Repo) loadShards(ctx context.Context, s *shardsIndex) (map[string]repo.ChartVersions, error) {
+	entries := map[string]repo.ChartVersions{}
+	var mu sync.Mutex
+	err := r.forEachShard(s, func(name string, shard shardEntry) error {
+		b, err := r.readShard(ctx, shard.Object)
+		if err != nil {
+			return errors.Wrapf(err, "load shard of %s", name)
+		}
+		i := &repo.IndexFile{}
+		if err := yaml.Unmarshal(b, i); err != nil {
+			return errors.Wrapf(err, "unmarshal shard of %s", name)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		entries[name] = i.Entries[name]
+		return nil
+	})
+	return entries, err
+}
+
+// readShard returns the content of the shard object, from the cache if it was already read.
+func (r *Repo) readShard(ctx context.Context, object string) ([]byte, error) {
+	r.shards.mu.Lock()
+	b, ok := r.shards.cache[object]
+	r.shards.mu.Unlock()
+	if ok {
+		return b, nil
+	}
+	o, err := gcs.Object(r.gcs, r.baseURL()+object)
+	if err != nil {
+		return nil, errors.Wrap(err, "object")
+	}
+	reader, err := o.NewReader(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "reader")
+	}
+	defer reader.Close()
+	if b, err = io.ReadAll(reader); err != nil {
+		return nil, errors.Wrap(err, "read")
+	}
+	if b, err = gcs.Gunzip(b); err != nil {
+		return nil, err
+	}
+	r.shards.mu.Lock()
+	r.shards.cache[object] = b
+	r.shards.mu.Unlock()
+	return b, nil
+}
+
+// forEachShard runs fn on each shard of s, with the concurrency of the repository.
+// It returns the first error.
+func (r *Repo) forEachShard(s *shardsIndex, fn func(name string, shard shardEntry) error) error {
+	type job struct {
+		name  string
+		shard shardEntry
+	}
+	jobs := make(chan job)
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for n := 0; n < r.workers(); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := fn(j.name, j.shard); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for name, shard := range s.Shards {
+		jobs <- job{name, shard}
+	}
+	close(jobs)
+	wg.Wait()
+	return firstErr
+}
+
+// uploadShardedIndexFile writes the index i of a sharded repository: the shards of the
+// charts which changed, then the top-level index, under optimistic locking, then the merged
+// index.yaml if enabled.
+func (r *Repo) uploadShardedIndexFile(ctx context.Context, i *repo.IndexFile) error {
+	b, err := r.commitShards(ctx, i)
+	if err != nil {
+		return err
+	}
+	if !r.shards.index.MergedIndex || r.shards.index.DeferRender {
+		if r.signer != nil {
+			return r.uploadSignature(ctx, r.signer, r.shardsIndexURL(), b)
+		}
+		return nil
+	}
+	// a newer index renders index.yaml itself
+	o, err := gcs.Object(r.gcs, r.shardsIndexURL())
+	if err != nil {
+		return errors.Wrap(err, "object")
+	}
+	if attrs, err := o.Attrs(ctx); err == nil && attrs.Generation != r.indexFileGeneration {
+		log.Debugf("shards index updated meanwhile, index.yaml not rendered")
+		return nil
+	}
+	if i, err = r.fullIndexFile(ctx, i); err != nil {
+		return errors.Wrap(err, "load index file")
+	}
+	return r.renderIndex(ctx, i, 0)
+}
+
+// commitShards writes the shards of the index i which changed since the top-level index was
+// read, then the new top-level index, if it was not updated meanwhile. It returns the
+// top-level index written.
+func (r *Repo) commitShards(ctx context.Context, i *repo.IndexFile) ([]byte, error) {
+	previous := r.shards.index
+	s := &shardsIndex{
+		APIVersion:  i.APIVersion,
+		Generated:   i.Generated,
+		MergedIndex: previous.MergedIndex,
+		DeferRender: previous.DeferRender,
+		Annotations: i.Annotations,
+		Shards:      map[string]shardEntry{},
+	}
+	changed := &shardsIndex{Shards: map[string]shardEntry{}}
+	contents := map[string][]byte{}
+	// the shards of the charts not read by a shallow read are unchanged
+	if r.shards.loaded != nil {
+		for name, shard := range previous.Shards {
+			if !r.shards.loaded[name] {
+				s.Shards[name] = shard
+			}
+		}
+	}
+	for name, versions := range i.Entries {
+		if len(versions) == 0 {
+			continue
+		}
+		b, err := yaml.Marshal(&repo.IndexFile{APIVersion: i.APIVersion, Entries: map[string]repo.ChartVersions{name: versions}})
+		if err != nil {
+			return nil, errors.Wrap(err, "marshal shard")
+		}
+		shard := shardEntry{Object: shardObject(name, b), Versions: len(versions), Latest: versions[0].Version}
+		s.Shards[name] = shard
+		if previous.Shards[name].Object != shard.Object {
+			changed.Shards[name] = shard
+			contents[shard.Object] = b
+		}
+	}
+	// shards are named after their content: they can be written without conditions,
+	// and are only garbage collected once unreferenced for a while.
+	err := r.forEachShard(changed, func(name string, shard shardEntry) error {
+		log.Debugf("write shard %s", shard.Object)
+		if _, err := r.writeIndexObject(ctx, r.baseURL()+shard.Object, contents[shard.Object], 0); err != nil {
+			return errors.Wrapf(err, "write shard of %s", name)
+		}
+		r.shards.mu.Lock()
+		r.shards.cache[shard.Object] = contents[shard.Object]
+		r.shards.mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := yaml.Marshal(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal shards index")
+	}
+	start := time.Now()
+	generation, err := r.writeIndexObject(ctx, r.shardsIndexURL(), b, r.indexFileGeneration)
+	if errors.Is(err, errPreconditionFailed) {
+		r.stats.since(OpIndexConflict, start)
+		return nil, r.indexConflict(ctx, r.shardsIndexURL())
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "write shards index")
+	}
+	log.Debugf("%d shards written, shards index generation: %d", len(changed.Shards), generation)
+	r.indexFileGeneration = generation
+	r.shards.index = s
+	return b, nil
+}
+
+// renderIndex writes the index.yaml of a sharded repository, for Helm clients: the index i,
+// or only its annotations if the merged index is disabled. The file is only written if it is
+// at generation, unless generation is 0.
+func (r *Repo) renderIndex(ctx context.Context, i *repo.IndexFile, generation int64) error {
+	rendered := &repo.IndexFile{
+		APIVersion:  i.APIVersion,
+		Generated:   i.Generated,
+		Entries:     map[string]repo.ChartVersions{},
+		Annotations: map[string]string{layoutAnnotation: layoutSharded},
+	}
+	for k, v := range i.Annotations {
+		rendered.Annotations[k] = v
+	}
+	if r.shards.index.MergedIndex {
+		rendered.Entries = i.Entries
+	}
+	b, err := yaml.Marshal(rendered)
+	if err != nil {
+		return errors.Wrap(err, "marshal")
+	}
+	if _, err := r.writeIndexObject(ctx, r.indexFileURL, b, generation); err != nil {
+		if errors.Is(err, errPreconditionFailed) {
+			return &IndexConflictError{URL: r.indexFileURL, ExpectedGeneration: generation}
+		}
+		return errors.Wrap(err, "render index file")
+	}
+	if r.signer != nil {
+		return r.uploadSignature(ctx, r.signer, r.indexFileURL, b)
+	}
+	return nil
+}
+
+// shardObject returns the path of the shard of the chart with content b, named after its digest.
+func shardObject(name string, b []byte) string {
+	sum := sha256.Sum256(b)
+	return fmt.Sprintf("%s%s-%s.yaml", shardsDir, name, hex.EncodeToString(sum[:8]))
+}
+
+// ShardIndex converts the repository to the sharded index layout, or changes whether a
+// merged index.yaml is rendered for Helm clients if it is already sharded. With deferRender,
+// the merged index.yaml is only rendered by RenderIndex, not by every update.
+// Every writer of a sharded repository must support the layout: older versions of the plugin
+// would update index.yaml only.
+func (r *Repo) ShardIndex(ctx context.Context, mergedIndex, deferRender bool) error {
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return errors.Wrap(err, "load index file")
+	}
+	if r.shards.index != nil {
+		r.shards.index.MergedIndex = mergedIndex
+		r.shards.index.DeferRender = deferRender
+		if err := r.uploadIndexFile(ctx, i); err != nil {
+			return err
+		}
+		if mergedIndex {
+			return nil
+		}
+		return r.renderIndex(ctx, i, 0)
+	}
+
+	log.Debugf("shard the index of %s", r.baseURL())
+	delete(i.Annotations, layoutAnnotation)
+	indexGeneration := r.indexFileGeneration
+	r.shards.index = &shardsIndex{MergedIndex: mergedIndex, DeferRender: deferRender}
+	r.indexFileGeneration = 0
+	i.SortEntries()
+	i.Generated = time.Now()
+	if _, err := r.commitShards(ctx, i); err != nil {
+		return err
+	}
+	// writers which don't know yet the repository is sharded update index.yaml:
+	// the conversion is undone if one of them did since the index was read.
+	err = r.renderIndex(ctx, i, indexGeneration)
+	if errors.Is(err, ErrIndexOutOfDate) {
+		o, oerr := gcs.Object(r.gcs, r.shardsIndexURL())
+		if oerr == nil {
+			_ = o.If(storage.Conditions{GenerationMatch: r.indexFileGeneration}).Delete(ctx)
+		}
+		r.shards.index = nil
+	}
+	return err
+}
+
+// RenderIndex renders the index.yaml of a sharded repository from its shards, for Helm
+// clients, when updates defer its rendering, e.g. on a schedule.
+func (r *Repo) RenderIndex(ctx context.Context) error {
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return errors.Wrap(err, "load index file")
+	}
+	if r.shards.index == nil {
+		return fmt.Errorf("the index of %s is not sharded", r.baseURL())
+	}
+	return r.renderIndex(ctx, i, 0)
+}
+
+// UnshardIndex converts a sharded repository back to a single index.yaml, and deletes the shards.
+func (r *Repo) UnshardIndex(ctx context.Context) error {
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return errors.Wrap(err, "load index file")
+	}
+	if r.shards.index == nil {
+		return fmt.Errorf("the index of %s is not sharded", r.baseURL())
+	}
+	log.Debugf("unshard the index of %s", r.baseURL())
+	shardsGeneration := r.indexFileGeneration
+	r.shards.index = nil
+	r.indexFileGeneration = 0
+	if err := r.uploadIndexFile(ctx, i); err != nil {
+		return err
+	}
+	// the top-level index is only deleted if no update was committed since it was read
+	o, err := gcs.Object(r.gcs, r.shardsIndexURL())
+	if err != nil {
+		return errors.Wrap(err, "object")
+	}
+	if err := o.If(storage.Conditions{GenerationMatch: shardsGeneration}).Delete(ctx); err != nil {
+		if isPreconditionFailed(err) {
+			r.shards.checked = false
+			return &IndexConflictError{URL: r.shardsIndexURL(), ExpectedGeneration: shardsGeneration}
+		}
+		return errors.Wrap(err, "delete shards index")
+	}
+	_, err = r.GCShards(ctx, 0)
+	return err
+}
+
+// GCShards deletes the shards no longer referenced by the top-level index, and not written
+// for minAge, and returns how many were deleted. All the shards are deleted if the
+// repository is not sharded.
+func (r *Repo) GCShards(ctx context.Context, minAge time.Duration) (int, error) {
+	s, _, err := r.loadShardsIndex(ctx)
+	if err != nil {
+		return 0, err
+	}
+	referenced := map[string]bool{}
+	if s != nil {
+		for _, shard := range s.Shards {
+			referenced[shard.Object] = true
+		}
+	}
+	objects, err := gcs.ListObjects(ctx, r.gcs, r.baseURL()+shardsDir)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, attrs := range objects {
+		object := shardsDir + path.Base(attrs.Name)
+		if object == shardsIndexFile || !strings.HasSuffix(object, ".yaml") || referenced[object] || time.Since(attrs.Updated) < minAge {
+			continue
+		}
+		objectURL := fmt.Sprintf("gs://%s/%s", attrs.Bucket, attrs.Name)
+		log.Debugf("delete shard %s", objectURL)
+		o, err := gcs.Object(r.gcs, objectURL)
+		if err != nil {
+			return deleted, errors.Wrap(err, "object")
+		}
+		// the shard may have been written again meanwhile
+		err = o.If(storage.Conditions{GenerationMatch: attrs.Generation}).Delete(ctx)
+		if err != nil && !isPreconditionFailed(err) && err != storage.ErrObjectNotExist {
+			return deleted, errors.Wrapf(err, "delete %s", objectURL)
+		}
+		if err == nil {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
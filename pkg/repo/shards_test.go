@@ -0,0 +1,23 @@
+package repo
+
+import "testing"
+
+func TestShardedHead(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want bool
+	}{
+		{name: "empty", head: "", want: false},
+		{name: "flat", head: "apiVersion: v1\n", want: false},
+		{name: "other annotations", head: "annotations:\n  owner: team\napiVersion: v1\n", want: false},
+		{name: "flat layout", head: "annotations:\n  helm-gcs.index/layout: flat\napiVersion: v1\n", want: false},
+		{name: "sharded", head: "annotations:\n  helm-gcs.index/layout: sharded\n  owner: team\napiVersion: v1\n", want: true},
+		{name: "invalid", head: "annotations: [\n", want: false},
+	}
+	for _, tt := range tests {
+		if got := shardedHead([]byte(tt.head)); got != tt.want {
+			t.Errorf("%s: shardedHead() = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
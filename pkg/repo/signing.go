@@ -0,0 +1,282 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp" //nolint:staticcheck // the package used by helm to sign charts
+	"google.golang.org/api/option"
+	"helm.sh/helm/v3/pkg/provenance"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+const (
+	// SignatureGPG signs index files with a GPG key, as helm does for charts.
+	SignatureGPG = "gpg"
+	// SignatureCosign signs index files with a cosign key, using the cosign binary.
+	SignatureCosign = "cosign"
+
+	// signatureSuffix is appended to the index file URL to name its detached signature.
+	signatureSuffix = ".sig"
+)
+
+// IndexSigner produces detached signatures of index files, and of charts with WithChartSigning.
+type IndexSigner interface {
+	Sign(ctx context.Context, index []byte) ([]byte, error)
+}
+
+// IndexVerifier checks detached signatures of index files and charts.
+type IndexVerifier interface {
+	Verify(ctx context.Context, index, signature []byte) error
+}
+
+// WithIndexSigner makes every write of the index file also write its detached signature,
+// in an object named after the index file with a ".sig" suffix.
+func WithIndexSigner(signer IndexSigner) Option {
+	return func(r *Repo) {
+		r.signer = signer
+	}
+}
+
+// WithChartSigning makes pushed charts signed too, by the index signer,
+// in an object named after the chart with a ".sig" suffix.
+func WithChartSigning(enabled bool) Option {
+	return func(r *Repo) {
+		r.signCharts = enabled
+	}
+}
+
+// WithChartSigner makes pushed charts signed by signer, in an object named after the chart
+// with a ".sig" suffix, whether the index file is signed or not.
+func WithChartSigner(signer IndexSigner) Option {
+	return func(r *Repo) {
+		r.chartSigner = signer
+	}
+}
+
+// NewIndexSigner returns a signer of the given method ("gpg", "cosign" or "kms").
+// For gpg, key is a secret keyring and keyID selects the key in it; the passphrase of
+// an encrypted key is read from HELM_GCS_SIGN_PASSPHRASE.
+// For cosign, key is any key reference understood by cosign (file, KMS URI...), or empty
+// to sign keyless: with a short-lived certificate issued to the OIDC identity of the caller,
+// e.g. the workload identity of a CI job, recorded in the Rekor transparency log.
+// For kms, key is the resource name of a Cloud KMS asymmetric key version, used with opts.
+func NewIndexSigner(method, key, keyID string, opts ...option.ClientOption) (IndexSigner, error) {
+	switch method {
+	case SignatureGPG:
+		s, err := provenance.NewFromKeyring(key, keyID)
+		if err != nil {
+			return nil, errors.Wrap(err, "load keyring")
+		}
+		err = s.DecryptKey(func(string) ([]byte, error) {
+			return []byte(os.Getenv("HELM_GCS_SIGN_PASSPHRASE")), nil
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "decrypt key")
+		}
+		return gpgSigner{s}, nil
+	case SignatureCosign:
+		if key == "" {
+			return cosignKeyless{}, nil
+		}
+		return cosignKey(key), nil
+	case SignatureKMS:
+		return newKMSKey(key, opts...)
+	}
+	return nil, errors.Errorf("unknown signature method %q", method)
+}
+
+// NewIndexVerifier returns a verifier of the given method ("gpg", "cosign" or "kms").
+// For gpg, key is a public keyring. For cosign, key is any public key reference understood by cosign,
+// keyless signatures are verified with NewCosignKeylessVerifier.
+// For kms, key is the resource name of a Cloud KMS asymmetric key version, used with opts.
+func NewIndexVerifier(method, key string, opts ...option.ClientOption) (IndexVerifier, error) {
+	switch method {
+	case SignatureGPG:
+		s, err := provenance.NewFromKeyring(key, "")
+		if err != nil {
+			return nil, errors.Wrap(err, "load keyring")
+		}
+		return gpgSigner{s}, nil
+	case SignatureCosign:
+		if key == "" {
+			return nil, errors.New("a cosign public key is required, keyless signatures are verified against a certificate identity")
+		}
+		return cosignKey(key), nil
+	case SignatureKMS:
+		return newKMSKey(key, opts...)
+	}
+	return nil, errors.Errorf("unknown signature method %q", method)
+}
+
+// NewCosignKeylessVerifier returns a verifier of keyless cosign signatures, made with a
+// certificate issued to identity (e.g. the email of a service account, or the URL of a
+// CI workflow) by the OIDC issuer (e.g. "https://accounts.google.com").
+func NewCosignKeylessVerifier(identity, issuer string) (IndexVerifier, error) {
+	if identity == "" || issuer == "" {
+		return nil, errors.New("keyless signatures are verified against a certificate identity and OIDC issuer")
+	}
+	return cosignKeyless{identity: identity, issuer: issuer}, nil
+}
+
+// VerifyFile checks the local file at path against its detached signature, at path with a ".sig" suffix.
+func VerifyFile(ctx context.Context, path string, verifier IndexVerifier) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sig, err := os.ReadFile(path + signatureSuffix)
+	if err != nil {
+		return errors.Wrap(err, "read signature")
+	}
+	return verifier.Verify(ctx, b, sig)
+}
+
+// VerifyIndex checks index, the content of the index file at indexFileURL,
+// against the detached signature stored next to it.
+func VerifyIndex(ctx context.Context, client *storage.Client, indexFileURL string, index []byte, verifier IndexVerifier) error {
+	return VerifyObject(ctx, client, indexFileURL, index, verifier)
+}
+
+// VerifyObject checks content, the content of the object at objectURL, e.g. a chart,
+// against the detached signature stored next to it.
+func VerifyObject(ctx context.Context, client *storage.Client, objectURL string, content []byte, verifier IndexVerifier) error {
+	reader, err := gcs.NewReader(ctx, client, objectURL+signatureSuffix)
+	if err != nil {
+		return errors.Wrap(err, "read signature")
+	}
+	defer reader.Close()
+	sig, err := io.ReadAll(reader)
+	if err != nil {
+		return errors.Wrap(err, "read signature")
+	}
+	return errors.Wrapf(verifier.Verify(ctx, content, sig), "verify signature of %s", objectURL)
+}
+
+// uploadSignature signs content, the content of the object at objectURL, and uploads the signature.
+func (r Repo) uploadSignature(ctx context.Context, signer IndexSigner, objectURL string, content []byte) error {
+	sig, err := signer.Sign(ctx, content)
+	if err != nil {
+		return errors.Wrapf(err, "sign %s", objectURL)
+	}
+	o, err := gcs.Object(r.gcs, objectURL+signatureSuffix)
+	if err != nil {
+		return errors.Wrap(err, "object")
+	}
+	w := gcs.NewWriter(ctx, o)
+	w.CacheControl = "no-cache, max-age=0, no-transform"
+	w.ContentType = "application/octet-stream"
+	if _, err := w.Write(sig); err != nil {
+		return errors.Wrap(err, "write")
+	}
+	return errors.Wrap(w.Close(), "close")
+}
+
+type gpgSigner struct {
+	*provenance.Signatory
+}
+
+func (s gpgSigner) Sign(ctx context.Context, index []byte) ([]byte, error) {
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, s.Entity, bytes.NewReader(index), nil); err != nil {
+		return nil, err
+	}
+	return sig.Bytes(), nil
+}
+
+func (s gpgSigner) Verify(ctx context.Context, index, signature []byte) error {
+	_, err := openpgp.CheckArmoredDetachedSignature(s.KeyRing, bytes.NewReader(index), bytes.NewReader(signature))
+	return err
+}
+
+// cosignKey signs and verifies blobs with the cosign binary.
+type cosignKey string
+
+func (k cosignKey) Sign(ctx context.Context, index []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "helm-gcs-sign")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	blob, sig := filepath.Join(dir, "index.yaml"), filepath.Join(dir, "index.yaml.sig")
+	if err := os.WriteFile(blob, index, 0o600); err != nil {
+		return nil, err
+	}
+	if err := runCosign(ctx, "sign-blob", "--yes", "--key", string(k), "--output-signature", sig, blob); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(sig)
+}
+
+func (k cosignKey) Verify(ctx context.Context, index, signature []byte) error {
+	dir, err := os.MkdirTemp("", "helm-gcs-verify")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	blob, sig := filepath.Join(dir, "index.yaml"), filepath.Join(dir, "index.yaml.sig")
+	if err := os.WriteFile(blob, index, 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(sig, signature, 0o600); err != nil {
+		return err
+	}
+	return runCosign(ctx, "verify-blob", "--key", string(k), "--signature", sig, blob)
+}
+
+// cosignKeyless signs blobs keyless with the cosign binary, and verifies them against a
+// certificate identity. The signature object holds the cosign bundle: the signature, the
+// certificate and the transparency log entry.
+type cosignKeyless struct {
+	identity string
+	issuer   string
+}
+
+func (k cosignKeyless) Sign(ctx context.Context, index []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "helm-gcs-sign")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	blob, bundle := filepath.Join(dir, "index.yaml"), filepath.Join(dir, "index.yaml.bundle")
+	if err := os.WriteFile(blob, index, 0o600); err != nil {
+		return nil, err
+	}
+	if err := runCosign(ctx, "sign-blob", "--yes", "--bundle", bundle, blob); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(bundle)
+}
+
+func (k cosignKeyless) Verify(ctx context.Context, index, signature []byte) error {
+	dir, err := os.MkdirTemp("", "helm-gcs-verify")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	blob, bundle := filepath.Join(dir, "index.yaml"), filepath.Join(dir, "index.yaml.bundle")
+	if err := os.WriteFile(blob, index, 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(bundle, signature, 0o600); err != nil {
+		return err
+	}
+	return runCosign(ctx, "verify-blob", "--bundle", bundle,
+		"--certificate-identity", k.identity, "--certificate-oidc-issuer", k.issuer, blob)
+}
+
+func runCosign(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "cosign", args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "cosign %s: %s", args[0], bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package repo
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Operations timed by Stats.
+const (
+	OpIndexRead     = "index_read"
+	OpIndexWrite    = "index_write"
+	OpIndexConflict = "index_conflict"
+	OpChartUpload   = "chart_upload"
+)
+
+// OpStats are the timings of an operation.
+type OpStats struct {
+	Count int           `json:"count"`
+	Total time.Duration `json:"total"`
+	Max   time.Duration `json:"max"`
+}
+
+// Stats records the timings of the operations of repositories, to find out what slows
+// down a command. A nil *Stats records nothing.
+type Stats struct {
+	mu  sync.Mutex
+	ops map[string]*OpStats
+}
+
+// NewStats returns empty stats.
+func NewStats() *Stats {
+	return &Stats{ops: map[string]*OpStats{}}
+}
+
+// WithStats makes the repository record the timings of its operations in s.
+func WithStats(s *Stats) Option {
+	return func(r *Repo) {
+		r.stats = s
+	}
+}
+
+// Observe records an operation which took d.
+func (s *Stats) Observe(op string, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.ops[op]
+	if !ok {
+		o = &OpStats{}
+		s.ops[op] = o
+	}
+	o.Count++
+	o.Total += d
+	if d > o.Max {
+		o.Max = d
+	}
+}
+
+// since records an operation started at start.
+func (s *Stats) since(op string, start time.Time) {
+	s.Observe(op, time.Since(start))
+}
+
+// Operations returns the timings recorded, by operation.
+func (s *Stats) Operations() map[string]OpStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ops := make(map[string]OpStats, len(s.ops))
+	for op, o := range s.ops {
+		ops[op] = *o
+	}
+	return ops
+}
+
+func (s *Stats) sortedOperations() ([]string, map[string]OpStats) {
+	ops := s.Operations()
+	names := make([]string, 0, len(ops))
+	for op := range ops {
+		names = append(names, op)
+	}
+	sort.Strings(names)
+	return names, ops
+}
+
+// WriteSummary writes a table of the timings of the operations, and the number of
+// retries of GCS requests.
+func (s *Stats) WriteSummary(w io.Writer, retries int64) error {
+	names, ops := s.sortedOperations()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OPERATION\tCOUNT\tTOTAL\tAVERAGE\tMAX")
+	for _, op := range names {
+		o := ops[op]
+		avg := o.Total / time.Duration(o.Count)
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", op, o.Count, o.Total.Round(time.Millisecond), avg.Round(time.Millisecond), o.Max.Round(time.Millisecond))
+	}
+	fmt.Fprintf(tw, "retries\t%d\t\t\t\n", retries)
+	return tw.Flush()
+}
+
+// WritePrometheus writes the timings of the operations of a command, and the number of
+// retries of GCS requests, in the Prometheus text format.
+func (s *Stats) WritePrometheus(w io.Writer, command string, duration time.Duration, retries int64) error {
+	names, ops := s.sortedOperations()
+	var err error
+	printf := func(format string, a ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, a...)
+		}
+	}
+	printf("# HELP helm_gcs_command_duration_seconds Duration of the command.\n# TYPE helm_gcs_command_duration_seconds gauge\n")
+	printf("helm_gcs_command_duration_seconds{command=%q} %g\n", command, duration.Seconds())
+	printf("# HELP helm_gcs_operation_duration_seconds Duration of the operations of the command.\n# TYPE helm_gcs_operation_duration_seconds summary\n")
+	for _, op := range names {
+		printf("helm_gcs_operation_duration_seconds_sum{command=%q,operation=%q} %g\n", command, op, ops[op].Total.Seconds())
+		printf("helm_gcs_operation_duration_seconds_count{command=%q,operation=%q} %d\n", command, op, ops[op].Count)
+	}
+	printf("# HELP helm_gcs_operation_max_duration_seconds Longest operation of the command.\n# TYPE helm_gcs_operation_max_duration_seconds gauge\n")
+	for _, op := range names {
+		printf("helm_gcs_operation_max_duration_seconds{command=%q,operation=%q} %g\n", command, op, ops[op].Max.Seconds())
+	}
+	printf("# HELP helm_gcs_retries_total Retries of GCS requests failing with a transient error.\n# TYPE helm_gcs_retries_total counter\n")
+	printf("helm_gcs_retries_total{command=%q} %d\n", command, retries)
+	return err
+}
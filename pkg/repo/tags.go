@@ -0,0 +1,119 @@
+package repo
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// tagsAnnotationPrefix prefixes the index annotations holding the tags of a chart,
+// as a JSON object mapping tags to versions.
+const tagsAnnotationPrefix = "helm-gcs.tags/"
+
+// TagChart maps tags (e.g. "stable", "canary") to versions of a chart.
+// A tag mapped to an empty version is removed.
+// The tags are stored in the index file annotations.
+func (r Repo) TagChart(ctx context.Context, name string, tags map[string]string, retry bool) error {
+	unlock, err := r.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	log.Debugf("tag chart %s: %v", name, tags)
+
+	for {
+		i, err := r.indexFile(ctx)
+		if err != nil {
+			return errors.Wrap(err, "load index file")
+		}
+		chartTags, err := indexTags(i, name)
+		if err != nil {
+			return err
+		}
+		for tag, version := range tags {
+			if version == "" {
+				delete(chartTags, tag)
+				continue
+			}
+			if !i.Has(name, version) {
+				return notFoundf("chart %s-%s not found", name, version)
+			}
+			chartTags[tag] = version
+		}
+		if err := setIndexTags(i, name, chartTags); err != nil {
+			return err
+		}
+
+		err = r.uploadIndexFile(ctx, i)
+		if errors.Is(err, ErrIndexOutOfDate) && retry {
+			continue
+		}
+		return err
+	}
+}
+
+// Tags returns the tags of a chart, mapped to their versions.
+func (r Repo) Tags(ctx context.Context, name string) (map[string]string, error) {
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "load index file")
+	}
+	return indexTags(i, name)
+}
+
+// ResolveVersion returns the chart version matching a tag, an exact version or a semver
+// constraint. If version is empty, the latest stable version is returned, or the latest
+// version including pre-releases if devel is true.
+func (r Repo) ResolveVersion(ctx context.Context, name, version string, devel bool) (*repo.ChartVersion, error) {
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "load index file")
+	}
+	return resolveVersion(i, name, version, devel)
+}
+
+func resolveVersion(i *repo.IndexFile, name, version string, devel bool) (*repo.ChartVersion, error) {
+	tags, err := indexTags(i, name)
+	if err != nil {
+		return nil, err
+	}
+	if tagged, ok := tags[version]; ok {
+		log.Debugf("tag %s of chart %s is version %s", version, name, tagged)
+		version = tagged
+	} else if version == "" && devel {
+		version = ">0.0.0-0"
+	}
+	cv, err := i.Get(name, version)
+	if err != nil {
+		return nil, errors.Wrapf(err, "chart %s", name)
+	}
+	return cv, nil
+}
+
+func indexTags(i *repo.IndexFile, name string) (map[string]string, error) {
+	tags := map[string]string{}
+	if v, ok := i.Annotations[tagsAnnotationPrefix+name]; ok {
+		if err := json.Unmarshal([]byte(v), &tags); err != nil {
+			return nil, errors.Wrapf(err, "invalid tags for chart %s", name)
+		}
+	}
+	return tags, nil
+}
+
+func setIndexTags(i *repo.IndexFile, name string, tags map[string]string) error {
+	if len(tags) == 0 {
+		delete(i.Annotations, tagsAnnotationPrefix+name)
+		return nil
+	}
+	b, err := json.Marshal(tags)
+	if err != nil {
+		return errors.Wrap(err, "marshal tags")
+	}
+	if i.Annotations == nil {
+		i.Annotations = map[string]string{}
+	}
+	i.Annotations[tagsAnnotationPrefix+name] = string(b)
+	return nil
+}
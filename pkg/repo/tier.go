@@ -0,0 +1,93 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// storagePrices are the list prices of storage classes, in USD per GB per month
+// (multi-region US), used to estimate the savings of tiering.
+var storagePrices = map[string]float64{
+	"STANDARD": 0.026,
+	"NEARLINE": 0.010,
+	"COLDLINE": 0.007,
+	"ARCHIVE":  0.0025,
+}
+
+// ValidStorageClass reports whether class is a storage class of GCS, case insensitively.
+func ValidStorageClass(class string) bool {
+	_, ok := storagePrices[strings.ToUpper(class)]
+	return ok
+}
+
+// TierResult describes a chart object moved to another storage class.
+type TierResult struct {
+	Chart   string
+	Version string
+	Object  string
+	From    string
+	Size    int64
+}
+
+// Tier rewrites, server-side, the objects of the chart versions created before olderThan
+// to the given storage class. URLs and the index are unchanged.
+// With dryRun, the objects are only listed.
+func (r Repo) Tier(ctx context.Context, olderThan time.Duration, class string, dryRun bool) ([]TierResult, error) {
+	class = strings.ToUpper(class)
+	if !ValidStorageClass(class) {
+		return nil, fmt.Errorf("unknown storage class %q", class)
+	}
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "load index file")
+	}
+	limit := time.Now().Add(-olderThan)
+	results := []TierResult{}
+	for _, versions := range i.Entries {
+		for _, cv := range versions {
+			if len(cv.URLs) == 0 || cv.Created.IsZero() || cv.Created.After(limit) {
+				continue
+			}
+			u, err := r.objectURL(cv.URLs[0])
+			if err != nil {
+				log.Debugf("skip %s-%s: %s", cv.Name, cv.Version, err)
+				continue
+			}
+			o, err := gcs.Object(r.gcs, u)
+			if err != nil {
+				return nil, errors.Wrap(err, "object")
+			}
+			attrs, err := o.Attrs(ctx)
+			if err != nil {
+				return nil, errors.Wrapf(err, "attrs of %s", u)
+			}
+			if attrs.StorageClass == class {
+				continue
+			}
+			if !dryRun {
+				log.Debugf("rewrite %s from %s to %s", u, attrs.StorageClass, class)
+				if _, err := gcs.SetStorageClass(ctx, r.gcs, u, class); err != nil {
+					return results, err
+				}
+			}
+			results = append(results, TierResult{Chart: cv.Name, Version: cv.Version, Object: u, From: attrs.StorageClass, Size: attrs.Size})
+		}
+	}
+	return results, nil
+}
+
+// MonthlyStorageCost estimates the monthly cost in USD of storing size bytes in a storage class.
+// Classes with an unknown price, such as regional ones, are priced like STANDARD.
+func MonthlyStorageCost(class string, size int64) float64 {
+	price, ok := storagePrices[strings.ToUpper(class)]
+	if !ok {
+		price = storagePrices["STANDARD"]
+	}
+	return price * float64(size) / (1 << 30)
+}
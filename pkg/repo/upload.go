@@ -0,0 +1,269 @@
+package repo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"path/filepath"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+
+	"github.com/hayorov/helm-gcs/pkg/gcs"
+)
+
+// uploadsDir is the directory of the repository holding the charts uploaded but not yet
+// indexed. Objects left there by interrupted pushes can be deleted, e.g. by a lifecycle rule.
+const uploadsDir = ".uploads/"
+
+// chartUpload is a chart uploaded to a temporary object, by stageUpload, and moved to its
+// final object by commitUpload once the index points to it. The index thus never points to a
+// chart whose upload failed: a failed push leaves at most a temporary object behind, and the
+// entry of a chart which can't be moved is removed again by rollbackIndex.
+type chartUpload struct {
+	chartpath string
+	chartURL  string
+	// tmpURL is the temporary object, "" if the chart object is already stored.
+	tmpURL string
+	// conds is the precondition of the final object, checked when the chart is staged.
+	conds storage.Conditions
+	force bool
+	// indexed is the index entry of the chart, set by indexUpload, and replaced the entries it
+	// removed from the index: the previous entry of the version and the versions pruned.
+	indexed  *repo.ChartVersion
+	replaced repo.ChartVersions
+}
+
+// stageUpload uploads the chart to a temporary object of the repository and verifies it.
+// The final object under baseURL is conditioned so that concurrent pushes of the same
+// version cannot clobber each other's object: it must not exist, or with force, must not
+// change until the chart is moved there.
+func (r Repo) stageUpload(ctx context.Context, chartpath, baseURL string, metadata map[string]string, force bool) (*chartUpload, error) {
+	defer r.stats.since(OpChartUpload, time.Now())
+	f, err := r.files().Open(chartpath)
+	if err != nil {
+		return nil, errors.Wrap(err, "open")
+	}
+	defer f.Close()
+	_, fname := filepath.Split(chartpath)
+	chartURL, err := resolveReference(baseURL, fname)
+	if err != nil {
+		return nil, errors.Wrap(err, "resolve reference")
+	}
+	o, err := gcs.Object(r.gcs, chartURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "object")
+	}
+	u := &chartUpload{chartpath: chartpath, chartURL: chartURL, force: force}
+	if r.contentAddressable {
+		// the object is named after its content: an existing one is the same chart
+		if _, err := o.Attrs(ctx); err == nil {
+			log.Debugf("chart object %s already stored", chartURL)
+			return u, nil
+		}
+	}
+	if u.conds, err = chartWriteConditions(ctx, o, force); err != nil {
+		return nil, err
+	}
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, errors.Wrap(err, "generate temporary name")
+	}
+	u.tmpURL = r.baseURL() + uploadsDir + hex.EncodeToString(suffix) + "-" + fname
+	log.Tracef("upload file %s to gcs path %s", fname, u.tmpURL)
+	tmp, err := gcs.Object(r.gcs, u.tmpURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "object")
+	}
+	tmpConds := storage.Conditions{DoesNotExist: true}
+
+	if r.uploader != nil {
+		// a copy, charts can be uploaded concurrently
+		uploader := *r.uploader
+		if r.chunkSize > 0 {
+			uploader.ChunkSize = r.chunkSize
+		}
+		uploader.StorageClass, uploader.CustomTime = r.storageClass, r.customTime
+		uploader.CacheControl = r.chartCacheControl(u.conds)
+		uploader.ContentDisposition = r.chartHeaders.ContentDisposition
+		uploader.ContentType = r.chartHeaders.ContentType
+		uploader.OnProgress = func(sent, total int64) {
+			r.report(PhaseUpload, chartURL, sent, total)
+		}
+		if err := uploader.Upload(ctx, chartpath, u.tmpURL, metadata, tmpConds); err != nil {
+			return nil, errors.Wrap(err, "resumable upload")
+		}
+		attrs, err := tmp.Attrs(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "attrs")
+		}
+		if err := r.checkUploadIntegrity(attrs, chartpath); err != nil {
+			r.abortUpload(ctx, u)
+			return nil, err
+		}
+		return u, nil
+	}
+
+	w := gcs.NewWriter(ctx, tmp.If(tmpConds))
+
+	w.Metadata = metadata
+	w.StorageClass = r.storageClass
+	w.CustomTime = r.customTime
+	w.CacheControl = r.chartCacheControl(u.conds)
+	w.ContentDisposition = r.chartHeaders.ContentDisposition
+	w.ContentType = r.chartHeaders.ContentType
+	if r.chunkSize > 0 {
+		w.ChunkSize = r.chunkSize
+	}
+
+	var size int64
+	if info, err := f.Stat(); err == nil {
+		size = info.Size()
+	}
+	if _, err := io.Copy(w, r.withProgress(f, PhaseUpload, chartURL, size)); err != nil {
+		return nil, errors.Wrap(err, "copy")
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, "close")
+	}
+	if err := r.checkUploadIntegrity(w.Attrs(), chartpath); err != nil {
+		r.abortUpload(ctx, u)
+		return nil, err
+	}
+	return u, nil
+}
+
+// commitUpload moves the staged chart to its final object, server-side, then uploads its
+// provenance file and signature. When the move fails, the temporary object is kept, see
+// revertUploads.
+func (r Repo) commitUpload(ctx context.Context, u *chartUpload) error {
+	if u.tmpURL != "" {
+		log.Tracef("move %s to %s", u.tmpURL, u.chartURL)
+		_, err := gcs.Move(ctx, r.gcs, u.tmpURL, u.chartURL, u.conds)
+		if isPreconditionFailed(err) {
+			return chartConflict(u.chartURL, u.force)
+		}
+		if err != nil {
+			return errors.Wrap(err, "move chart")
+		}
+		u.tmpURL = ""
+	}
+	return r.signChart(ctx, u.chartpath, u.chartURL)
+}
+
+// indexUpload adds the chart of u to the index, see addToIndex, and records the entries it
+// removed for rollbackIndex.
+func (r Repo) indexUpload(i *repo.IndexFile, u *chartUpload, chart *chart.Chart, urls []string, hash string) (repo.ChartVersions, error) {
+	previous, _ := i.Get(chart.Metadata.Name, chart.Metadata.Version)
+	pruned, err := r.addToIndex(i, u.chartpath, chart, urls, hash)
+	if err != nil {
+		return nil, err
+	}
+	u.indexed, _ = i.Get(chart.Metadata.Name, chart.Metadata.Version)
+	u.replaced = append(repo.ChartVersions{}, pruned...)
+	if previous != nil {
+		u.replaced = append(u.replaced, previous)
+	}
+	return pruned, nil
+}
+
+// revertUploads handles the failure err of commitUpload: the index entries of the uploads
+// which weren't moved to their final object are rolled back, so that the index doesn't point
+// to missing objects, and their temporary objects deleted. If the index can't be rolled back,
+// the temporary objects are kept so that the charts aren't lost.
+func (r *Repo) revertUploads(ctx context.Context, uploads []*chartUpload, err error) error {
+	var failed []*chartUpload
+	for _, u := range uploads {
+		if u.tmpURL != "" && u.indexed != nil {
+			failed = append(failed, u)
+		}
+	}
+	if len(failed) == 0 {
+		return err
+	}
+	if rerr := r.rollbackIndex(ctx, failed); rerr != nil {
+		log.Warnf("roll back index file: %s", rerr)
+		return errors.Wrapf(err, "the index points to %s, which is kept at %s, push it again with --force", failed[0].chartURL, failed[0].tmpURL)
+	}
+	for _, u := range failed {
+		r.abortUpload(ctx, u)
+	}
+	return errors.Wrap(err, "index entry rolled back")
+}
+
+// rollbackIndex removes the entries of the uploads from the index, and adds back the entries
+// they replaced. Entries changed since by another push are left as they are.
+func (r *Repo) rollbackIndex(ctx context.Context, uploads []*chartUpload) error {
+	names := make([]string, 0, len(uploads))
+	for _, u := range uploads {
+		names = append(names, u.indexed.Name)
+	}
+	for {
+		i, err := r.shallowIndexFile(ctx, names...)
+		if err != nil {
+			return errors.Wrap(err, "load index file")
+		}
+		changed := false
+		for _, u := range uploads {
+			if unindexUpload(i, u) {
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		log.Debugf("roll back index file")
+		if err := r.uploadIndexFile(ctx, i); !errors.Is(err, ErrIndexOutOfDate) {
+			return err
+		}
+	}
+}
+
+// unindexUpload removes the entry of u from the index i, if it is still there, and adds back
+// the entries it replaced. It reports whether i changed.
+func unindexUpload(i *repo.IndexFile, u *chartUpload) bool {
+	versions := i.Entries[u.indexed.Name]
+	for n, cv := range versions {
+		if cv.Version != u.indexed.Version || cv.Digest != u.indexed.Digest {
+			continue
+		}
+		versions = append(versions[:n:n], versions[n+1:]...)
+		for _, old := range u.replaced {
+			if old.Name == u.indexed.Name && !hasVersion(versions, old.Version) {
+				versions = append(versions, old)
+			}
+		}
+		if len(versions) == 0 {
+			delete(i.Entries, u.indexed.Name)
+		} else {
+			i.Entries[u.indexed.Name] = versions
+		}
+		return true
+	}
+	return false
+}
+
+// hasVersion reports whether versions has the version.
+func hasVersion(versions repo.ChartVersions, version string) bool {
+	for _, cv := range versions {
+		if cv.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// abortUpload deletes the temporary object of a chart which won't be indexed.
+func (r Repo) abortUpload(ctx context.Context, u *chartUpload) {
+	if u.tmpURL == "" {
+		return
+	}
+	if err := r.deleteObject(ctx, u.tmpURL); err != nil {
+		log.Warnf("delete temporary object %s: %s", u.tmpURL, err)
+	}
+	u.tmpURL = ""
+}
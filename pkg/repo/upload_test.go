@@ -0,0 +1,88 @@
+package repo
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+func chartVersion(version, digest string) *repo.ChartVersion {
+	cv := &repo.ChartVersion{Digest: digest}
+	cv.Metadata = &chart.Metadata{Name: "mychart", Version: version}
+	return cv
+}
+
+func versionsOf(i *repo.IndexFile) []string {
+	var versions []string
+	for _, cv := range i.Entries["mychart"] {
+		versions = append(versions, cv.Version+"@"+cv.Digest)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+func TestUnindexUpload(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  repo.ChartVersions
+		upload   *chartUpload
+		want     []string
+		wantDiff bool
+	}{
+		{
+			name:     "new version",
+			entries:  repo.ChartVersions{chartVersion("0.1.0", "a"), chartVersion("0.2.0", "b")},
+			upload:   &chartUpload{indexed: chartVersion("0.2.0", "b")},
+			want:     []string{"0.1.0@a"},
+			wantDiff: true,
+		},
+		{
+			name:     "only version",
+			entries:  repo.ChartVersions{chartVersion("0.1.0", "a")},
+			upload:   &chartUpload{indexed: chartVersion("0.1.0", "a")},
+			wantDiff: true,
+		},
+		{
+			name:     "forced version",
+			entries:  repo.ChartVersions{chartVersion("0.1.0", "b")},
+			upload:   &chartUpload{indexed: chartVersion("0.1.0", "b"), replaced: repo.ChartVersions{chartVersion("0.1.0", "a")}},
+			want:     []string{"0.1.0@a"},
+			wantDiff: true,
+		},
+		{
+			name:     "pruned versions",
+			entries:  repo.ChartVersions{chartVersion("0.3.0", "c")},
+			upload:   &chartUpload{indexed: chartVersion("0.3.0", "c"), replaced: repo.ChartVersions{chartVersion("0.1.0", "a"), chartVersion("0.2.0", "b")}},
+			want:     []string{"0.1.0@a", "0.2.0@b"},
+			wantDiff: true,
+		},
+		{
+			name:    "pushed again meanwhile",
+			entries: repo.ChartVersions{chartVersion("0.1.0", "other")},
+			upload:  &chartUpload{indexed: chartVersion("0.1.0", "a")},
+			want:    []string{"0.1.0@other"},
+		},
+		{
+			name:    "removed meanwhile",
+			entries: repo.ChartVersions{chartVersion("0.2.0", "b")},
+			upload:  &chartUpload{indexed: chartVersion("0.1.0", "a"), replaced: repo.ChartVersions{chartVersion("0.0.1", "z")}},
+			want:    []string{"0.2.0@b"},
+		},
+	}
+	for _, tt := range tests {
+		i := repo.NewIndexFile()
+		i.Entries["mychart"] = tt.entries
+		if got := unindexUpload(i, tt.upload); got != tt.wantDiff {
+			t.Errorf("%s: unindexUpload() = %t, want %t", tt.name, got, tt.wantDiff)
+		}
+		if got := versionsOf(i); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: versions = %q, want %q", tt.name, got, tt.want)
+		}
+		if _, ok := i.Entries["mychart"]; ok && len(tt.want) == 0 {
+			t.Errorf("%s: empty entry of the chart kept", tt.name)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package repo
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	yamlv3 "gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+var digestPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// IndexProblem is an invalid field of an index file, or of one of its entries.
+type IndexProblem struct {
+	// Chart is the name of the chart of the invalid entry, empty for the index itself.
+	Chart string
+	// Entry is the position of the entry among the versions of the chart, from 0.
+	Entry   int
+	Version string
+	// Line is the line of the entry in index.yaml, 0 if unknown, e.g. for sharded indexes.
+	Line    int
+	Message string
+}
+
+func (p IndexProblem) String() string {
+	var where string
+	if p.Line > 0 {
+		where = fmt.Sprintf("line %d: ", p.Line)
+	}
+	if p.Chart == "" {
+		return where + p.Message
+	}
+	return fmt.Sprintf("%sentry %s[%d] (version %q): %s", where, p.Chart, p.Entry, p.Version, p.Message)
+}
+
+// IndexValidationError reports the problems of an index file loaded with WithStrictIndex.
+type IndexValidationError struct {
+	URL      string
+	Problems []IndexProblem
+}
+
+func (e *IndexValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		msgs = append(msgs, p.String())
+	}
+	return fmt.Sprintf("index file %s has %d invalid fields:\n  %s", e.URL, len(e.Problems), strings.Join(msgs, "\n  "))
+}
+
+// Is makes the error match ErrInvalid.
+func (e *IndexValidationError) Is(target error) bool {
+	return target == ErrInvalid
+}
+
+// validateIndex checks the index file i, read from b if known, and logs a warning for each
+// problem found, or fails with an IndexValidationError with WithStrictIndex.
+func (r Repo) validateIndex(i *repo.IndexFile, b []byte) error {
+	problems := ValidateIndex(i, b)
+	if len(problems) == 0 {
+		return nil
+	}
+	if r.strictIndex {
+		return &IndexValidationError{URL: r.indexFileURL, Problems: problems}
+	}
+	for _, p := range problems {
+		log.Warnf("index file %s: %s", r.indexFileURL, p)
+	}
+	return nil
+}
+
+// ValidateIndex checks the API version of the index file i and the entries of its charts:
+// required fields, semver versions, URLs which can be parsed and sha256 digests.
+// b, if not nil, is the YAML the index was read from, to report the line of the problems.
+// The entries must not have been sorted since they were read, for the lines to match.
+func ValidateIndex(i *repo.IndexFile, b []byte) []IndexProblem {
+	apiLine, lines := indexLines(b)
+	var problems []IndexProblem
+	if i.APIVersion != repo.APIVersionV1 {
+		problems = append(problems, IndexProblem{Line: apiLine, Message: fmt.Sprintf("apiVersion %q, should be %q", i.APIVersion, repo.APIVersionV1)})
+	}
+	for name, versions := range i.Entries {
+		for n, cv := range versions {
+			problem := IndexProblem{Chart: name, Entry: n}
+			if n < len(lines[name]) {
+				problem.Line = lines[name][n]
+			}
+			if cv != nil && cv.Metadata != nil {
+				problem.Version = cv.Version
+			}
+			for _, msg := range entryProblems(name, cv) {
+				problem.Message = msg
+				problems = append(problems, problem)
+			}
+		}
+	}
+	return problems
+}
+
+// entryProblems returns the problems of the entry cv of the chart name.
+func entryProblems(name string, cv *repo.ChartVersion) []string {
+	if cv == nil || cv.Metadata == nil {
+		return []string{"empty entry"}
+	}
+	var problems []string
+	switch cv.APIVersion {
+	case "", chart.APIVersionV1, chart.APIVersionV2:
+	default:
+		problems = append(problems, fmt.Sprintf("unknown apiVersion %q", cv.APIVersion))
+	}
+	if cv.Name != name {
+		problems = append(problems, fmt.Sprintf("name %q doesn't match the chart", cv.Name))
+	}
+	if cv.Version == "" {
+		problems = append(problems, "version is missing")
+	} else if _, err := semver.NewVersion(cv.Version); err != nil {
+		problems = append(problems, fmt.Sprintf("version is not valid semver: %s", err))
+	}
+	if len(cv.URLs) == 0 {
+		problems = append(problems, "urls are missing")
+	}
+	for _, u := range cv.URLs {
+		if _, err := url.Parse(u); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid url: %s", err))
+		}
+	}
+	if cv.Digest != "" && !digestPattern.MatchString(cv.Digest) {
+		problems = append(problems, fmt.Sprintf("digest %q is not a sha256 hex digest", cv.Digest))
+	}
+	return problems
+}
+
+// indexLines returns the line of the apiVersion field of the index file b, and the lines of
+// its entries by chart, in the order of the file. Lines are unknown (0) if b can't be parsed.
+func indexLines(b []byte) (int, map[string][]int) {
+	lines := map[string][]int{}
+	var doc yamlv3.Node
+	if len(b) == 0 || yamlv3.Unmarshal(b, &doc) != nil || len(doc.Content) == 0 {
+		return 0, lines
+	}
+	apiLine := 0
+	root := doc.Content[0]
+	for k := 0; k+1 < len(root.Content); k += 2 {
+		switch root.Content[k].Value {
+		case "apiVersion":
+			apiLine = root.Content[k].Line
+		case "entries":
+			entries := root.Content[k+1]
+			for c := 0; c+1 < len(entries.Content); c += 2 {
+				name := entries.Content[c].Value
+				for _, item := range entries.Content[c+1].Content {
+					lines[name] = append(lines[name], item.Line)
+				}
+			}
+		}
+	}
+	return apiLine, lines
+}
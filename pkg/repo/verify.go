@@ -0,0 +1,86 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/provenance"
+	"helm.sh/helm/v3/pkg/repo"
+)
+
+// VerifyResult is the result of the verification of a chart file against an index.
+type VerifyResult struct {
+	File     string
+	Chart    string
+	Version  string
+	Expected string
+	Actual   string
+	Err      error
+}
+
+// OK reports whether the chart file matches its index entry.
+func (v VerifyResult) OK() bool {
+	return v.Err == nil && v.Expected == v.Actual
+}
+
+// VerifyOffline verifies local chart files against a previously exported index file,
+// without any network access. Directories are searched for chart archives (*.tgz).
+func VerifyOffline(indexPath string, chartpaths []string) ([]VerifyResult, error) {
+	i, err := repo.LoadIndexFile(indexPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "load index file")
+	}
+
+	files, err := chartFiles(chartpaths)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]VerifyResult, 0, len(files))
+	for _, f := range files {
+		results = append(results, verifyFile(i, f))
+	}
+	return results, nil
+}
+
+func verifyFile(i *repo.IndexFile, file string) VerifyResult {
+	result := VerifyResult{File: file}
+	c, err := loader.Load(file)
+	if err != nil {
+		result.Err = errors.Wrap(err, "load chart")
+		return result
+	}
+	result.Chart, result.Version = c.Metadata.Name, c.Metadata.Version
+
+	cv, err := i.Get(c.Metadata.Name, c.Metadata.Version)
+	if err != nil || cv.Version != c.Metadata.Version {
+		result.Err = fmt.Errorf("chart %s-%s is not in the index", c.Metadata.Name, c.Metadata.Version)
+		return result
+	}
+	result.Expected = cv.Digest
+	result.Actual, result.Err = provenance.DigestFile(file)
+	return result
+}
+
+// chartFiles expands directories into the chart archives they contain.
+func chartFiles(paths []string) ([]string, error) {
+	files := []string{}
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		archives, err := filepath.Glob(filepath.Join(p, "*.tgz"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, archives...)
+	}
+	return files, nil
+}
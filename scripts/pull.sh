@@ -1,3 +0,0 @@
-#!/bin/sh
-
-$HELM_PLUGIN_DIR/bin/helm-gcs pull $*